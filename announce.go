@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+var announceSounds = flag.Bool("announce", false, "Speak the description of each sound before it plays, with espeak-ng, espeak, pico2wave or say")
+
+// speaker is a text to speech command that writes the speech of its last argument to the
+// file after its arguments
+type speaker struct {
+	args []string
+	ext  string // of the file the speech is written to
+}
+
+// speakers are the text to speech commands, in order of preference. The speech is written
+// to a file and played like the sounds, so it is heard in the stream too
+var speakers = []speaker{
+	{[]string{"espeak-ng", "-w"}, ".wav"},
+	{[]string{"espeak", "-w"}, ".wav"},
+	{[]string{"pico2wave", "-w"}, ".wav"},
+	{[]string{"say", "-o"}, ".aiff"},
+}
+
+// announceMu keeps the announcements of the players of a mix from talking over each other
+var announceMu sync.Mutex
+
+// findSpeaker returns the first of speakers that is installed
+func findSpeaker() (speaker, error) {
+	for _, s := range speakers {
+		if _, err := exec.LookPath(s.args[0]); err == nil {
+			return s, nil
+		}
+	}
+
+	return speaker{}, fmt.Errorf("--announce needs a text to speech command, install espeak-ng")
+}
+
+// announce speaks text before a sound plays
+func announce(ctx context.Context, text string) error {
+	s, err := findSpeaker()
+	if err != nil {
+		return err
+	}
+
+	fout, err := ioutil.TempFile("", "thames-announce-*"+s.ext)
+	if err != nil {
+		return err
+	}
+	fout.Close()
+	defer os.Remove(fout.Name())
+
+	args := append(append([]string(nil), s.args[1:]...), fout.Name(), text)
+	cmd := exec.CommandContext(ctx, s.args[0], args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v: %s", s.args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	announceMu.Lock()
+	defer announceMu.Unlock()
+
+	return playFile(ctx, fout.Name(), 1.0, 0)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The daemon serves an HTTP API with --addr, to search, listen and request sounds from a phone
+// or another machine on the LAN. There is no authentication, the API is for trusted networks
+//
+//	GET  /search?q=cafe&limit=20    the sounds the query selects, as json, with their stories
+//	                                and places. near=place and radius=km select those of
+//	                                the place, like --near and --radius
+//	GET  /places                    the places of the sounds, with their number
+//	GET  /sound/location            the audio of the sound, fetched into the cache if missing
+//	POST /play?location=l&now=1     play the sounds at the locations next, or at once with now,
+//	                                like the next and now commands. session=name requests
+//	                                them in the session name instead of the default
+//	POST /mix?session=name          mix, or play, the json playlist of queries of the body,
+//	                                like --playlist, in place of what plays
+//	GET  /mixes                     the names of the playlists saved in the root directory
+//	GET  /mixes/name                the playlist name
+//	PUT  /mixes/name                save the playlist of the body as name
+//
+// The other paths serve the web UI, a page to search and preview sounds and build mixes.
+// A location may be repeated. The errors are replies with the status and the message
+
+// apiSound is a sound of the replies of the API
+type apiSound struct {
+	Location    string   `json:"location"`
+	Description string   `json:"description"`
+	Secs        int      `json:"secs"`
+	Cached      bool     `json:"cached"`
+	URL         string   `json:"url"` // of its audio
+	Story       string   `json:"story,omitempty"`
+	Places      []string `json:"places,omitempty"`
+}
+
+// apiPlace is a place of the sounds, of the replies of /places
+type apiPlace struct {
+	Name   string  `json:"name"`
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+	Sounds int     `json:"sounds"`
+}
+
+func newAPISounds(sounds []sound) []apiSound {
+	out := []apiSound{}
+	for _, snd := range sounds {
+		out = append(out, apiSound{Location: snd.fname, Description: snd.descr, Secs: snd.secs, Cached: snd.cached, URL: "/sound/" + snd.fname})
+	}
+
+	return out
+}
+
+// serveAPI serves the HTTP API of the daemon at addr, until the daemon stops
+func (d *daemon) serveAPI(addr string) error {
+	web, err := webHandler()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	f := newFetcher(d.db)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", d.apiSearch)
+	mux.HandleFunc("/sound/", func(w http.ResponseWriter, r *http.Request) {
+		d.apiSound(w, r, f)
+	})
+	mux.HandleFunc("/play", d.apiPlay)
+	mux.HandleFunc("/places", d.apiPlaces)
+	mux.HandleFunc("/mix", d.apiMix)
+	mux.HandleFunc("/mixes", d.apiMixes)
+	mux.HandleFunc("/mixes/", d.apiSavedMix)
+	mux.Handle("/", web)
+	srv := &http.Server{Handler: mux}
+	log.Printf("Serving the API and the web UI at http://%s", ln.Addr())
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			log.Printf("Error:API: %v", err)
+			pipelineErrors.report("api", addr, err)
+		}
+	}()
+	go func() {
+		<-d.ctx.Done()
+		srv.Close()
+	}()
+
+	return nil
+}
+
+// apiSearch replies with the sounds that query q selects, limit of them or -n, near the place
+// near if given
+func (d *daemon) apiSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "expected GET", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := *nsounds
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "the limit must be positive", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	sel := d.sel
+	if v := r.FormValue("near"); v != "" {
+		radius := *nearRadius
+		if v := r.FormValue("radius"); v != "" {
+			km, err := strconv.ParseFloat(v, 64)
+			if err != nil || km < 0 {
+				http.Error(w, "the radius is a number of km", http.StatusBadRequest)
+				return
+			}
+			radius = km
+		}
+		g, err := loadGazetteer()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p, err := g.resolve(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		near := *d.sel
+		near.near, near.nearKm = &p, p.km+radius
+		sel = &near
+	}
+
+	sounds := selectSounds(r.Context(), sel, r.FormValue("q"), limit, soundsDir)
+	out := newAPISounds(sounds)
+	meta, err := readMetadata(r.Context(), d.db, sounds)
+	if err != nil {
+		log.Printf("Error:API: %v", err)
+	}
+	var locations []string
+	for _, snd := range sounds {
+		locations = append(locations, snd.fname)
+	}
+	places, err := readPlaces(d.db, locations)
+	if err != nil {
+		log.Printf("Error:API: %v", err)
+	}
+	for i := range out {
+		out[i].Story = meta[out[i].Location].story()
+		out[i].Places = places[out[i].Location]
+	}
+
+	writeJSON(w, out)
+}
+
+// apiPlaces replies with the places of the sounds, those of the most sounds first
+func (d *daemon) apiPlaces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "expected GET", http.StatusMethodNotAllowed)
+		return
+	}
+	places, err := readPlaceCounts(d.db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out := []apiPlace{}
+	for _, p := range places {
+		out = append(out, apiPlace{p.name, p.lat, p.lon, p.sounds})
+	}
+
+	writeJSON(w, out)
+}
+
+// apiSound replies with the audio of the sound of the path, fetched with f if missing. The
+// ranges of the requests are served, so players can seek
+func (d *daemon) apiSound(w http.ResponseWriter, r *http.Request, f *fetcher) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "expected GET", http.StatusMethodNotAllowed)
+		return
+	}
+	sounds, err := lookupSounds(r.Context(), d.db, []string{strings.TrimPrefix(r.URL.Path, "/sound/")}, soundsDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	snd := sounds[0]
+	sp, exists, err := f.cache(r.Context(), snd.fname)
+	if err != nil || !exists {
+		if r.Context().Err() == nil {
+			log.Printf("Missing File: %s: %v", sp, err)
+			pipelineErrors.report("fetch", snd.fname, missingError(err))
+		}
+		http.Error(w, "the sound is missing from the sources", http.StatusBadGateway)
+		return
+	}
+
+	http.ServeFile(w, r, sp)
+}
+
+// apiPlay requests the sounds of the locations in a session and replies with them
+func (d *daemon) apiPlay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	locations := r.Form["location"]
+	if len(locations) == 0 {
+		http.Error(w, "expected locations", http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("session")
+	if name == "" {
+		name = defaultSession
+	}
+	s, err := d.session(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	sounds, err := lookupSounds(r.Context(), d.db, locations, soundsDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	now, _ := strconv.ParseBool(r.FormValue("now"))
+	if err := s.ctl.request(sounds, now); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, newAPISounds(sounds))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error:API: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the credit the BBC asks for the sounds of the archive
+const (
+	attributionNotice  = "Sound effects from the BBC Sound Effects archive, https://sound-effects.bbcrewind.co.uk/. © copyright BBC."
+	attributionLicence = "BBC RemArc Licence. The sounds may be used for personal, educational or research purposes."
+)
+
+// attribution is the manifest of the sounds used in a playlist or an export
+type attribution struct {
+	Notice  string             `json:"notice"`
+	Licence string             `json:"licence"`
+	Sounds  []attributionSound `json:"sounds"`
+}
+
+type attributionSound struct {
+	Location    string `json:"location"`
+	Description string `json:"description"`
+	CDNumber    string `json:"cdNumber,omitempty"`
+	CDName      string `json:"cdName,omitempty"`
+	Tracknum    string `json:"tracknum,omitempty"`
+	URL         string `json:"url"`
+}
+
+// attributionCommand implements the attribution command. It prints the credits of the sounds
+// of an export directory or of a playlist, a file with a path or location on each line like m3u
+func attributionCommand(args []string) error {
+	fs := flag.NewFlagSet("attribution", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the manifest as json")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames attribution [--json] playlist|dir...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	var locations []string
+	for _, arg := range fs.Args() {
+		found, err := usedLocations(arg)
+		if err != nil {
+			return err
+		}
+		locations = append(locations, found...)
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	manifest, err := attributionOf(context.Background(), db, locations)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		data, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", data)
+		return nil
+	}
+
+	fmt.Printf("%s\n%s\n\n", manifest.Notice, manifest.Licence)
+	for _, s := range manifest.Sounds {
+		var from []string
+		if s.CDName != "" {
+			from = append(from, s.CDName)
+		}
+		if s.CDNumber != "" {
+			from = append(from, s.CDNumber)
+		}
+		if s.Tracknum != "" {
+			from = append(from, "track "+s.Tracknum)
+		}
+		if len(from) > 0 {
+			fmt.Printf("%s  %s (%s)\n", s.Location, s.Description, strings.Join(from, ", "))
+		} else {
+			fmt.Printf("%s  %s\n", s.Location, s.Description)
+		}
+	}
+
+	return nil
+}
+
+// attributionOf returns the manifest of the sounds at the locations, in their order and once each
+func attributionOf(ctx context.Context, db *sql.DB, locations []string) (attribution, error) {
+	manifest := attribution{Notice: attributionNotice, Licence: attributionLicence}
+
+	seen := make(map[string]bool)
+	var sounds []sound
+	for _, l := range locations {
+		if !seen[l] {
+			seen[l] = true
+			sounds = append(sounds, sound{fname: l})
+		}
+	}
+	meta, err := readMetadata(ctx, db, sounds)
+	if err != nil {
+		return manifest, err
+	}
+
+	for _, snd := range sounds {
+		m, ok := meta[snd.fname]
+		if !ok {
+			log.Printf("Error:Attribution: %s is not in the index", snd.fname)
+			continue
+		}
+		manifest.Sounds = append(manifest.Sounds, attributionSound{
+			Location:    snd.fname,
+			Description: m.description,
+			CDNumber:    m.cdNumber,
+			CDName:      m.cdName,
+			Tracknum:    m.tracknum,
+			URL:         soundURL(catalogURL, snd.fname),
+		})
+	}
+
+	return manifest, nil
+}
+
+// usedLocations returns the locations of the sounds of a playlist, or an export directory.
+// Sounds exported with their sidecars are found by them, others by their file names
+func usedLocations(fpath string) ([]string, error) {
+	info, err := os.Stat(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		fin, err := os.Open(fpath)
+		if err != nil {
+			return nil, err
+		}
+		defer fin.Close()
+
+		var locations []string
+		scanner := bufio.NewScanner(fin)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			// the last field, the lines printed by --query end with the path
+			fields := strings.Fields(line)
+			locations = append(locations, normalizeLocation(fields[len(fields)-1]))
+		}
+		return locations, scanner.Err()
+	}
+
+	var locations []string
+	err = filepath.Walk(fpath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := filepath.Ext(p)
+		if info.IsDir() || ext != ".wav" && ext != ".flac" {
+			return nil
+		}
+		sc := strings.TrimSuffix(p, ext) + ".json"
+		if data, err := ioutil.ReadFile(sc); err == nil {
+			var s sidecar
+			if err := json.Unmarshal(data, &s); err == nil && s.Location != "" {
+				locations = append(locations, s.Location)
+				return nil
+			}
+		}
+		locations = append(locations, normalizeLocation(p))
+		return nil
+	})
+
+	return locations, err
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	stereoOnly    = flag.Bool("stereo-only", false, "Select only sounds known to be stereo, or of more channels, from their headers. See cache verify")
+	minSampleRate = flag.Int("min-samplerate", 0, "Select only sounds known to be sampled at `rate` or more, like 44100, from their headers. See cache verify")
+)
+
+// audioInfo is what the header of a sound file tells about its audio
+type audioInfo struct {
+	format     string // wav, flac or mp3. Wavs other than pcm add the encoding, like wav/ulaw
+	sampleRate int
+	channels   int
+	bits       int // per sample, 0 for mp3
+}
+
+func (a audioInfo) String() string {
+	s := fmt.Sprintf("%s %dHz %dch", a.format, a.sampleRate, a.channels)
+	if a.bits > 0 {
+		s += fmt.Sprintf(" %dbit", a.bits)
+	}
+
+	return s
+}
+
+// wavEncodings are the names of the format codes of wav files, other than pcm
+var wavEncodings = map[uint16]string{
+	2:    "adpcm",
+	3:    "float",
+	6:    "alaw",
+	7:    "ulaw",
+	0x11: "ima-adpcm",
+	0x55: "mp3",
+}
+
+// probeAudio reads the header of the sound file at fpath. It fails for files that aren't
+// audio, like the html error pages that some servers send with a 200
+func probeAudio(fpath string) (audioInfo, error) {
+	fin, err := os.Open(fpath)
+	if err != nil {
+		return audioInfo{}, err
+	}
+	defer fin.Close()
+
+	head := make([]byte, 12)
+	n, _ := io.ReadFull(fin, head)
+	head = head[:n]
+	switch {
+	case len(head) == 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WAVE":
+		return probeWAV(fin)
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return probeFLAC(fin)
+	case bytes.HasPrefix(head, []byte("ID3")) || len(head) >= 2 && head[0] == 0xFF && head[1]&0xE0 == 0xE0:
+		return probeMP3(fin)
+	case len(bytes.TrimSpace(head)) > 0 && bytes.TrimSpace(head)[0] == '<':
+		return audioInfo{}, errors.New("an html or xml page, not audio")
+	case n == 0:
+		return audioInfo{}, errors.New("empty file")
+	}
+
+	return audioInfo{}, errors.New("not a wav, flac or mp3 file")
+}
+
+// probeWAV reads the fmt chunk of a wav, after the RIFF header. Archive wavs have a
+// broadcast extension chunk before it
+func probeWAV(fin *os.File) (audioInfo, error) {
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(fin, chunk); err != nil {
+			return audioInfo{}, errors.New("wav without a fmt chunk")
+		}
+		size := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		if string(chunk[0:4]) != "fmt " {
+			// chunks are padded to an even size
+			if _, err := fin.Seek(size+size%2, io.SeekCurrent); err != nil {
+				return audioInfo{}, err
+			}
+			continue
+		}
+		if size < 16 {
+			return audioInfo{}, fmt.Errorf("wav fmt chunk of %d bytes", size)
+		}
+
+		fmtChunk := make([]byte, size)
+		if _, err := io.ReadFull(fin, fmtChunk); err != nil {
+			return audioInfo{}, errors.New("truncated wav fmt chunk")
+		}
+		code := binary.LittleEndian.Uint16(fmtChunk[0:])
+		if code == 0xFFFE && size >= 26 {
+			// extensible, the code is the start of the subformat guid
+			code = binary.LittleEndian.Uint16(fmtChunk[24:])
+		}
+		info := audioInfo{
+			format:     "wav",
+			channels:   int(binary.LittleEndian.Uint16(fmtChunk[2:])),
+			sampleRate: int(binary.LittleEndian.Uint32(fmtChunk[4:])),
+			bits:       int(binary.LittleEndian.Uint16(fmtChunk[14:])),
+		}
+		if code != 1 {
+			enc := wavEncodings[code]
+			if enc == "" {
+				enc = fmt.Sprintf("0x%x", code)
+			}
+			info.format += "/" + enc
+		}
+		if info.channels == 0 || info.sampleRate == 0 {
+			return audioInfo{}, errors.New("wav of no channels or no sample rate")
+		}
+
+		return info, nil
+	}
+}
+
+// probeFLAC reads the STREAMINFO block, which is always the first
+func probeFLAC(fin *os.File) (audioInfo, error) {
+	if _, err := fin.Seek(4, io.SeekStart); err != nil {
+		return audioInfo{}, err
+	}
+	block := make([]byte, 4+18)
+	if _, err := io.ReadFull(fin, block); err != nil || block[0]&0x7F != 0 {
+		return audioInfo{}, errors.New("flac without a STREAMINFO block")
+	}
+
+	// after the sizes of the blocks and frames, 20 bits of sample rate, 3 of channels
+	// minus one and 5 of bits per sample minus one
+	v := binary.BigEndian.Uint64(block[4+10:])
+	return audioInfo{
+		format:     "flac",
+		sampleRate: int(v >> 44),
+		channels:   int(v>>41&0x7) + 1,
+		bits:       int(v>>36&0x1F) + 1,
+	}, nil
+}
+
+// probeMP3 reads the header of the first frame, after the ID3 tag if any
+func probeMP3(fin *os.File) (audioInfo, error) {
+	if _, err := fin.Seek(0, io.SeekStart); err != nil {
+		return audioInfo{}, err
+	}
+	id3 := make([]byte, 10)
+	if _, err := io.ReadFull(fin, id3); err != nil {
+		return audioInfo{}, errors.New("truncated mp3")
+	}
+	offset := int64(0)
+	if string(id3[0:3]) == "ID3" {
+		// the size is syncsafe, 7 bits in each byte
+		size := int64(id3[6])<<21 | int64(id3[7])<<14 | int64(id3[8])<<7 | int64(id3[9])
+		offset = 10 + size
+	}
+
+	header := make([]byte, 4)
+	if _, err := fin.ReadAt(header, offset); err != nil || header[0] != 0xFF || header[1]&0xE0 != 0xE0 {
+		return audioInfo{}, errors.New("mp3 without a frame header")
+	}
+	rates := map[byte][]int{
+		3: {44100, 48000, 32000}, // MPEG 1
+		2: {22050, 24000, 16000}, // MPEG 2
+		0: {11025, 12000, 8000},  // MPEG 2.5
+	}
+	version := header[1] >> 3 & 0x3
+	rate := header[2] >> 2 & 0x3
+	if rates[version] == nil || rate == 3 {
+		return audioInfo{}, errors.New("mp3 frame header of a reserved version or sample rate")
+	}
+	channels := 2
+	if header[3]>>6 == 3 {
+		channels = 1
+	}
+
+	return audioInfo{format: "mp3", sampleRate: rates[version][rate], channels: channels}, nil
+}
+
+// audioColumns are the columns of the files table with the audio properties
+var audioColumns = []string{"format TEXT", "samplerate INTEGER", "channels INTEGER", "bits INTEGER"}
+
+// migrateAudio adds the audio columns to the files table of older databases
+func migrateAudio(db *sql.DB) error {
+	for _, c := range audioColumns {
+		name := strings.Fields(c)[0]
+		exists, err := hasColumn(db, "files", name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if _, err := db.Exec(`ALTER TABLE files ADD COLUMN ` + c); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func recordAudio(db execer, fname string, info audioInfo) error {
+	_, err := db.Exec(`INSERT INTO files(location, format, samplerate, channels, bits) VALUES(?, ?, ?, ?, ?)
+                           ON CONFLICT(location) DO UPDATE SET format = excluded.format, samplerate = excluded.samplerate,
+                                                               channels = excluded.channels, bits = excluded.bits`,
+		fname, info.format, info.sampleRate, info.channels, info.bits)
+
+	return err
+}
+
+// quarantinePath returns where the invalid file of the sound fname is kept, out of the cache
+func quarantinePath(fname string) string {
+	return filepath.Join(*rootDir, "quarantine", fname)
+}
+
+// quarantine moves the invalid file at fpath, of the sound fname, out of the cache, so the
+// sound is fetched again. The file is kept for inspection
+func quarantine(fpath, fname string) error {
+	qpath := quarantinePath(fname)
+	if err := os.MkdirAll(filepath.Dir(qpath), 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(fpath, qpath)
+}
+
+// cacheVerify checks the headers of the files of the cache, records their audio properties
+// and quarantines those that aren't audio
+func cacheVerify(db *sql.DB) error {
+	infos, err := ioutil.ReadDir(soundsDir)
+	if err != nil {
+		return err
+	}
+
+	var files []os.FileInfo
+	for _, info := range infos {
+		if info.Mode().IsRegular() && !strings.HasSuffix(info.Name(), ".part") {
+			files = append(files, info)
+		}
+	}
+	p := newProgress("Verifying", len(files))
+
+	var valid, invalid int
+	for _, info := range files {
+		name := info.Name()
+		// compressed sounds are indexed by the name of the original wav
+		fname := name
+		if filepath.Ext(name) == ".flac" {
+			fname = strings.TrimSuffix(name, ".flac") + ".wav"
+		}
+
+		a, err := probeAudio(soundPath(name))
+		if err != nil {
+			if err := quarantine(soundPath(name), fname); err != nil {
+				return err
+			}
+			p.logf("Quarantined: %s: %v, moved to %s", name, err, quarantinePath(fname))
+			if err := setCached(db, fname, false); err != nil {
+				return err
+			}
+			invalid++
+		} else {
+			if err := recordAudio(db, fname, a); err != nil {
+				return err
+			}
+			valid++
+		}
+		p.step()
+	}
+	p.finish()
+
+	log.Printf("Verified %d sounds, quarantined %d", valid, invalid)
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// riffChunk returns the chunk of id and data, padded to an even size
+func riffChunk(id string, data []byte) []byte {
+	c := append([]byte(id), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(c[4:], uint32(len(data)))
+	c = append(c, data...)
+	if len(data)%2 == 1 {
+		c = append(c, 0)
+	}
+
+	return c
+}
+
+// wavFile returns a wav of the chunks
+func wavFile(chunks ...[]byte) []byte {
+	w := []byte("RIFF\x00\x00\x00\x00WAVE")
+	for _, c := range chunks {
+		w = append(w, c...)
+	}
+
+	return w
+}
+
+// fmtChunk returns the data of a fmt chunk
+func fmtChunk(code, channels uint16, rate uint32, bits uint16, ext []byte) []byte {
+	f := make([]byte, 16)
+	binary.LittleEndian.PutUint16(f[0:], code)
+	binary.LittleEndian.PutUint16(f[2:], channels)
+	binary.LittleEndian.PutUint32(f[4:], rate)
+	binary.LittleEndian.PutUint16(f[14:], bits)
+
+	return append(f, ext...)
+}
+
+func TestProbeWAV(t *testing.T) {
+	// the extension of an extensible fmt: its size, the valid bits, the channel mask and the
+	// subformat guid, which starts with the code
+	extensible := make([]byte, 24)
+	binary.LittleEndian.PutUint16(extensible[0:], 22)
+	binary.LittleEndian.PutUint16(extensible[8:], 3)
+
+	tests := []struct {
+		name string
+		data []byte
+		want audioInfo // zero if the file is rejected
+	}{
+		{"archive", tinyWAV(), audioInfo{"wav", streamRate, streamChannels, 16}},
+		{"bext first", wavFile(riffChunk("bext", make([]byte, 603)), riffChunk("fmt ", fmtChunk(1, 1, 48000, 24, nil))),
+			audioInfo{"wav", 48000, 1, 24}},
+		{"ulaw", wavFile(riffChunk("fmt ", fmtChunk(7, 1, 8000, 8, nil))), audioInfo{"wav/ulaw", 8000, 1, 8}},
+		{"unknown code", wavFile(riffChunk("fmt ", fmtChunk(0x99, 2, 44100, 16, nil))), audioInfo{"wav/0x99", 44100, 2, 16}},
+		{"extensible", wavFile(riffChunk("fmt ", fmtChunk(0xFFFE, 2, 96000, 32, extensible))), audioInfo{"wav/float", 96000, 2, 32}},
+		{"no fmt", wavFile(riffChunk("data", make([]byte, 8))), audioInfo{}},
+		{"short fmt", wavFile(riffChunk("fmt ", make([]byte, 12))), audioInfo{}},
+		{"truncated fmt", wavFile(riffChunk("fmt ", fmtChunk(1, 2, 44100, 16, nil))[:16]), audioInfo{}},
+		{"no channels", wavFile(riffChunk("fmt ", fmtChunk(1, 0, 44100, 16, nil))), audioInfo{}},
+		{"html", []byte("  <html><body>Not Found</body></html>"), audioInfo{}},
+		{"empty", nil, audioInfo{}},
+		{"text", []byte("just some text"), audioInfo{}},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		fpath := filepath.Join(dir, tt.name+".wav")
+		if err := ioutil.WriteFile(fpath, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := probeAudio(fpath)
+		if tt.want == (audioInfo{}) {
+			if err == nil {
+				t.Errorf("%s: probed as %v", tt.name, info)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if info != tt.want {
+			t.Errorf("%s: %v, expected %v", tt.name, info, tt.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var auditFile = flag.String("audit", "", "Append a record of every sound exported, and the file it was exported to, to the audit log `file`")
+
+// auditRecord is a line of the audit log. The log is json lines, one for each sound written
+// into an output file, so it can also be searched with grep or jq
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"` // export
+	Location    string    `json:"location"`
+	Description string    `json:"description"`
+	Output      string    `json:"output"` // absolute path
+	Query       string    `json:"query,omitempty"`
+}
+
+var auditMu sync.Mutex
+
+// audit appends the record to the audit log, if there is one
+func audit(action string, snd sound, output string) {
+	if *auditFile == "" {
+		return
+	}
+	if abs, err := filepath.Abs(output); err == nil {
+		output = abs
+	}
+	data, err := json.Marshal(auditRecord{time.Now(), action, snd.fname, snd.descr, output, snd.query})
+	if err != nil {
+		log.Printf("Error:Audit: %v", err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	fout, err := os.OpenFile(*auditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("Error:Audit: %v", err)
+		return
+	}
+	if _, err := fout.Write(append(data, '\n')); err != nil {
+		log.Printf("Error:Audit: %v", err)
+	}
+	if err := fout.Close(); err != nil {
+		log.Printf("Error:Audit: %v", err)
+	}
+}
+
+// auditCommand implements the audit command. It prints the records of the audit log whose
+// output file, or sound, contains the pattern, like "episode12"
+func auditCommand(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames --audit file audit [pattern]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *auditFile == "" || fs.NArg() > 1 {
+		fs.Usage()
+		return errUsage
+	}
+	pattern := strings.ToLower(fs.Arg(0))
+
+	fin, err := os.Open(*auditFile)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+
+	scanner := bufio.NewScanner(fin)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		var r auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			log.Printf("Error:Audit: %s:%d: %v", *auditFile, lineno, err)
+			continue
+		}
+		if pattern != "" && !strings.Contains(strings.ToLower(r.Output), pattern) &&
+			!strings.Contains(strings.ToLower(r.Location+" "+r.Description), pattern) {
+			continue
+		}
+		fmt.Printf("%s %s %s %s -> %s\n", r.Time.Format(time.RFC3339), r.Action, r.Location, r.Description, r.Output)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// auditionCommand implements the audition command. It plays a preview of each sound of the
+// queries and records the verdict of a key into a collection, to build a pack quickly
+func auditionCommand(args []string) error {
+	fs := flag.NewFlagSet("audition", flag.ExitOnError)
+	name := fs.String("collection", "", "Record the verdicts into the collection `name`")
+	preview := fs.Duration("preview", 10*time.Second, "Play the first `duration` of each sound, 0 for all of it")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames audition --collection name [--preview duration] queries...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 || *name == "" {
+		fs.Usage()
+		return errUsage
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	judged, err := verdicts(ctx, db, *name)
+	if err != nil {
+		return err
+	}
+
+	// the sounds already judged aren't auditioned again, skipped sounds are
+	sel := newSelection(db)
+	var sounds []sound
+	seen := make(map[string]bool)
+	for _, query := range fs.Args() {
+		for _, snd := range selectSounds(ctx, sel, query, *nsounds, soundsDir) {
+			if judged[snd.fname] == "" && !seen[snd.fname] {
+				seen[snd.fname] = true
+				sounds = append(sounds, snd)
+			}
+		}
+	}
+	if len(sounds) == 0 {
+		log.Printf("Audition: no sounds to audition, all are in the collection %s or blocked", *name)
+		return nil
+	}
+
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
+	keys, restore, err := readKeys(tty, *plainOutput)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	a := &audition{name: *name, preview: *preview, keys: keys}
+	if *plainOutput {
+		log.Printf("Audition: type k to keep, b to block, r to replay and q to quit. An empty line skips")
+	} else {
+		log.Printf("Audition: k keeps, space skips, b blocks, r replays and q quits")
+	}
+	if err := a.run(ctx, db, sounds); err != nil {
+		return err
+	}
+
+	var total int
+	db.QueryRow(`SELECT count(*) FROM collections WHERE name = ? AND verdict = ?`, *name, verdictKeep).Scan(&total)
+	log.Printf("Audition: kept %d, blocked %d, skipped %d of %d sounds. The collection %s has %d sounds",
+		a.kept, a.blocked, a.skipped, len(sounds), *name, total)
+
+	return nil
+}
+
+// audition is the state of the audition command
+type audition struct {
+	name    string // of the collection
+	preview time.Duration
+	keys    <-chan byte
+
+	kept, blocked, skipped int
+}
+
+// run auditions the sounds in order until all are judged, q is pressed or ctx is done. The
+// next sound is fetched while one plays
+func (a *audition) run(ctx context.Context, db *sql.DB, sounds []sound) error {
+	fetched := make(chan sound, 1)
+	go func() {
+		defer close(fetched)
+		f := newFetcher(db)
+		for _, snd := range sounds {
+			sp, exists, err := f.cache(ctx, snd.fname)
+			if err != nil || !exists {
+				log.Printf("Missing File: %s: %v", sp, missingError(err))
+				continue
+			}
+			snd.fpath = sp
+			select {
+			case fetched <- snd:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	i := 0
+	for snd := range fetched {
+		i++
+		log.Printf("Audition: %d/%d %s %s %s", i, len(sounds), snd.fname, snd.descr, time.Duration(snd.secs)*time.Second)
+		verdict, quit := a.judge(ctx, snd)
+		switch verdict {
+		case verdictKeep:
+			a.kept++
+		case verdictBlock:
+			a.blocked++
+		default:
+			if !quit {
+				a.skipped++
+			}
+		}
+		if verdict != "" {
+			if err := setVerdict(db, a.name, snd.fname, verdict); err != nil {
+				return err
+			}
+		}
+		if quit || ctx.Err() != nil {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// judge plays the preview of the sound and returns the verdict of the key pressed, empty to
+// skip, and whether to quit. A key stops the preview, r plays it again
+func (a *audition) judge(ctx context.Context, snd sound) (string, bool) {
+	for {
+		pctx, cancel := context.WithCancel(ctx)
+		if a.preview > 0 {
+			pctx, cancel = context.WithTimeout(ctx, a.preview)
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- playSound(pctx, snd.fpath, 1, 0)
+		}()
+
+		verdict, quit, replay := a.waitKey(ctx, pctx, cancel, done)
+		if !replay {
+			return verdict, quit
+		}
+	}
+}
+
+// waitKey waits for a key while the preview plays and after it ends. It returns the verdict
+// of the key, whether to quit and whether to replay. It stops the preview, with cancel, and
+// waits for it to end before it returns
+func (a *audition) waitKey(ctx, pctx context.Context, cancel context.CancelFunc, done chan error) (string, bool, bool) {
+	playing := true
+	defer func() {
+		cancel()
+		if playing {
+			<-done
+		}
+	}()
+
+	for {
+		select {
+		case k, ok := <-a.keys:
+			if !ok {
+				return "", true, false
+			}
+			switch k {
+			case 'k':
+				return verdictKeep, false, false
+			case 'b':
+				return verdictBlock, false, false
+			case ' ', 's', '\n':
+				return "", false, false
+			case 'q':
+				return "", true, false
+			case 'r':
+				return "", false, true
+			}
+		case err := <-done:
+			// the preview ended, wait for the verdict
+			if err != nil && pctx.Err() == nil {
+				log.Printf("Error:Play: %v", err)
+			}
+			playing = false
+			done = nil
+		case <-ctx.Done():
+			return "", true, false
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	bootstrapIndex = flag.Bool("bootstrap", false, "Download the csv of the archive again from --csv-url and rebuild the index with it")
+	csvURL         = flag.String("csv-url", defaultCSVURL, "Download the csv of the archive from `url` when the root has none, on the first run")
+	csvChecksum    = flag.String("csv-sha256", "", "Verify the downloaded csv against the sha256 `checksum`, in hex")
+)
+
+// The first run needs the csv of the archive to build the index. When the root has none,
+// thames unpacks BBCSoundEffects.csv.gz of the root, a copy like the one of its repository,
+// or else downloads the csv from the mirror of the archive. The download is verified before
+// it replaces anything: it must be a csv of sounds with few rows that can't be indexed, the
+// csv of the mirror must have about the sounds of the archive, and with --csv-sha256 its
+// checksum must match
+
+const (
+	defaultCSVURL = "https://bbcsfx.acropolis.org.uk/assets/BBCSoundEffects.csv"
+
+	// archiveSounds is the least number of sounds of a complete csv of the archive, which
+	// has some 16000
+	archiveSounds = 15000
+
+	// maxSkippedRows is the fraction of the rows of a downloaded csv that may be skipped
+	maxSkippedRows = 0.1
+)
+
+var sha256Re = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// ensureCSV makes sure that the csv of the archive is at fpath, unpacking or downloading it
+// if it is missing, or downloading it again if force
+func ensureCSV(fpath string, force bool) error {
+	if exists, err := fileExists(fpath); err != nil || exists && !force {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return err
+	}
+	if !force {
+		if exists, _ := fileExists(fpath + ".gz"); exists {
+			return unpackCSV(fpath)
+		}
+	}
+	if *noDownload {
+		return fmt.Errorf(tr("%s is missing and --no-download doesn't download it from %s, copy it to the root"), fpath, *csvURL)
+	}
+
+	return downloadCSV(context.Background(), *csvURL, fpath)
+}
+
+// unpackCSV unpacks the compressed copy of the csv next to fpath
+func unpackCSV(fpath string) error {
+	log.Printf("Bootstrap: unpacking %s.gz", fpath)
+	fin, err := os.Open(fpath + ".gz")
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+	zr, err := gzip.NewReader(fin)
+	if err != nil {
+		return fmt.Errorf("%s.gz: %v", fpath, err)
+	}
+
+	return writeCSV(fpath, zr, false)
+}
+
+// downloadCSV downloads the csv at rawurl to fpath, if it verifies. Urls ending in .gz are
+// unpacked
+func downloadCSV(ctx context.Context, rawurl, fpath string) error {
+	log.Printf("Bootstrap: downloading the csv of the archive from %s", rawurl)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawurl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", rawurl, resp.Status)
+	}
+
+	var body io.Reader = resp.Body
+	if strings.HasSuffix(req.URL.Path, ".gz") && !resp.Uncompressed {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("%s: %v", rawurl, err)
+		}
+		body = zr
+	}
+	if err := writeCSV(fpath, body, true); err != nil {
+		return fmt.Errorf("%s: %v", rawurl, err)
+	}
+
+	return nil
+}
+
+// writeCSV writes the csv of r to fpath, through a temporary file that replaces it only if
+// the csv verifies
+func writeCSV(fpath string, r io.Reader, downloaded bool) error {
+	tmp := fpath + ".download"
+	fout, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(fout, h), r)
+	if cerr := fout.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); downloaded && *csvChecksum != "" && !strings.EqualFold(sum, *csvChecksum) {
+		return fmt.Errorf("the sha256 checksum is %s, expected %s", sum, *csvChecksum)
+	}
+	report, err := verifyCSV(tmp, downloaded)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fpath); err != nil {
+		return err
+	}
+	log.Printf("Bootstrap: %s has %d sounds", fpath, report.valid)
+
+	return nil
+}
+
+// verifyCSV reads the csv at fpath and returns its report, or an error if it doesn't look like
+// a complete csv of sounds. downloaded csvs are checked for all the rows they should have
+func verifyCSV(fpath string, downloaded bool) (csvReport, error) {
+	fin, err := os.Open(fpath)
+	if err != nil {
+		return csvReport{}, err
+	}
+	defer fin.Close()
+
+	c, err := newSoundsCSV(fin)
+	if err != nil {
+		return csvReport{}, err
+	}
+	for {
+		if _, err := c.next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return c.report, err
+		}
+	}
+
+	r := c.report
+	switch {
+	case r.valid == 0:
+		return r, errors.New("the csv has no sounds")
+	case !downloaded:
+	case float64(len(r.skipped)) > maxSkippedRows*float64(r.rows):
+		return r, fmt.Errorf("%d of the %d rows of the csv can't be indexed, it may be damaged", len(r.skipped), r.rows)
+	case *csvURL == defaultCSVURL && r.valid < archiveSounds:
+		return r, fmt.Errorf("the csv has %d sounds, the archive has at least %d, it may be truncated", r.valid, archiveSounds)
+	}
+
+	return r, nil
+}
+
+// rebuildIndex indexes the csv again in the index of db, like reindex. The places and the eras
+// of the sounds are found again by the migrations
+func rebuildIndex(db *sql.DB) error {
+	fin, err := os.Open(csvFile)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+
+	log.Printf("Bootstrap: rebuilding the index from %s", csvFile)
+	if err := createIndex(db, fin); err != nil {
+		return err
+	}
+	_, err = db.Exec(`DROP TABLE IF EXISTS places; DROP TABLE IF EXISTS eras`)
+
+	return err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	minResults = flag.Int("min", 0, "Broaden the queries that match fewer than `n` sounds: drop NEAR, add the synonyms of thames.json, match any word, match the words as prefixes")
+	askBroaden = flag.Bool("ask", false, "With --min, ask on the terminal which broader query to play instead of picking the first that matches enough")
+)
+
+var nearRe = regexp.MustCompile(`\s+NEAR(/\d+)?\s+`)
+
+// broadenings returns broader versions of the full text query, each broader than the one before:
+// without NEAR, with the synonyms of the words, with any of the words and with the words as
+// prefixes. Versions that are the same as the one before are left out
+func broadenings(query string, configured map[string][]string) []string {
+	synonyms := make(map[string][]string)
+	for w, syns := range configured {
+		synonyms[strings.ToLower(w)] = syns
+	}
+
+	var broader []string
+	add := func(q string) {
+		last := query
+		if len(broader) > 0 {
+			last = broader[len(broader)-1]
+		}
+		if q != last {
+			broader = append(broader, q)
+		}
+	}
+
+	q := nearRe.ReplaceAllString(query, " ")
+	add(q)
+
+	if len(synonyms) > 0 {
+		var terms []string
+		for _, t := range splitTerms(q) {
+			if syns := synonyms[strings.ToLower(t)]; len(syns) > 0 {
+				or := []string{t}
+				for _, s := range syns {
+					or = append(or, phrase(s))
+				}
+				t = "(" + strings.Join(or, " OR ") + ")"
+			}
+			terms = append(terms, t)
+		}
+		q = strings.Join(terms, " ")
+		add(q)
+	}
+
+	words := strings.Fields(queryWords(query))
+	var expanded []string
+	for _, w := range words {
+		expanded = append(expanded, w)
+		for _, s := range synonyms[w] {
+			expanded = append(expanded, phrase(s))
+		}
+	}
+	if len(expanded) > 1 {
+		add(strings.Join(expanded, " OR "))
+	}
+
+	var prefixes []string
+	for _, w := range expanded {
+		if !strings.HasSuffix(w, "*") && !strings.HasPrefix(w, `"`) {
+			w += "*"
+		}
+		prefixes = append(prefixes, w)
+	}
+	if len(prefixes) > 0 {
+		add(strings.Join(prefixes, " OR "))
+	}
+
+	return broader
+}
+
+// phrase quotes the synonyms of more than one word
+func phrase(s string) string {
+	if strings.Contains(strings.TrimSpace(s), " ") {
+		return exactPhrase(s)
+	}
+
+	return s
+}
+
+// broadenGroups replaces the queries of the groups that match fewer than min sounds with the
+// first broader version that matches enough, or the broadest, or the one picked with --ask
+func broadenGroups(ctx context.Context, sel *selection, groups []queryGroup, min int) []queryGroup {
+	for i, g := range groups {
+		queries := append([]string(nil), g.queries...)
+		for j, q := range queries {
+			if _, _, ok := collectionQuery(q); q == "" || ok {
+				// the sounds of a collection are chosen by hand
+				continue
+			}
+			n, err := sel.count(ctx, q)
+			if err != nil || n >= min {
+				continue
+			}
+
+			var candidates []string
+			var counts []int
+			for _, b := range broadenings(q, conf.Synonyms) {
+				c, err := sel.count(ctx, b)
+				if err != nil || c <= n || len(counts) > 0 && c <= counts[len(counts)-1] {
+					continue
+				}
+				candidates = append(candidates, b)
+				counts = append(counts, c)
+			}
+			if len(candidates) == 0 {
+				log.Printf("Broaden: %q matches %d sounds, fewer than --min %d, and nothing broader matches more", q, n, min)
+				continue
+			}
+
+			pick := len(candidates) - 1
+			for k, c := range counts {
+				if c >= min {
+					pick = k
+					break
+				}
+			}
+			if *askBroaden {
+				pick = askBroader(q, n, candidates, counts, pick)
+				if pick < 0 {
+					continue
+				}
+			}
+			log.Printf("Broaden: %q matches %d sounds, fewer than --min %d, selecting from %q with %d", q, n, min, candidates[pick], counts[pick])
+			queries[j] = candidates[pick]
+		}
+		groups[i].queries = queries
+	}
+
+	return groups
+}
+
+// askBroader asks on the terminal which of the broader queries to select from. It returns the
+// index of the choice, or -1 to keep the query
+func askBroader(query string, n int, candidates []string, counts []int, suggested int) int {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		log.Printf("Error:Broaden: %v", err)
+		return suggested
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "%q matches %d sounds. Select instead from\n", query, n)
+	for k, c := range candidates {
+		fmt.Fprintf(tty, "  %d) %s, %d sounds\n", k+1, c, counts[k])
+	}
+	fmt.Fprintf(tty, "  0) %s, %d sounds\n", query, n)
+
+	scanner := bufio.NewScanner(tty)
+	for {
+		fmt.Fprintf(tty, "choice [%d]: ", suggested+1)
+		if !scanner.Scan() {
+			return suggested
+		}
+		answer := strings.TrimSpace(scanner.Text())
+		if answer == "" {
+			return suggested
+		}
+		if k, err := strconv.Atoi(answer); err == nil && k >= 0 && k <= len(candidates) {
+			return k - 1
+		}
+	}
+}
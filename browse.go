@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var browseResults = flag.Bool("browse", false, "Browse the results of the queries in the terminal, playing and fetching sounds with keys")
+
+// The browser of --browse lists the sounds of the queries on the whole terminal. The arrows
+// move, enter plays the sound, space stops it, d fetches it into the cache, i shows its
+// archival context, / types a new query and q quits. With --plain it prints them as numbered
+// lines and reads the same commands as lines, with the number of the sound
+
+const (
+	browseHelp      = "enter play  space stop  d fetch  i info  / search  q quit"
+	browsePlainHelp = "type a number to play its sound, d and a number fetches it, i and a number shows its archival context, / and a query searches, l lists the sounds again and q quits. An empty line stops"
+)
+
+// browser is the state of --browse
+type browser struct {
+	db  *sql.DB
+	sel *selection
+	f   *fetcher
+	tty *os.File
+	out *bufio.Writer
+
+	queries []string
+	sounds  []sound
+	meta    map[string]soundMeta
+
+	cur, top   int // the selected sound and the first on the screen
+	rows, cols int
+	status     string
+	editing    bool
+	input      []rune
+
+	stop    context.CancelFunc // of the sound that plays, nil if none
+	playing string
+	events  chan func()
+}
+
+// browse implements --browse
+func browse(ctx context.Context, db *sql.DB, sel *selection, queries []string) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
+
+	b := &browser{db: db, sel: sel, f: newFetcher(db), tty: tty, out: bufio.NewWriter(tty), events: make(chan func(), 16)}
+	if *plainOutput {
+		return b.lines(ctx, queries)
+	}
+	keys, restore, err := readKeys(tty, false)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	b.resize()
+	// the screen is the terminal's, the logs show in the status line
+	log.SetOutput(browseLog{b})
+	defer log.SetOutput(os.Stderr)
+	b.out.WriteString("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		b.out.WriteString("\x1b[?25h\x1b[?1049l")
+		b.out.Flush()
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGWINCH)
+	defer signal.Stop(sigs)
+
+	b.search(ctx, queries)
+	for {
+		b.draw()
+		select {
+		case k, ok := <-keys:
+			if !ok || !b.key(ctx, k, keys) {
+				b.halt()
+				return nil
+			}
+		case ev := <-b.events:
+			ev()
+		case sig := <-sigs:
+			if sig != syscall.SIGWINCH {
+				b.halt()
+				return nil
+			}
+			b.resize()
+		case <-ctx.Done():
+			b.halt()
+			return nil
+		}
+	}
+}
+
+// lines implements --browse with --plain. The sounds are printed as numbered lines and the
+// commands are read as lines, so screen readers echo what is typed and nothing is drawn
+// over. The statuses are printed as they change
+func (b *browser) lines(ctx context.Context, queries []string) error {
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(b.tty)
+		for scanner.Scan() {
+			lines <- strings.TrimSpace(scanner.Text())
+		}
+		close(lines)
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	b.search(ctx, queries)
+	b.list()
+	b.printf("%s\n", tr(browsePlainHelp))
+	printed := ""
+	for {
+		if b.status != printed {
+			if b.status != "" {
+				b.printf("%s\n", b.status)
+			}
+			printed = b.status
+		}
+		select {
+		case line, ok := <-lines:
+			// the statuses of a command are printed even if they are those of the last
+			b.status, printed = "", ""
+			if !ok || !b.command(ctx, line) {
+				b.halt()
+				return nil
+			}
+		case ev := <-b.events:
+			ev()
+		case <-sigs:
+			b.halt()
+			return nil
+		case <-ctx.Done():
+			b.halt()
+			return nil
+		}
+	}
+}
+
+// command handles a line of --browse --plain and reports whether to go on
+func (b *browser) command(ctx context.Context, line string) bool {
+	cmd, arg := line, ""
+	if i := strings.IndexAny(line, " \t"); i > 0 {
+		cmd, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	switch {
+	case line == "":
+		b.halt()
+	case line == "q":
+		return false
+	case line == "l":
+		b.list()
+	case strings.HasPrefix(line, "/"):
+		if query := strings.TrimSpace(line[1:]); query != "" {
+			b.status = ""
+			b.search(ctx, []string{query})
+			b.list()
+		}
+	case cmd == "d" && b.pick(arg):
+		b.fetch(ctx)
+	case cmd == "i" && b.pick(arg):
+		b.info()
+	case cmd == "d", cmd == "i":
+	case b.pick(line):
+		b.play(ctx)
+	}
+
+	return true
+}
+
+// pick selects the sound of the number n, from 1, and reports whether there is one. The
+// status says why not
+func (b *browser) pick(n string) bool {
+	i, err := strconv.Atoi(n)
+	if err != nil {
+		b.status = tr(browsePlainHelp)
+		return false
+	}
+	if i < 1 || i > len(b.sounds) {
+		b.status = fmt.Sprintf(tr("no sound %d, the sounds are 1 to %d"), i, len(b.sounds))
+		return false
+	}
+	b.cur = i - 1
+
+	return true
+}
+
+// list prints the sounds as numbered lines
+func (b *browser) list() {
+	b.printf(tr("thames: %s  %d sounds")+"\n", strings.Join(b.queries, ", "), len(b.sounds))
+	for i, snd := range b.sounds {
+		mark := ""
+		if snd.fname == b.playing {
+			mark = tr("playing") + ", "
+		} else if snd.cached {
+			mark = tr("cached") + ", "
+		}
+		b.printf("%d. %s%s, %d:%02d, %s\n", i+1, mark, snd.descr, snd.secs/60, snd.secs%60, b.meta[snd.fname].category)
+	}
+}
+
+func (b *browser) printf(format string, args ...interface{}) {
+	fmt.Fprintf(b.out, format, args...)
+	b.out.Flush()
+}
+
+// search selects the sounds of the queries, like --query
+func (b *browser) search(ctx context.Context, queries []string) {
+	b.queries = queries
+	b.sounds = nil
+	for _, query := range queries {
+		b.sounds = append(b.sounds, selectSounds(ctx, b.sel, query, *nsounds, b.f.dir)...)
+	}
+	meta, err := readMetadata(ctx, b.db, b.sounds)
+	if err != nil {
+		log.Printf("Error:Query: %v", err)
+	}
+	b.meta = meta
+	b.cur, b.top = 0, 0
+	if len(b.sounds) == 0 {
+		b.status = tr("no sounds match, / searches again")
+	}
+}
+
+// key handles a key and reports whether to go on. The escape sequences of the arrows are
+// read from keys
+func (b *browser) key(ctx context.Context, k byte, keys <-chan byte) bool {
+	if k == 0x1b {
+		k = escapeKey(keys)
+	}
+	if b.editing {
+		b.edit(ctx, k)
+		return true
+	}
+
+	page := b.rows - 2
+	switch k {
+	case 'q':
+		return false
+	case 'k', keyUp:
+		b.move(-1)
+	case 'j', keyDown:
+		b.move(1)
+	case keyPageUp:
+		b.move(-page)
+	case keyPageDown, 'f':
+		b.move(page)
+	case 'g', keyHome:
+		b.move(-len(b.sounds))
+	case 'G', keyEnd:
+		b.move(len(b.sounds))
+	case '\r', '\n':
+		b.play(ctx)
+	case ' ':
+		b.halt()
+		b.status = ""
+	case 'd':
+		b.fetch(ctx)
+	case 'i':
+		b.info()
+	case '/':
+		b.editing = true
+		b.input = []rune(strings.Join(b.queries, " "))
+	}
+
+	return true
+}
+
+// edit handles a key while a query is typed
+func (b *browser) edit(ctx context.Context, k byte) {
+	switch k {
+	case '\r', '\n':
+		b.editing = false
+		if query := strings.TrimSpace(string(b.input)); query != "" {
+			b.status = ""
+			b.search(ctx, []string{query})
+		}
+	case keyEscape:
+		b.editing = false
+	case 0x7f, 0x08:
+		if len(b.input) > 0 {
+			b.input = b.input[:len(b.input)-1]
+		}
+	case 0x15: // ^U
+		b.input = nil
+	default:
+		if k >= ' ' && k < 0x7f {
+			b.input = append(b.input, rune(k))
+		}
+	}
+}
+
+func (b *browser) move(n int) {
+	b.cur += n
+	if b.cur >= len(b.sounds) {
+		b.cur = len(b.sounds) - 1
+	}
+	if b.cur < 0 {
+		b.cur = 0
+	}
+}
+
+// play plays the selected sound, fetching it first if it is missing, after stopping the one
+// that plays
+func (b *browser) play(ctx context.Context) {
+	if len(b.sounds) == 0 {
+		return
+	}
+	b.halt()
+	snd := b.sounds[b.cur]
+	pctx, cancel := context.WithCancel(ctx)
+	b.stop, b.playing = cancel, snd.fname
+	b.status = "Playing: " + snd.descr
+
+	go func() {
+		fpath, exists, err := b.f.cache(pctx, snd.fname)
+		if err != nil || !exists {
+			b.post(func() { b.status = fmt.Sprintf("Missing File: %s: %v", snd.fname, missingError(err)) })
+			return
+		}
+		b.post(func() { b.markCached(snd.fname) })
+		err = playSound(pctx, fpath, 1, 0)
+		b.post(func() {
+			if b.playing != snd.fname || pctx.Err() != nil {
+				return
+			}
+			b.stop, b.playing = nil, ""
+			if err != nil {
+				b.status = fmt.Sprintf("Error:Play: %v", err)
+			} else {
+				b.status = ""
+			}
+		})
+	}()
+}
+
+// halt stops the sound that plays
+func (b *browser) halt() {
+	if b.stop != nil {
+		b.stop()
+		b.stop, b.playing = nil, ""
+	}
+}
+
+// fetch fetches the selected sound into the cache
+func (b *browser) fetch(ctx context.Context) {
+	if len(b.sounds) == 0 {
+		return
+	}
+	snd := b.sounds[b.cur]
+	b.status = "Fetching: " + snd.descr
+	go func() {
+		_, exists, err := b.f.cache(ctx, snd.fname)
+		b.post(func() {
+			if err != nil || !exists {
+				b.status = fmt.Sprintf("Missing File: %s: %v", snd.fname, missingError(err))
+				return
+			}
+			b.markCached(snd.fname)
+			b.status = "Fetched: " + snd.descr
+		})
+	}()
+}
+
+// info shows the archival context of the selected sound in the status line
+func (b *browser) info() {
+	if len(b.sounds) == 0 {
+		return
+	}
+	snd := b.sounds[b.cur]
+	if story := b.meta[snd.fname].story(); story != "" {
+		b.status = story
+	} else {
+		b.status = fmt.Sprintf(tr("%s: no notes of the archive"), snd.fname)
+	}
+}
+
+func (b *browser) markCached(fname string) {
+	for i := range b.sounds {
+		if b.sounds[i].fname == fname {
+			b.sounds[i].cached = true
+		}
+	}
+}
+
+// post runs ev in the loop of the browser, which owns its state. Events are dropped if the
+// loop is behind, they are only statuses
+func (b *browser) post(ev func()) {
+	select {
+	case b.events <- ev:
+	default:
+	}
+}
+
+// resize reads the size of the terminal
+func (b *browser) resize() {
+	b.rows, b.cols = 24, 80
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = b.tty
+	if out, err := cmd.Output(); err == nil {
+		var rows, cols int
+		if n, _ := fmt.Sscan(string(out), &rows, &cols); n == 2 && rows > 2 && cols > 20 {
+			b.rows, b.cols = rows, cols
+		}
+	}
+}
+
+// draw draws the title, the sounds that fit around the selected one and the status line
+func (b *browser) draw() {
+	page := b.rows - 2
+	if b.cur < b.top {
+		b.top = b.cur
+	} else if b.cur >= b.top+page {
+		b.top = b.cur - page + 1
+	}
+
+	b.out.WriteString("\x1b[H")
+	title := fmt.Sprintf(tr(" thames: %s  %d sounds"), strings.Join(b.queries, ", "), len(b.sounds))
+	b.line("\x1b[7m", fit(title, b.cols))
+	for i := b.top; i < b.top+page; i++ {
+		if i >= len(b.sounds) {
+			b.line("", "")
+			continue
+		}
+		b.line(b.rowStyle(i), b.row(i))
+	}
+	if b.editing {
+		b.out.WriteString("\x1b[2K" + fit("/"+string(b.input), b.cols))
+	} else {
+		status := b.status
+		if status == "" {
+			status = tr(browseHelp)
+		}
+		b.out.WriteString("\x1b[2K" + fit(status, b.cols))
+	}
+	b.out.Flush()
+}
+
+func (b *browser) line(style, text string) {
+	b.out.WriteString("\x1b[2K" + style + text)
+	if style != "" {
+		b.out.WriteString("\x1b[0m")
+	}
+	b.out.WriteString("\r\n")
+}
+
+// row is the line of a sound: whether it plays or is cached, the description, the duration
+// and the category
+func (b *browser) row(i int) string {
+	snd := b.sounds[i]
+	mark := " "
+	if snd.fname == b.playing {
+		mark = ">"
+	} else if snd.cached {
+		mark = "*"
+	}
+	duration := fmt.Sprintf("%d:%02d", snd.secs/60, snd.secs%60)
+	category := b.meta[snd.fname].category
+	width := b.cols / 4
+	if width > 24 {
+		width = 24
+	}
+	descr := b.cols - width - len(duration) - 6
+
+	return fmt.Sprintf(" %s %s %s  %s", mark, pad(fit(snd.descr, descr), descr), duration, fit(category, width))
+}
+
+func (b *browser) rowStyle(i int) string {
+	if i == b.cur {
+		return "\x1b[7m"
+	}
+
+	return ""
+}
+
+// fit cuts s to n characters
+func fit(s string, n int) string {
+	r := []rune(s)
+	if n <= 0 {
+		return ""
+	}
+	if len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+
+	return s
+}
+
+// pad pads s with spaces to n characters
+func pad(s string, n int) string {
+	if l := len([]rune(s)); l < n {
+		return s + strings.Repeat(" ", n-l)
+	}
+
+	return s
+}
+
+// The keys of escape sequences, out of the range of the bytes of keys
+const (
+	keyEscape = 0x80 + iota
+	keyUp
+	keyDown
+	keyPageUp
+	keyPageDown
+	keyHome
+	keyEnd
+	keyUnknown
+)
+
+// escapeKey reads the rest of an escape sequence from keys and returns its key. An escape
+// that isn't followed at once by [ or O is the escape key
+func escapeKey(keys <-chan byte) byte {
+	next := func() (byte, bool) {
+		select {
+		case k, ok := <-keys:
+			return k, ok
+		case <-time.After(50 * time.Millisecond):
+			return 0, false
+		}
+	}
+	k, ok := next()
+	if !ok || k != '[' && k != 'O' {
+		return keyEscape
+	}
+
+	var seq []byte
+	for {
+		k, ok := next()
+		if !ok {
+			return keyUnknown
+		}
+		seq = append(seq, k)
+		if k >= 0x40 && k <= 0x7e {
+			break
+		}
+	}
+	switch string(seq) {
+	case "A":
+		return keyUp
+	case "B":
+		return keyDown
+	case "5~":
+		return keyPageUp
+	case "6~":
+		return keyPageDown
+	case "H", "1~", "7~":
+		return keyHome
+	case "F", "4~", "8~":
+		return keyEnd
+	}
+
+	return keyUnknown
+}
+
+// browseLog shows the logs in the status line of the browser
+type browseLog struct {
+	b *browser
+}
+
+func (w browseLog) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	w.b.post(func() { w.b.status = line })
+
+	return len(p), nil
+}
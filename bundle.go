@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A bundle is a soundscape recipe to share, presets and the collections they play, as json.
+// It has the queries, volumes and automations of the presets and the locations of the sounds
+// of the collections, but no audio: those who install it fetch the sounds from the archive
+type bundle struct {
+	Thames      int              `json:"thames"` // the version of the format
+	Name        string           `json:"name"`
+	Presets     []bundlePreset   `json:"presets,omitempty"`
+	Collections []collectionJSON `json:"collections,omitempty"`
+}
+
+type bundlePreset struct {
+	Name string `json:"name"`
+	Text string `json:"text"`
+}
+
+const bundleVersion = 1
+
+// presetsDir is where the presets of the bundles are installed. Presets are found there
+// by name, like --preset focus-mix
+func presetsDir() string {
+	return filepath.Join(*rootDir, "presets")
+}
+
+// resolvePreset returns the file of the preset fpath. A name that is not a file is that of
+// a preset file in the current directory, or of an installed preset
+func resolvePreset(fpath string) string {
+	if _, err := os.Stat(fpath); err == nil || strings.ContainsRune(fpath, os.PathSeparator) {
+		return fpath
+	}
+	name := strings.TrimSuffix(fpath, ".preset") + ".preset"
+	for _, p := range []string{name, filepath.Join(presetsDir(), name)} {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+
+	return fpath
+}
+
+// presetName is the name of the preset file fpath, without the directory and extension
+func presetName(fpath string) string {
+	return strings.TrimSuffix(filepath.Base(fpath), ".preset")
+}
+
+// validName reports whether name can be the file name of an installed preset
+func validName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+// addPreset adds the preset file fpath to the bundle, with the collections its queries select from
+func (b *bundle) addPreset(ctx context.Context, db *sql.DB, fpath string) error {
+	lines, err := loadPreset(fpath)
+	if err != nil {
+		return err
+	}
+	text, err := ioutil.ReadFile(resolvePreset(fpath))
+	if err != nil {
+		return err
+	}
+	b.Presets = append(b.Presets, bundlePreset{Name: presetName(fpath), Text: string(text)})
+
+	for _, line := range lines {
+		for _, q := range line.group.queries {
+			if name, _, ok := collectionQuery(q); ok {
+				if err := b.addCollection(ctx, db, name); err != nil {
+					return fmt.Errorf("%s: %v", fpath, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// addCollection adds the collection name to the bundle, once
+func (b *bundle) addCollection(ctx context.Context, db *sql.DB, name string) error {
+	for _, c := range b.Collections {
+		if c.Name == name {
+			return nil
+		}
+	}
+
+	sounds, err := collectionSounds(ctx, db, name)
+	if err != nil {
+		return err
+	}
+	if len(sounds) == 0 {
+		return fmt.Errorf("no collection %q", name)
+	}
+	b.Collections = append(b.Collections, collectionJSON{Name: name, Sounds: sounds})
+
+	return nil
+}
+
+// shareCommand implements the share command. It prints the bundle of presets and collections
+func shareCommand(args []string) error {
+	fs := flag.NewFlagSet("share", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames share preset|@collection...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	b := bundle{Thames: bundleVersion, Name: presetName(strings.TrimPrefix(fs.Arg(0), "@"))}
+	for _, arg := range fs.Args() {
+		fpath := resolvePreset(arg)
+		isPreset, err := fileExists(fpath)
+		switch {
+		case strings.HasPrefix(arg, "@"):
+			err = b.addCollection(ctx, db, arg[1:])
+		case err != nil:
+		case isPreset:
+			err = b.addPreset(ctx, db, fpath)
+		default:
+			// a collection without the @
+			if err = b.addCollection(ctx, db, arg); err != nil {
+				err = fmt.Errorf("no preset or collection %q", arg)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+
+	return nil
+}
+
+// readBundle reads and validates the bundle file fpath
+func readBundle(fpath string) (bundle, error) {
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return bundle{}, err
+	}
+
+	return parseBundle(data, fpath)
+}
+
+// parseBundle parses and validates the bundle data of fpath, a file or a url
+func parseBundle(data []byte, fpath string) (bundle, error) {
+	var b bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return b, fmt.Errorf("%s: not a bundle: %v", fpath, err)
+	}
+	if b.Thames == 0 {
+		return b, fmt.Errorf("%s: not a bundle of thames", fpath)
+	}
+	if b.Thames > bundleVersion {
+		return b, fmt.Errorf("%s: a bundle of version %d, this thames reads up to %d", fpath, b.Thames, bundleVersion)
+	}
+	if len(b.Presets) == 0 && len(b.Collections) == 0 {
+		return b, fmt.Errorf("%s: an empty bundle", fpath)
+	}
+
+	for _, p := range b.Presets {
+		if !validName(p.Name) {
+			return b, fmt.Errorf("%s: bad preset name %q", fpath, p.Name)
+		}
+		for lineno, text := range strings.Split(p.Text, "\n") {
+			text = strings.TrimSpace(text)
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+			if _, err := parsePresetLine(text); err != nil {
+				return b, fmt.Errorf("%s: preset %s:%d: %v", fpath, p.Name, lineno+1, err)
+			}
+		}
+	}
+	for _, c := range b.Collections {
+		if c.Name == "" {
+			return b, fmt.Errorf("%s: a collection without a name", fpath)
+		}
+	}
+
+	return b, nil
+}
+
+// installCommand implements the install command. It installs the presets and collections
+// of bundles
+func installCommand(args []string) error {
+	fs := flag.NewFlagSet("install", flag.ExitOnError)
+	force := fs.Bool("force", false, "Replace the installed presets of the same name")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames install [--force] bundle...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, fpath := range fs.Args() {
+		b, err := readBundle(fpath)
+		if err != nil {
+			return err
+		}
+		if err := installBundle(db, fpath, b, *force); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// installBundle installs the presets of the bundle b, of the file or url fpath, into the
+// presets directory and adds the sounds of its collections to the collections of the same name
+func installBundle(db *sql.DB, fpath string, b bundle, force bool) error {
+	// nothing is installed if any preset would be replaced
+	for _, p := range b.Presets {
+		dst := filepath.Join(presetsDir(), p.Name+".preset")
+		if exists, err := fileExists(dst); err != nil {
+			return err
+		} else if exists && !force {
+			return fmt.Errorf("%s: preset %s is installed, --force replaces it", fpath, p.Name)
+		}
+	}
+
+	for _, c := range b.Collections {
+		added, err := importCollection(db, c.Name, c)
+		if err != nil {
+			return err
+		}
+		log.Printf("Install: collection %s, %d of %d sounds", c.Name, added, len(c.Sounds))
+	}
+	if len(b.Presets) > 0 {
+		if err := os.MkdirAll(presetsDir(), 0755); err != nil {
+			return err
+		}
+	}
+	for _, p := range b.Presets {
+		dst := filepath.Join(presetsDir(), p.Name+".preset")
+		if err := ioutil.WriteFile(dst, []byte(p.Text), 0644); err != nil {
+			return err
+		}
+		log.Printf("Install: preset %s, play it with --preset %s", dst, p.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var storeFlac = flag.Bool("flac", false, "Store the fetched sounds in the cache compressed as FLAC")
+
+// compressedPath returns the path of the FLAC copy of the sound file fname in the cache dir
+func compressedPath(dir, fname string) string {
+	return filepath.Join(dir, strings.TrimSuffix(fname, filepath.Ext(fname))+".flac")
+}
+
+// cachedPath returns the path of the sound file fname in the cache dir, as is or compressed,
+// and whether it exists. Players decode FLAC transparently, so callers can use either
+func cachedPath(dir, fname string) (string, bool, error) {
+	for _, p := range []string{filepath.Join(dir, fname), compressedPath(dir, fname)} {
+		if exists, err := fileExists(p); err != nil || exists {
+			return p, exists, err
+		}
+	}
+
+	return filepath.Join(dir, fname), false, nil
+}
+
+// compressSound replaces the sound file fname in the cache dir with a FLAC copy of it
+func compressSound(dir, fname string) error {
+	src := filepath.Join(dir, fname)
+	dst := compressedPath(dir, fname)
+	tmp := dst + ".part"
+
+	cmd := exec.Command("flac", "--best", "--silent", "--force", "-o", tmp, src)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("flac: %s: %v: %s", fname, err, out)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+
+	return os.Remove(src)
+}
+
+// cacheCommand implements the cache command which maintains the cache of sounds
+func cacheCommand(args []string) error {
+	usage := func() error {
+		fmt.Fprintf(os.Stderr, "usage: thames cache dedupe [--dry-run]\n       thames cache compress\n       thames cache sync\n       thames cache verify\n")
+		return errUsage
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+
+	switch args[0] {
+	case "dedupe":
+		return cacheDedupe(args[1:])
+	case "compress":
+		return cacheCompress(args[1:])
+	case "sync":
+		db, err := openDatabase()
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if err := syncCached(db); err != nil {
+			return err
+		}
+	case "verify":
+		db, err := openDatabase()
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return cacheVerify(db)
+	default:
+		return usage()
+	}
+
+	return nil
+}
+
+// cacheDedupe hard links byte-identical files of the cache to each other.
+// Some sounds appear in the archive under different locations, on different CDs,
+// and each copy costs disk space for no reason
+func cacheDedupe(args []string) error {
+	fs := flag.NewFlagSet("cache dedupe", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only report the duplicates, don't link them")
+	fs.Parse(args)
+
+	infos, err := ioutil.ReadDir(soundsDir)
+	if err != nil {
+		return err
+	}
+
+	// only files of the same size can be identical, so hash just those
+	bySize := make(map[int64][]os.FileInfo)
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			bySize[info.Size()] = append(bySize[info.Size()], info)
+		}
+	}
+
+	var linked int
+	var saved int64
+	for size, group := range bySize {
+		if len(group) < 2 {
+			continue
+		}
+		sort.Slice(group, func(i, j int) bool { return group[i].Name() < group[j].Name() })
+
+		byHash := make(map[string][]os.FileInfo)
+		for _, info := range group {
+			sum, err := fileHash(soundPath(info.Name()))
+			if err != nil {
+				return err
+			}
+			byHash[string(sum)] = append(byHash[string(sum)], info)
+		}
+
+		for _, same := range byHash {
+			orig := same[0]
+			for _, dup := range same[1:] {
+				if os.SameFile(orig, dup) {
+					continue
+				}
+				log.Printf("Duplicate: %s %s", dup.Name(), orig.Name())
+				if !*dryRun {
+					if err := linkFile(soundPath(orig.Name()), soundPath(dup.Name())); err != nil {
+						return err
+					}
+				}
+				linked++
+				saved += size
+			}
+		}
+	}
+
+	verb := "Linked"
+	if *dryRun {
+		verb = "Found"
+	}
+	log.Printf("%s %d duplicates, %d MB", verb, linked, saved>>20)
+
+	return nil
+}
+
+// cacheCompress migrates an existing cache to FLAC, compressing every wav in it
+func cacheCompress(args []string) error {
+	fs := flag.NewFlagSet("cache compress", flag.ExitOnError)
+	fs.Parse(args)
+
+	infos, err := ioutil.ReadDir(soundsDir)
+	if err != nil {
+		return err
+	}
+
+	var wavs []os.FileInfo
+	for _, info := range infos {
+		if info.Mode().IsRegular() && strings.EqualFold(filepath.Ext(info.Name()), ".wav") {
+			wavs = append(wavs, info)
+		}
+	}
+	p := newProgress("Compressing", len(wavs))
+
+	var n int
+	var before, after int64
+	for _, info := range wavs {
+		err := compressSound(soundsDir, info.Name())
+		p.step()
+		if err != nil {
+			p.logf("Error:Compress: %v", err)
+			continue
+		}
+		if cinfo, err := os.Stat(compressedPath(soundsDir, info.Name())); err == nil {
+			after += cinfo.Size()
+		}
+		before += info.Size()
+		n++
+	}
+	p.finish()
+
+	log.Printf("Compressed %d sounds, %d MB to %d MB", n, before>>20, after>>20)
+
+	return nil
+}
+
+// linkFile replaces dst with a hard link to src
+func linkFile(src, dst string) error {
+	tmp := dst + ".link"
+	os.Remove(tmp)
+	if err := os.Link(src, tmp); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, dst)
+}
+
+func fileHash(fpath string) ([]byte, error) {
+	fin, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fin); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// importDump implements the import-dump command. It walks a directory with an existing copy
+// of the archive and links, or moves, every file that is in the index into the cache
+func importDump(args []string) error {
+	fs := flag.NewFlagSet("import-dump", flag.ExitOnError)
+	move := fs.Bool("move", false, "Move the files instead of hard linking them")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames import-dump [--move] dir...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	indexed := make(map[string]bool)
+	rows, err := db.Query(`SELECT location FROM sounds`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var location string
+		if err := rows.Scan(&location); err != nil {
+			return err
+		}
+		indexed[location] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if err := os.MkdirAll(soundsDir, 0755); err != nil {
+		return err
+	}
+
+	var imported, cached, unknown int
+	for _, dir := range fs.Args() {
+		err := filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			fname := info.Name()
+			if !indexed[fname] {
+				unknown++
+				return nil
+			}
+			dst := soundPath(fname)
+			if _, exists, err := cachedPath(soundsDir, fname); err != nil {
+				return err
+			} else if exists {
+				cached++
+				return nil
+			}
+			if err := importFile(fpath, dst, *move); err != nil {
+				return err
+			}
+			if err := setCached(db, fname, true); err != nil {
+				return err
+			}
+			imported++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Imported %d sounds, %d already cached, %d files not in the index", imported, cached, unknown)
+
+	return nil
+}
+
+// importFile puts src in the cache as dst. It prefers to move or hard link and falls back to
+// copying when src is on another file system
+func importFile(src, dst string, move bool) error {
+	if move {
+		if err := os.Rename(src, dst); err == nil {
+			return nil
+		}
+	} else if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	if move {
+		return os.Remove(src)
+	}
+
+	return nil
+}
+
+// copyFile copies src to dst atomically
+func copyFile(src, dst string) error {
+	fin, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+
+	fout, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fout.Name())
+
+	if _, err := io.Copy(fout, fin); err != nil {
+		fout.Close()
+		return err
+	}
+	if err := fout.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(fout.Name(), dst)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var calendarSource = flag.String("calendar", "", "Soften the mix during the events of the ical calendar at `url`, or in the file, like meetings")
+
+// The calendar is an ical feed, like the secret address of a calendar of Google or Outlook, or
+// an .ics file. Its timed events soften the mix while they last, the all-day events and those
+// marked free or cancelled don't. Events that recur daily or weekly, maybe on some days, every
+// few days or weeks, until a date or a number of times, soften the mix each time. Of the other
+// recurrences only the first time does
+
+// calendarEvent is a timed event of a calendar
+type calendarEvent struct {
+	summary  string
+	start    time.Time // in the time zone of the event, so it recurs at the same time of day
+	duration time.Duration
+	repeat   *recurrence    // nil if it doesn't recur
+	except   map[int64]bool // the starts of the recurrences that don't happen, in unix seconds
+}
+
+// recurrence is a daily or weekly recurrence rule of an event
+type recurrence struct {
+	weekly   bool
+	interval int            // the days or weeks between the recurrences
+	days     []time.Weekday // of the weekly recurrences, from Monday, the day of the start if none
+	until    time.Time      // zero if forever
+	count    int            // the number of recurrences, 0 if no limit
+}
+
+var icalDays = map[string]time.Weekday{
+	"MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday, "TH": time.Thursday,
+	"FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday,
+}
+
+// readCalendar reads the events of the calendar at source, a url or a file
+func readCalendar(ctx context.Context, source string) ([]calendarEvent, error) {
+	if strings.HasPrefix(source, "webcal://") {
+		source = "https://" + strings.TrimPrefix(source, "webcal://")
+	}
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		fin, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer fin.Close()
+		return parseCalendar(fin)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", source, resp.Status)
+	}
+
+	return parseCalendar(resp.Body)
+}
+
+// parseCalendar parses the timed events of an ical calendar
+func parseCalendar(r io.Reader) ([]calendarEvent, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// long lines are folded, continued on lines that start with a space or a tab
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.NewReplacer("\n ", "", "\n\t", "").Replace(text)
+	if !strings.Contains(text, "BEGIN:VCALENDAR") {
+		return nil, errors.New("not an ical calendar")
+	}
+
+	var events []calendarEvent
+	var props map[string]icalProp
+	var exdates []icalProp
+	for _, line := range strings.Split(text, "\n") {
+		p, ok := parseICalLine(line)
+		switch {
+		case !ok:
+		case p.name == "BEGIN" && p.value == "VEVENT":
+			props, exdates = make(map[string]icalProp), nil
+		case p.name == "END" && p.value == "VEVENT" && props != nil:
+			e, ok, err := newCalendarEvent(props, exdates)
+			if err != nil {
+				return nil, fmt.Errorf("event %q: %v", props["SUMMARY"].value, err)
+			}
+			if ok {
+				events = append(events, e)
+			}
+			props = nil
+		case props != nil && p.name == "EXDATE":
+			exdates = append(exdates, p)
+		case props != nil:
+			props[p.name] = p
+		}
+	}
+
+	return events, nil
+}
+
+// icalProp is a property of an ical component, like DTSTART;TZID=Europe/Athens:20261014T090000
+type icalProp struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+func parseICalLine(line string) (icalProp, bool) {
+	line = strings.TrimSpace(line)
+	i := strings.IndexByte(line, ':')
+	if i <= 0 {
+		return icalProp{}, false
+	}
+	fields := strings.Split(line[:i], ";")
+	p := icalProp{name: strings.ToUpper(fields[0]), params: make(map[string]string), value: line[i+1:]}
+	for _, f := range fields[1:] {
+		if kv := strings.SplitN(f, "=", 2); len(kv) == 2 {
+			p.params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	if p.name == "SUMMARY" {
+		p.value = strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, " ", `\N`, " ", `\\`, `\`).Replace(p.value)
+	}
+
+	return p, true
+}
+
+// newCalendarEvent returns the event of the properties of a VEVENT, if it softens the mix
+func newCalendarEvent(props map[string]icalProp, exdates []icalProp) (calendarEvent, bool, error) {
+	e := calendarEvent{summary: props["SUMMARY"].value}
+	if strings.EqualFold(props["STATUS"].value, "CANCELLED") || strings.EqualFold(props["TRANSP"].value, "TRANSPARENT") {
+		return e, false, nil
+	}
+	dtstart, ok := props["DTSTART"]
+	if !ok {
+		return e, false, errors.New("no DTSTART")
+	}
+	start, allDay, err := parseICalTime(dtstart)
+	if err != nil || allDay {
+		return e, false, err
+	}
+	e.start = start
+
+	if end, ok := props["DTEND"]; ok {
+		t, _, err := parseICalTime(end)
+		if err != nil {
+			return e, false, err
+		}
+		e.duration = t.Sub(start)
+	} else if d, ok := props["DURATION"]; ok {
+		if e.duration, err = parseICalDuration(d.value); err != nil {
+			return e, false, err
+		}
+	}
+	if e.duration <= 0 {
+		return e, false, nil
+	}
+
+	if rule, ok := props["RRULE"]; ok {
+		if e.repeat, err = parseRecurrence(rule.value, start.Location()); err != nil {
+			return e, false, err
+		}
+	}
+	e.except = make(map[int64]bool)
+	for _, p := range exdates {
+		for _, v := range strings.Split(p.value, ",") {
+			t, _, err := parseICalTime(icalProp{params: p.params, value: v})
+			if err != nil {
+				return e, false, err
+			}
+			e.except[t.Unix()] = true
+		}
+	}
+
+	return e, true, nil
+}
+
+// parseICalTime parses a date or a date with a time, in UTC, in the zone of its TZID, or
+// local. It reports whether it is a date
+func parseICalTime(p icalProp) (time.Time, bool, error) {
+	loc := time.Local
+	if tzid := p.params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	v := p.value
+	switch {
+	case p.params["VALUE"] == "DATE" || len(v) == len("20060102"):
+		t, err := time.ParseInLocation("20060102", v, loc)
+		return t, true, err
+	case strings.HasSuffix(v, "Z"):
+		t, err := time.Parse("20060102T150405Z", v)
+		return t, false, err
+	}
+	t, err := time.ParseInLocation("20060102T150405", v, loc)
+
+	return t, false, err
+}
+
+// parseICalDuration parses a duration like PT1H30M or P1D
+func parseICalDuration(v string) (time.Duration, error) {
+	s := strings.TrimPrefix(strings.TrimPrefix(v, "+"), "P")
+	if s == v || s == "" {
+		return 0, fmt.Errorf("bad duration %q", v)
+	}
+	units := map[byte]time.Duration{'W': 7 * 24 * time.Hour, 'D': 24 * time.Hour, 'H': time.Hour, 'M': time.Minute, 'S': time.Second}
+	var d time.Duration
+	inTime := false
+	for len(s) > 0 {
+		if s[0] == 'T' {
+			inTime = true
+			s = s[1:]
+			continue
+		}
+		i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+		if i <= 0 {
+			return 0, fmt.Errorf("bad duration %q", v)
+		}
+		n, _ := strconv.Atoi(s[:i])
+		unit, ok := units[s[i]]
+		if !ok || s[i] == 'M' && !inTime {
+			return 0, fmt.Errorf("bad duration %q", v)
+		}
+		d += time.Duration(n) * unit
+		s = s[i+1:]
+	}
+
+	return d, nil
+}
+
+// parseRecurrence parses an RRULE, nil if thames doesn't follow it
+func parseRecurrence(v string, loc *time.Location) (*recurrence, error) {
+	r := &recurrence{interval: 1}
+	for _, part := range strings.Split(v, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.ToUpper(kv[0]) {
+		case "FREQ":
+			switch kv[1] {
+			case "DAILY":
+			case "WEEKLY":
+				r.weekly = true
+			default:
+				return nil, nil
+			}
+		case "INTERVAL":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("bad INTERVAL %q", kv[1])
+			}
+			r.interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("bad COUNT %q", kv[1])
+			}
+			r.count = n
+		case "UNTIL":
+			t, _, err := parseICalTime(icalProp{value: kv[1]})
+			if err != nil {
+				return nil, err
+			}
+			if t.Location() == time.Local {
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc)
+			}
+			if len(kv[1]) == len("20060102") {
+				t = t.AddDate(0, 0, 1).Add(-time.Second)
+			}
+			r.until = t
+		case "BYDAY":
+			for _, d := range strings.Split(kv[1], ",") {
+				wd, ok := icalDays[d]
+				if !ok {
+					// like 1MO, the first Monday of monthly recurrences
+					return nil, nil
+				}
+				r.days = append(r.days, wd)
+			}
+		case "WKST":
+		default:
+			// like BYMONTHDAY or BYSETPOS, not followed
+			return nil, nil
+		}
+	}
+	sort.Slice(r.days, func(i, j int) bool { return (r.days[i]+6)%7 < (r.days[j]+6)%7 })
+
+	return r, nil
+}
+
+// at returns the start of the time of the event that is on at t, if any
+func (e calendarEvent) at(t time.Time) (time.Time, bool) {
+	var on time.Time
+	found := false
+	e.each(t, func(start time.Time) {
+		if !t.Before(start) && t.Before(start.Add(e.duration)) {
+			on, found = start, true
+		}
+	})
+
+	return on, found
+}
+
+// each calls f with the starts of the times of the event, in order, until one is after t
+func (e calendarEvent) each(t time.Time, f func(start time.Time)) {
+	r := e.repeat
+	if r == nil {
+		if !e.start.After(t) {
+			f(e.start)
+		}
+		return
+	}
+
+	n := 0
+	emit := func(start time.Time) bool {
+		if start.After(t) || !r.until.IsZero() && start.After(r.until) || r.count > 0 && n >= r.count {
+			return false
+		}
+		n++
+		if !e.except[start.Unix()] {
+			f(start)
+		}
+		return true
+	}
+	if !r.weekly {
+		for k := 0; emit(e.start.AddDate(0, 0, k*r.interval)); k++ {
+		}
+		return
+	}
+
+	days := r.days
+	if len(days) == 0 {
+		days = []time.Weekday{e.start.Weekday()}
+	}
+	// the weeks start on Monday
+	monday := e.start.AddDate(0, 0, -int((e.start.Weekday()+6)%7))
+	for w := 0; ; w++ {
+		week := monday.AddDate(0, 0, 7*w*r.interval)
+		for _, d := range days {
+			start := week.AddDate(0, 0, int((d+6)%7))
+			if start.Before(e.start) {
+				continue
+			}
+			if !emit(start) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+var copyResults = flag.Bool("copy", false, "With --query, copy the paths of the cached sounds, and the urls of the others, to the clipboard")
+
+// clipboards are the commands that write their input to the clipboard, in order of preference:
+// wayland, X11, macOS and windows, for WSL
+var clipboards = [][]string{
+	{"wl-copy"},
+	{"xclip", "-selection", "clipboard"},
+	{"xsel", "--clipboard", "--input"},
+	{"pbcopy"},
+	{"clip.exe"},
+}
+
+// copyToClipboard puts text on the clipboard with the first of clipboards that is installed
+func copyToClipboard(text string) error {
+	for _, c := range clipboards {
+		if _, err := exec.LookPath(c[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(c[0], c[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %v: %s", c[0], err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+
+	return fmt.Errorf("no clipboard command, install wl-copy, xclip or xsel")
+}
+
+// urlSource is a source that fetches sounds from urls
+type urlSource interface {
+	url(fname string) string
+}
+
+// copyTarget returns what --copy puts on the clipboard for the sound: its path if it is
+// in the cache, otherwise its url at the first source with urls, otherwise the path it will have
+func copyTarget(snd sound) string {
+	if fpath, exists, _ := cachedPath(soundsDir, snd.fname); snd.cached && exists {
+		return fpath
+	}
+	for _, src := range extraSources {
+		if u, ok := src.(urlSource); ok {
+			return u.url(snd.fname)
+		}
+	}
+
+	return snd.fpath
+}
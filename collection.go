@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// collectionSchema is the table of the collections, named sets of sounds. Each sound of a
+// collection has a verdict: keep, it is in the collection, or block, it was auditioned and
+// rejected, so it isn't auditioned again
+const collectionSchema = `CREATE TABLE IF NOT EXISTS collections(
+                            name TEXT NOT NULL,
+                            location TEXT NOT NULL,
+                            verdict TEXT NOT NULL DEFAULT 'keep',
+                            PRIMARY KEY(name, location)
+                          )`
+
+const (
+	verdictKeep  = "keep"
+	verdictBlock = "block"
+)
+
+// setVerdict records the verdict of the sound at location in the collection name
+func setVerdict(db execer, name, location, verdict string) error {
+	_, err := db.Exec(`INSERT INTO collections(name, location, verdict) VALUES(?, ?, ?)
+                           ON CONFLICT(name, location) DO UPDATE SET verdict = excluded.verdict`, name, location, verdict)
+
+	return err
+}
+
+// verdicts returns the verdicts of the sounds of the collection name, by location
+func verdicts(ctx context.Context, db *sql.DB, name string) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT location, verdict FROM collections WHERE name = ?`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	v := make(map[string]string)
+	for rows.Next() {
+		var location, verdict string
+		if err := rows.Scan(&location, &verdict); err != nil {
+			return nil, err
+		}
+		v[location] = verdict
+	}
+
+	return v, rows.Err()
+}
+
+// collectionJSON is a collection as shared, the locations of its sounds and, for people,
+// their descriptions
+type collectionJSON struct {
+	Name   string                `json:"name"`
+	Sounds []collectionSoundJSON `json:"sounds"`
+}
+
+type collectionSoundJSON struct {
+	Location    string `json:"location"`
+	Description string `json:"description,omitempty"`
+}
+
+// collectionQuery splits a query of a collection, like @forest or @forest birds, into the
+// name of the collection and the full text query that restricts it
+func collectionQuery(query string) (string, string, bool) {
+	if !strings.HasPrefix(query, "@") || len(query) == 1 {
+		return "", "", false
+	}
+	fields := strings.SplitN(query[1:], " ", 2)
+	rest := ""
+	if len(fields) == 2 {
+		rest = strings.TrimSpace(fields[1])
+	}
+
+	return fields[0], rest, true
+}
+
+// collectionSounds returns the sounds kept in the collection name, by location
+func collectionSounds(ctx context.Context, db *sql.DB, name string) ([]collectionSoundJSON, error) {
+	rows, err := db.QueryContext(ctx, `SELECT collections.location, coalesce(description, '')
+                                           FROM collections LEFT JOIN sounds ON sounds.location = collections.location
+                                           WHERE name = ? AND verdict = ? ORDER BY collections.location`, name, verdictKeep)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sounds []collectionSoundJSON
+	for rows.Next() {
+		var s collectionSoundJSON
+		if err := rows.Scan(&s.Location, &s.Description); err != nil {
+			return nil, err
+		}
+		sounds = append(sounds, s)
+	}
+
+	return sounds, rows.Err()
+}
+
+// importCollection adds the sounds of the shared collection c to the collection name. The
+// locations that aren't in the index are left out
+func importCollection(db *sql.DB, name string, c collectionJSON) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	added := 0
+	for _, s := range c.Sounds {
+		location := normalizeLocation(s.Location)
+		var n int
+		if err := tx.QueryRow(`SELECT count(*) FROM sounds WHERE location = ?`, location).Scan(&n); err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			log.Printf("Import: %s %s is not in the index", location, s.Description)
+			continue
+		}
+		if err := setVerdict(tx, name, location, verdictKeep); err != nil {
+			return 0, err
+		}
+		added++
+	}
+
+	return added, tx.Commit()
+}
+
+// collectionCommand implements the collection command which maintains the collections
+func collectionCommand(args []string) error {
+	usage := func() error {
+		fmt.Fprintf(os.Stderr, "usage: thames collection add name location...\n       thames collection remove name location...\n"+
+			"       thames collection list [name]\n       thames collection delete name\n"+
+			"       thames collection export name\n       thames collection import [name] file.json\n")
+		return errUsage
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	switch {
+	case args[0] == "add" && len(args) >= 3:
+		sounds, err := lookupSounds(ctx, db, args[2:], soundsDir)
+		if err != nil {
+			return err
+		}
+		for _, snd := range sounds {
+			if err := setVerdict(db, args[1], snd.fname, verdictKeep); err != nil {
+				return err
+			}
+		}
+	case args[0] == "remove" && len(args) >= 3:
+		for _, location := range args[2:] {
+			res, err := db.Exec(`DELETE FROM collections WHERE name = ? AND location = ?`, args[1], normalizeLocation(location))
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				log.Printf("Error:Collection: %s is not in the collection %s", location, args[1])
+			}
+		}
+	case args[0] == "list" && len(args) == 1:
+		rows, err := db.Query(`SELECT name, sum(verdict = ?), sum(verdict = ?) FROM collections GROUP BY name ORDER BY name`, verdictKeep, verdictBlock)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			var kept, blocked int
+			if err := rows.Scan(&name, &kept, &blocked); err != nil {
+				return err
+			}
+			fmt.Printf("%s\t%d sounds\t%d blocked\n", name, kept, blocked)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	case args[0] == "list" && len(args) == 2:
+		sounds, err := collectionSounds(ctx, db, args[1])
+		if err != nil {
+			return err
+		}
+		for _, s := range sounds {
+			fmt.Printf("%s\t%s\n", s.Location, s.Description)
+		}
+	case args[0] == "delete" && len(args) == 2:
+		res, err := db.Exec(`DELETE FROM collections WHERE name = ?`, args[1])
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("no collection %q", args[1])
+		}
+	case args[0] == "export" && len(args) == 2:
+		sounds, err := collectionSounds(ctx, db, args[1])
+		if err != nil {
+			return err
+		}
+		if len(sounds) == 0 {
+			return fmt.Errorf("no collection %q", args[1])
+		}
+		data, err := json.MarshalIndent(collectionJSON{Name: args[1], Sounds: sounds}, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	case args[0] == "import" && (len(args) == 2 || len(args) == 3):
+		data, err := ioutil.ReadFile(args[len(args)-1])
+		if err != nil {
+			return err
+		}
+		var c collectionJSON
+		if err := json.Unmarshal(data, &c); err != nil {
+			return fmt.Errorf("%s: %v", args[len(args)-1], err)
+		}
+		name := c.Name
+		if len(args) == 3 {
+			name = args[1]
+		}
+		if name == "" {
+			return fmt.Errorf("%s: the collection has no name, name it with thames collection import name file.json", args[len(args)-1])
+		}
+		added, err := importCollection(db, name, c)
+		if err != nil {
+			return err
+		}
+		log.Printf("Import: %d of %d sounds into the collection %s", added, len(c.Sounds), name)
+	default:
+		return usage()
+	}
+
+	return nil
+}
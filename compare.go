@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// compareCommand implements the compare command. It plays two sounds at the same loudness
+// and switches between them at once, at the same position, to pick the better
+func compareCommand(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames compare location location\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errUsage
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	sounds, err := lookupSounds(ctx, db, fs.Args(), soundsDir)
+	if err != nil {
+		return err
+	}
+	f := newFetcher(db)
+	var c comparison
+	for i := range sounds {
+		sp, exists, err := f.cache(ctx, sounds[i].fname)
+		if err != nil || !exists {
+			return fmt.Errorf("Missing File: %s: %v", sp, missingError(err))
+		}
+		sounds[i].fpath = sp
+		if c.levels[i], err = soundLevel(ctx, sp); err != nil {
+			return fmt.Errorf("%s: %v", sounds[i].fname, err)
+		}
+		c.sounds[i] = sounds[i]
+		c.lengths[i] = time.Duration(sounds[i].secs) * time.Second
+		if length, _, err := wavMarkers(sp); err == nil {
+			c.lengths[i] = length
+		}
+	}
+
+	picked, err := c.run(ctx)
+	if err != nil {
+		return err
+	}
+	if picked != "" {
+		fmt.Println(picked)
+	}
+
+	return nil
+}
+
+// comparison is the state of compare, the two sounds and the one that plays
+type comparison struct {
+	sounds  [2]sound
+	levels  [2]float64 // rms, from 0 to 1
+	lengths [2]time.Duration
+
+	current int
+	from    time.Duration // where the current sound started
+	started time.Time
+	stop    context.CancelFunc
+	done    chan error
+}
+
+// gain is the volume of the sound i that matches the loudness of the other. The louder is
+// turned down, never the quieter up, so neither clips
+func (c *comparison) gain(i int) float64 {
+	quieter := math.Min(c.levels[0], c.levels[1])
+	if quieter == 0 {
+		// a silent sound can't be matched
+		return 1
+	}
+
+	return quieter / c.levels[i]
+}
+
+// play stops the sound that plays and plays the sound i from the position from
+func (c *comparison) play(ctx context.Context, i int, from time.Duration) {
+	c.halt()
+
+	if from >= c.lengths[i] {
+		from = 0
+	}
+	pctx, cancel := context.WithCancel(ctx)
+	c.current, c.from, c.started, c.stop = i, from, time.Now(), cancel
+	c.done = make(chan error, 1)
+	go func(done chan error) {
+		done <- playFile(pctx, c.sounds[i].fpath, c.gain(i), from)
+	}(c.done)
+
+	snd := c.sounds[i]
+	log.Printf("Compare: %c %s/%s %s %s", 'A'+i, formatPosition(from), formatPosition(c.lengths[i]), snd.fname, snd.descr)
+}
+
+// halt stops the sound that plays, if any
+func (c *comparison) halt() {
+	if c.stop != nil {
+		c.stop()
+		<-c.done
+		c.stop = nil
+	}
+}
+
+func (c *comparison) position() time.Duration {
+	return c.from + time.Since(c.started)
+}
+
+// run plays the sounds until one is picked, which it returns, or the comparison is quit.
+// The keys are space to switch, a and b to play either, r to restart, p to pick and q to quit.
+// A sound that ends plays again
+func (c *comparison) run(ctx context.Context) (string, error) {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+
+	keys, restore, err := readKeys(tty, *plainOutput)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+	if *plainOutput {
+		log.Printf("Compare: enter switches, type a or b to play either, r to restart, p to pick and q to quit")
+	} else {
+		log.Printf("Compare: space switches, a or b plays either, r restarts, p picks and q quits")
+	}
+	for i, snd := range c.sounds {
+		log.Printf("Compare: %c %s gain %.2f %s", 'A'+i, snd.fname, c.gain(i), snd.descr)
+	}
+
+	c.play(ctx, 0, 0)
+	defer c.halt()
+	for {
+		select {
+		case k, ok := <-keys:
+			if !ok {
+				return "", nil
+			}
+			switch k {
+			case ' ', '\t', '\n':
+				c.play(ctx, 1-c.current, c.position())
+			case 'a', 'A', 'b', 'B':
+				if i := int(k|0x20) - 'a'; i != c.current {
+					c.play(ctx, i, c.position())
+				}
+			case 'r':
+				c.play(ctx, c.current, 0)
+			case 'p':
+				return c.sounds[c.current].fname, nil
+			case 'q':
+				return "", nil
+			}
+		case err := <-c.done:
+			c.stop = nil
+			if ctx.Err() != nil {
+				return "", nil
+			}
+			if err != nil {
+				return "", fmt.Errorf("play: %v", err)
+			}
+			c.play(ctx, c.current, 0)
+		case <-ctx.Done():
+			return "", nil
+		}
+	}
+}
+
+// soundLevel returns the rms level of the sound file at fpath, from 0 to 1. Files other than
+// pcm wavs are read from a converted copy
+func soundLevel(ctx context.Context, fpath string) (float64, error) {
+	info, err := probeAudio(fpath)
+	if err != nil {
+		return 0, err
+	}
+	if info.format != "wav" || info.bits%8 != 0 || info.bits > 32 {
+		if fpath, err = convertSound(ctx, fpath); err != nil {
+			return 0, err
+		}
+	}
+
+	return wavRMS(fpath)
+}
+
+// wavRMS returns the rms level of the pcm wav at fpath, over all channels
+func wavRMS(fpath string) (float64, error) {
+	fin, err := os.Open(fpath)
+	if err != nil {
+		return 0, err
+	}
+	defer fin.Close()
+
+	head := make([]byte, 12)
+	if _, err := io.ReadFull(fin, head); err != nil || string(head[0:4]) != "RIFF" || string(head[8:12]) != "WAVE" {
+		return 0, errors.New("not a wav file")
+	}
+
+	bits := 0
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(fin, chunk); err != nil {
+			return 0, errors.New("wav without a data chunk")
+		}
+		size := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		if string(chunk[0:4]) == "fmt " {
+			body := make([]byte, size)
+			if _, err := io.ReadFull(fin, body); err != nil || size < 16 {
+				return 0, errors.New("truncated wav fmt chunk")
+			}
+			bits = int(binary.LittleEndian.Uint16(body[14:]))
+			if size%2 == 1 {
+				fin.Seek(1, io.SeekCurrent)
+			}
+			continue
+		}
+		if string(chunk[0:4]) == "data" {
+			if bits == 0 {
+				return 0, errors.New("wav without a fmt chunk")
+			}
+			return pcmRMS(io.LimitReader(fin, size), bits/8)
+		}
+		// chunks are padded to an even size
+		if _, err := fin.Seek(size+size%2, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// pcmRMS returns the rms of the little endian signed samples of width bytes, unsigned for 8 bits
+func pcmRMS(r io.Reader, width int) (float64, error) {
+	full := math.Ldexp(1, 8*width-1)
+	buf := make([]byte, width*8192)
+	var sum float64
+	var n int64
+	for {
+		m, err := io.ReadFull(r, buf)
+		for i := 0; i+width <= m; i += width {
+			var v int64
+			for j := width - 1; j >= 0; j-- {
+				v = v<<8 | int64(buf[i+j])
+			}
+			if width == 1 {
+				v -= 128
+			} else if v >= int64(full) {
+				v -= 2 * int64(full)
+			}
+			x := float64(v) / full
+			sum += x * x
+			n++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	return math.Sqrt(sum / float64(n)), nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var profileName = flag.String("profile", "", "Use the `profile` of the configuration file")
+
+// config is the optional configuration file thames.json in the root directory
+type config struct {
+	// Profiles restrict thames to parts of the archive, for example on devices with little storage
+	Profiles map[string]profile `json:"profiles"`
+
+	// MIDI maps the controls of a MIDI controller to thames
+	MIDI midiConfig `json:"midi"`
+
+	// ListenBrainz is where to submit the sounds played, if there is a token
+	ListenBrainz listenBrainzConfig `json:"listenbrainz"`
+
+	// Progress is the style of --progress, for consoles that can't redraw a bar
+	Progress string `json:"progress"`
+
+	// Synonyms are the words --min adds to the queries that match too few sounds, by word
+	Synonyms map[string][]string `json:"synonyms"`
+
+	// Registry is where thames preset searches and installs the bundles others share
+	Registry registryConfig `json:"registry"`
+
+	// Stats is whether to count the features used, locally, true if not set
+	Stats *bool `json:"stats"`
+
+	// SelectionCache is whether sessions start with a sound of the last selection, the default
+	// of --selection-cache, true if not set
+	SelectionCache *bool `json:"selectionCache"`
+
+	// Schedule softens the mix during the events of a calendar and at the times of its rules
+	Schedule scheduleConfig `json:"schedule"`
+}
+
+type midiConfig struct {
+	Device  string            `json:"device"`  // the raw MIDI device, like /dev/snd/midiC1D0
+	Gains   map[string]string `json:"gains"`   // controller number to the query group whose volume it sets
+	Notes   map[string]string `json:"notes"`   // note number to the query of a one-shot
+	Presets map[string]string `json:"presets"` // program number to the preset file it switches to
+}
+
+type profile struct {
+	// Categories is an allowlist of categories. Sounds in other categories are never selected
+	Categories []string `json:"categories"`
+}
+
+var (
+	conf          config
+	activeProfile profile
+)
+
+// loadConfig reads the configuration file, if it exists, and activates the selected profile
+func loadConfig(fpath string) error {
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &conf); err != nil {
+			return fmt.Errorf("%s: %v", fpath, err)
+		}
+	}
+
+	if *midiDevice == "" {
+		*midiDevice = conf.MIDI.Device
+	}
+	if *progressStyle == "" {
+		*progressStyle = conf.Progress
+	}
+	if *calendarSource == "" {
+		*calendarSource = conf.Schedule.Calendar
+	}
+	if quietRules, err = parseScheduleRules(conf.Schedule); err != nil {
+		return fmt.Errorf("%s: %v", fpath, err)
+	}
+	if v := quietVolume(conf.Schedule); v < 0 || v > 100 {
+		return fmt.Errorf("%s: schedule: the volume is from 0 to 100", fpath)
+	}
+	if conf.SelectionCache != nil {
+		set := false
+		flag.Visit(func(f *flag.Flag) {
+			set = set || f.Name == "selection-cache"
+		})
+		if !set {
+			*selectionCache = *conf.SelectionCache
+		}
+	}
+	if *progressStyle != "" && !progressStyles[*progressStyle] {
+		return fmt.Errorf("unknown progress style %q, the styles are bar, percent and none", *progressStyle)
+	}
+
+	if *profileName != "" {
+		p, ok := conf.Profiles[*profileName]
+		if !ok {
+			return fmt.Errorf("%s: no profile %q", fpath, *profileName)
+		}
+		activeProfile = p
+	}
+
+	return nil
+}
+
+// stringsFlag is a flag that may be repeated
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// controls are the knobs of the running session, shared by the controllers like MIDI and OSC
+type controls struct {
+	sync.Mutex
+
+	autos    map[string]*automation // the volumes of the current session, by group
+	oneshots *oneshots
+	switchTo chan sessionSpec // what should replace the current session
+	quit     chan bool        // requests to stop the session
+	skips    *skipSet         // of the current session
+	requests *requests        // of the current session, nil when nothing plays
+	playing  *playbacks       // the sounds that play, where they are
+	queue    *playQueue       // of the current session, nil when nothing plays
+
+	state *watchState // with --forever, the changes survive restarts
+}
+
+func newControls() *controls {
+	c := new(controls)
+	c.autos = make(map[string]*automation)
+	c.switchTo = make(chan sessionSpec, 1)
+	c.quit = make(chan bool, 1)
+	c.playing = new(playbacks)
+
+	return c
+}
+
+// startControllers starts the controllers of the command line, one-shots, MIDI, OSC and plugins.
+// The returned function waits for them to clean up, like restoring the terminal, once ctx is done
+func startControllers(ctx context.Context, db *sql.DB, sel *selection, ctl *controls) (func(), error) {
+	// any controller may fire one-shots
+	o, err := newOneshots(db, sel)
+	if err != nil {
+		return nil, err
+	}
+	ctl.oneshots = o
+	done := make(chan bool)
+	go func() {
+		o.run(ctx)
+		close(done)
+	}()
+
+	if *midiDevice != "" {
+		go supervise(ctx, "MIDI", func(ctx context.Context) error {
+			return readMIDI(ctx, *midiDevice, ctl)
+		})
+	}
+
+	if *oscAddr != "" {
+		go supervise(ctx, "OSC", func(ctx context.Context) error {
+			return serveOSC(ctx, *oscAddr, ctl)
+		})
+	}
+
+	activePlugins.control(ctx, ctl)
+
+	if hasSchedule() {
+		// the rules soften the first sounds already, the events once the calendar is read
+		s := newScheduler()
+		s.check(time.Now())
+		go s.run(ctx)
+	}
+
+	return func() {
+		<-done
+	}, nil
+}
+
+func (c *controls) setAutomations(autos map[string]*automation) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.autos = autos
+}
+
+// setGain sets the volume of the group. It reports whether the group is in the session
+func (c *controls) setGain(group string, gain float64) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	a, ok := c.autos[group]
+	if ok {
+		a.setGain(gain)
+		log.Printf("Gain: %q %.2f", group, gain)
+		if c.state != nil {
+			c.state.setGain(group, gain)
+		}
+	}
+
+	return ok
+}
+
+// fire plays a one-shot of query
+func (c *controls) fire(query string) {
+	if c.oneshots != nil {
+		c.oneshots.fireQuery(query)
+	}
+}
+
+// sessionSpec is what a session plays, the lines of a preset or query groups
+type sessionSpec struct {
+	preset string
+	groups []queryGroup
+	mix    bool
+}
+
+// sessionEnd is how a session ended
+type sessionEnd int
+
+const (
+	sessionDone     sessionEnd = iota // all the sounds played
+	sessionSwitched                   // a controller replaced it
+	sessionStopped                    // a controller stopped it
+)
+
+// load returns the query groups of the spec with their automations and whether they are mixed
+func (s sessionSpec) load() ([]queryGroup, map[string]*automation, bool, error) {
+	if s.preset != "" {
+		groups, autos, err := presetGroups(s.preset)
+		return groups, autos, true, err
+	}
+
+	autos := make(map[string]*automation)
+	if s.mix {
+		for _, g := range s.groups {
+			autos[g.name] = &automation{gain: 1}
+		}
+	}
+
+	return s.groups, autos, s.mix, nil
+}
+
+// switchPreset replaces the current session with the preset
+func (c *controls) switchPreset(fpath string) {
+	c.switchSession(sessionSpec{preset: fpath})
+}
+
+// switchSession replaces the current session. If a switch is pending, the latest request wins
+func (c *controls) switchSession(next sessionSpec) {
+	select {
+	case c.switchTo <- next:
+	default:
+		select {
+		case <-c.switchTo:
+		default:
+		}
+		c.switchTo <- next
+	}
+}
+
+// stop ends the current session
+func (c *controls) stop() {
+	select {
+	case c.quit <- true:
+	default:
+	}
+}
+
+// skip drops the remaining sounds of the query, or query group, from the session
+func (c *controls) skip(query string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.skips.add(query)
+	log.Printf("Skip: %q", query)
+}
+
+// next skips the sounds that play, their players go on with their next sounds. It returns
+// how many were skipped
+func (c *controls) next() int {
+	sounds := c.playing.playing("")
+	for _, p := range sounds {
+		p.skip()
+	}
+
+	return len(sounds)
+}
+
+// request plays the sounds in the current session, next or now, at once
+func (c *controls) request(sounds []sound, now bool) error {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, snd := range sounds {
+		if err := c.requests.add(snd, now); err != nil {
+			return err
+		}
+		log.Printf("Requested: %s %s", snd.fname, snd.descr)
+	}
+
+	return nil
+}
+
+// positions returns a line for each sound that plays, its group, where it is, how long it
+// has to play and its description
+func (c *controls) positions() string {
+	var lines []string
+	for _, p := range c.playing.playing("") {
+		lines = append(lines, p.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// queued returns the queue of the session, the sound that plays and the next n of each
+// player, empty if nothing plays
+func (c *controls) queued(n int) string {
+	c.Lock()
+	q := c.queue
+	c.Unlock()
+
+	return q.view(n)
+}
+
+// seek moves the sounds of the group that play, or all those that play if group is empty,
+// to the target
+func (c *controls) seek(group string, target seekTarget) error {
+	sounds := c.playing.playing(group)
+	if len(sounds) == 0 {
+		if group != "" {
+			return fmt.Errorf("no sound of %q is playing", group)
+		}
+		return errors.New("nothing is playing")
+	}
+
+	var errs []string
+	for _, p := range sounds {
+		pos, err := target.resolve(p)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		p.seek(pos)
+	}
+	if len(errs) == len(sounds) {
+		return errors.New(strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// play runs the session until it ends, or until a controller switches or stops it.
+// When switched it also returns what should play next
+func (c *controls) play(ctx context.Context, session func(ctx context.Context, skips *skipSet, req *requests)) (sessionSpec, sessionEnd) {
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sctx = context.WithValue(sctx, playbacksKey{}, c.playing)
+	q := newPlayQueue(c.playing)
+	sctx = context.WithValue(sctx, playQueueKey{}, q)
+
+	skips := newSkipSet()
+	req := newRequests()
+	c.Lock()
+	c.skips = skips
+	c.requests = req
+	c.queue = q
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		c.requests = nil
+		c.queue = nil
+		c.Unlock()
+	}()
+
+	done := make(chan bool)
+	go func() {
+		session(sctx, skips, req)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return sessionSpec{}, sessionDone
+	case next := <-c.switchTo:
+		cancel()
+		<-done
+		if ctx.Err() != nil {
+			return next, sessionStopped
+		}
+		return next, sessionSwitched
+	case <-c.quit:
+		cancel()
+		<-done
+		return sessionSpec{}, sessionStopped
+	}
+}
+
+// skipSet is the queries and query groups whose remaining sounds a session skips
+type skipSet struct {
+	sync.Mutex
+
+	queries map[string]bool
+}
+
+func newSkipSet() *skipSet {
+	s := new(skipSet)
+	s.queries = make(map[string]bool)
+
+	return s
+}
+
+func (s *skipSet) add(query string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	s.queries[query] = true
+}
+
+// skipped reports whether the sound should be skipped. A nil set skips nothing
+func (s *skipSet) skipped(snd sound) bool {
+	if s == nil {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	return s.queries[snd.query] || s.queries[snd.group]
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// wavBytesPerSec is the rate of the archive's wavs, 44.1kHz 16bit stereo.
+	// It is used to estimate sizes when the sources can't tell
+	wavBytesPerSec = 44100 * 2 * 2
+
+	// maxSizeRequests is the number of missing sounds up to which sizes are asked from the sources.
+	// For more, like when fetching whole categories, the estimation from durations is good enough
+	maxSizeRequests = 100
+)
+
+var (
+	maxDownload bytesFlag
+	cacheQuota  bytesFlag
+)
+
+func init() {
+	flag.Var(&maxDownload, "max-download", "Don't fetch anything if the session would download more than `size`, like 500MB")
+	flag.Var(&cacheQuota, "cache-quota", "Don't fetch anything if the cache would grow over `size`")
+}
+
+// sizer is implemented by the sources that can tell the size of a sound without fetching it
+type sizer interface {
+	size(fname string) (int64, error)
+}
+
+// downloadCost returns the number of sounds missing from the cache and an estimation of their total size
+func downloadCost(selected [][]sound, f *fetcher) (int, int64) {
+	missing := make(map[string]sound)
+	for _, sounds := range selected {
+		for _, snd := range sounds {
+			if !snd.cached {
+				missing[snd.fname] = snd
+			}
+		}
+	}
+
+	var mu sync.Mutex
+	var total int64
+	var wg sync.WaitGroup
+	sem := make(chan bool, 8)
+	for _, snd := range missing {
+		wg.Add(1)
+		go func(snd sound) {
+			defer wg.Done()
+
+			n, known := knownSize(f.db, snd.fname)
+			if !known {
+				n = int64(snd.secs) * wavBytesPerSec
+			}
+			if !known && len(missing) <= maxSizeRequests {
+				sem <- true
+				if sz, err := soundSize(snd.fname, f.sources); err == nil {
+					n = sz
+					recordSize(f.db, snd.fname, sz)
+				}
+				<-sem
+			}
+
+			mu.Lock()
+			total += n
+			mu.Unlock()
+		}(snd)
+	}
+	wg.Wait()
+
+	return len(missing), total
+}
+
+// soundSize asks the sources, in order, for the size of the sound file fname
+func soundSize(fname string, sources []source) (int64, error) {
+	err := fmt.Errorf("no source knows the size of %s", fname)
+	for _, src := range sources {
+		if sz, ok := src.(sizer); ok {
+			var n int64
+			if n, err = sz.size(fname); err == nil {
+				return n, nil
+			}
+		}
+	}
+
+	return 0, err
+}
+
+// downloadBudget logs the cost of fetching the missing sounds of the selection and returns an
+// error if it is over --max-download or --cache-quota
+func downloadBudget(selected [][]sound, f *fetcher) error {
+	if len(f.sources) == 0 {
+		return nil
+	}
+
+	n, total := downloadCost(selected, f)
+	if n == 0 {
+		return nil
+	}
+	log.Printf("Download: %d sounds, ~%s", n, formatBytes(total))
+
+	if maxDownload > 0 && total > int64(maxDownload) {
+		return fmt.Errorf("download of ~%s is more than --max-download %s", formatBytes(total), formatBytes(int64(maxDownload)))
+	}
+
+	if cacheQuota > 0 {
+		used, err := cacheUsage()
+		if err != nil {
+			return err
+		}
+		if used+total > int64(cacheQuota) {
+			return fmt.Errorf("cache of %s and download of ~%s exceed --cache-quota %s", formatBytes(used), formatBytes(total), formatBytes(int64(cacheQuota)))
+		}
+	}
+
+	return nil
+}
+
+// cacheUsage returns the total size of the files in the cache
+func cacheUsage() (int64, error) {
+	infos, err := ioutil.ReadDir(soundsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	var used int64
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			used += info.Size()
+		}
+	}
+
+	return used, nil
+}
+
+// bytesFlag is a size flag that accepts the suffixes K, M, G with an optional B, like 500MB
+type bytesFlag int64
+
+func (f *bytesFlag) String() string {
+	if *f == 0 {
+		return ""
+	}
+
+	return formatBytes(int64(*f))
+}
+
+func (f *bytesFlag) Set(v string) error {
+	n, err := parseBytes(v)
+	if err != nil {
+		return err
+	}
+	*f = bytesFlag(n)
+
+	return nil
+}
+
+func parseBytes(v string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(v)), "B")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", v)
+	}
+
+	return int64(n * float64(mult)), nil
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Users may describe the sounds whose descriptions of the archive don't help, like "Various
+// atmos" or a catalogue number. Their descriptions are kept in user.db, the index isn't
+// touched and its descriptions come back with --delete. They are shown instead of those of
+// the archive and queries search both
+
+// descriptionsIndex is the full text index of the descriptions of the users, kept up to date by
+// triggers, with the unicode tokenizer like the notes
+const descriptionsIndex = `CREATE VIRTUAL TABLE descriptions_fts USING fts4(
+                             location, description,
+
+                             tokenize=unicode61 "remove_diacritics=1", notindexed=location
+                           );
+                           INSERT INTO descriptions_fts(location, description) SELECT location, description FROM descriptions`
+
+const descriptionsTriggers = `CREATE TRIGGER IF NOT EXISTS descriptions_insert AFTER INSERT ON descriptions BEGIN
+                                INSERT INTO descriptions_fts(location, description) VALUES(new.location, new.description);
+                              END;
+                              CREATE TRIGGER IF NOT EXISTS descriptions_update AFTER UPDATE ON descriptions BEGIN
+                                UPDATE descriptions_fts SET description = new.description WHERE location = old.location;
+                              END;
+                              CREATE TRIGGER IF NOT EXISTS descriptions_delete AFTER DELETE ON descriptions BEGIN
+                                DELETE FROM descriptions_fts WHERE location = old.location;
+                              END`
+
+// describedAs is the sql expression of the description of a sound of the sounds table, that of
+// the user if there is one
+const describedAs = `coalesce((SELECT d.description FROM descriptions d WHERE d.location = sounds.location), sounds.description)`
+
+// migrateDescriptions creates the full text index of the descriptions in older databases
+func migrateDescriptions(db *sql.DB) error {
+	var exists bool
+	if err := db.QueryRow(`SELECT count(*) > 0 FROM sqlite_master WHERE name = 'descriptions_fts'`).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := db.Exec(descriptionsIndex); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(descriptionsTriggers)
+
+	return err
+}
+
+// hasDescriptions reports whether any sound has a description of the user, so queries should
+// search them too
+func hasDescriptions(db *sql.DB) bool {
+	var n bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM descriptions)`).Scan(&n); err != nil {
+		return false
+	}
+
+	return n
+}
+
+// readDescriptions reads a csv of locations and descriptions, with an optional header
+func readDescriptions(fpath string) ([][2]string, error) {
+	fin, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	c := csv.NewReader(fin)
+	c.FieldsPerRecord = 2
+	c.TrimLeadingSpace = true
+	records, err := c.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fpath, err)
+	}
+	var descriptions [][2]string
+	for i, rec := range records {
+		if i == 0 && strings.EqualFold(rec[0], "location") {
+			continue
+		}
+		descriptions = append(descriptions, [2]string{normalizeLocation(strings.TrimSpace(rec[0])), strings.TrimSpace(rec[1])})
+	}
+
+	return descriptions, nil
+}
+
+// describeCommand implements the describe command. It prints, sets or removes the description
+// of a sound, or sets the descriptions of many from a csv
+func describeCommand(args []string) error {
+	fs := flag.NewFlagSet("describe", flag.ExitOnError)
+	remove := fs.Bool("delete", false, "Remove the description, the sound is described by the archive again")
+	importFile := fs.String("import", "", "Set the descriptions of the csv `file` of locations and descriptions. An empty description removes it")
+	dryRun := fs.Bool("dry-run", false, "With --import, print the changes, don't make them")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames describe [--delete] location [description...]\n")
+		fmt.Fprintf(os.Stderr, "       thames describe --import file.csv [--dry-run]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if (*importFile == "") == (fs.NArg() == 0) || *remove && (fs.NArg() > 1 || *importFile != "") {
+		fs.Usage()
+		return errUsage
+	}
+
+	var edits [][2]string
+	if *importFile != "" {
+		var err error
+		if edits, err = readDescriptions(*importFile); err != nil {
+			return err
+		}
+	} else {
+		edits = append(edits, [2]string{normalizeLocation(fs.Arg(0)), strings.TrimSpace(strings.Join(fs.Args()[1:], " "))})
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	var sounds []sound
+	var locations []string
+	for _, e := range edits {
+		sounds = append(sounds, sound{fname: e[0]})
+		locations = append(locations, e[0])
+	}
+	meta, err := readMetadata(ctx, db, sounds)
+	if err != nil {
+		return err
+	}
+	for _, l := range locations {
+		if _, ok := meta[l]; !ok {
+			return fmt.Errorf("%s is not in the index", l)
+		}
+	}
+	current, err := readUserMeta(ctx, db, locations)
+	if err != nil {
+		return err
+	}
+
+	if *importFile == "" && edits[0][1] == "" && !*remove {
+		if d := current[locations[0]].description; d != "" {
+			fmt.Println(d)
+		} else {
+			fmt.Println(meta[locations[0]].description)
+		}
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	changed := 0
+	for _, e := range edits {
+		m := current[e[0]]
+		edit := userEdit{field: "description", value: e[1], unset: e[1] == ""}
+		n := m.apply([]userEdit{edit})
+		d := m.diff(n)
+		if d == "" {
+			continue
+		}
+		changed++
+		if *importFile != "" {
+			fmt.Printf("%s %s: %s\n", e[0], meta[e[0]].description, d)
+		}
+		if *dryRun {
+			continue
+		}
+		if err := writeUserMeta(tx, e[0], n); err != nil {
+			return err
+		}
+		current[e[0]] = n
+	}
+	if *dryRun {
+		log.Printf("Would describe %d of %d sounds", changed, len(edits))
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if *importFile != "" {
+		log.Printf("Described %d of %d sounds", changed, len(edits))
+	}
+
+	return nil
+}
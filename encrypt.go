@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The user data can be kept encrypted, for those who sync the root through cloud storage.
+// Then the root has user.db.enc instead of user.db, and thames works on a plain copy in the
+// runtime directory, which is private to the user and usually in memory, and seals it back
+// into user.db.enc every few minutes and on exit. The passphrase is $THAMES_PASSPHRASE or
+// the one stored for thames in the keyring of the desktop
+
+const (
+	sealMagic      = "THAMESENC1"
+	sealSaltSize   = 16
+	sealIterations = 210000 // of PBKDF2-HMAC-SHA256
+	sealInterval   = 5 * time.Minute
+)
+
+var errPassphrase = errors.New("wrong passphrase, or a damaged file")
+
+// sealedUser is the encrypted user database opened by this process
+var sealedUser struct {
+	sync.Mutex
+	enc  string // the encrypted file in the root
+	work string // the plain copy it is opened as
+	salt []byte
+	key  []byte
+}
+
+// sealedUserFile is the encrypted user database of the root
+func sealedUserFile() string {
+	return filepath.Join(*rootDir, "user.db.enc")
+}
+
+// unsealUserDatabase decrypts user.db.enc, if the root has it, and makes userDBFile its plain
+// copy. The copy is kept if it is newer than user.db.enc, it has changes that weren't sealed
+func unsealUserDatabase() error {
+	sealedUser.Lock()
+	unsealed := sealedUser.work != ""
+	sealedUser.Unlock()
+	if unsealed {
+		return nil
+	}
+	enc := sealedUserFile()
+	encInfo, err := os.Stat(enc)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if exists, _ := fileExists(userDBFile); exists {
+		return fmt.Errorf("both %s and %s exist, remove the one that is not used", userDBFile, enc)
+	}
+
+	work, err := workingUserFile()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(enc)
+	if err != nil {
+		return err
+	}
+	salt, key, err := unsealKey(data)
+	if err != nil {
+		return err
+	}
+	// decrypting checks the passphrase, the copy is sealed with it later
+	plain, err := openSealed(data, key)
+	if err != nil {
+		return fmt.Errorf("%s: %v", enc, err)
+	}
+
+	if workInfo, err := os.Stat(work); err == nil && workInfo.ModTime().After(encInfo.ModTime()) {
+		log.Printf("Recovered: the changes of %s not sealed into %s", work, enc)
+	} else {
+		os.Remove(work + "-journal")
+		if err := writeFileAtomic(work, plain); err != nil {
+			return err
+		}
+	}
+
+	sealedUser.Lock()
+	sealedUser.enc, sealedUser.work, sealedUser.salt, sealedUser.key = enc, work, salt, key
+	sealedUser.Unlock()
+	userDBFile = work
+	go sealPeriodically()
+
+	return nil
+}
+
+// sealUserDatabase encrypts the plain copy of the user database back into user.db.enc, if it
+// changed since it was sealed
+func sealUserDatabase() error {
+	sealedUser.Lock()
+	defer sealedUser.Unlock()
+	if sealedUser.work == "" {
+		return nil
+	}
+
+	workInfo, err := os.Stat(sealedUser.work)
+	if err != nil {
+		return err
+	}
+	if encInfo, err := os.Stat(sealedUser.enc); err == nil && !workInfo.ModTime().After(encInfo.ModTime()) {
+		return nil
+	}
+
+	plain, err := snapshotDatabase(sealedUser.work)
+	if err != nil {
+		return err
+	}
+	data, err := seal(plain, sealedUser.salt, sealedUser.key)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(sealedUser.enc, data)
+}
+
+// sealPeriodically seals the user database every few minutes, for the long sessions
+func sealPeriodically() {
+	for range time.Tick(sealInterval) {
+		if err := sealUserDatabase(); err != nil {
+			log.Printf("Error:UserDB: %v", err)
+		}
+	}
+}
+
+// workingUserFile is where the plain copy of the user database of the root is kept, in the
+// runtime directory of the user
+func workingUserFile() (string, error) {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("thames-%d", os.Getuid()))
+	}
+	root, err := filepath.Abs(*rootDir)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(root))
+	dir = filepath.Join(dir, "thames", hex.EncodeToString(sum[:8]))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(filepath.Dir(dir), 0700); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "user.db"), nil
+}
+
+// snapshotDatabase returns a consistent copy of the sqlite database at fpath, even while
+// others write to it
+func snapshotDatabase(fpath string) ([]byte, error) {
+	snapshot := fpath + ".snapshot"
+	os.Remove(snapshot)
+	defer os.Remove(snapshot)
+
+	db, err := sql.Open(sqliteDriver, "file:"+fpath+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if _, err := db.Exec(`VACUUM INTO ?`, snapshot); err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(snapshot)
+}
+
+// sealPassphrase returns the passphrase of the user database, from the environment or the
+// keyring
+func sealPassphrase() (string, error) {
+	if p := os.Getenv("THAMES_PASSPHRASE"); p != "" {
+		return p, nil
+	}
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", "thames", "-a", "user.db", "-w")
+	default:
+		cmd = exec.Command("secret-tool", "lookup", "service", "thames", "account", "user.db")
+	}
+	out, err := cmd.Output()
+	if p := strings.TrimRight(string(out), "\r\n"); err == nil && p != "" {
+		return p, nil
+	}
+
+	return "", errors.New("no passphrase for the user database, set THAMES_PASSPHRASE or store it in the keyring " +
+		"with secret-tool store --label thames service thames account user.db")
+}
+
+// sealKey derives the key of the passphrase with the salt
+func sealKey(salt []byte) ([]byte, error) {
+	pass, err := sealPassphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	return pbkdf2SHA256([]byte(pass), salt, sealIterations, 32), nil
+}
+
+// unsealKey returns the salt of the sealed data and the key of the passphrase with it
+func unsealKey(data []byte) ([]byte, []byte, error) {
+	if len(data) < len(sealMagic)+sealSaltSize || string(data[:len(sealMagic)]) != sealMagic {
+		return nil, nil, errors.New("not an encrypted user database of thames")
+	}
+	salt := data[len(sealMagic) : len(sealMagic)+sealSaltSize]
+	key, err := sealKey(salt)
+
+	return salt, key, err
+}
+
+// seal encrypts plain with AES-256-GCM: the magic, the salt, the nonce and the ciphertext
+func seal(plain, salt, key []byte) ([]byte, error) {
+	aead, err := newSealCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.WriteString(sealMagic)
+	b.Write(salt)
+	b.Write(nonce)
+	header := b.Bytes()
+
+	return aead.Seal(header, nonce, plain, header), nil
+}
+
+// openSealed decrypts the data of seal
+func openSealed(data, key []byte) ([]byte, error) {
+	aead, err := newSealCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	n := len(sealMagic) + sealSaltSize + aead.NonceSize()
+	if len(data) < n {
+		return nil, errPassphrase
+	}
+	plain, err := aead.Open(nil, data[n-aead.NonceSize():n], data[n:], data[:n])
+	if err != nil {
+		return nil, errPassphrase
+	}
+
+	return plain, nil
+}
+
+func newSealCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// pbkdf2SHA256 is the key derivation of RFC 8018 with HMAC-SHA256
+func pbkdf2SHA256(pass, salt []byte, iterations, size int) []byte {
+	prf := hmac.New(sha256.New, pass)
+	var key []byte
+	for block := uint32(1); len(key) < size; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+
+	return key[:size]
+}
+
+// userdbCommand encrypts the user database of the root, or decrypts it back
+func userdbCommand(args []string) error {
+	if len(args) != 1 || args[0] != "encrypt" && args[0] != "decrypt" {
+		fmt.Fprintf(os.Stderr, "usage: thames userdb encrypt | decrypt\n")
+		return errUsage
+	}
+	enc := sealedUserFile()
+
+	switch args[0] {
+	case "encrypt":
+		if exists, _ := fileExists(enc); exists {
+			return fmt.Errorf("%s is already encrypted", enc)
+		}
+		db, err := openDatabase()
+		if err != nil {
+			return err
+		}
+		db.Close()
+
+		salt := make([]byte, sealSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		key, err := sealKey(salt)
+		if err != nil {
+			return err
+		}
+		plain, err := snapshotDatabase(userDBFile)
+		if err != nil {
+			return err
+		}
+		data, err := seal(plain, salt, key)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(enc, data); err != nil {
+			return err
+		}
+		for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+			if err := os.Remove(userDBFile + suffix); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		log.Printf("Encrypted: %s into %s", userDBFile, enc)
+	case "decrypt":
+		plainFile := userDBFile
+		if err := unsealUserDatabase(); err != nil {
+			return err
+		}
+		if sealedUser.work == "" {
+			return fmt.Errorf("%s is not encrypted", plainFile)
+		}
+		plain, err := snapshotDatabase(sealedUser.work)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(plainFile, plain); err != nil {
+			return err
+		}
+		sealedUser.Lock()
+		work := sealedUser.work
+		sealedUser.work = ""
+		sealedUser.Unlock()
+		if err := os.Remove(enc); err != nil {
+			return err
+		}
+		os.Remove(work)
+		os.Remove(work + "-journal")
+		log.Printf("Decrypted: %s into %s", enc, plainFile)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// the vectors of RFC 7914
+	tests := []struct {
+		pass, salt string
+		iterations int
+		key        string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+	for _, tt := range tests {
+		key := pbkdf2SHA256([]byte(tt.pass), []byte(tt.salt), tt.iterations, len(tt.key)/2)
+		if got := hex.EncodeToString(key); got != tt.key {
+			t.Errorf("%q %q %d: %s, expected %s", tt.pass, tt.salt, tt.iterations, got, tt.key)
+		}
+	}
+}
+
+func TestSeal(t *testing.T) {
+	t.Setenv("THAMES_PASSPHRASE", "the sound of the thames")
+	salt := bytes.Repeat([]byte{7}, sealSaltSize)
+	key, err := sealKey(salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, plain := range [][]byte{nil, []byte("SQLite format 3\x00"), bytes.Repeat([]byte("user.db"), 10000)} {
+		data, err := seal(plain, salt, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, k, err := unsealKey(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(s, salt) || !bytes.Equal(k, key) {
+			t.Errorf("unsealed with the salt %x and the key %x, expected %x and %x", s, k, salt, key)
+		}
+		got, err := openSealed(data, k)
+		if err != nil {
+			t.Errorf("%d bytes: %v", len(plain), err)
+		} else if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: opened %d other bytes", len(plain), len(got))
+		}
+	}
+
+	data, err := seal([]byte("SQLite format 3\x00"), salt, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey := pbkdf2SHA256([]byte("not the passphrase"), salt, sealIterations, 32)
+	header := len(sealMagic) + sealSaltSize
+	tests := []struct {
+		name string
+		data []byte
+		key  []byte
+	}{
+		{"wrong passphrase", data, otherKey},
+		{"damaged salt", flipByte(data, len(sealMagic)), key},
+		{"damaged nonce", flipByte(data, header), key},
+		{"damaged ciphertext", flipByte(data, len(data)-1), key},
+		{"truncated", data[:header+4], key},
+	}
+	for _, tt := range tests {
+		if _, err := openSealed(tt.data, tt.key); err != errPassphrase {
+			t.Errorf("%s: error %v, expected %v", tt.name, err, errPassphrase)
+		}
+	}
+
+	if _, _, err := unsealKey([]byte("SQLite format 3\x00 and more than the salt")); err == nil {
+		t.Error("a plain database unsealed")
+	}
+}
+
+// flipByte returns a copy of data with the byte at i changed
+func flipByte(data []byte, i int) []byte {
+	d := append([]byte(nil), data...)
+	d[i] ^= 0xFF
+
+	return d
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The years of the sounds are found in their descriptions, and in the recording dates of the
+// newer editions of the csv, when the index is created: years like 1968, decades like 1950s,
+// '50s or the fifties and ranges like 1939-45. --era selects the sounds of a period, for
+// period film and theatre. A year may also be a number of something else, like 2000 rpm
+
+var sessionEra = flag.String("era", "", "Select only sounds of the `era` their descriptions name: a decade like 1950s, a year like 1968 or years like 1939-1945")
+
+const erasSchema = `CREATE TABLE IF NOT EXISTS eras(
+                      location TEXT NOT NULL,
+                      first INTEGER NOT NULL,  -- the years of the period, the same for a year
+                      last INTEGER NOT NULL,
+                      PRIMARY KEY(location, first, last)
+                    )`
+
+// the years that are eras, others are likely numbers of something else
+const (
+	minEraYear = 1800
+	maxEraYear = 2099
+)
+
+var (
+	yearRangeRe = regexp.MustCompile(`\b(1[89][0-9]{2}|20[0-9]{2}) ?(?:-|–|to) ?([0-9]{2}|1[89][0-9]{2}|20[0-9]{2})\b`)
+	decadeRe    = regexp.MustCompile(`(?:\b(1[89][0-9]|20[0-9])0|['’]([1-9])0)['’]?s\b`)
+	yearRe      = regexp.MustCompile(`\b(1[89][0-9]{2}|20[0-9]{2})\b`)
+	decadeWords = map[string]int{"twenties": 1920, "thirties": 1930, "forties": 1940, "fifties": 1950,
+		"sixties": 1960, "seventies": 1970, "eighties": 1980, "nineties": 1990}
+	wordsRe = regexp.MustCompile(`[A-Za-z]+`)
+)
+
+// era is a period of years
+type era struct {
+	first, last int
+}
+
+func (e era) String() string {
+	switch {
+	case e.first == e.last:
+		return strconv.Itoa(e.first)
+	case e.first%10 == 0 && e.last == e.first+9:
+		return fmt.Sprintf("%ds", e.first)
+	}
+
+	return fmt.Sprintf("%d-%d", e.first, e.last)
+}
+
+// findEras returns the eras named in text
+func findEras(text string) []era {
+	var eras []era
+	add := func(e era) {
+		if e.first < minEraYear || e.last > maxEraYear || e.first > e.last {
+			return
+		}
+		for _, o := range eras {
+			if o == e {
+				return
+			}
+		}
+		eras = append(eras, e)
+	}
+
+	// the ranges and the decades first, their years aren't eras of their own
+	text = yearRangeRe.ReplaceAllStringFunc(text, func(s string) string {
+		m := yearRangeRe.FindStringSubmatch(s)
+		first, _ := strconv.Atoi(m[1])
+		last, _ := strconv.Atoi(m[2])
+		if len(m[2]) == 2 {
+			last += first / 100 * 100
+		}
+		add(era{first, last})
+		return " "
+	})
+	text = decadeRe.ReplaceAllStringFunc(text, func(s string) string {
+		m := decadeRe.FindStringSubmatch(s)
+		var decade int
+		if m[1] != "" {
+			decade, _ = strconv.Atoi(m[1] + "0")
+		} else {
+			decade, _ = strconv.Atoi("19" + m[2] + "0")
+		}
+		add(era{decade, decade + 9})
+		return " "
+	})
+	for _, w := range wordsRe.FindAllString(text, -1) {
+		if decade, ok := decadeWords[strings.ToLower(w)]; ok {
+			add(era{decade, decade + 9})
+		}
+	}
+	for _, y := range yearRe.FindAllString(text, -1) {
+		year, _ := strconv.Atoi(y)
+		add(era{year, year})
+	}
+
+	return eras
+}
+
+// parseEra parses the era of --era
+func parseEra(s string) (era, error) {
+	if eras := findEras(strings.TrimSpace(s)); len(eras) == 1 {
+		return eras[0], nil
+	}
+
+	return era{}, fmt.Errorf(tr("bad --era %q, expected a decade like 1950s, a year like 1968 or years like 1939-1945"), s)
+}
+
+// indexEras finds the eras of all the sounds of the index, replacing the old ones
+func indexEras(tx *sql.Tx) error {
+	if _, err := tx.Exec(erasSchema); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM eras`); err != nil {
+		return err
+	}
+
+	type text struct{ location, descr, recorded string }
+	var texts []text
+	rows, err := tx.Query(`SELECT sounds.location, description, coalesce(extras.recorded, '')
+                               FROM sounds LEFT JOIN extras ON extras.location = sounds.location`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var t text
+		if err := rows.Scan(&t.location, &t.descr, &t.recorded); err != nil {
+			rows.Close()
+			return err
+		}
+		texts = append(texts, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO eras(location, first, last) VALUES(?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, t := range texts {
+		for _, e := range findEras(t.descr + "; " + t.recorded) {
+			if _, err := stmt.Exec(t.location, e.first, e.last); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrateEras finds the eras of the sounds of indexes older than the eras table
+func migrateEras(db *sql.DB) error {
+	var n int
+	if err := db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'eras'`).Scan(&n); err != nil || n > 0 {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := indexEras(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// readEras returns the eras of the sounds, by location
+func readEras(db *sql.DB, locations []string) (map[string][]era, error) {
+	eras := make(map[string][]era)
+	for _, location := range locations {
+		rows, err := db.Query(`SELECT first, last FROM eras WHERE location = ? ORDER BY first, last`, location)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var e era
+			if err := rows.Scan(&e.first, &e.last); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			eras[location] = append(eras[location], e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return eras, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The components of the pipeline, inquirers, downloaders, players and controllers, don't
+// stop the session when they fail. They publish their errors on a channel, the errors are
+// counted and summarized at exit, or on request in daemon mode. A session with errors exits
+// with the code of the most serious, for scripts
+
+// the exit codes of thames
+const (
+	exitFailed   = 1 // anything else, like a bad configuration
+	exitUsage    = 2
+	exitQuery    = 3 // a query failed, like a malformed one
+	exitDatabase = 4 // the index or the user database can't be opened, read or written
+	exitPlayer   = 5 // sounds didn't play
+	exitFetch    = 6 // sounds couldn't be fetched
+)
+
+// stageExits are the exit codes of the stages, the most serious first. The errors of the
+// other stages, like the plugins and the controllers, exit with exitFailed
+var stageExits = []struct {
+	stage string
+	code  int
+}{{"database", exitDatabase}, {"play", exitPlayer}, {"query", exitQuery}, {"fetch", exitFetch}}
+
+// pipelineError is an error of a component of the pipeline
+type pipelineError struct {
+	stage string // the component, like query, fetch or play
+	item  string // what failed, like the query or the sound file
+	err   error
+
+	flushed chan bool // if not nil, a request to wait for the errors before it
+}
+
+func (e pipelineError) String() string {
+	if e.item == "" {
+		return fmt.Sprintf("%s: %v", e.stage, e.err)
+	}
+
+	return fmt.Sprintf("%s: %s: %v", e.stage, e.item, e.err)
+}
+
+// errorLog aggregates the errors of the pipeline
+type errorLog struct {
+	c chan pipelineError
+
+	mu     sync.Mutex
+	counts map[string]int  // by stage
+	recent []pipelineError // the last few
+}
+
+const recentErrors = 10
+
+// pipelineErrors is the error channel of the pipeline
+var pipelineErrors = newErrorLog()
+
+func newErrorLog() *errorLog {
+	l := new(errorLog)
+	l.c = make(chan pipelineError, 100)
+	l.counts = make(map[string]int)
+	go l.collect()
+
+	return l
+}
+
+// report publishes an error. Logging it is up to the component. A query that fails because
+// the database does, not because of the query, is an error of the database
+func (l *errorLog) report(stage, item string, err error) {
+	if stage == "query" && isDatabaseError(err) {
+		stage = "database"
+	}
+	l.c <- pipelineError{stage: stage, item: item, err: err}
+}
+
+func (l *errorLog) collect() {
+	for e := range l.c {
+		if e.flushed != nil {
+			close(e.flushed)
+			continue
+		}
+		l.mu.Lock()
+		l.counts[e.stage]++
+		l.recent = append(l.recent, e)
+		if len(l.recent) > recentErrors {
+			l.recent = l.recent[1:]
+		}
+		l.mu.Unlock()
+	}
+}
+
+// summary returns the counts of the errors by stage and the most recent errors,
+// or an empty string if there were none
+func (l *errorLog) summary() string {
+	flushed := make(chan bool)
+	l.c <- pipelineError{flushed: flushed}
+	<-flushed
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.counts) == 0 {
+		return ""
+	}
+	var stages []string
+	for stage, n := range l.counts {
+		stages = append(stages, fmt.Sprintf("%d %s", n, stage))
+	}
+	sort.Strings(stages)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Errors: %s", strings.Join(stages, ", "))
+	for _, e := range l.recent {
+		fmt.Fprintf(&b, "\n  %s", e)
+	}
+
+	return b.String()
+}
+
+// exitCode returns the exit code of the errors, 0 if there were none
+func (l *errorLog) exitCode() int {
+	flushed := make(chan bool)
+	l.c <- pipelineError{flushed: flushed}
+	<-flushed
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, e := range stageExits {
+		if l.counts[e.stage] > 0 {
+			return e.code
+		}
+	}
+	if len(l.counts) > 0 {
+		return exitFailed
+	}
+
+	return 0
+}
+
+// logSummary logs the summary of the errors, if there were any
+func (l *errorLog) logSummary() {
+	if s := l.summary(); s != "" {
+		log.Print(s)
+	}
+}
+
+// errUsage is the error of a command called wrongly, after it printed its usage
+var errUsage = errors.New("usage")
+
+// stageError is an error of a stage, like the database, that the commands return to run
+// for its exit code
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e stageError) Unwrap() error {
+	return e.err
+}
+
+// errorStage returns the stage of the error of a command: its own, the database for
+// the errors of sqlite, or the command
+func errorStage(err error) string {
+	var e stageError
+	switch {
+	case errors.As(err, &e):
+		return e.stage
+	case isDatabaseError(err):
+		return "database"
+	}
+
+	return "command"
+}
+
+// missingError is the error of a sound missing from the cache and the sources
+func missingError(err error) error {
+	if err == nil {
+		return fmt.Errorf("not in the cache")
+	}
+
+	return err
+}
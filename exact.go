@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+var (
+	exactQuery = flag.Bool("exact", false, "Match each query as an exact phrase, its words in order and spelled as written, without stemming")
+	noStem     = flag.Bool("no-stem", false, "Match the words of the queries as written, so rain doesn't find raining")
+)
+
+// exactPhrase returns the full text query that matches query as a phrase
+func exactPhrase(query string) string {
+	return `"` + strings.Join(strings.Fields(strings.ReplaceAll(query, `"`, " ")), " ") + `"`
+}
+
+// queryWords returns the words of a full text query, folded and lower case, without the operators
+// and the syntax. Prefix queries keep their *
+func queryWords(query string) string {
+	var words []string
+	for _, w := range strings.FieldsFunc(foldDiacritics(query), func(r rune) bool {
+		return r == ' ' || r == '"' || r == '(' || r == ')' || r == '\t'
+	}) {
+		switch {
+		case w == "OR" || w == "AND" || w == "NOT" || w == "NEAR" || strings.HasPrefix(w, "NEAR/"):
+			continue
+		case strings.HasPrefix(w, "-"):
+			// excluded words don't match anything
+			continue
+		}
+		if i := strings.IndexByte(w, ':'); i >= 0 {
+			w = w[i+1:]
+		}
+		if w = strings.ToLower(w); w != "" {
+			words = append(words, w)
+		}
+	}
+
+	return strings.Join(words, " ")
+}
+
+// indexColumns are the columns of the index, in order
+var indexColumns = []string{"location", "description", "secs", "category", "CDNumber", "CDName", "tracknum", "folded"}
+
+// unstemmed is the sql function unstemmed(words, highlights...), of the highlights of the columns
+// of the index. It reports whether every token that matched a full text query is one of the
+// words of the query as written, or begins with a prefix query. The porter tokenizer matches
+// the stems of the words, so raining matches rain; this undoes it
+func unstemmed(words string, highlighted ...interface{}) bool {
+	set := make(map[string]bool)
+	var prefixes []string
+	for _, w := range strings.Fields(words) {
+		if strings.HasSuffix(w, "*") {
+			prefixes = append(prefixes, strings.TrimSuffix(w, "*"))
+		} else {
+			set[w] = true
+		}
+	}
+
+	for _, h := range highlighted {
+		text, _ := h.(string)
+		for _, t := range matchedTokens(text) {
+			token := strings.ToLower(foldDiacritics(t))
+			if set[token] {
+				continue
+			}
+			matched := false
+			for _, p := range prefixes {
+				if strings.HasPrefix(token, p) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		}
+	}
+
+	return true
+}
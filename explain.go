@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	explainSelection = flag.Bool("explain", false, "Log why each sound was selected: the words that matched, the filters, the order and the seed of the random selection")
+	replaySeed       = flag.Int64("session-seed", 0, "Draw the random selections and the shuffle of the session from the `seed` logged by --explain, to replay its choices")
+)
+
+// sessionSeed is the seed of the random selections of the session, logged by --explain
+var sessionSeed int64
+
+// newSessionRand returns the random source of the selections of the session, drawn from seed
+// alone, so that the seed replays the choices whatever else uses math/rand. The inquirers of
+// the query groups share it, so it is locked
+func newSessionRand(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed).(rand.Source64)})
+}
+
+// lockedSource is a source of random numbers safe for concurrent use
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.src.Seed(seed)
+}
+
+// filters describes the restrictions of the selection, besides the query
+func (s *selection) filters() []string {
+	var filters []string
+	if len(s.categories) > 0 {
+		filters = append(filters, "categories "+strings.Join(s.categories, ", "))
+	}
+	if s.shortest > 0 {
+		filters = append(filters, fmt.Sprintf("at least %ds", s.shortest))
+	}
+	if s.longest > 0 {
+		filters = append(filters, fmt.Sprintf("at most %ds", s.longest))
+	}
+	if len(s.cds) > 0 {
+		filters = append(filters, "cds "+strings.Join(s.cds, ", "))
+	}
+	if s.cachedOnly {
+		filters = append(filters, "cached only")
+	} else if s.maxSecs > 0 {
+		filters = append(filters, fmt.Sprintf("metered connection, cached or up to %ds", s.maxSecs))
+	}
+	if s.stereo {
+		filters = append(filters, "stereo only")
+	}
+	if s.minRate > 0 {
+		filters = append(filters, fmt.Sprintf("sampled at %dHz or more", s.minRate))
+	}
+	if s.exact {
+		filters = append(filters, "exact phrases")
+	} else if s.noStem {
+		filters = append(filters, "no stemming")
+	}
+	if s.grep != "" {
+		filters = append(filters, "grep "+s.grep)
+	}
+	if s.near != nil {
+		filters = append(filters, fmt.Sprintf("recorded within %gkm of %s", s.nearKm, s.near.name))
+	}
+	if s.era != nil {
+		filters = append(filters, "of the era "+s.era.String())
+	}
+	for _, p := range excludeCDs {
+		filters = append(filters, "exclude cd "+p)
+	}
+	for _, p := range excludeLocations {
+		filters = append(filters, "exclude location "+p)
+	}
+	if len(s.rules) > 0 {
+		filters = append(filters, fmt.Sprintf("smart playlist %s of %d rules", *smartName, len(s.rules)))
+	}
+	if s.notes {
+		filters = append(filters, "queries match notes")
+	}
+	if s.described {
+		filters = append(filters, "queries match the descriptions of the users")
+	}
+	if s.translated {
+		lang := s.lang
+		if lang == "" {
+			lang = "any language"
+		}
+		filters = append(filters, "queries match translations to "+lang)
+	}
+
+	return filters
+}
+
+// explain logs why the sounds were selected for the query, out of how many, in what order
+// and with what seed
+func explain(ctx context.Context, sel *selection, query string, sounds []sound, limit int) {
+	how := "in " + sel.order + " order"
+	if *sampleSize > 0 && *onlyQuery {
+		how = fmt.Sprintf("at random with --seed %d", *sampleSeed)
+	} else if sel.order == "random" {
+		how = fmt.Sprintf("at random, %s sampling, seed %d", sel.sampling, sessionSeed)
+	}
+	filters := "no filters"
+	if f := sel.filters(); len(f) > 0 {
+		filters = strings.Join(f, "; ")
+	}
+	matching := "?"
+	if n, err := sel.count(ctx, query); err == nil {
+		matching = strconv.Itoa(n)
+	}
+	wanted := "all"
+	if limit > 0 {
+		wanted = strconv.Itoa(limit)
+	}
+	log.Printf("Explain: %q: %s sounds match, selected %d, wanted %s, %s; %s", query, matching, len(sounds), wanted, how, filters)
+
+	matched, err := matchedWords(ctx, sel, query, sounds)
+	if err != nil {
+		log.Printf("Error:Explain: %q: %v", query, err)
+	}
+	for _, snd := range sounds {
+		why := matched[snd.fname]
+		if len(why) == 0 {
+			why = []string{"every sound matches"}
+			if query != "" {
+				why = []string{"no words matched"}
+			}
+		}
+		log.Printf("Explain: %s %s: %s", snd.fname, snd.descr, strings.Join(why, ", "))
+	}
+}
+
+// explainDuplicates logs the sounds selected by more than one query. They aren't deduplicated,
+// each query plays its own
+func explainDuplicates(selected [][]sound) {
+	queries := make(map[string][]string)
+	var order []string
+	for _, sounds := range selected {
+		for _, snd := range sounds {
+			if len(queries[snd.fname]) == 0 {
+				order = append(order, snd.fname)
+			}
+			queries[snd.fname] = append(queries[snd.fname], strconv.Quote(snd.query))
+		}
+	}
+	for _, fname := range order {
+		if q := queries[fname]; len(q) > 1 {
+			log.Printf("Explain: %s is selected by %s and plays %d times, sounds are not deduplicated", fname, strings.Join(q, " and "), len(q))
+		}
+	}
+}
+
+// matchedWords returns, for each sound, the words of the query that matched and where, like
+// "rain in description", and whether its note or a translation matched
+func matchedWords(ctx context.Context, sel *selection, query string, sounds []sound) (map[string][]string, error) {
+	matched := make(map[string][]string)
+	if query == "" || len(sounds) == 0 {
+		return matched, nil
+	}
+	if sel.exact {
+		query = exactPhrase(query)
+	}
+	columns := indexColumns
+
+	for start := 0; start < len(sounds); start += sampleBatch {
+		batch := sounds[start:]
+		if len(batch) > sampleBatch {
+			batch = batch[:sampleBatch]
+		}
+		if err := matchedBatch(ctx, sel, query, columns, batch, matched); err != nil {
+			return matched, err
+		}
+	}
+
+	return matched, nil
+}
+
+func matchedBatch(ctx context.Context, sel *selection, query string, columns []string, sounds []sound, matched map[string][]string) error {
+	marks := strings.TrimSuffix(strings.Repeat("?,", len(sounds)), ",")
+	var locations []interface{}
+	for _, snd := range sounds {
+		locations = append(locations, snd.fname)
+	}
+
+	stmt := `SELECT location, ` + highlights(columns) + ` FROM sounds
+                 WHERE sounds MATCH ? AND location IN (` + marks + `)`
+	rows, err := sel.db.QueryContext(ctx, stmt, append([]interface{}{matchQuery(query)}, locations...)...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var location string
+		values := make([]string, len(columns))
+		dest := []interface{}{&location}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return err
+		}
+
+		seen := make(map[string]bool)
+		for col, value := range values {
+			column := columns[col]
+			if column == "folded" {
+				column = "description (without accents)"
+			}
+			for _, t := range matchedTokens(value) {
+				w := t + " in " + column
+				if !seen[w] {
+					seen[w] = true
+					matched[location] = append(matched[location], w)
+				}
+			}
+		}
+		sort.Strings(matched[location])
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var extra []string
+	if sel.notes {
+		extra = append(extra, `SELECT location, 'its note' FROM notes_fts WHERE notes_fts MATCH ? AND location IN (`+marks+`)`)
+	}
+	if sel.described {
+		extra = append(extra, `SELECT location, 'its description' FROM descriptions_fts WHERE descriptions_fts MATCH ? AND location IN (`+marks+`)`)
+	}
+	if sel.translated {
+		extra = append(extra, `SELECT location, 'the translation to ' || lang FROM translations_fts WHERE translations_fts MATCH ? AND location IN (`+marks+`)`)
+	}
+	for _, stmt := range extra {
+		rows, err := sel.db.QueryContext(ctx, stmt, append([]interface{}{userMatchQuery(query)}, locations...)...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var location, what string
+			if err := rows.Scan(&location, &what); err != nil {
+				rows.Close()
+				return err
+			}
+			matched[location] = append(matched[location], "the query matched "+what)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// layouts are the values of export --layout
+//
+//	flat  the files as named in the archive, in one directory
+//	daw   a directory for each query and in it for each category, files named after their
+//	      descriptions, each with a json sidecar of its metadata, like the sample browsers
+//	      of DAWs such as Reaper and Ableton show them
+var layouts = map[string]bool{
+	"flat": true,
+	"daw":  true,
+}
+
+// sidecar is the metadata of an exported sound, written next to it in the daw layout
+type sidecar struct {
+	Location    string `json:"location"`
+	Description string `json:"description"`
+	Secs        int    `json:"secs"`
+	Category    string `json:"category,omitempty"`
+	CDNumber    string `json:"cdNumber,omitempty"`
+	CDName      string `json:"cdName,omitempty"`
+	Tracknum    string `json:"tracknum,omitempty"`
+	Query       string `json:"query"`
+	Source      string `json:"source"`
+}
+
+// exportCommand implements the export command. It selects sounds like fetch, fetching the
+// missing ones, and copies them out of the cache to a directory
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	layout := fs.String("layout", "flat", "How to organize the files: flat or daw")
+	link := fs.Bool("link", false, "Hard link the files to the cache instead of copying them. Editing them edits the cache")
+	var categories stringsFlag
+	fs.Var(&categories, "category", "Export only sounds of `category` and its subcategories. May be repeated")
+	all := fs.Bool("all", false, "Export all the sounds, not only -n for each query")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames export [--layout flat|daw] [--link] [--category c]... [--all] dir [queries...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 || fs.NArg() == 1 && !*all || !layouts[*layout] {
+		fs.Usage()
+		return errUsage
+	}
+	dir := fs.Arg(0)
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	sel := newSelection(db)
+	if err := sel.restrictCategories(categories); err != nil {
+		return err
+	}
+
+	limit := *nsounds
+	if *all {
+		limit = 0
+	}
+	queries := fs.Args()[1:]
+	if len(queries) == 0 {
+		queries = []string{""}
+	}
+
+	ctx := context.Background()
+	f := newFetcher(db)
+	var selected [][]sound
+	for _, query := range queries {
+		selected = append(selected, selectSounds(ctx, sel, query, limit, soundsDir))
+	}
+	if err := downloadBudget(selected, f); err != nil {
+		return err
+	}
+
+	total := 0
+	for _, sounds := range selected {
+		total += len(sounds)
+	}
+	p := newProgress("Exporting", total)
+
+	var exported, failed int
+	for _, sounds := range selected {
+		meta, err := readMetadata(ctx, db, sounds)
+		if err != nil {
+			return err
+		}
+		for _, snd := range sounds {
+			src, exists, err := f.cache(ctx, snd.fname)
+			p.step()
+			if err != nil || !exists {
+				p.logf("Missing File: %s: %v", snd.fname, err)
+				failed++
+				continue
+			}
+			dst := filepath.Join(dir, filepath.Base(src))
+			if *layout == "daw" {
+				dst = dawPath(dir, snd, meta[snd.fname], filepath.Ext(src))
+			}
+			if err := exportFile(src, dst, *link); err != nil {
+				p.logf("Error:Export: %s: %v", snd.fname, err)
+				failed++
+				continue
+			}
+			audit("export", snd, dst)
+			if *layout == "daw" {
+				if err := writeSidecar(dst, snd, meta[snd.fname]); err != nil {
+					p.logf("Error:Export: %s: %v", snd.fname, err)
+				}
+			}
+			exported++
+		}
+	}
+	p.finish()
+
+	log.Printf("Exported %d sounds to %s, %d failed", exported, dir, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d sounds failed to export", failed)
+	}
+
+	return nil
+}
+
+// dawPath returns the path of the sound in the daw layout: dir/query/category/description_location.ext
+// Sounds without a category go in Uncategorized, the subcategories are ignored
+func dawPath(dir string, snd sound, m soundMeta, ext string) string {
+	query := snd.query
+	if query == "" {
+		query = "all"
+	}
+	category := strings.TrimSpace(strings.SplitN(m.category, ":", 2)[0])
+	if category == "" {
+		category = "Uncategorized"
+	}
+	name := normalizeName(snd.descr, 60) + "_" + strings.TrimSuffix(snd.fname, filepath.Ext(snd.fname))
+
+	return filepath.Join(dir, normalizeName(query, 40), normalizeName(category, 40), name+ext)
+}
+
+// normalizeName turns s into a file name that every file system and DAW accepts: ascii letters,
+// digits and dashes, at most max bytes, cut at a word
+func normalizeName(s string, max int) string {
+	var words []string
+	for _, w := range strings.FieldsFunc(foldDiacritics(s), func(r rune) bool {
+		return r > unicode.MaxASCII || !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		words = append(words, strings.ToLower(w))
+	}
+
+	name := ""
+	for _, w := range words {
+		if name != "" && len(name)+1+len(w) > max {
+			break
+		}
+		if name != "" {
+			name += "-"
+		}
+		name += w
+	}
+	if len(name) > max {
+		name = name[:max]
+	}
+	if name == "" {
+		name = "sound"
+	}
+
+	return name
+}
+
+// exportFile copies, or links, the file of the cache src to dst
+func exportFile(src, dst string, link bool) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if link {
+		return linkFile(src, dst)
+	}
+
+	return copyFile(src, dst)
+}
+
+// writeSidecar writes the metadata of the exported sound at fpath to fpath with the extension .json
+func writeSidecar(fpath string, snd sound, m soundMeta) error {
+	s := sidecar{
+		Location:    snd.fname,
+		Description: snd.descr,
+		Secs:        snd.secs,
+		Category:    m.category,
+		CDNumber:    m.cdNumber,
+		CDName:      m.cdName,
+		Tracknum:    m.tracknum,
+		Query:       snd.query,
+		Source:      soundURL(catalogURL, snd.fname),
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(strings.TrimSuffix(fpath, filepath.Ext(fpath))+".json", append(data, '\n'), 0644)
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ipfsGateway = flag.String("ipfs-gateway", "https://ipfs.io", "IPFS gateway used by ipfs: sources")
+	cdnURL      = flag.String("cdn", "https://bbcsfx.acropolis.org.uk/assets/", "Fetch missing sounds from the CDN of the archive at `url`, after the other sources. Empty to never")
+	noDownload  = flag.Bool("no-download", false, "Never fetch missing sounds, report them as missing and play the rest")
+	fetchOnly   = flag.Bool("fetch", false, "Fetch the sounds the queries select into the cache and exit, without playing, to prepare for offline")
+)
+
+// fetchRetries is how many times a source is tried for a sound, if it fails with transient errors
+const fetchRetries = 3
+
+// sourcesFlag collects the -source flags. Each is one of
+//
+//	http://host/path/  a mirror of the archive, sounds are fetched from path/<location>
+//	ipfs:<cid>         a directory of the archive published on IPFS, fetched through the gateway
+//	torrent:<file>     a torrent of the archive, single sounds are fetched with aria2c
+type sourcesFlag []source
+
+func (f *sourcesFlag) String() string {
+	var names []string
+	for _, s := range *f {
+		names = append(names, s.String())
+	}
+
+	return strings.Join(names, ",")
+}
+
+func (f *sourcesFlag) Set(v string) error {
+	switch {
+	case strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://"):
+		*f = append(*f, newHTTPSource(v))
+	case strings.HasPrefix(v, "ipfs:"):
+		*f = append(*f, newIPFSSource(strings.TrimPrefix(v, "ipfs:")))
+	case strings.HasPrefix(v, "torrent:"):
+		*f = append(*f, newTorrentSource(strings.TrimPrefix(v, "torrent:")))
+	default:
+		return fmt.Errorf("unknown source %q", v)
+	}
+
+	return nil
+}
+
+// source is a place, other than the local cache, where sound files can be fetched from
+type source interface {
+	// fetch writes the contents of the sound file fname to w, until ctx is done
+	fetch(ctx context.Context, fname string, w io.Writer) error
+
+	String() string
+}
+
+// fetcher brings sounds into the cache from the sources
+type fetcher struct {
+	db      *sql.DB
+	sources []source // in order of preference
+	dir     string   // the cache
+}
+
+// newFetcher returns a fetcher for the sources of the command line, into the cache of the root
+func newFetcher(db *sql.DB) *fetcher {
+	return &fetcher{db: db, sources: flagSources(), dir: soundsDir}
+}
+
+// flagSources returns the sources of the command line, none with --cached or --no-download
+func flagSources() []source {
+	if *onlyCached || *noDownload {
+		return nil
+	}
+	var sources []source
+	if *usePeers {
+		sources = append(sources, newPeersSource())
+	}
+	sources = append(sources, extraSources...)
+	if *cdnURL != "" {
+		sources = append(sources, newHTTPSource(*cdnURL))
+	}
+
+	return sources
+}
+
+// cache makes sure the sound file fname is in the cache, fetching it from the sources
+// if missing. It returns the path of the file in the cache and whether it exists. A fetch
+// is cancelled when ctx is done
+func (f *fetcher) cache(ctx context.Context, fname string) (string, bool, error) {
+	sp, exists, err := cachedPath(f.dir, fname)
+	if err != nil || exists || len(f.sources) == 0 {
+		return sp, exists, err
+	}
+
+	if err := f.fetch(ctx, fname); err != nil {
+		return sp, false, err
+	}
+	if *storeFlac {
+		if err := compressSound(f.dir, fname); err != nil {
+			log.Printf("Error:Compress: %v", err)
+		}
+	}
+
+	return cachedPath(f.dir, fname)
+}
+
+// fetchCommand implements the fetch command. It selects sounds like when playing
+// but only fetches them into the cache
+func fetchCommand(args []string) error {
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+	var categories stringsFlag
+	fs.Var(&categories, "category", "Fetch only sounds of `category` and its subcategories. May be repeated")
+	all := fs.Bool("all", false, "Fetch all the sounds, not only -n for each query")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames fetch [--category c]... [--all] [queries...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 && !*all {
+		fs.Usage()
+		return errUsage
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	sel := newSelection(db)
+	if err := sel.restrictCategories(categories); err != nil {
+		return err
+	}
+
+	limit := *nsounds
+	if *all {
+		limit = 0
+	}
+	queries := fs.Args()
+	if len(queries) == 0 {
+		queries = []string{""}
+	}
+
+	var selected [][]sound
+	for _, query := range queries {
+		selected = append(selected, selectSounds(context.Background(), sel, query, limit, soundsDir))
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	fetchSounds(ctx, newFetcher(db), selected)
+
+	return nil
+}
+
+// fetchSounds fetches the selected sounds into the cache, in parallel, and prints what was
+// fetched, how much and what was already cached. When ctx is done the fetches in flight are
+// cancelled, leaving no partial files, and the rest aren't started
+func fetchSounds(ctx context.Context, f *fetcher, selected [][]sound) {
+	if err := downloadBudget(selected, f); err != nil {
+		log.Printf("Error:Fetch: %v", err)
+		pipelineErrors.report("fetch", "", err)
+		return
+	}
+
+	// a sound of more than one query is fetched once
+	var unique []sound
+	seen := make(map[string]bool)
+	for _, sounds := range selected {
+		for _, snd := range sounds {
+			if !seen[snd.fname] {
+				seen[snd.fname] = true
+				unique = append(unique, snd)
+			}
+		}
+	}
+	p := newProgress("Fetching", len(unique))
+
+	// the sounds are fetched in parallel, each host limits how many at once
+	var mu sync.Mutex
+	var fetched, cached, failed int
+	var fetchedBytes int64
+	var wg sync.WaitGroup
+	work := make(chan sound)
+	for i := 0; i < *fetchParallel*len(f.sources) || i == 0; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for snd := range work {
+				var counter *int
+				var size int64
+				if snd.cached {
+					counter = &cached
+				} else if sp, exists, err := f.cache(ctx, snd.fname); ctx.Err() != nil {
+					continue
+				} else if err != nil || !exists {
+					p.logf("Missing File: %s: %v", snd.fname, err)
+					pipelineErrors.report("fetch", snd.fname, missingError(err))
+					counter = &failed
+				} else {
+					p.logf("Fetched: %s %s", snd.fname, snd.descr)
+					counter = &fetched
+					if info, err := os.Stat(sp); err == nil {
+						size = info.Size()
+					}
+				}
+				mu.Lock()
+				*counter++
+				fetchedBytes += size
+				mu.Unlock()
+				p.step()
+			}
+		}()
+	}
+	for _, snd := range unique {
+		work <- snd
+	}
+	close(work)
+	wg.Wait()
+	p.finish()
+
+	log.Printf("Fetched %d sounds, %s, %d already cached, %d failed", fetched, formatBytes(fetchedBytes), cached, failed)
+	if ctx.Err() != nil {
+		log.Printf("Interrupted: %d sounds not fetched", len(unique)-fetched-cached-failed)
+	}
+}
+
+// fetch tries the sources in order and stores the sound file fname in the cache
+// The file is written atomically, so an interrupted fetch never leaves a partial sound in the cache
+func (f *fetcher) fetch(ctx context.Context, fname string) error {
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return err
+	}
+
+	var lastErr error = fmt.Errorf("no sources for %s", fname)
+	for _, src := range f.sources {
+		if _, lan := src.(*peersSource); !lan && isMetered() {
+			if err := f.checkMetered(fname); err != nil {
+				return fmt.Errorf("%s: %v", src, err)
+			}
+		}
+		err := f.fetchRetrying(ctx, src, fname)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		lastErr = fmt.Errorf("%s: %v", src, err)
+	}
+
+	return lastErr
+}
+
+// fetchRetrying fetches the sound file fname from src, trying again after a while if it
+// fails with a transient error, like a timeout, a reset connection or a busy server
+func (f *fetcher) fetchRetrying(ctx context.Context, src source, fname string) error {
+	var err error
+	for i := 0; i < fetchRetries; i++ {
+		if i > 0 {
+			wait := time.Duration(1<<(i-1)) * time.Second
+			log.Printf("Retry: %s from %s in %s: %v", fname, src, wait, err)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err = f.fetchFrom(ctx, src, fname); err == nil || ctx.Err() != nil || !transient(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// httpStatusError is the error of an http request that the server didn't serve
+type httpStatusError struct {
+	method, url string
+	status      string
+	code        int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.method, e.url, e.status)
+}
+
+// transient reports whether err may not happen if the request is repeated: the server errors
+// that mean busy, timeouts and connections cut short. A refused connection or a host that
+// doesn't resolve is a dead or mistyped source, it fails over to the next at once
+func transient(err error) bool {
+	var se *httpStatusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests || se.code == http.StatusRequestTimeout
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED)
+}
+
+func (f *fetcher) fetchFrom(ctx context.Context, src source, fname string) error {
+	fout, err := ioutil.TempFile(f.dir, fname+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fout.Name())
+
+	if err := src.fetch(ctx, fname, fout); err != nil {
+		fout.Close()
+		return err
+	}
+	if err := fout.Close(); err != nil {
+		return err
+	}
+
+	// servers may send error pages with a 200
+	a, err := probeAudio(fout.Name())
+	if err != nil {
+		// the size of the page, if the source told it, is not the size of the sound
+		if info, serr := os.Stat(fout.Name()); serr == nil {
+			if expected, ok := knownSize(f.db, fname); ok && expected == info.Size() {
+				recordSize(f.db, fname, 0)
+			}
+		}
+		if qerr := quarantine(fout.Name(), fname); qerr != nil {
+			log.Printf("Error:Quarantine: %v", qerr)
+		} else {
+			log.Printf("Quarantined: %s from %s: %v, moved to %s", fname, src, err, quarantinePath(fname))
+		}
+		return fmt.Errorf("%s: %v", fname, err)
+	}
+
+	info, err := os.Stat(fout.Name())
+	if err != nil {
+		return err
+	}
+	if expected, ok := knownSize(f.db, fname); ok && expected != info.Size() {
+		return fmt.Errorf("%s: got %d bytes, expected %d", fname, info.Size(), expected)
+	}
+	if err := recordSize(f.db, fname, info.Size()); err != nil {
+		log.Printf("Error:Size: %v", err)
+	}
+	if err := recordAudio(f.db, fname, a); err != nil {
+		log.Printf("Error:Audio: %v", err)
+	}
+	if err := os.Rename(fout.Name(), filepath.Join(f.dir, fname)); err != nil {
+		return err
+	}
+
+	return setCached(f.db, fname, true)
+}
+
+// httpGet copies the body of a successful GET for url to w, until ctx is done
+func httpGet(ctx context.Context, client *http.Client, url string, w io.Writer) error {
+	defer acquireHost(url)()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &httpStatusError{"GET", url, resp.Status, resp.StatusCode}
+	}
+	_, err = io.Copy(w, resp.Body)
+
+	return err
+}
+
+// httpSource fetches sounds from a directory served over http, like a mirror or an IPFS gateway
+type httpSource struct {
+	base   string
+	client *http.Client
+}
+
+func newHTTPSource(base string) *httpSource {
+	s := new(httpSource)
+	s.base = strings.TrimSuffix(base, "/") + "/"
+	s.client = httpClient()
+
+	return s
+}
+
+func (s *httpSource) url(fname string) string {
+	return s.base + fname
+}
+
+func (s *httpSource) fetch(ctx context.Context, fname string, w io.Writer) error {
+	return httpGet(ctx, s.client, s.url(fname), w)
+}
+
+func (s *httpSource) size(fname string) (int64, error) {
+	return httpSize(s.client, s.url(fname))
+}
+
+func (s *httpSource) String() string {
+	return s.base
+}
+
+// ipfsSource fetches sounds from a directory published on IPFS through an http gateway
+type ipfsSource struct {
+	cid    string
+	client *http.Client
+}
+
+func newIPFSSource(cid string) *ipfsSource {
+	s := new(ipfsSource)
+	s.cid = strings.Trim(cid, "/")
+	s.client = httpClient()
+
+	return s
+}
+
+func (s *ipfsSource) url(fname string) string {
+	return strings.TrimSuffix(*ipfsGateway, "/") + "/ipfs/" + s.cid + "/" + fname
+}
+
+func (s *ipfsSource) fetch(ctx context.Context, fname string, w io.Writer) error {
+	return httpGet(ctx, s.client, s.url(fname), w)
+}
+
+func (s *ipfsSource) size(fname string) (int64, error) {
+	return httpSize(s.client, s.url(fname))
+}
+
+func (s *ipfsSource) String() string {
+	return "ipfs:" + s.cid
+}
+
+// httpSize returns the size of the resource at url, as reported by a HEAD request
+func httpSize(client *http.Client, url string) (int64, error) {
+	defer acquireHost(url)()
+
+	resp, err := client.Head(url)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("HEAD %s: %s", url, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("HEAD %s: unknown size", url)
+	}
+
+	return resp.ContentLength, nil
+}
+
+// peersSource fetches sounds from the caches of other thames mirrors on the LAN
+// Peers are discovered with mDNS the first time a sound is missing
+type peersSource struct {
+	once   sync.Once
+	peers  []mdnsPeer
+	client *http.Client
+}
+
+func newPeersSource() *peersSource {
+	s := new(peersSource)
+	s.client = httpClient()
+
+	return s
+}
+
+// discover finds the peers the first time it is called
+func (s *peersSource) discover() {
+	s.once.Do(func() {
+		peers, err := discoverPeers(time.Second)
+		if err != nil {
+			log.Printf("Error:mDNS: %v", err)
+		}
+		for _, p := range peers {
+			log.Printf("Peer: %s %s", p.name, p.addr)
+		}
+		s.peers = peers
+	})
+}
+
+func (s *peersSource) fetch(ctx context.Context, fname string, w io.Writer) error {
+	s.discover()
+	if len(s.peers) == 0 {
+		return fmt.Errorf("no peers")
+	}
+
+	var lastErr error
+	for _, p := range s.peers {
+		// a failed GET may leave garbage in w, so first find a peer that has the sound
+		if _, err := httpSize(s.client, "http://"+p.addr+"/sounds/"+fname); err != nil {
+			lastErr = err
+			continue
+		}
+		return httpGet(ctx, s.client, "http://"+p.addr+"/sounds/"+fname, w)
+	}
+
+	return lastErr
+}
+
+func (s *peersSource) size(fname string) (int64, error) {
+	s.discover()
+	if len(s.peers) == 0 {
+		return 0, fmt.Errorf("no peers")
+	}
+
+	var lastErr error
+	for _, p := range s.peers {
+		n, err := httpSize(s.client, "http://"+p.addr+"/sounds/"+fname)
+		if err == nil {
+			return n, nil
+		}
+		lastErr = err
+	}
+
+	return 0, lastErr
+}
+
+func (s *peersSource) String() string {
+	return "lan peers"
+}
+
+// shareCache serves the local cache over http at addr and advertises it with mDNS
+func shareCache(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	go func() {
+		if err := advertise(port); err != nil {
+			log.Printf("Error:mDNS: %v", err)
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle("/sounds/", http.StripPrefix("/sounds/", http.FileServer(http.Dir(soundsDir))))
+	log.Printf("Sharing %s at %s", soundsDir, ln.Addr())
+
+	return http.Serve(ln, mux)
+}
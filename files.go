@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// filesSchema is the table with what is known about the sound files themselves,
+// apart from the full text index which is only about their descriptions
+const filesSchema = `CREATE TABLE IF NOT EXISTS files(
+                       location TEXT PRIMARY KEY,
+                       size INTEGER,
+                       cached INTEGER NOT NULL DEFAULT 0,
+                       format TEXT,           -- of the header, like wav or wav/ulaw
+                       samplerate INTEGER,
+                       channels INTEGER,
+                       bits INTEGER
+                     )`
+
+// migrateFiles brings the files table of older databases up to date
+func migrateFiles(db *sql.DB) error {
+	if _, err := db.Exec(filesSchema); err != nil {
+		return err
+	}
+	if _, err := db.Exec(extrasSchema); err != nil {
+		return err
+	}
+	if err := migrateAudio(db); err != nil {
+		return err
+	}
+
+	hasCached, err := hasColumn(db, "files", "cached")
+	if err != nil || hasCached {
+		return err
+	}
+	if _, err := db.Exec(`ALTER TABLE files ADD COLUMN cached INTEGER NOT NULL DEFAULT 0`); err != nil {
+		return err
+	}
+
+	return syncCached(db)
+}
+
+func hasColumn(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+
+	return false, rows.Err()
+}
+
+// setCached records whether the sound file fname is in the cache. The flag saves
+// a stat for every result of a query and makes filtering by it possible
+func setCached(db *sql.DB, fname string, cached bool) error {
+	_, err := db.Exec(`INSERT INTO files(location, cached) VALUES(?, ?)
+                           ON CONFLICT(location) DO UPDATE SET cached = excluded.cached`, fname, cached)
+
+	return err
+}
+
+// syncCached sets the cached flags from the contents of the cache directory
+func syncCached(db *sql.DB) error {
+	infos, err := ioutil.ReadDir(soundsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE files SET cached = 0`); err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || strings.HasSuffix(name, ".part") {
+			continue
+		}
+		// compressed sounds are indexed by the name of the original wav
+		if filepath.Ext(name) == ".flac" {
+			name = strings.TrimSuffix(name, ".flac") + ".wav"
+		}
+		if _, err := tx.Exec(`INSERT INTO files(location, cached) VALUES(?, 1)
+                                      ON CONFLICT(location) DO UPDATE SET cached = 1`, name); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// knownSize returns the size of the sound file fname, if known
+func knownSize(db *sql.DB, fname string) (int64, bool) {
+	var size sql.NullInt64
+	if err := db.QueryRow(`SELECT size FROM files WHERE location = ?`, fname).Scan(&size); err != nil {
+		return 0, false
+	}
+
+	return size.Int64, size.Valid && size.Int64 > 0
+}
+
+func recordSize(db execer, fname string, size int64) error {
+	_, err := db.Exec(`INSERT INTO files(location, size) VALUES(?, ?)
+                           ON CONFLICT(location) DO UPDATE SET size = excluded.size`, fname, size)
+
+	return err
+}
+
+// execer is a database or a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
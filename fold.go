@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var tokenizer = flag.String("tokenizer", "porter", "Tokenizer of the full text index when it is created: porter or unicode61")
+
+// tokenizers are the fts5 tokenize options for the values of --tokenizer. porter stems english words,
+// so rain matches raining, but only knows ascii. unicode61 knows the case and the accents of all the
+// scripts, so cafe matches café, but doesn't stem
+var tokenizers = map[string]string{
+	"porter":    `tokenize = 'porter ascii'`,
+	"unicode61": `tokenize = 'unicode61 remove_diacritics 1'`,
+}
+
+// fts4Tokenizers are the same tokenizers for the fts4 index of a thames without fts5
+var fts4Tokenizers = map[string]string{
+	"porter":    `tokenize=porter`,
+	"unicode61": `tokenize=unicode61 "remove_diacritics=1"`,
+}
+
+// foldings are the ascii spellings of the accented latin letters, the ligatures and the typographic quotes
+var foldings = map[rune]string{}
+
+func init() {
+	for ascii, letters := range map[string]string{
+		"a": "àáâãäåāăąǎ", "c": "çćĉċč", "d": "ďđð", "e": "èéêëēĕėęě", "g": "ĝğġģ", "h": "ĥħ",
+		"i": "ìíîïĩīĭįı", "j": "ĵ", "k": "ķ", "l": "ĺļľŀł", "n": "ñńņňŉ", "o": "òóôõöøōŏőǒ",
+		"r": "ŕŗř", "s": "śŝşšș", "t": "ţťŧț", "u": "ùúûüũūŭůűųǔ", "w": "ŵ", "y": "ýÿŷ", "z": "źżž",
+		"ae": "æ", "oe": "œ", "ss": "ß", "th": "þ", "'": "‘’‛′", `"`: "“”„″",
+	} {
+		for _, r := range letters {
+			foldings[r] = ascii
+			if u := unicode.ToUpper(r); u != r {
+				foldings[u] = strings.ToUpper(ascii)
+			}
+		}
+	}
+}
+
+// foldDiacritics replaces the accented letters of s with their ascii spellings, keeping the case
+func foldDiacritics(s string) string {
+	if isASCII(s) {
+		return s
+	}
+
+	var b strings.Builder
+	for _, r := range s {
+		if f, ok := foldings[r]; ok {
+			b.WriteString(f)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// foldText returns the lower case ascii spelling of the text of a sound, or "" if the
+// tokenizers already see the same words in it
+func foldText(texts ...string) string {
+	var folded []string
+	for _, t := range texts {
+		if isASCII(t) {
+			continue
+		}
+		if f := foldDiacritics(strings.ToLower(t)); f != t {
+			folded = append(folded, f)
+		}
+	}
+
+	return strings.Join(folded, " ")
+}
+
+// foldQuery folds the accents of a full text query, so different spellings of a word match each other.
+// The case is kept, the operators like OR and NEAR are upper case
+func foldQuery(query string) string {
+	return foldDiacritics(query)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// reindexCommand implements the reindex command. It recreates the full text index from the csv,
+// for example with another --tokenizer, and keeps the cache records
+func reindexCommand(args []string) error {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames [--tokenizer t] reindex [file]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return errUsage
+	}
+	fpath := csvFile
+	if fs.NArg() == 1 {
+		fpath = fs.Arg(0)
+	}
+
+	fin, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	log.Printf("Reindexing %s with the %s tokenizer", fpath, *tokenizer)
+	if err := createIndex(db, fin); err != nil {
+		return err
+	}
+
+	return nil
+}
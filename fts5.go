@@ -0,0 +1,384 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// The index is an fts5 table, which ranks the sounds by relevance with bm25. The go-sqlite3
+// driver has fts5 only when thames is built with -tags sqlite_fts5. Indexes of older versions
+// of thames are fts4 tables and are migrated when opened, keeping their tokenizer. Queries
+// keep the syntax of fts4, matchQuery writes them for fts5. The indexes of the user data,
+// of the notes, the translations and the descriptions, are still fts4.
+//
+// A thames built without the tag keeps the index an fts4 table, like older versions did, and
+// can't order by relevance
+
+// the markers of the tokens that matched, in the columns of highlight()
+const (
+	matchOn  = "\x01"
+	matchOff = "\x02"
+)
+
+// soundsSchema returns the schema of the index, the fts5 table named table with the tokenizer,
+// or the fts4 table if the sqlite of thames lacks fts5. folded is the lower case ascii spelling
+// of the texts with accents, see foldText
+func soundsSchema(table, tokenizer string) (string, error) {
+	if !hasFTS5() {
+		tokenize, ok := fts4Tokenizers[tokenizer]
+		if !ok {
+			return "", fmt.Errorf("unknown tokenizer %q", tokenizer)
+		}
+		return `CREATE VIRTUAL TABLE ` + table + ` USING fts4(
+                  location, description, secs, category, CDNumber, CDName, tracknum, folded,
+
+                  ` + tokenize + `, notindexed=location, notindexed=secs, notindexed=CDNumber, notindexed=tracknum
+                )`, nil
+	}
+	tokenize, ok := tokenizers[tokenizer]
+	if !ok {
+		return "", fmt.Errorf("unknown tokenizer %q", tokenizer)
+	}
+
+	return `CREATE VIRTUAL TABLE ` + table + ` USING fts5(
+              location UNINDEXED, description, secs UNINDEXED, category, CDNumber UNINDEXED, CDName, tracknum UNINDEXED, folded,
+
+              ` + tokenize + `
+            )`, nil
+}
+
+var fts5Check struct {
+	once sync.Once
+	ok   bool
+}
+
+// hasFTS5 reports whether the sqlite of thames has fts5, which it has only when thames is
+// built with -tags sqlite_fts5
+func hasFTS5() bool {
+	fts5Check.once.Do(func() {
+		db, err := sql.Open(sqliteDriver, ":memory:")
+		if err == nil {
+			err = db.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&fts5Check.ok)
+			db.Close()
+		}
+		if err != nil {
+			log.Printf("Error:Index: %v", err)
+		}
+	})
+
+	return fts5Check.ok
+}
+
+// errNoFTS5 is the error of indexes that are fts5 tables, for a thames without fts5
+var errNoFTS5 = errors.New("the index is an fts5 table and the sqlite of thames has no fts5: build thames with go build -tags sqlite_fts5, or remove the index to create it again as an fts4 table")
+
+// migrateFTS5 migrates an fts4 index to fts5. The rowids of the sounds are kept. Without fts5
+// the fts4 index stays as it is
+func migrateFTS5(db *sql.DB) error {
+	var schema string
+	if err := db.QueryRow(`SELECT sql FROM sqlite_master WHERE name = 'sounds'`).Scan(&schema); err != nil {
+		return err
+	}
+	schema = strings.ToLower(schema)
+	if !hasFTS5() {
+		if strings.Contains(schema, "fts5") {
+			return errNoFTS5
+		}
+		return nil
+	}
+	if !strings.Contains(schema, "fts4") {
+		return nil
+	}
+	tokenizer := "porter"
+	if strings.Contains(schema, "unicode61") {
+		tokenizer = "unicode61"
+	}
+	log.Printf("Migrating the index %s to fts5, with the %s tokenizer", dbFile, tokenizer)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	type row struct {
+		id     int64
+		fields [7]string
+	}
+	var sounds []row
+	rows, err := tx.Query(`SELECT docid, location, description, secs, category, CDNumber, CDName, tracknum FROM sounds`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var r row
+		f := &r.fields
+		if err := rows.Scan(&r.id, &f[0], &f[1], &f[2], &f[3], &f[4], &f[5], &f[6]); err != nil {
+			rows.Close()
+			return err
+		}
+		sounds = append(sounds, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	schemaSql, err := soundsSchema("sounds_fts5", tokenizer)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DROP TABLE IF EXISTS sounds_fts5`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(schemaSql); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO sounds_fts5(rowid, location, description, secs, category, CDNumber, CDName, tracknum, folded)
+                                 VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range sounds {
+		f := r.fields
+		if _, err := stmt.Exec(r.id, f[0], f[1], f[2], f[3], f[4], f[5], f[6], foldText(f[1], f[3], f[5])); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DROP TABLE sounds`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`ALTER TABLE sounds_fts5 RENAME TO sounds`); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Migrated %d sounds", len(sounds))
+
+	return nil
+}
+
+// matchQuery returns the fts5 query of a full text query of the syntax of fts4, folded. Words
+// with characters fts5 doesn't take bare, like o'clock, are quoted and NEAR, or NEAR/n, between
+// words is written NEAR(words, n). The words and the phrases excluded with -, like rain -thunder,
+// are written rain NOT thunder, the only exclusion of fts5 and of the fts4 of the driver. Without
+// fts5 the query is only folded and its exclusions written with NOT. Malformed queries, like
+// those with unbalanced quotes, are left for sqlite to report
+func matchQuery(query string) string {
+	return rewriteQuery(foldQuery(query), hasFTS5())
+}
+
+// userMatchQuery returns the query of the fts4 indexes of the user data, the notes, the
+// descriptions and the translations. Their texts aren't folded, only the exclusions are
+// written with NOT, like matchQuery does without fts5
+func userMatchQuery(query string) string {
+	return rewriteQuery(query, false)
+}
+
+// rewriteQuery writes the exclusions of query with NOT and, for fts5, its words and NEARs as
+// matchQuery does
+func rewriteQuery(query string, fts5 bool) string {
+	var tokens []string
+	for i := 0; i < len(query); {
+		switch c := query[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := strings.IndexByte(query[i+1:], '"')
+			if end < 0 {
+				return query
+			}
+			phrase := query[i : i+end+2]
+			i += end + 2
+			if i < len(query) && query[i] == '*' {
+				phrase += "*"
+				i++
+			}
+			tokens = append(tokens, phrase)
+		default:
+			end := strings.IndexAny(query[i:], " \t\n()\"")
+			if end < 0 {
+				end = len(query) - i
+			}
+			w := query[i : i+end]
+			i += end
+			if strings.HasPrefix(w, "-") && excludes(tokens) && (len(w) > 1 || i < len(query) && query[i] == '"') {
+				// -word, or -"a phrase" that follows
+				tokens = append(tokens, "NOT")
+				if w = w[1:]; w == "" {
+					continue
+				}
+			}
+			if !fts5 {
+				tokens = append(tokens, w)
+			} else if t := matchWord(w); t != "" {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	if !fts5 {
+		return strings.Join(tokens, " ")
+	}
+
+	return strings.Join(nearGroups(tokens), " ")
+}
+
+// excludes reports whether a - after tokens excludes what follows, as it does after a word, a
+// phrase or a group. NOT is binary, a query can't start with an exclusion
+func excludes(tokens []string) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	switch t := tokens[len(tokens)-1]; {
+	case t == "(" || t == "AND" || t == "OR" || t == "NOT" || t == "NEAR" || strings.HasPrefix(t, "NEAR/"):
+		return false
+	case strings.HasSuffix(t, " :"):
+		return false
+	}
+
+	return true
+}
+
+// matchWord returns the fts5 token of a bare word of a query, "" if it has no letters or digits
+func matchWord(w string) string {
+	switch {
+	case w == "AND" || w == "OR" || w == "NOT" || w == "NEAR" || strings.HasPrefix(w, "NEAR/"):
+		return w
+	case strings.HasPrefix(w, "^"):
+		if t := matchWord(w[1:]); t != "" {
+			return "^" + t
+		}
+		return ""
+	}
+	if i := strings.IndexByte(w, ':'); i > 0 && isBareword(w[:i]) {
+		// a column filter, the word may be a phrase that follows
+		return w[:i] + " : " + matchWord(w[i+1:])
+	}
+
+	prefix := ""
+	if strings.HasSuffix(w, "*") {
+		w, prefix = strings.TrimSuffix(w, "*"), "*"
+	}
+	if strings.IndexFunc(w, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) < 0 {
+		return ""
+	}
+	if !isBareword(w) {
+		w = `"` + w + `"`
+	}
+
+	return w + prefix
+}
+
+// isBareword reports whether fts5 takes w as a word without quotes
+func isBareword(w string) bool {
+	for _, r := range w {
+		if r < 0x80 && !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+
+	return w != ""
+}
+
+// nearGroups replaces the words joined by NEAR, like a NEAR/3 b, with NEAR(a b, 3). fts4 and fts5
+// both default to 10 tokens apart. A NEAR that doesn't join words is a word
+func nearGroups(tokens []string) []string {
+	isOperand := func(t string) bool {
+		return t != "(" && t != ")" && t != "AND" && t != "OR" && t != "NOT" && t != "NEAR" &&
+			!strings.HasPrefix(t, "NEAR/") && !strings.HasSuffix(t, " :") && !strings.Contains(t, ": ")
+	}
+	distance := func(t string) (int, bool) {
+		if t == "NEAR" {
+			return 10, true
+		}
+		if !strings.HasPrefix(t, "NEAR/") {
+			return 0, false
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(t, "NEAR/"))
+		return n, err == nil && n >= 0
+	}
+
+	var out []string
+	for i := 0; i < len(tokens); i++ {
+		if _, ok := distance(tokens[i]); ok {
+			out = append(out, `"`+tokens[i]+`"`)
+			continue
+		}
+		if !isOperand(tokens[i]) || i+2 >= len(tokens) {
+			out = append(out, tokens[i])
+			continue
+		}
+		group := []string{tokens[i]}
+		n := 0
+		for i+2 < len(tokens) {
+			d, ok := distance(tokens[i+1])
+			if !ok || !isOperand(tokens[i+2]) {
+				break
+			}
+			group = append(group, tokens[i+2])
+			if d > n {
+				n = d
+			}
+			i += 2
+		}
+		if len(group) == 1 {
+			out = append(out, tokens[i])
+			continue
+		}
+		out = append(out, fmt.Sprintf("NEAR(%s, %d)", strings.Join(group, " "), n))
+	}
+
+	return out
+}
+
+// highlights returns the sql of the columns of the index with the tokens that matched a query
+// between matchOn and matchOff. fts4 has no highlight(), its snippet() of the whole column is
+// used, which is the column for texts of up to 64 tokens
+func highlights(columns []string) string {
+	var hs []string
+	for i := range columns {
+		if hasFTS5() {
+			hs = append(hs, fmt.Sprintf("coalesce(highlight(sounds, %d, char(1), char(2)), '')", i))
+		} else {
+			hs = append(hs, fmt.Sprintf("coalesce(snippet(sounds, char(1), char(2), '', %d, 64), '')", i))
+		}
+	}
+
+	return strings.Join(hs, ", ")
+}
+
+// snippetSQL returns the sql of the snippet of column of the index, of up to 64 tokens, with
+// the tokens that matched between the two arguments that follow and ellipsis where it is cut.
+// fts4 and fts5 take the arguments of snippet() in another order
+func snippetSQL(column int, ellipsis string) string {
+	if !hasFTS5() {
+		return fmt.Sprintf("snippet(sounds, ?, ?, '%s', %d, 64)", ellipsis, column)
+	}
+
+	return fmt.Sprintf("snippet(sounds, %d, ?, ?, '%s', 64)", column, ellipsis)
+}
+
+// matchedTokens returns the tokens between the markers of a column of highlights
+func matchedTokens(highlighted string) []string {
+	var tokens []string
+	for _, s := range strings.Split(highlighted, matchOn)[1:] {
+		if i := strings.Index(s, matchOff); i >= 0 {
+			tokens = append(tokens, strings.FieldsFunc(s[:i], func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+			})...)
+		}
+	}
+
+	return tokens
+}
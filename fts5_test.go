@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestMatchQuery(t *testing.T) {
+	tests := []struct {
+		query      string
+		fts5, fts4 string
+	}{
+		{"rain", "rain", "rain"},
+		{"café", "cafe", "cafe"},
+		{"rain -thunder", "rain NOT thunder", "rain NOT thunder"},
+		{`rain -"heavy rain"`, `rain NOT "heavy rain"`, `rain NOT "heavy rain"`},
+		{"(rain OR snow) -wind", "( rain OR snow ) NOT wind", "( rain OR snow ) NOT wind"},
+		{"description:rain -roof", "description : rain NOT roof", "description:rain NOT roof"},
+		{"o'clock", `"o'clock"`, "o'clock"},
+		{"a-b", `"a-b"`, "a-b"},
+		{"rain NEAR thunder", "NEAR(rain thunder, 10)", "rain NEAR thunder"},
+		{"rain NEAR/3 thunder NEAR/5 roof", "NEAR(rain thunder roof, 5)", "rain NEAR/3 thunder NEAR/5 roof"},
+		{"category:weather", "category : weather", "category:weather"},
+		{"bird*", "bird*", "bird*"},
+		{`"dawn chorus"*`, `"dawn chorus"*`, `"dawn chorus"*`},
+		{`unbalanced "quote`, `unbalanced "quote`, `unbalanced "quote`},
+	}
+	for _, tt := range tests {
+		if got := rewriteQuery(foldQuery(tt.query), true); got != tt.fts5 {
+			t.Errorf("fts5 %q: got %q, expected %q", tt.query, got, tt.fts5)
+		}
+		if got := rewriteQuery(foldQuery(tt.query), false); got != tt.fts4 {
+			t.Errorf("fts4 %q: got %q, expected %q", tt.query, got, tt.fts4)
+		}
+		want := tt.fts4
+		if hasFTS5() {
+			want = tt.fts5
+		}
+		if got := matchQuery(tt.query); got != want {
+			t.Errorf("matchQuery(%q) = %q, expected %q", tt.query, got, want)
+		}
+	}
+}
+
+func TestUserMatchQuery(t *testing.T) {
+	tests := []struct {
+		query, want string
+	}{
+		{"rain -thunder", "rain NOT thunder"},
+		{`rain -"heavy rain"`, `rain NOT "heavy rain"`},
+		{"rain -thunder -wind", "rain NOT thunder NOT wind"},
+		{"(rain OR snow) -wind", "( rain OR snow ) NOT wind"},
+		{"café -bar", "café NOT bar"}, // the notes aren't folded
+		// a - that excludes nothing is kept
+		{"-rain", "-rain"},
+		{"rain OR -thunder", "rain OR -thunder"},
+		{"rain - thunder", "rain - thunder"},
+		{"a-b", "a-b"},
+	}
+	for _, tt := range tests {
+		if got := userMatchQuery(tt.query); got != tt.want {
+			t.Errorf("userMatchQuery(%q) = %q, expected %q", tt.query, got, tt.want)
+		}
+	}
+}
@@ -1,5 +1,5 @@
 module github.com/anastasop/thames
 
-go 1.14
+go 1.17
 
 require github.com/mattn/go-sqlite3 v2.0.3+incompatible
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var playerName = flag.String("player", "native", "Play the sounds with `player`: native, exec:play for the play of sox, or null to play nothing, for testing")
+
+// The pieces of the test harness, a fake CDN, an index in memory and the null player, are
+// part of thames so that the wrapper scripts of users can test against them too
+
+// runPlayer plays the sounds of in, and first those of first, with the player of --player
+func runPlayer(ctx context.Context, in, first <-chan sound, auto *automation, skips *skipSet) {
+	if *playerName == "null" {
+		mockPlayer(ctx, in, first, auto, skips)
+	} else {
+		realPlayer(ctx, in, first, auto, skips)
+	}
+}
+
+// fakeCDN serves a tiny wav of silence for any path ending in .wav. With failRate it
+// fails that fraction of the requests, to test the error paths
+func fakeCDN(failRate float64) http.Handler {
+	wav := tinyWAV()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, ".wav") {
+			http.NotFound(w, r)
+			return
+		}
+		if rand.Float64() < failRate {
+			http.Error(w, "fake failure", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, filepath.Base(r.URL.Path), time.Time{}, bytes.NewReader(wav))
+	})
+}
+
+// tinyWAV returns a wav of 0.1s of silence, in the format of the archive
+func tinyWAV() []byte {
+	frames := streamRate / 10
+	h := wavHeader()
+	binary.LittleEndian.PutUint32(h[4:], uint32(36+frames*frameSize))
+	binary.LittleEndian.PutUint32(h[40:], uint32(frames*frameSize))
+
+	return append(h, make([]byte, frames*frameSize)...)
+}
+
+// fakeCDNCommand implements the fake-cdn command
+func fakeCDNCommand(args []string) error {
+	fs := flag.NewFlagSet("fake-cdn", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8090", "Serve at `addr`")
+	failRate := fs.Float64("fail", 0, "Fail this `fraction` of the requests")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames fake-cdn [--addr addr] [--fail fraction]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	log.Printf("Fake CDN at http://%s/", *addr)
+
+	return http.ListenAndServe(*addr, fakeCDN(*failRate))
+}
+
+// selftestCSV is the index of the self test, in the format of the BBC csv
+const selftestCSV = `"location","description","secs","category","CDNumber","CD Name","tracknumber"
+"10000001.wav","Heavy rain on a tin roof","60","Weather: Rain","EC001","Weather","1"
+"10000002.wav","Light rain in a garden","45","Weather: Rain","EC001","Weather","2"
+"10000003.wav","Rain and distant thunder","90","Weather: Rain","EC001","Weather","3"
+"10000004.wav","Busy cafe with chatter","120","Atmosphere: Cafe","EC002","Atmospheres","1"
+"10000005.wav","Quiet cafe, clinks of cups","80","Atmosphere: Cafe","EC002","Atmospheres","2"
+"10000006.wav","Typewriter, fast typing","30","Office","EC003","Office","1"
+`
+
+// openMemoryDatabase returns an index in memory, created from the csv
+func openMemoryDatabase(name, csv string) (*sql.DB, error) {
+	db, err := sql.Open(sqliteDriver, "file:"+name+"?mode=memory&cache=shared&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if err := createIndex(db, strings.NewReader(csv)); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrateFiles(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrateUser(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// testPipeline returns the pipeline of the self test: the sounds of db are fetched from the
+// fake CDN at url into the cache dir and played by the null player, up to 30 of each query
+func testPipeline(db *sql.DB, url, dir string) *pipeline {
+	return &pipeline{db: db, sources: []source{newHTTPSource(url)}, soundsDir: dir, play: mockPlayer, nsounds: 30}
+}
+
+// selftestCommand implements the selftest command. It plays sessions end to end, against
+// the fake CDN, an index in memory and the null player, and checks what was played and cached
+func selftestCommand(args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames selftest\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	dir, err := ioutil.TempDir("", "thames-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	cdn := httptest.NewServer(fakeCDN(0))
+	defer cdn.Close()
+
+	db, err := openMemoryDatabase("selftest", selftestCSV)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	p := testPipeline(db, cdn.URL, filepath.Join(dir, "sounds"))
+	sel := newSelection(db)
+	checks := []struct {
+		name    string
+		queries []string
+		mix     bool
+		played  int
+	}{
+		{"sequential", []string{"rain", "typewriter"}, false, 4},
+		{"mix", []string{"rain", "cafe"}, true, 5},
+		{"group", []string{"(cafe typewriter)"}, false, 3},
+		{"no match", []string{"elephant"}, false, 0},
+	}
+
+	failed := 0
+	for _, c := range checks {
+		groups := parseGroups(c.queries)
+		autos := make(map[string]*automation)
+		if c.mix {
+			for _, g := range groups {
+				autos[g.name] = &automation{gain: 1}
+			}
+		}
+
+		before := atomic.LoadInt64(&played)
+		playSession(context.Background(), p, sel, groups, autos, c.mix, nil, nil)
+		n := int(atomic.LoadInt64(&played) - before)
+
+		if n != c.played {
+			fmt.Printf("FAIL %s: played %d sounds, expected %d\n", c.name, n, c.played)
+			failed++
+		} else {
+			fmt.Printf("ok   %s: played %d sounds\n", c.name, n)
+		}
+	}
+
+	// everything that played was fetched into the cache and recorded in the index
+	var cached int
+	if err := db.QueryRow(`SELECT count(*) FROM files WHERE cached = 1`).Scan(&cached); err != nil {
+		return err
+	}
+	entries, _ := ioutil.ReadDir(p.soundsDir)
+	if cached != 6 || len(entries) != 6 {
+		fmt.Printf("FAIL cache: %d files, %d recorded as cached, expected 6\n", len(entries), cached)
+		failed++
+	} else {
+		fmt.Printf("ok   cache: %d files\n", len(entries))
+	}
+
+	if s := pipelineErrors.summary(); s != "" {
+		fmt.Printf("FAIL %s\n", s)
+		failed++
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks of the self test failed", failed)
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var maxGoroutines = flag.Int("max-goroutines", 2000, "With serve, report a leak when more than `n` goroutines run")
+
+// The daemon runs for months, so it checks itself for leaks: the goroutines, the open files,
+// the memory and how full the queues are. A queue that stays full is a component that
+// stopped consuming it
+
+const (
+	healthInterval = time.Minute
+	maxSessions    = 16 // the sessions of the daemon, each has its own queues and players
+)
+
+// health is a sample of the resources of the process
+type health struct {
+	goroutines int
+	fds        int // open files, -1 if unknown
+	maxFDs     int // the limit of open files, 0 if unknown
+	heap       uint64
+	queues     []queueDepth
+}
+
+// queueDepth is the number of items of a queue and its capacity
+type queueDepth struct {
+	name     string
+	len, cap int
+}
+
+func (q queueDepth) full() bool {
+	return q.cap > 0 && q.len >= q.cap
+}
+
+// sampleHealth samples the resources of the process and the queues of the daemon
+func (d *daemon) sampleHealth() health {
+	h := health{goroutines: runtime.NumGoroutine(), fds: -1}
+	if fds, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+		h.fds = len(fds)
+	}
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err == nil {
+		h.maxFDs = int(rlim.Cur)
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	h.heap = mem.HeapInuse
+
+	h.queues = append(h.queues, queueDepth{"errors", len(pipelineErrors.c), cap(pipelineErrors.c)})
+	if playScrobbler != nil {
+		h.queues = append(h.queues, queueDepth{"scrobbles", len(playScrobbler.listens), cap(playScrobbler.listens)})
+	}
+	d.mu.Lock()
+	for name, s := range d.sessions {
+		s.ctl.Lock()
+		if s.ctl.requests != nil {
+			h.queues = append(h.queues, queueDepth{name + " requests", len(s.ctl.requests.c), cap(s.ctl.requests.c)})
+		}
+		if s.ctl.oneshots != nil {
+			h.queues = append(h.queues, queueDepth{name + " oneshots", len(s.ctl.oneshots.c), cap(s.ctl.oneshots.c)})
+		}
+		s.ctl.Unlock()
+	}
+	d.mu.Unlock()
+	for _, p := range activePlugins {
+		h.queues = append(h.queues, queueDepth{"plugin " + p.name, len(p.commands), cap(p.commands)})
+	}
+	sort.Slice(h.queues, func(i, j int) bool { return h.queues[i].name < h.queues[j].name })
+
+	return h
+}
+
+// String is the reply of the health command, a line for each measure
+func (h health) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "goroutines %d\n", h.goroutines)
+	if h.fds >= 0 {
+		fmt.Fprintf(&b, "fds %d of %d\n", h.fds, h.maxFDs)
+	}
+	fmt.Fprintf(&b, "heap %s\n", formatBytes(int64(h.heap)))
+	for _, q := range h.queues {
+		fmt.Fprintf(&b, "queue %s %d of %d\n", q.name, q.len, q.cap)
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// problems returns what is wrong in h. Queues are wrong when they were full in the sample
+// before too
+func (h health) problems(last health) []string {
+	var probs []string
+	if h.goroutines > *maxGoroutines {
+		probs = append(probs, fmt.Sprintf("%d goroutines, more than --max-goroutines %d", h.goroutines, *maxGoroutines))
+	}
+	if h.fds >= 0 && h.maxFDs > 0 && h.fds > h.maxFDs*8/10 {
+		probs = append(probs, fmt.Sprintf("%d open files of at most %d", h.fds, h.maxFDs))
+	}
+	for _, q := range h.queues {
+		if !q.full() {
+			continue
+		}
+		for _, lq := range last.queues {
+			if lq.name == q.name && lq.full() {
+				probs = append(probs, fmt.Sprintf("the %s queue is full for %s", q.name, healthInterval))
+			}
+		}
+	}
+
+	return probs
+}
+
+// checkHealth samples the health of the daemon every minute until ctx is done, and reports
+// its problems
+func (d *daemon) checkHealth(ctx context.Context) {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+
+	var last health
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		h := d.sampleHealth()
+		for _, p := range h.problems(last) {
+			log.Printf("Error:Health: %s", p)
+			pipelineErrors.report("health", "", fmt.Errorf("%s", p))
+		}
+		last = h
+	}
+}
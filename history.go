@@ -0,0 +1,61 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// historySchema is the table of the sounds played, for smart playlists and reports
+const historySchema = `CREATE TABLE IF NOT EXISTS plays(
+                         location TEXT NOT NULL,
+                         query TEXT NOT NULL,
+                         preset TEXT NOT NULL DEFAULT '',
+                         at INTEGER NOT NULL,   -- unix time the sound started
+                         secs INTEGER NOT NULL  -- how long it played
+                       );
+                       CREATE INDEX IF NOT EXISTS plays_location ON plays(location, at);
+                       CREATE INDEX IF NOT EXISTS plays_at ON plays(at)`
+
+// history records the sounds the players play
+type history struct {
+	db *sql.DB
+
+	mu     sync.Mutex
+	preset string // of the session playing
+}
+
+// playHistory is the history of the session, nil when it is not recorded, like in the selftest
+var playHistory *history
+
+func newHistory(db *sql.DB) *history {
+	return &history{db: db}
+}
+
+// setPreset records that the sounds played from now on are of the preset
+func (h *history) setPreset(fpath string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.preset = fpath
+}
+
+// record records that snd played from start until now
+func (h *history) record(snd sound, start time.Time) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	preset := h.preset
+	h.mu.Unlock()
+
+	secs := int(time.Since(start).Round(time.Second) / time.Second)
+	if _, err := h.db.Exec(`INSERT INTO plays(location, query, preset, at, secs) VALUES(?, ?, ?, ?, ?)`,
+		snd.fname, snd.query, preset, start.Unix(), secs); err != nil {
+		log.Printf("Error:History: %v", err)
+	}
+}
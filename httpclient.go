@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var fetchParallel = flag.Int("parallel", 4, "Fetch up to `n` sounds at once from each host, with fetch")
+
+var (
+	fetchClientOnce sync.Once
+	fetchClient     *http.Client
+)
+
+// httpClient returns the http client of the sources, shared by all of them. Its connections
+// are kept alive and reused from sound to sound, over HTTP/2 where the servers speak it, and
+// dialed over IPv6 or IPv4, whichever connects first
+func httpClient() *http.Client {
+	fetchClientOnce.Do(func() {
+		idle := *fetchParallel
+		if idle < 2 {
+			idle = 2
+		}
+		fetchClient = &http.Client{
+			Timeout: 5 * time.Minute,
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: (&net.Dialer{
+					Timeout:   30 * time.Second,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				ForceAttemptHTTP2:     true,
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   idle,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ExpectContinueTimeout: time.Second,
+			},
+		}
+	})
+
+	return fetchClient
+}
+
+// hostSlots limits the requests in flight to each host to --parallel
+var hostSlots = struct {
+	sync.Mutex
+	slots map[string]chan bool
+}{slots: make(map[string]chan bool)}
+
+// acquireHost waits for a free slot of the host of rawurl and returns the function that frees it
+func acquireHost(rawurl string) func() {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return func() {}
+	}
+
+	hostSlots.Lock()
+	slots, ok := hostSlots.slots[u.Host]
+	if !ok {
+		n := *fetchParallel
+		if n < 1 {
+			n = 1
+		}
+		slots = make(chan bool, n)
+		hostSlots.slots[u.Host] = slots
+	}
+	hostSlots.Unlock()
+
+	slots <- true
+
+	return func() {
+		<-slots
+	}
+}
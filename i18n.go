@@ -0,0 +1,76 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The messages for people, the usage, the errors of the flags and the labels of --browse,
+// are translated with the catalog of the locale of the environment, from $LC_ALL,
+// $LC_MESSAGES or $LANG. A catalog is locales/<lang>.json, like locales/el.json, and maps
+// each message in English to its translation. The logs aren't translated, other programs
+// read them. go run ./tools/messages <lang> adds the messages of the source that the catalog
+// is missing, for translators to fill in
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+var (
+	catalogOnce sync.Once
+	catalog     map[string]string
+)
+
+// tr returns the translation of msg for the locale, msg itself if there is none. Formats
+// keep their verbs, in the same order
+func tr(msg string) string {
+	catalogOnce.Do(loadCatalog)
+	if t := catalog[msg]; t != "" {
+		return t
+	}
+
+	return msg
+}
+
+// loadCatalog loads the catalog of the most specific language of the locale, like el_GR
+// before el
+func loadCatalog() {
+	for _, lang := range localeLanguages() {
+		data, err := localeFiles.ReadFile("locales/" + lang + ".json")
+		if err != nil {
+			continue
+		}
+		var c map[string]string
+		if err := json.Unmarshal(data, &c); err == nil {
+			catalog = c
+			return
+		}
+	}
+}
+
+// localeLanguages are the languages of the locale of the environment, from the most specific,
+// none for the C locale
+func localeLanguages() []string {
+	var locale string
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if locale = os.Getenv(name); locale != "" {
+			break
+		}
+	}
+	// language_TERRITORY.codeset@modifier
+	if i := strings.IndexAny(locale, ".@"); i >= 0 {
+		locale = locale[:i]
+	}
+	if locale == "" || locale == "C" || locale == "POSIX" {
+		return nil
+	}
+
+	langs := []string{locale}
+	if i := strings.Index(locale, "_"); i > 0 {
+		langs = append(langs, locale[:i])
+	}
+
+	return langs
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxSkippedReport is the number of skipped rows whose errors are logged one by one
+const maxSkippedReport = 20
+
+// csvColumn is a column of the index and the names it may have in the header of a csv.
+// Names are compared ignoring case, spaces, underscores and dashes
+type csvColumn struct {
+	name     string
+	aliases  []string
+	required bool
+}
+
+// csvColumns are the columns of the index in the order of the sounds table, the size and
+// the archival context of the newer editions, see extrasSchema
+var csvColumns = []csvColumn{
+	{"location", []string{"location", "filename", "file"}, true},
+	{"description", []string{"description", "desc", "title"}, true},
+	{"secs", []string{"secs", "seconds", "duration"}, false},
+	{"category", []string{"category", "categories"}, false},
+	{"CDNumber", []string{"cdnumber", "cd"}, false},
+	{"CDName", []string{"cdname", "cdtitle", "album"}, false},
+	{"tracknum", []string{"tracknum", "tracknumber", "track"}, false},
+	{"size", []string{"size", "bytes", "filesize"}, false},
+	{"recordist", []string{"recordist", "recordedby", "recorder"}, false},
+	{"place", []string{"recordinglocation", "recordedat", "place", "geolocation"}, false},
+	{"recorded", []string{"recordingdate", "daterecorded", "recorded", "date"}, false},
+	{"notes", []string{"recordistnotes", "recordingnotes", "notes"}, false},
+}
+
+// soundRow is a record of the csv, with its fields in the order of csvColumns
+type soundRow [12]string
+
+func (row *soundRow) location() string { return row[0] }
+func (row *soundRow) size() string     { return row[7] }
+
+// extras are the fields of the archival context, empty for the older editions
+func (row *soundRow) extras() []string { return row[8:12] }
+
+func normalizeColumn(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '_', '-':
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, strings.TrimSpace(name))
+}
+
+// mapColumns returns the field of each of csvColumns in the header, -1 for the missing ones
+func mapColumns(header []string) ([]int, error) {
+	fields := make([]int, len(csvColumns))
+	var missing []string
+	for i, col := range csvColumns {
+		fields[i] = -1
+		for j, name := range header {
+			n := normalizeColumn(name)
+			for _, alias := range col.aliases {
+				if n == alias {
+					fields[i] = j
+				}
+			}
+			if fields[i] >= 0 {
+				break
+			}
+		}
+		if fields[i] < 0 && col.required {
+			missing = append(missing, col.name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("csv: missing required columns %s, the header has %s",
+			strings.Join(missing, ", "), strings.Join(header, ", "))
+	}
+
+	return fields, nil
+}
+
+// csvReport is the validation report of a csv
+type csvReport struct {
+	rows     int  // records after the header
+	valid    int  // records that can be indexed
+	repaired int  // records with unquoted commas in the description, joined back
+	bom      bool // the csv starts with a byte order mark, which is ignored
+	skipped  []csvProblem
+}
+
+// csvProblem is a row of the csv that can't be indexed
+type csvProblem struct {
+	line int
+	err  error
+}
+
+// soundsCSV reads the sound records of a csv a record at a time, so even the big csv of the
+// remastered archive needs little memory. It tolerates the usual flaws of exported csvs,
+// a byte order mark, stray quotes and unquoted commas in the descriptions, and skips the
+// rows it can't make sense of
+type soundsCSV struct {
+	r      *csv.Reader
+	header []string
+	fields []int // of csvColumns in the records
+	report csvReport
+}
+
+// newSoundsCSV reads the header of the csv
+func newSoundsCSV(in io.Reader) (*soundsCSV, error) {
+	c := new(soundsCSV)
+
+	br := bufio.NewReader(in)
+	if bom, err := br.Peek(3); err == nil && string(bom) == "\xEF\xBB\xBF" {
+		br.Discard(3)
+		c.report.bom = true
+	}
+
+	c.r = csv.NewReader(br)
+	c.r.LazyQuotes = true
+	c.r.FieldsPerRecord = -1
+
+	header, err := c.r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("csv header: %v", err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+	c.header = header
+	if c.fields, err = mapColumns(header); err != nil {
+		return nil, err
+	}
+	c.r.ReuseRecord = true
+
+	return c, nil
+}
+
+// next returns the next valid record, or io.EOF after the last
+func (c *soundsCSV) next() (*soundRow, error) {
+	for {
+		record, err := c.r.Read()
+		if err == io.EOF {
+			return nil, err
+		}
+		if perr, ok := err.(*csv.ParseError); ok {
+			c.report.rows++
+			c.report.skipped = append(c.report.skipped, csvProblem{perr.StartLine, perr.Err})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		c.report.rows++
+		line, _ := c.r.FieldPos(0)
+
+		// commas in an unquoted description split it in more fields
+		if extra := len(record) - len(c.header); extra > 0 {
+			d := c.fields[1]
+			record[d] = strings.Join(record[d:d+1+extra], ",")
+			record = append(record[:d+1], record[d+1+extra:]...)
+			c.report.repaired++
+		}
+		if len(record) < len(c.header) {
+			c.report.skipped = append(c.report.skipped, csvProblem{line, fmt.Errorf("%d fields, expected %d", len(record), len(c.header))})
+			continue
+		}
+
+		var row soundRow
+		for i, f := range c.fields {
+			if f >= 0 {
+				row[i] = strings.TrimSpace(record[f])
+			}
+		}
+		if i := c.fields[1]; i >= 0 {
+			// descriptions keep their spacing
+			row[1] = record[i]
+		}
+		if err := validateRow(&row); err != nil {
+			c.report.skipped = append(c.report.skipped, csvProblem{line, err})
+			continue
+		}
+		c.report.valid++
+
+		return &row, nil
+	}
+}
+
+// validateRow checks a record of the csv before indexing it. Durations are optional
+func validateRow(row *soundRow) error {
+	if row.location() == "" {
+		return fmt.Errorf("no location")
+	}
+	if row[2] == "" {
+		row[2] = "0"
+	} else if _, err := strconv.Atoi(row[2]); err != nil {
+		return fmt.Errorf("secs %q is not a number", row[2])
+	}
+
+	return nil
+}
+
+// log logs the summary of the report and the first skipped rows
+func (report csvReport) log() {
+	for i, p := range report.skipped {
+		if i == maxSkippedReport {
+			log.Printf("Skipped: %d more rows", len(report.skipped)-maxSkippedReport)
+			break
+		}
+		log.Printf("Skipped: line %d: %v", p.line, p.err)
+	}
+	if report.repaired > 0 {
+		log.Printf("Repaired %d rows with unquoted commas", report.repaired)
+	}
+	log.Printf("Indexed %d sounds, skipped %d rows", report.valid, len(report.skipped))
+}
+
+// createIndex creates the schema and fills the tables with the sound records of the csv.
+// An existing sounds table is replaced, the files table is kept. Without fts5 it logs that
+// the index is an fts4 table, once for the index and not on every run
+func createIndex(db *sql.DB, csvReader io.Reader) error {
+	schemaSql, err := soundsSchema("sounds", *tokenizer)
+	if err != nil {
+		return err
+	}
+	if !hasFTS5() {
+		log.Printf("Index: the sqlite of thames has no fts5, the index is an fts4 table and the sounds can't be ordered by relevance. Build thames with go build -tags sqlite_fts5 for them")
+	}
+
+	c, err := newSoundsCSV(csvReader)
+	if err != nil {
+		return err
+	}
+
+	// a single transaction is much faster than a commit for every sound, and a failed
+	// reindex leaves the old index in place
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DROP TABLE IF EXISTS sounds`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(schemaSql); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(filesSchema); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DROP TABLE IF EXISTS extras`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(extrasSchema); err != nil {
+		return err
+	}
+
+	insertSql := `INSERT INTO sounds(location, description, secs, category, CDNumber, CDName, tracknum, folded) VALUES(?, ?, ?, ?, ?, ?, ?, ?);`
+	stmt, err := tx.Prepare(insertSql)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for {
+		row, err := c.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if _, err := stmt.Exec(row[0], row[1], row[2], row[3], row[4], row[5], row[6], foldText(row[1], row[3], row[5])); err != nil {
+			return err
+		}
+		// newer editions of the csv also have the sizes of the files
+		if size, err := strconv.ParseInt(row.size(), 10, 64); err == nil && size > 0 {
+			if err := recordSize(tx, row.location(), size); err != nil {
+				return err
+			}
+		}
+		if err := recordExtras(tx, row.location(), row.extras()); err != nil {
+			return err
+		}
+	}
+	if err := indexPlaces(tx); err != nil {
+		return err
+	}
+	if err := indexEras(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	c.report.log()
+
+	return nil
+}
+
+// checkCSVCommand implements the check-csv command. It validates a csv without indexing it
+func checkCSVCommand(args []string) error {
+	fs := flag.NewFlagSet("check-csv", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames check-csv [file]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return errUsage
+	}
+	fpath := csvFile
+	if fs.NArg() == 1 {
+		fpath = fs.Arg(0)
+	}
+
+	fin, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+
+	c, err := newSoundsCSV(fin)
+	if err != nil {
+		return err
+	}
+	for {
+		if _, err := c.next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	r := c.report
+	fmt.Printf("%s: %d columns: %s\n", fpath, len(c.header), strings.Join(c.header, ", "))
+	for i, col := range csvColumns {
+		if f := c.fields[i]; f >= 0 {
+			fmt.Printf("%s from column %d, %s\n", col.name, f+1, c.header[f])
+		} else {
+			fmt.Printf("%s missing\n", col.name)
+		}
+	}
+	if r.bom {
+		fmt.Printf("byte order mark, ignored\n")
+	}
+	fmt.Printf("%d rows, %d valid, %d repaired, %d skipped\n", r.rows, r.valid, r.repaired, len(r.skipped))
+	for _, p := range r.skipped {
+		fmt.Printf("line %d: %v\n", p.line, p.err)
+	}
+	if len(r.skipped) > 0 {
+		return fmt.Errorf("%d rows of %s can't be indexed", len(r.skipped), fpath)
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMapColumns(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		fields []int // of csvColumns, nil if the header is rejected
+	}{
+		{"archive", "location,description,secs,category,CDNumber,CD Name,tracknumber",
+			[]int{0, 1, 2, 3, 4, 5, 6, -1, -1, -1, -1, -1}},
+		{"aliases", "File Name,Title,Duration,Categories,CD,Album,Track,File_Size",
+			[]int{0, 1, 2, 3, 4, 5, 6, 7, -1, -1, -1, -1}},
+		{"any order", "secs,description,location", []int{2, 1, 0, -1, -1, -1, -1, -1, -1, -1, -1, -1}},
+		{"first of the names", "location,description,file,desc", []int{0, 1, -1, -1, -1, -1, -1, -1, -1, -1, -1, -1}},
+		{"context", "location,description,Recordist,Recording Location,Recording Date,Recordist Notes",
+			[]int{0, 1, -1, -1, -1, -1, -1, -1, 2, 3, 4, 5}},
+		{"no description", "location,secs,category", nil},
+		{"no location", "description,secs", nil},
+	}
+	for _, tt := range tests {
+		fields, err := mapColumns(strings.Split(tt.header, ","))
+		if tt.fields == nil {
+			if err == nil {
+				t.Errorf("%s: accepted %q", tt.name, tt.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("%s: fields %v, expected %v", tt.name, fields, tt.fields)
+		}
+	}
+}
+
+func TestSoundsCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		rows    []soundRow
+		skipped int
+	}{
+		{"reordered", "description,secs,location\n\"Rain, heavy\",60,1.wav\n",
+			[]soundRow{{0: "1.wav", 1: "Rain, heavy", 2: "60"}}, 0},
+		{"bom", "\xEF\xBB\xBFlocation,description\n1.wav,Rain\n", []soundRow{{0: "1.wav", 1: "Rain", 2: "0"}}, 0},
+		{"unquoted commas", "location,description,secs\n1.wav,Rain, wind, thunder,60\n",
+			[]soundRow{{0: "1.wav", 1: "Rain, wind, thunder", 2: "60"}}, 0},
+		{"spacing", "location,description\n 1.wav ,  Rain  \n", []soundRow{{0: "1.wav", 1: "  Rain  ", 2: "0"}}, 0},
+		{"bad rows", "location,description,secs\n,Rain,60\n2.wav,Wind,long\n3.wav\n4.wav,Snow,5\n",
+			[]soundRow{{0: "4.wav", 1: "Snow", 2: "5"}}, 3},
+		{"context", "location,description,recordist,place,date,notes\n1.wav,Rain,Ann,Oxford,1970,at dawn\n",
+			[]soundRow{{0: "1.wav", 1: "Rain", 2: "0", 8: "Ann", 9: "Oxford", 10: "1970", 11: "at dawn"}}, 0},
+	}
+	for _, tt := range tests {
+		c, err := newSoundsCSV(strings.NewReader(tt.csv))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var rows []soundRow
+		for {
+			row, err := c.next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			rows = append(rows, *row)
+		}
+		if !reflect.DeepEqual(rows, tt.rows) {
+			t.Errorf("%s: rows %q, expected %q", tt.name, rows, tt.rows)
+		}
+		if len(c.report.skipped) != tt.skipped {
+			t.Errorf("%s: skipped %v, expected %d rows", tt.name, c.report.skipped, tt.skipped)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// extrasSchema is the table with the archival context of the sounds that the newer editions of
+// the csv have: who recorded them, where, when and their notes. The sounds of the older
+// editions have no row
+const extrasSchema = `CREATE TABLE IF NOT EXISTS extras(
+                        location TEXT PRIMARY KEY,
+                        recordist TEXT NOT NULL DEFAULT '',
+                        place TEXT NOT NULL DEFAULT '',
+                        recorded TEXT NOT NULL DEFAULT '',   -- as the csv has it, a year or a date
+                        notes TEXT NOT NULL DEFAULT ''
+                      )`
+
+// recordExtras records the archival context of the sound at fname, extras in the order of
+// the table, if it has any
+func recordExtras(db execer, fname string, extras []string) error {
+	if strings.Join(extras, "") == "" {
+		return nil
+	}
+	_, err := db.Exec(`INSERT OR REPLACE INTO extras(location, recordist, place, recorded, notes) VALUES(?, ?, ?, ?, ?)`,
+		fname, extras[0], extras[1], extras[2], extras[3])
+
+	return err
+}
+
+// story is the archival context of a sound on a line, like
+// recorded by J. Smith, Thames Estuary, 1968: low tide. Empty if there is none
+func (m soundMeta) story() string {
+	var parts []string
+	if m.recordist != "" {
+		parts = append(parts, "recorded by "+m.recordist)
+	}
+	for _, p := range []string{m.place, m.recorded} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	s := strings.Join(parts, ", ")
+	if m.notes != "" {
+		if s != "" {
+			s += ": "
+		}
+		s += m.notes
+	}
+
+	return s
+}
+
+// infoCommand implements the info command. It prints all that is known about sounds: the
+// metadata of the index, the archival context, the places and the eras, the audio and the user metadata
+func infoCommand(args []string) error {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames info location...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	sounds, err := lookupSounds(ctx, db, fs.Args(), soundsDir)
+	if err != nil {
+		return err
+	}
+	meta, err := readMetadata(ctx, db, sounds)
+	if err != nil {
+		return err
+	}
+	locations := make([]string, len(sounds))
+	for i, snd := range sounds {
+		locations[i] = snd.fname
+	}
+	user, err := readUserMeta(ctx, db, locations)
+	if err != nil {
+		return err
+	}
+	places, err := readPlaces(db, locations)
+	if err != nil {
+		return err
+	}
+	eras, err := readEras(db, locations)
+	if err != nil {
+		return err
+	}
+
+	for i, snd := range sounds {
+		if i > 0 {
+			fmt.Println()
+		}
+		m, u := meta[snd.fname], user[snd.fname]
+		field := func(name, value string) {
+			if value != "" {
+				fmt.Printf("  %-10s %s\n", name+":", value)
+			}
+		}
+		fmt.Printf("%s: %s\n", snd.fname, snd.descr)
+		if u.description != "" {
+			field("archive", m.description)
+		}
+		field("duration", (time.Duration(snd.secs) * time.Second).String())
+		field("category", m.category)
+		field("cd", strings.TrimSpace(m.cdNumber+" "+m.cdName))
+		field("track", m.tracknum)
+		field("recordist", m.recordist)
+		field("place", m.place)
+		field("recorded", m.recorded)
+		field("notes", m.notes)
+		field("places", strings.Join(places[snd.fname], ", "))
+		var years []string
+		for _, e := range eras[snd.fname] {
+			years = append(years, e.String())
+		}
+		field("eras", strings.Join(years, ", "))
+		if m.audio.format != "" {
+			field("audio", m.audio.String())
+		}
+		if m.size > 0 {
+			field("size", fmt.Sprintf("%d bytes", m.size))
+		}
+		if p, exists, _ := cachedPath(soundsDir, snd.fname); exists {
+			field("cached", p)
+		} else {
+			field("cached", "no")
+		}
+		field("tags", strings.Join(u.tags, ", "))
+		if u.rating > 0 {
+			field("rating", fmt.Sprintf("%d", u.rating))
+		}
+		field("note", u.note)
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// In a session Ctrl-C skips the sounds that play, like the next button of a player, and a
+// second Ctrl-C soon after stops the session: the selections and the downloads in flight
+// are cancelled, their partial files removed, the players stopped and thames exits as it
+// does at the end, saving the history. SIGTERM stops the session at once. Once stopping,
+// Ctrl-C is the default again and exits without waiting
+
+// interruptWindow is how soon after a Ctrl-C another one stops the session
+const interruptWindow = 2 * time.Second
+
+// runDetached runs cmd in a process group of its own, so that Ctrl-C on the terminal is for
+// thames alone, and kills the group when ctx is done
+func runDetached(ctx context.Context, cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// handleInterrupts handles Ctrl-C and SIGTERM for the sessions of ctl until ctx is done. To
+// stop, it stops the session and calls cancel, which ends ctx
+func handleInterrupts(ctx context.Context, ctl *controls, cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	var last time.Time
+	for {
+		select {
+		case sig := <-sigs:
+			switch {
+			case sig == syscall.SIGTERM || time.Since(last) < interruptWindow:
+				log.Printf("Stopping: cancelling the downloads and the players")
+				ctl.stop()
+				cancel()
+				return
+			default:
+				last = time.Now()
+				if ctl.next() == 0 {
+					log.Printf("Interrupt: nothing plays, ^C again within %s to stop", interruptWindow)
+				} else {
+					log.Printf("Interrupt: skipped, ^C again within %s to stop", interruptWindow)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+)
+
+var loopSession = flag.Bool("loop", false, "Keep the soundscape going until stopped, selecting more sounds for each query when its sounds are over")
+
+// loopRounds feeds the sounds of new selections of the groups, nsounds of each query, a round
+// after the other, until ctx is done. Each round is selected while the last plays, so there is
+// no gap between them. A round that would fetch more than --max-download or --cache-quota
+// allow plays only the cached sounds, the same ones reshuffled when offline
+func loopRounds(ctx context.Context, sel *selection, groups []queryGroup, f *fetcher, nsounds int, interleaved bool, out chan<- sound, skips *skipSet) {
+	var idle backoff
+	for ctx.Err() == nil {
+		selected := make([][]sound, len(groups))
+		for i, g := range groups {
+			selected[i] = selectGroup(ctx, sel, g, nsounds*ratioWeight(i), f.dir)
+		}
+		if err := downloadBudget(selected, f); err != nil {
+			log.Printf("Loop: %v, playing the cached sounds", err)
+			for i, sounds := range selected {
+				var cached []sound
+				for _, snd := range sounds {
+					if snd.cached {
+						cached = append(cached, snd)
+					}
+				}
+				selected[i] = cached
+			}
+		}
+
+		n := 0
+		for _, sounds := range selected {
+			n += len(sounds)
+		}
+		if n == 0 {
+			// nothing to play now, like when the sources are down, try again later
+			if !idle.wait(ctx) {
+				return
+			}
+			continue
+		}
+		idle.reset()
+
+		if !interleaved {
+			numberProgram(selected)
+		}
+		feed(ctx, program(sel.rng, selected, interleaved), out, skips)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// A minimal mDNS/DNS-SD implementation, just enough for thames mirrors to find each other.
+// Mirrors advertise the service _thames._tcp.local and answer PTR queries for it
+// with PTR, SRV and A records. See RFC 6762 and RFC 6763
+
+const (
+	mdnsService = "_thames._tcp.local."
+
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeSRV = 33
+	dnsClassIN = 1
+
+	mdnsTTL = 120
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsPeer is the address of a thames mirror found on the LAN
+type mdnsPeer struct {
+	name string
+	addr string // host:port of the mirror's http server
+}
+
+// advertise answers mDNS queries for the thames service until the connection fails
+// port is the port of the http server that shares the local cache
+func advertise(port int) error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	hostname = strings.Split(hostname, ".")[0]
+	instance := hostname + "." + mdnsService
+	target := hostname + ".local."
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		if !isServiceQuery(buf[:n]) {
+			continue
+		}
+		ip, err := localIPFor(src)
+		if err != nil {
+			log.Printf("Error:mDNS: %v", err)
+			continue
+		}
+		resp := serviceResponse(instance, target, ip, port)
+		// legacy unicast queries come from ports other than 5353 and expect a direct reply
+		dst := src
+		if src.Port == mdnsGroup.Port {
+			dst = mdnsGroup
+		}
+		if _, err := conn.WriteToUDP(resp, dst); err != nil {
+			log.Printf("Error:mDNS: %v", err)
+		}
+	}
+}
+
+// discoverPeers sends a query for the thames service and collects the answers until timeout
+func discoverPeers(timeout time.Duration) ([]mdnsPeer, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.WriteToUDP(serviceQuery(), mdnsGroup); err != nil {
+		return nil, err
+	}
+
+	self := make(map[string]bool)
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok {
+				self[ipn.IP.String()] = true
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	var peers []mdnsPeer
+	buf := make([]byte, 9000)
+	deadline := time.Now().Add(timeout)
+	for {
+		conn.SetReadDeadline(deadline)
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			return peers, err
+		}
+		found, err := parseServiceResponse(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, p := range found {
+			host, _, _ := net.SplitHostPort(p.addr)
+			if self[host] && *shareAddr != "" {
+				continue
+			}
+			if !seen[p.addr] {
+				seen[p.addr] = true
+				peers = append(peers, p)
+			}
+		}
+	}
+
+	return peers, nil
+}
+
+// localIPFor returns the local IPv4 address used to reach addr
+func localIPFor(addr *net.UDPAddr) (net.IP, error) {
+	c, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	return c.LocalAddr().(*net.UDPAddr).IP.To4(), nil
+}
+
+func serviceQuery() []byte {
+	msg := dnsHeader(0, 0, 1, 0)
+	msg = appendName(msg, mdnsService)
+	msg = appendUint16(msg, dnsTypePTR)
+	msg = appendUint16(msg, dnsClassIN)
+
+	return msg
+}
+
+func serviceResponse(instance, target string, ip net.IP, port int) []byte {
+	msg := dnsHeader(0, 0x8400, 0, 3)
+
+	msg = appendRecord(msg, mdnsService, dnsTypePTR, appendName(nil, instance))
+
+	srv := appendUint16(nil, 0) // priority
+	srv = appendUint16(srv, 0)  // weight
+	srv = appendUint16(srv, uint16(port))
+	srv = appendName(srv, target)
+	msg = appendRecord(msg, instance, dnsTypeSRV, srv)
+
+	msg = appendRecord(msg, target, dnsTypeA, []byte(ip.To4()))
+
+	return msg
+}
+
+// isServiceQuery reports whether msg is a query containing a question for the thames service
+func isServiceQuery(msg []byte) bool {
+	if len(msg) < 12 || msg[2]&0x80 != 0 {
+		return false
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		name, n, err := readName(msg, off)
+		if err != nil || n+4 > len(msg) {
+			return false
+		}
+		qtype := binary.BigEndian.Uint16(msg[n:])
+		off = n + 4
+		if strings.EqualFold(name, mdnsService) && (qtype == dnsTypePTR || qtype == 255) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseServiceResponse extracts the peers from the SRV and A records of a response
+func parseServiceResponse(msg []byte) ([]mdnsPeer, error) {
+	if len(msg) < 12 || msg[2]&0x80 == 0 {
+		return nil, errors.New("not a response")
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	nrecords := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		_, n, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n + 4
+	}
+
+	type srvRecord struct {
+		name, target string
+		port         uint16
+	}
+	var srvs []srvRecord
+	ips := make(map[string]net.IP)
+	for i := 0; i < nrecords; i++ {
+		name, n, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if n+10 > len(msg) {
+			return nil, errors.New("short record")
+		}
+		rtype := binary.BigEndian.Uint16(msg[n:])
+		rdlen := int(binary.BigEndian.Uint16(msg[n+8:]))
+		rdata := n + 10
+		if rdata+rdlen > len(msg) {
+			return nil, errors.New("short record data")
+		}
+		switch rtype {
+		case dnsTypeSRV:
+			if rdlen < 7 {
+				return nil, errors.New("short SRV record")
+			}
+			target, _, err := readName(msg, rdata+6)
+			if err != nil {
+				return nil, err
+			}
+			srvs = append(srvs, srvRecord{name, strings.ToLower(target), binary.BigEndian.Uint16(msg[rdata+4:])})
+		case dnsTypeA:
+			if rdlen == 4 {
+				ips[strings.ToLower(name)] = net.IP(msg[rdata : rdata+4])
+			}
+		}
+		off = rdata + rdlen
+	}
+
+	var peers []mdnsPeer
+	for _, s := range srvs {
+		if !strings.HasSuffix(strings.ToLower(s.name), mdnsService) {
+			continue
+		}
+		if ip, ok := ips[s.target]; ok {
+			peers = append(peers, mdnsPeer{s.name, net.JoinHostPort(ip.String(), fmt.Sprint(s.port))})
+		}
+	}
+
+	return peers, nil
+}
+
+func dnsHeader(id, flags, qdcount, ancount uint16) []byte {
+	msg := make([]byte, 0, 512)
+	msg = appendUint16(msg, id)
+	msg = appendUint16(msg, flags)
+	msg = appendUint16(msg, qdcount)
+	msg = appendUint16(msg, ancount)
+	msg = appendUint16(msg, 0)
+	msg = appendUint16(msg, 0)
+
+	return msg
+}
+
+func appendRecord(msg []byte, name string, rtype uint16, rdata []byte) []byte {
+	msg = appendName(msg, name)
+	msg = appendUint16(msg, rtype)
+	msg = appendUint16(msg, dnsClassIN)
+	msg = append(msg, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(msg[len(msg)-4:], mdnsTTL)
+	msg = appendUint16(msg, uint16(len(rdata)))
+
+	return append(msg, rdata...)
+}
+
+func appendName(msg []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+
+	return append(msg, 0)
+}
+
+func appendUint16(msg []byte, v uint16) []byte {
+	return append(msg, byte(v>>8), byte(v))
+}
+
+// readName decodes the, possibly compressed, name at off and returns it with the offset after it
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; hops < 32; hops++ {
+		if off >= len(msg) {
+			return "", 0, errors.New("name out of bounds")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("name out of bounds")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errors.New("name out of bounds")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+
+	return "", 0, errors.New("too many compression pointers")
+}
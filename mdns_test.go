@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestReadName(t *testing.T) {
+	// a header, then _thames._tcp.local. at 12 and a name compressed to point at it
+	msg := dnsHeader(0, 0, 0, 0)
+	msg = appendName(msg, mdnsService)
+	pointer := len(msg)
+	msg = append(msg, 4, 'h', 'o', 'm', 'e', 0xC0, 12)
+	loop := len(msg)
+	msg = append(msg, 0xC0, byte(loop))
+	long := len(msg)
+	msg = append(msg, 63, 'a')
+
+	tests := []struct {
+		name string
+		off  int
+		want string // "" if the name is rejected
+		end  int
+	}{
+		{"labels", 12, mdnsService, pointer},
+		{"compressed", pointer, "home." + mdnsService, pointer + 7},
+		{"into a name", 12 + 8, "_tcp.local.", pointer},
+		{"root", len(dnsHeader(0, 0, 0, 0)) - 1, ".", 12},
+		{"pointer loop", loop, "", 0},
+		{"label out of bounds", long, "", 0},
+		{"out of bounds", len(msg), "", 0},
+	}
+	for _, tt := range tests {
+		name, end, err := readName(msg, tt.off)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: read %q", tt.name, name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if name != tt.want || end != tt.end {
+			t.Errorf("%s: %q ending at %d, expected %q at %d", tt.name, name, end, tt.want, tt.end)
+		}
+	}
+}
+
+func TestServiceResponse(t *testing.T) {
+	ip := net.IPv4(192, 168, 1, 7)
+	msg := serviceResponse("kitchen."+mdnsService, "kitchen.local.", ip, 8080)
+	peers, err := parseServiceResponse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []mdnsPeer{{"kitchen." + mdnsService, "192.168.1.7:8080"}}
+	if !reflect.DeepEqual(peers, want) {
+		t.Errorf("peers %v, expected %v", peers, want)
+	}
+
+	if _, err := parseServiceResponse(serviceQuery()); err == nil {
+		t.Error("a query parsed as a response")
+	}
+	if _, err := parseServiceResponse(msg[:len(msg)-2]); err == nil {
+		t.Error("a truncated response parsed")
+	}
+	if !isServiceQuery(serviceQuery()) {
+		t.Error("the query of the service isn't one")
+	}
+	if isServiceQuery(msg) {
+		t.Error("a response is a query of the service")
+	}
+}
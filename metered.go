@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// meteredFlag is --metered. Unset, the connection is metered if NetworkManager says so
+type meteredFlag struct {
+	set, value bool
+}
+
+func (f *meteredFlag) String() string {
+	if f == nil || !f.set {
+		return ""
+	}
+
+	return strconv.FormatBool(f.value)
+}
+
+func (f *meteredFlag) Set(v string) error {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	f.set, f.value = true, b
+
+	return nil
+}
+
+func (f *meteredFlag) IsBoolFlag() bool {
+	return true
+}
+
+var (
+	meteredConnection meteredFlag
+	meteredMax        = bytesFlag(2 << 20)
+)
+
+func init() {
+	flag.Var(&meteredConnection, "metered", "On a metered connection fetch only the sounds smaller than --metered-max, play the others only if cached. The default is what NetworkManager reports, --metered=false fetches all")
+	flag.Var(&meteredMax, "metered-max", "The `size` of the largest sound fetched on a metered connection, a short sound like a preview")
+}
+
+var (
+	meteredOnce sync.Once
+	metered     bool
+)
+
+// isMetered reports whether the connection is metered, as set with --metered or, if unset,
+// as NetworkManager reports it. Sounds from the peers on the LAN are not metered
+func isMetered() bool {
+	meteredOnce.Do(func() {
+		if meteredConnection.set {
+			metered = meteredConnection.value
+			return
+		}
+		var why string
+		metered, why = networkManagerMetered()
+		if metered {
+			log.Printf("Metered: %s, fetching only sounds under %s. --metered=false fetches all", why, formatBytes(int64(meteredMax)))
+		}
+	})
+
+	return metered
+}
+
+// networkManagerMetered asks NetworkManager, over D-Bus, whether the primary connection is
+// metered. Its Metered property is 1 for yes and 3 for a guessed yes, like a phone hotspot
+func networkManagerMetered() (bool, string) {
+	out, err := exec.Command("busctl", "--system", "get-property", "org.freedesktop.NetworkManager",
+		"/org/freedesktop/NetworkManager", "org.freedesktop.NetworkManager", "Metered").Output()
+	if err != nil {
+		// no busctl or no NetworkManager, nothing is known
+		return false, ""
+	}
+
+	// the reply is like u 1
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 || fields[0] != "u" {
+		return false, ""
+	}
+	switch fields[1] {
+	case "1":
+		return true, "NetworkManager reports a metered connection"
+	case "3":
+		return true, "NetworkManager guesses the connection is metered"
+	}
+
+	return false, ""
+}
+
+// meteredSecs is the duration of the largest sound fetched on a metered connection,
+// estimated from the rate of the archive
+func meteredSecs() int {
+	return int(int64(meteredMax) / wavBytesPerSec)
+}
+
+// checkMetered returns an error if fname is too big to fetch on a metered connection
+func (f *fetcher) checkMetered(fname string) error {
+	size, known := knownSize(f.db, fname)
+	if !known {
+		var secs int
+		if err := f.db.QueryRow(`SELECT secs FROM sounds WHERE location = ?`, fname).Scan(&secs); err != nil {
+			return err
+		}
+		size = int64(secs) * wavBytesPerSec
+	}
+	if size > int64(meteredMax) {
+		return fmt.Errorf("~%s is more than --metered-max %s on a metered connection", formatBytes(size), formatBytes(int64(meteredMax)))
+	}
+
+	return nil
+}
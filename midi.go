@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"os"
+	"strconv"
+)
+
+var midiDevice = flag.String("midi", "", "Control the session from the raw MIDI `device`, like /dev/snd/midiC1D0, as mapped in the configuration")
+
+// MIDI status bytes of the messages thames understands
+const (
+	midiNoteOn        = 0x90
+	midiControlChange = 0xB0
+	midiProgramChange = 0xC0
+)
+
+// readMIDI reads the MIDI stream of the device and applies the mappings of the configuration.
+// Control changes set the volume of query groups, notes fire one-shots and program changes
+// switch presets
+func readMIDI(ctx context.Context, device string, ctl *controls) error {
+	fin, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		fin.Close()
+	}()
+
+	r := bufio.NewReader(fin)
+	var p midiParser
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		m, ok := p.feed(b)
+		if !ok {
+			continue
+		}
+
+		switch m.command {
+		case midiProgramChange:
+			if preset, ok := conf.MIDI.Presets[strconv.Itoa(int(m.data[0]))]; ok {
+				ctl.switchPreset(preset)
+			}
+		case midiNoteOn:
+			if query, ok := conf.MIDI.Notes[strconv.Itoa(int(m.data[0]))]; ok && m.data[1] > 0 {
+				ctl.fire(query)
+			}
+		case midiControlChange:
+			if group, ok := conf.MIDI.Gains[strconv.Itoa(int(m.data[0]))]; ok {
+				ctl.setGain(group, float64(m.data[1])/127)
+			}
+		}
+	}
+}
+
+// midiMessage is a channel message of a MIDI stream, its command without the channel and
+// its data bytes
+type midiMessage struct {
+	command byte
+	data    []byte
+}
+
+// midiParser decodes the channel messages of a MIDI stream, keeping the running status
+type midiParser struct {
+	status byte
+	data   []byte
+}
+
+// feed reads the next byte of the stream and returns the message it completes, if it does
+func (p *midiParser) feed(b byte) (midiMessage, bool) {
+	switch {
+	case b >= 0xF8:
+		// real time messages may appear anywhere and don't affect the running status
+		return midiMessage{}, false
+	case b >= 0xF0:
+		// system messages cancel the running status
+		p.status = 0
+		return midiMessage{}, false
+	case b&0x80 != 0:
+		p.status = b
+		p.data = p.data[:0]
+		return midiMessage{}, false
+	}
+	if p.status == 0 {
+		return midiMessage{}, false
+	}
+
+	p.data = append(p.data, b)
+	cmd := p.status & 0xF0
+	// messages have two data bytes, program changes and channel pressures one
+	if (cmd == midiProgramChange || cmd == 0xD0) && len(p.data) == 1 || len(p.data) == 2 {
+		m := midiMessage{cmd, append([]byte(nil), p.data...)}
+		p.data = p.data[:0]
+		return m, true
+	}
+
+	return midiMessage{}, false
+}
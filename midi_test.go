@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMIDIParser(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream []byte
+		msgs   []midiMessage
+	}{
+		{"note on", []byte{0x90, 60, 100}, []midiMessage{{midiNoteOn, []byte{60, 100}}}},
+		{"channel", []byte{0xB3, 7, 127}, []midiMessage{{midiControlChange, []byte{7, 127}}}},
+		{"program change", []byte{0xC0, 5}, []midiMessage{{midiProgramChange, []byte{5}}}},
+		{"running status", []byte{0x90, 60, 100, 62, 0, 0xC0, 1, 2},
+			[]midiMessage{{midiNoteOn, []byte{60, 100}}, {midiNoteOn, []byte{62, 0}}, {midiProgramChange, []byte{1}}, {midiProgramChange, []byte{2}}}},
+		{"real time", []byte{0x90, 60, 0xF8, 100, 0xFE}, []midiMessage{{midiNoteOn, []byte{60, 100}}}},
+		{"system cancels the status", []byte{0x90, 60, 100, 0xF0, 1, 2, 0xF7, 62, 100}, []midiMessage{{midiNoteOn, []byte{60, 100}}}},
+		{"no status", []byte{60, 100}, nil},
+		{"status before the data", []byte{0x90, 60, 0xB0, 7, 64}, []midiMessage{{midiControlChange, []byte{7, 64}}}},
+		{"channel pressure", []byte{0xD0, 64, 0x90, 60, 100}, []midiMessage{{0xD0, []byte{64}}, {midiNoteOn, []byte{60, 100}}}},
+	}
+	for _, tt := range tests {
+		var p midiParser
+		var msgs []midiMessage
+		for _, b := range tt.stream {
+			if m, ok := p.feed(b); ok {
+				msgs = append(msgs, m)
+			}
+		}
+		if !reflect.DeepEqual(msgs, tt.msgs) {
+			t.Errorf("%s: %v, expected %v", tt.name, msgs, tt.msgs)
+		}
+	}
+}
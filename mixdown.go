@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	gainSettings stringsFlag
+	masterVolume = flag.Int("volume", 100, "Play all the sounds at the `volume`, from 0 to 100")
+	recordFile   = flag.String("record", "", "Don't use an audio device. Mix the sounds into the wav `file`, and into the stream of --stream if given")
+)
+
+func init() {
+	flag.Var(&gainSettings, "gain", "Play the sounds of a query at a volume, `query=gain`, like cafe=0.5. May be repeated")
+}
+
+// queryGains are the volumes of --gain and of the queries like rain:80, by query or group
+var (
+	queryGainsMu sync.Mutex
+	queryGains   = make(map[string]float64)
+)
+
+// parseGains parses the settings of --gain
+func parseGains() error {
+	queryGainsMu.Lock()
+	defer queryGainsMu.Unlock()
+	for _, setting := range gainSettings {
+		i := strings.LastIndex(setting, "=")
+		if i <= 0 {
+			return fmt.Errorf("bad --gain %q, expected query=gain", setting)
+		}
+		gain, err := strconv.ParseFloat(setting[i+1:], 64)
+		if err != nil || gain < 0 {
+			return fmt.Errorf("bad --gain %q, the gain is a number like 0.5", setting)
+		}
+		queryGains[setting[:i]] = gain
+	}
+
+	return nil
+}
+
+// queryGain is the volume of --gain for the sound, 1 if none was set. It multiplies the
+// volume of the automation and the controllers
+func queryGain(snd sound) float64 {
+	queryGainsMu.Lock()
+	defer queryGainsMu.Unlock()
+	if g, ok := queryGains[snd.group]; ok {
+		return g
+	}
+	if g, ok := queryGains[snd.query]; ok {
+		return g
+	}
+
+	return 1
+}
+
+// volumeRe is a query with a volume from 0 to 100, like rain:80 or '(rain thunder):40'
+var volumeRe = regexp.MustCompile(`^(.+):([0-9]{1,3})$`)
+
+// volumeArgs returns the queries of args without their volumes, and sets the volumes of the
+// queries that have one
+func volumeArgs(args []string) []string {
+	queryGainsMu.Lock()
+	defer queryGainsMu.Unlock()
+
+	var queries []string
+	for _, arg := range args {
+		if m := volumeRe.FindStringSubmatch(arg); m != nil {
+			if v, _ := strconv.Atoi(m[2]); v <= 100 {
+				queryGains[m[1]] = float64(v) / 100
+				arg = m[1]
+			}
+		}
+		queries = append(queries, arg)
+	}
+
+	return queries
+}
+
+// volumeGain is the gain of --volume
+func volumeGain() float64 {
+	return float64(*masterVolume) / 100
+}
+
+// startRecording mixes the sounds into the wav file, with the mixer of --stream if there is
+// one. The returned function ends the recording and completes the header of the file
+func startRecording(ctx context.Context, fpath string) (func(), error) {
+	fout, err := os.Create(fpath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fout.Write(wavHeader()); err != nil {
+		fout.Close()
+		return nil, err
+	}
+
+	if streamMixer == nil {
+		streamMixer = newMixer()
+		go streamMixer.run(ctx)
+	}
+	m := streamMixer
+
+	// the file keeps up with the mix, there is room for a slow disk
+	l := make(chan []byte, 200)
+	m.mu.Lock()
+	m.listeners[l] = true
+	m.mu.Unlock()
+
+	done := make(chan int64)
+	go func() {
+		var size int64
+		for chunk := range l {
+			if _, err := fout.Write(chunk); err != nil {
+				log.Printf("Error:Record: %v", err)
+				break
+			}
+			size += int64(len(chunk))
+		}
+		for range l {
+		}
+		done <- size
+	}()
+	log.Printf("Recording: %s", fpath)
+
+	return func() {
+		m.mu.Lock()
+		delete(m.listeners, l)
+		m.mu.Unlock()
+		close(l)
+		size := <-done
+
+		// the sizes of the header are known now
+		h := make([]byte, 4)
+		binary.LittleEndian.PutUint32(h, uint32(size+36))
+		fout.WriteAt(h, 4)
+		binary.LittleEndian.PutUint32(h, uint32(size))
+		fout.WriteAt(h, 40)
+		if err := fout.Close(); err != nil {
+			log.Printf("Error:Record: %v", err)
+			return
+		}
+		log.Printf("Recorded: %s, %s", fpath, (time.Duration(size/frameSize) * time.Second / streamRate).Round(time.Second))
+	}, nil
+}
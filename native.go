@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var pcmDevice = flag.String("pcm", "/dev/snd/pcmC0D0p", "Play with --player native on the ALSA playback `device`")
+
+// With --player native thames decodes the wavs itself and mixes them, like for --stream, into
+// the ALSA device, with no sox. When the device can't be opened, for example because a sound
+// server holds it or the system has no ALSA, the sounds play with exec:play
+
+// pcmPeriod is the number of frames written to the device at once
+const pcmPeriod = 1024
+
+var (
+	nativeOnce  sync.Once
+	nativeMixer *mixer
+)
+
+// deviceMixer returns the mixer of the audio device with --player native, nil if the sounds
+// play with a command
+func deviceMixer() *mixer {
+	nativeOnce.Do(func() {
+		if *playerName != "native" {
+			return
+		}
+		dev, err := openPCM(*pcmDevice)
+		if err != nil {
+			log.Printf("Player: %s: %v, playing with exec:play", *pcmDevice, err)
+			return
+		}
+		nativeMixer = newMixer()
+		go nativeMixer.drive(dev)
+	})
+
+	return nativeMixer
+}
+
+// playerCommand is the command that plays the sounds, with the arguments of play(1)
+func playerCommand() string {
+	if strings.HasPrefix(*playerName, "exec:") {
+		return strings.TrimPrefix(*playerName, "exec:")
+	}
+
+	return "play"
+}
+
+// validPlayer reports whether name is a player of --player
+func validPlayer(name string) bool {
+	return name == "native" || name == "play" || name == "null" || strings.HasPrefix(name, "exec:") && len(name) > len("exec:")
+}
+
+// drive mixes the inputs into the device, at the pace of the device. If the device fails the
+// inputs are mixed into nothing, at the pace of the clock, so the sessions don't hang
+func (m *mixer) drive(dev *pcm) {
+	for {
+		if err := dev.write(m.mix(pcmPeriod)); err != nil {
+			log.Printf("Error:Player: %s: %v", dev.name, err)
+			dev.close()
+			break
+		}
+	}
+	m.run(context.Background())
+}
+
+// errNotNative is the error of sounds thames can't decode itself, sox decodes them
+var errNotNative = errors.New("not a wav that thames decodes")
+
+// decodeWAV decodes the sound file at fpath, from the position from and at the gain, into
+// the format of the mix and writes it to w. It decodes the pcm wavs of 8 to 32 bits at the
+// rate of the mix, mono or stereo, and fails with errNotNative for the others
+func decodeWAV(fpath string, gain float64, from time.Duration, w io.Writer) error {
+	fin, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+
+	info, err := probeAudio(fpath)
+	if err != nil || info.format != "wav" || info.sampleRate != streamRate ||
+		info.channels > 2 || info.bits%8 != 0 || info.bits > 32 {
+		return errNotNative
+	}
+	width := info.bits / 8
+	frame := width * info.channels
+
+	// the data chunk, after the RIFF header and the others
+	if _, err := fin.Seek(12, io.SeekStart); err != nil {
+		return err
+	}
+	chunk := make([]byte, 8)
+	var size int64
+	for {
+		if _, err := io.ReadFull(fin, chunk); err != nil {
+			return errors.New("wav without a data chunk")
+		}
+		size = int64(binary.LittleEndian.Uint32(chunk[4:]))
+		if string(chunk[0:4]) == "data" {
+			break
+		}
+		if _, err := fin.Seek(size+size%2, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+	if skip := int64(from.Seconds()*streamRate) * int64(frame); skip > 0 {
+		if skip >= size {
+			return nil
+		}
+		if _, err := fin.Seek(skip, io.SeekCurrent); err != nil {
+			return err
+		}
+		size -= skip
+	}
+
+	r := io.LimitReader(fin, size-size%int64(frame))
+	buf := make([]byte, frame*pcmPeriod)
+	out := make([]byte, frameSize*pcmPeriod)
+	for {
+		n, err := io.ReadFull(r, buf)
+		frames := n / frame
+		for i := 0; i < frames; i++ {
+			left := pcmSample(buf[i*frame:], width, gain)
+			right := left
+			if info.channels == 2 {
+				right = pcmSample(buf[i*frame+width:], width, gain)
+			}
+			binary.LittleEndian.PutUint16(out[i*frameSize:], uint16(left))
+			binary.LittleEndian.PutUint16(out[i*frameSize+2:], uint16(right))
+		}
+		if frames > 0 {
+			if _, werr := w.Write(out[:frames*frameSize]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// pcmSample is the little endian sample of width bytes at p, as 16 bits, at the gain
+func pcmSample(p []byte, width int, gain float64) int16 {
+	var v int32
+	switch width {
+	case 1:
+		v = (int32(p[0]) - 128) << 8
+	case 2:
+		v = int32(int16(binary.LittleEndian.Uint16(p)))
+	case 3:
+		v = int32(uint32(p[0])<<8|uint32(p[1])<<16|uint32(p[2])<<24) >> 16
+	case 4:
+		v = int32(binary.LittleEndian.Uint32(p)) >> 16
+	}
+	if gain != 1 {
+		v = int32(float64(v) * gain)
+		if v > 32767 {
+			v = 32767
+		} else if v < -32768 {
+			v = -32768
+		}
+	}
+
+	return int16(v)
+}
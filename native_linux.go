@@ -0,0 +1,152 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// The ALSA kernel interface of playback devices, from <sound/asound.h>, enough to play
+// interleaved 16 bit stereo at the rate of the mix
+
+const (
+	pcmParamAccess     = 0
+	pcmParamFormat     = 1
+	pcmParamSubformat  = 2
+	pcmParamChannels   = 10
+	pcmParamRate       = 11
+	pcmParamPeriodSize = 13
+	pcmParamBufferSize = 17
+	pcmFirstInterval   = 8
+
+	pcmAccessRWInterleaved = 3
+	pcmFormatS16LE         = 2
+	pcmSubformatStd        = 0
+	pcmIntervalInteger     = 1 << 2
+)
+
+type pcmInterval struct {
+	min, max uint32
+	flags    uint32
+}
+
+type pcmHWParams struct {
+	flags     uint32
+	masks     [3][8]uint32
+	mres      [5][8]uint32
+	intervals [12]pcmInterval
+	ires      [9]pcmInterval
+	rmask     uint32
+	cmask     uint32
+	info      uint32
+	msbits    uint32
+	rateNum   uint32
+	rateDen   uint32
+	fifoSize  uint64
+	reserved  [64]byte
+}
+
+type pcmXferI struct {
+	result int64
+	buf    uintptr
+	frames uint64
+}
+
+const (
+	pcmIoctlHWParams = 3<<30 | unsafe.Sizeof(pcmHWParams{})<<16 | 'A'<<8 | 0x11
+	pcmIoctlPrepare  = 'A'<<8 | 0x40
+	pcmIoctlWriteI   = 1<<30 | unsafe.Sizeof(pcmXferI{})<<16 | 'A'<<8 | 0x50
+)
+
+// pcm is an open playback device
+type pcm struct {
+	name string
+	f    *os.File
+}
+
+// openPCM opens the playback device and sets it to the format of the mix
+func openPCM(name string) (*pcm, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	p := &pcm{name, f}
+
+	var hw pcmHWParams
+	for i := range hw.masks {
+		for j := range hw.masks[i] {
+			hw.masks[i][j] = ^uint32(0)
+		}
+	}
+	for i := range hw.intervals {
+		hw.intervals[i] = pcmInterval{0, ^uint32(0), 0}
+	}
+	hw.rmask = ^uint32(0)
+	hw.info = ^uint32(0)
+	only := func(param, value int) {
+		hw.masks[param] = [8]uint32{}
+		hw.masks[param][value/32] = 1 << (value % 32)
+	}
+	between := func(param int, min, max uint32) {
+		hw.intervals[param-pcmFirstInterval] = pcmInterval{min, max, pcmIntervalInteger}
+	}
+	only(pcmParamAccess, pcmAccessRWInterleaved)
+	only(pcmParamFormat, pcmFormatS16LE)
+	only(pcmParamSubformat, pcmSubformatStd)
+	between(pcmParamChannels, streamChannels, streamChannels)
+	between(pcmParamRate, streamRate, streamRate)
+	// about 20ms periods in a buffer of 200ms at most, for volumes and skips to be heard soon
+	between(pcmParamPeriodSize, pcmPeriod/2, pcmPeriod*2)
+	between(pcmParamBufferSize, pcmPeriod*2, pcmPeriod*8)
+
+	if err := p.ioctl(pcmIoctlHWParams, unsafe.Pointer(&hw)); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("16 bit stereo at %dHz: %v", streamRate, err)
+	}
+	if err := p.ioctl(pcmIoctlPrepare, nil); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *pcm) ioctl(req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, p.f.Fd(), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// write plays the frames, waiting for room in the buffer of the device. It recovers from
+// underruns, when the buffer played out before the frames arrived
+func (p *pcm) write(frames []byte) error {
+	for len(frames) >= frameSize {
+		x := pcmXferI{buf: uintptr(unsafe.Pointer(&frames[0])), frames: uint64(len(frames) / frameSize)}
+		err := p.ioctl(pcmIoctlWriteI, unsafe.Pointer(&x))
+		runtime.KeepAlive(frames)
+		switch err {
+		case nil:
+			frames = frames[x.result*frameSize:]
+		case syscall.EINTR, syscall.EAGAIN:
+		case syscall.EPIPE, syscall.ESTRPIPE:
+			if err := p.ioctl(pcmIoctlPrepare, nil); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *pcm) close() {
+	p.f.Close()
+}
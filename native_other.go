@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// errNoALSA is the error of --player native on the systems without ALSA
+var errNoALSA = errors.New("the native player plays on ALSA, which is only on linux")
+
+// pcm is the playback device of --player native, which none of these systems opens
+type pcm struct {
+	name string
+}
+
+func openPCM(name string) (*pcm, error) {
+	return nil, errNoALSA
+}
+
+func (p *pcm) write(frames []byte) error {
+	return errNoALSA
+}
+
+func (p *pcm) close() {
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// notesIndex is the full text index of the notes, kept up to date by triggers. Notes are written
+// by users in any language, so they are indexed with the unicode tokenizer whatever --tokenizer
+const notesIndex = `CREATE VIRTUAL TABLE notes_fts USING fts4(
+                      location, note,
+
+                      tokenize=unicode61 "remove_diacritics=1", notindexed=location
+                    );
+                    INSERT INTO notes_fts(location, note) SELECT location, note FROM notes`
+
+const notesTriggers = `CREATE TRIGGER IF NOT EXISTS notes_insert AFTER INSERT ON notes BEGIN
+                         INSERT INTO notes_fts(location, note) VALUES(new.location, new.note);
+                       END;
+                       CREATE TRIGGER IF NOT EXISTS notes_update AFTER UPDATE ON notes BEGIN
+                         UPDATE notes_fts SET note = new.note WHERE location = old.location;
+                       END;
+                       CREATE TRIGGER IF NOT EXISTS notes_delete AFTER DELETE ON notes BEGIN
+                         DELETE FROM notes_fts WHERE location = old.location;
+                       END`
+
+// migrateNotes creates the full text index of the notes in older databases
+func migrateNotes(db *sql.DB) error {
+	var exists bool
+	if err := db.QueryRow(`SELECT count(*) > 0 FROM sqlite_master WHERE name = 'notes_fts'`).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := db.Exec(notesIndex); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(notesTriggers)
+
+	return err
+}
+
+// hasNotes reports whether any sound has a note, so queries should search the notes too
+func hasNotes(db *sql.DB) bool {
+	var n bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM notes)`).Scan(&n); err != nil {
+		return false
+	}
+
+	return n
+}
+
+// readNotes reads the notes of the sounds, by location
+func readNotes(ctx context.Context, db *sql.DB, sounds []sound) (map[string]string, error) {
+	var locations []string
+	for _, snd := range sounds {
+		locations = append(locations, snd.fname)
+	}
+	meta, err := readUserMeta(ctx, db, locations)
+	if err != nil {
+		return nil, err
+	}
+
+	notes := make(map[string]string)
+	for l, m := range meta {
+		if m.note != "" {
+			notes[l] = m.note
+		}
+	}
+
+	return notes, nil
+}
+
+// noteCommand implements the note command. It prints, sets or removes the note of a sound
+func noteCommand(args []string) error {
+	fs := flag.NewFlagSet("note", flag.ExitOnError)
+	remove := fs.Bool("delete", false, "Remove the note")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames note [--delete] location [note...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 || *remove && fs.NArg() > 1 {
+		fs.Usage()
+		return errUsage
+	}
+	location := normalizeLocation(fs.Arg(0))
+	note := strings.TrimSpace(strings.Join(fs.Args()[1:], " "))
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var descr string
+	if err := db.QueryRow(`SELECT description FROM sounds WHERE location = ?`, location).Scan(&descr); err == sql.ErrNoRows {
+		return fmt.Errorf("%s is not in the index", location)
+	} else if err != nil {
+		return err
+	}
+
+	current, err := readUserMeta(context.Background(), db, []string{location})
+	if err != nil {
+		return err
+	}
+	m := current[location]
+	if note == "" && !*remove {
+		if m.note != "" {
+			fmt.Println(m.note)
+		}
+		return nil
+	}
+
+	edit := userEdit{field: "note", value: note, unset: *remove}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := writeUserMeta(tx, location, m.apply([]userEdit{edit})); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
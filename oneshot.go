@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var oneshotKeys stringsFlag
+
+func init() {
+	flag.Var(&oneshotKeys, "oneshot", "Bind `key=query` so that pressing key plays a sound of query at once, over the others. May be repeated")
+}
+
+// oneshots plays single sounds on demand over the running session, like a door knock or a
+// thunderclap in a theatre or tabletop game. They have their own player, so they don't wait
+// for the sounds already queued
+type oneshots struct {
+	queries map[byte]string // by key
+	sel     *selection
+	f       *fetcher
+	c       chan sound
+}
+
+// newOneshots parses the --oneshot flags
+func newOneshots(db *sql.DB, sel *selection) (*oneshots, error) {
+	o := new(oneshots)
+	o.queries = make(map[byte]string)
+	for _, binding := range oneshotKeys {
+		kv := strings.SplitN(binding, "=", 2)
+		if len(kv) != 2 || len(kv[0]) != 1 || kv[1] == "" {
+			return nil, fmt.Errorf("bad --oneshot %q, expected key=query", binding)
+		}
+		o.queries[kv[0][0]] = kv[1]
+	}
+	o.sel = sel
+	o.f = newFetcher(db)
+	o.c = make(chan sound, PlayerChannelSize)
+
+	return o, nil
+}
+
+// fire plays a random sound of the query bound to key
+func (o *oneshots) fire(key byte) {
+	if query, ok := o.queries[key]; ok {
+		o.fireQuery(query)
+	}
+}
+
+// fireQuery plays a random sound of query
+func (o *oneshots) fireQuery(query string) {
+	go func() {
+		sounds := selectSounds(context.Background(), o.sel, query, 1, soundsDir)
+		if len(sounds) == 0 {
+			log.Printf("One-shot: no sounds for %q", query)
+			return
+		}
+		snd := sounds[0]
+		snd.group = "oneshot"
+		sp, exists, err := o.f.cache(context.Background(), snd.fname)
+		if err != nil || !exists {
+			log.Printf("Missing File: %s: %v", sp, err)
+			pipelineErrors.report("fetch", snd.fname, missingError(err))
+			return
+		}
+		snd.fpath = sp
+		o.c <- snd
+	}()
+}
+
+// run plays the one-shots and reads the keys from the terminal until ctx is done
+func (o *oneshots) run(ctx context.Context) {
+	go runPlayer(ctx, o.c, nil, nil, nil)
+	if len(o.queries) == 0 {
+		return
+	}
+
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		log.Printf("Error:One-shot: %v", err)
+		return
+	}
+	defer tty.Close()
+	if *plainOutput {
+		o.readLines(ctx, tty)
+		return
+	}
+	restore, err := cbreak(tty)
+	if err != nil {
+		log.Printf("Error:One-shot: %v", err)
+		return
+	}
+	defer restore()
+
+	for k, q := range o.queries {
+		log.Printf("One-shot: press %c for %q", k, q)
+	}
+
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if n, err := tty.Read(buf); err != nil || n == 0 {
+				close(keys)
+				return
+			}
+			keys <- buf[0]
+		}
+	}()
+
+	for {
+		select {
+		case k, ok := <-keys:
+			if !ok {
+				return
+			}
+			o.fire(k)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readLines reads the one-shots from the terminal as lines, for --plain. The terminal stays
+// as it is, so screen readers echo what is typed. A line of a key fires it, any other line
+// is a query
+func (o *oneshots) readLines(ctx context.Context, tty *os.File) {
+	for k, q := range o.queries {
+		log.Printf("One-shot: type %c and enter for %q, or type a query", k, q)
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(tty)
+		for scanner.Scan() {
+			lines <- strings.TrimSpace(scanner.Text())
+		}
+		close(lines)
+	}()
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			if len(line) == 1 {
+				o.fire(line[0])
+			} else if line != "" {
+				o.fireQuery(line)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readKeys reads the keys pressed on the terminal, as they are pressed or, with plain, as
+// lines of which the first key counts and an empty line is a space. The returned function
+// restores the terminal
+func readKeys(tty *os.File, plain bool) (<-chan byte, func(), error) {
+	keys := make(chan byte)
+	if plain {
+		go func() {
+			scanner := bufio.NewScanner(tty)
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if line == "" {
+					line = " "
+				}
+				keys <- line[0]
+			}
+			close(keys)
+		}()
+		return keys, func() {}, nil
+	}
+
+	restore, err := cbreak(tty)
+	if err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if n, err := tty.Read(buf); err != nil || n == 0 {
+				close(keys)
+				return
+			}
+			keys <- buf[0]
+		}
+	}()
+
+	return keys, restore, nil
+}
+
+// cbreak puts the terminal in cbreak mode, so that keys are read as they are pressed,
+// and returns a function that restores its previous mode
+func cbreak(tty *os.File) (func(), error) {
+	cmd := exec.Command("stty", "-g")
+	cmd.Stdin = tty
+	saved, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("stty: %v", err)
+	}
+
+	cmd = exec.Command("stty", "cbreak", "-echo")
+	cmd.Stdin = tty
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("stty: %v", err)
+	}
+
+	return func() {
+		cmd := exec.Command("stty", strings.TrimSpace(string(saved)))
+		cmd.Stdin = tty
+		cmd.Run()
+	}, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// catalogURL is the page of a sound at the BBC Sound Effects website. %s is the location without the extension
+const catalogURL = "https://sound-effects.bbcrewind.co.uk/search?q=%s"
+
+// soundURL returns the url of the page of the sound in the online catalog
+func soundURL(template, location string) string {
+	return fmt.Sprintf(template, strings.TrimSuffix(location, ".wav"))
+}
+
+// openCommand implements the open command. It opens the pages of sounds of the index at
+// the BBC website in the browser
+func openCommand(args []string) error {
+	fs := flag.NewFlagSet("open", flag.ExitOnError)
+	printOnly := fs.Bool("print", false, "Print the urls, don't open them")
+	template := fs.String("url", catalogURL, "The `url` of the page of a sound, %s is its location without the extension")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames open [--print] [--url template] location...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	failed := false
+	for _, location := range fs.Args() {
+		location = normalizeLocation(location)
+		var descr string
+		err := db.QueryRow(`SELECT description FROM sounds WHERE location = ?`, location).Scan(&descr)
+		if err == sql.ErrNoRows {
+			log.Printf("Error:Open: %s is not in the index", location)
+			failed = true
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		url := soundURL(*template, location)
+		if *printOnly {
+			fmt.Println(url)
+			continue
+		}
+		log.Printf("Opening: %s %s", descr, url)
+		if err := openBrowser(url); err != nil {
+			log.Printf("Error:Open: %v", err)
+			failed = true
+		}
+	}
+	if failed {
+		return errors.New("some sounds couldn't be opened")
+	}
+
+	return nil
+}
+
+// normalizeLocation accepts the location of a sound as printed by --query, a path in
+// the cache, or without the extension
+func normalizeLocation(location string) string {
+	location = location[strings.LastIndex(location, "/")+1:]
+	location = strings.TrimSuffix(location, ".flac")
+	if !strings.HasSuffix(location, ".wav") {
+		location += ".wav"
+	}
+
+	return location
+}
+
+// openBrowser opens url in the browser of $BROWSER, or the default browser of the desktop
+func openBrowser(url string) error {
+	browser := os.Getenv("BROWSER")
+	if browser == "" {
+		browser = "xdg-open"
+	}
+	cmd := exec.Command(browser, url)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s: %v: %s", browser, err, msg)
+		}
+		return fmt.Errorf("%s: %v", browser, err)
+	}
+
+	return nil
+}
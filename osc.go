@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+)
+
+var oscAddr = flag.String("osc", "", "Accept OSC (Open Sound Control) messages on the UDP `addr`, like :9000")
+
+// The OSC methods of thames are
+//
+//	/thames/gain group volume    set the volume of a query group when mixing
+//	/thames/oneshot query        fire a one-shot of query
+//	/thames/preset file          replace the session with a preset
+//	/thames/skip query           skip the remaining sounds of a query, or query group
+//	/thames/stop                 stop the session
+//
+// Volumes may be floats or integers. Bundles are accepted and their
+// time tags ignored, messages execute as they arrive
+
+// oscMessage is a decoded OSC message
+type oscMessage struct {
+	address string
+	args    []interface{} // string, int32 or float32
+}
+
+// serveOSC receives OSC messages on addr and applies them to the controls until ctx is done
+func serveOSC(ctx context.Context, addr string, ctl *controls) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	log.Printf("OSC: listening at %s", conn.LocalAddr())
+
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		msgs, err := parseOSC(buf[:n])
+		if err != nil {
+			log.Printf("Error:OSC: %v", err)
+			continue
+		}
+		for _, m := range msgs {
+			if err := applyOSC(m, ctl); err != nil {
+				log.Printf("Error:OSC: %s: %v", m.address, err)
+				pipelineErrors.report("osc", m.address, err)
+			}
+		}
+	}
+}
+
+func applyOSC(m oscMessage, ctl *controls) error {
+	switch m.address {
+	case "/thames/gain":
+		if len(m.args) != 2 {
+			return errors.New("expected group and volume")
+		}
+		group, ok := m.args[0].(string)
+		if !ok {
+			return errors.New("group is not a string")
+		}
+		var gain float64
+		switch v := m.args[1].(type) {
+		case float32:
+			// the shortest decimal of the float32, 0.3 and not 0.30000001
+			gain, _ = strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+		case int32:
+			gain = float64(v)
+		default:
+			return errors.New("volume is not a number")
+		}
+		if !ctl.setGain(group, gain) {
+			return fmt.Errorf("no group %q in the session", group)
+		}
+	case "/thames/oneshot":
+		query, ok := oscString(m)
+		if !ok {
+			return errors.New("expected a query")
+		}
+		ctl.fire(query)
+	case "/thames/preset":
+		fpath, ok := oscString(m)
+		if !ok {
+			return errors.New("expected a preset file")
+		}
+		ctl.switchPreset(fpath)
+	case "/thames/skip":
+		query, ok := oscString(m)
+		if !ok {
+			return errors.New("expected a query")
+		}
+		ctl.skip(query)
+	case "/thames/seek":
+		var words []string
+		for _, a := range m.args {
+			s, ok := a.(string)
+			if !ok {
+				return errors.New("expected strings, the group if any and the offset")
+			}
+			words = append(words, s)
+		}
+		group, target, err := seekArgs(words)
+		if err != nil {
+			return err
+		}
+		return ctl.seek(group, target)
+	case "/thames/stop":
+		ctl.stop()
+	default:
+		return errors.New("unknown method")
+	}
+
+	return nil
+}
+
+func oscString(m oscMessage) (string, bool) {
+	if len(m.args) != 1 {
+		return "", false
+	}
+	s, ok := m.args[0].(string)
+
+	return s, ok
+}
+
+// parseOSC decodes a packet, a message or a bundle, into its messages
+func parseOSC(packet []byte) ([]oscMessage, error) {
+	if bytes.HasPrefix(packet, []byte("#bundle\x00")) {
+		var msgs []oscMessage
+		off := 16 // the bundle tag and the time tag
+		for off+4 <= len(packet) {
+			size := int(binary.BigEndian.Uint32(packet[off:]))
+			off += 4
+			if size < 0 || off+size > len(packet) {
+				return nil, errors.New("bad bundle element size")
+			}
+			elem, err := parseOSC(packet[off : off+size])
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, elem...)
+			off += size
+		}
+		return msgs, nil
+	}
+
+	address, off, err := oscReadString(packet, 0)
+	if err != nil {
+		return nil, err
+	}
+	m := oscMessage{address: address}
+	if off >= len(packet) {
+		// old implementations may omit the type tags of messages without arguments
+		return []oscMessage{m}, nil
+	}
+
+	tags, off, err := oscReadString(packet, off)
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) == 0 || tags[0] != ',' {
+		return nil, errors.New("missing type tags")
+	}
+	for _, tag := range tags[1:] {
+		switch tag {
+		case 's':
+			var s string
+			if s, off, err = oscReadString(packet, off); err != nil {
+				return nil, err
+			}
+			m.args = append(m.args, s)
+		case 'i':
+			if off+4 > len(packet) {
+				return nil, errors.New("short int argument")
+			}
+			m.args = append(m.args, int32(binary.BigEndian.Uint32(packet[off:])))
+			off += 4
+		case 'f':
+			if off+4 > len(packet) {
+				return nil, errors.New("short float argument")
+			}
+			m.args = append(m.args, math.Float32frombits(binary.BigEndian.Uint32(packet[off:])))
+			off += 4
+		default:
+			return nil, fmt.Errorf("unsupported type tag %q", tag)
+		}
+	}
+
+	return []oscMessage{m}, nil
+}
+
+// oscReadString reads the zero terminated, padded to 4 bytes, string at off
+func oscReadString(packet []byte, off int) (string, int, error) {
+	end := bytes.IndexByte(packet[off:], 0)
+	if end < 0 {
+		return "", 0, errors.New("unterminated string")
+	}
+	s := string(packet[off : off+end])
+	off += (end + 4) &^ 3
+
+	return s, off, nil
+}
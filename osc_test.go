@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// oscPad returns s zero terminated and padded to 4 bytes, as OSC strings are
+func oscPad(s string) []byte {
+	b := append([]byte(s), 0)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+
+	return b
+}
+
+func oscAppendUint32(b []byte, v uint32) []byte {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], v)
+
+	return append(b, n[:]...)
+}
+
+// oscPacket encodes a message of the arguments, string, int32 or float32
+func oscPacket(address string, args ...interface{}) []byte {
+	tags := ","
+	var data []byte
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			tags += "s"
+			data = append(data, oscPad(v)...)
+		case int32:
+			tags += "i"
+			data = oscAppendUint32(data, uint32(v))
+		case float32:
+			tags += "f"
+			data = oscAppendUint32(data, math.Float32bits(v))
+		}
+	}
+
+	return append(append(oscPad(address), oscPad(tags)...), data...)
+}
+
+// oscBundle encodes a bundle of the elements
+func oscBundle(elems ...[]byte) []byte {
+	b := append([]byte("#bundle\x00"), make([]byte, 8)...)
+	for _, e := range elems {
+		b = oscAppendUint32(b, uint32(len(e)))
+		b = append(b, e...)
+	}
+
+	return b
+}
+
+func TestParseOSC(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		msgs   []oscMessage // nil if the packet is rejected
+	}{
+		{"string", oscPacket("/thames/skip", "rain"),
+			[]oscMessage{{"/thames/skip", []interface{}{"rain"}}}},
+		{"int and float", oscPacket("/thames/gain", "rain", int32(1), float32(0.5)),
+			[]oscMessage{{"/thames/gain", []interface{}{"rain", int32(1), float32(0.5)}}}},
+		{"no arguments", oscPacket("/thames/stop"), []oscMessage{{address: "/thames/stop"}}},
+		{"no type tags", oscPad("/thames/stop"), []oscMessage{{address: "/thames/stop"}}},
+		{"padded to 4", oscPacket("/abc", "wxyz"), []oscMessage{{"/abc", []interface{}{"wxyz"}}}},
+		{"bundle", oscBundle(oscPacket("/thames/stop"), oscBundle(oscPacket("/thames/oneshot", "door"))),
+			[]oscMessage{{address: "/thames/stop"}, {"/thames/oneshot", []interface{}{"door"}}}},
+		{"empty bundle", oscBundle(), []oscMessage{}},
+		{"unterminated", []byte("/thames/stop"), nil},
+		{"missing tags", append(oscPad("/thames/skip"), oscPad("s")...), nil},
+		{"short int", append(append(oscPad("/thames/gain"), oscPad(",i")...), 0, 0), nil},
+		{"unsupported tag", append(append(oscPad("/thames/gain"), oscPad(",b")...), 0, 0, 0, 0), nil},
+		{"bad element size", append(oscBundle(), 0, 0, 1, 0), nil},
+	}
+	for _, tt := range tests {
+		msgs, err := parseOSC(tt.packet)
+		if tt.msgs == nil {
+			if err == nil {
+				t.Errorf("%s: accepted %q as %v", tt.name, tt.packet, msgs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if len(msgs) != len(tt.msgs) || len(msgs) > 0 && !reflect.DeepEqual(msgs, tt.msgs) {
+			t.Errorf("%s: %v, expected %v", tt.name, msgs, tt.msgs)
+		}
+	}
+}
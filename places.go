@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	_ "embed"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// The places of the sounds are found in their descriptions, and in the places of the newer
+// editions of the csv, by the names of a gazetteer, when the index is created. The gazetteer
+// of thames has the places the archive was recorded at most, and gazetteer.csv in the root
+// adds more, or corrects them. Its columns are name, lat, lon and km, the extent of the place
+// around its center, like 25 for London and 1 for Big Ben. thames places --extract finds the
+// places again after editing it
+
+var (
+	nearPlace  = flag.String("near", "", "Select only sounds recorded near `place`, a name of the gazetteer like London or lat,lon. See thames places")
+	nearRadius = flag.Float64("radius", 10, "The `km` around the place of --near, beyond its extent")
+)
+
+//go:embed gazetteer.csv
+var builtinGazetteer []byte
+
+const placesSchema = `CREATE TABLE IF NOT EXISTS places(
+                        location TEXT NOT NULL,
+                        place TEXT NOT NULL,  -- the name of the gazetteer
+                        lat REAL NOT NULL,
+                        lon REAL NOT NULL,
+                        PRIMARY KEY(location, place)
+                      )`
+
+// place is a place of the gazetteer
+type place struct {
+	name     string
+	lat, lon float64
+	km       float64 // the extent around lat, lon
+}
+
+// gazetteer has the places by their names in lower case
+type gazetteer struct {
+	places   map[string]place
+	maxWords int // of the longest name
+}
+
+var (
+	gazetteerOnce sync.Once
+	gazetteerData *gazetteer
+	gazetteerErr  error
+)
+
+// loadGazetteer returns the gazetteer of thames with the places of gazetteer.csv of the root
+func loadGazetteer() (*gazetteer, error) {
+	gazetteerOnce.Do(func() {
+		g := &gazetteer{places: make(map[string]place)}
+		if err := g.read(bytes.NewReader(builtinGazetteer)); err != nil {
+			gazetteerErr = fmt.Errorf("gazetteer: %v", err)
+			return
+		}
+		fpath := filepath.Join(*rootDir, "gazetteer.csv")
+		if fin, err := os.Open(fpath); err == nil {
+			defer fin.Close()
+			if err := g.read(fin); err != nil {
+				gazetteerErr = fmt.Errorf("%s: %v", fpath, err)
+				return
+			}
+		} else if !os.IsNotExist(err) {
+			gazetteerErr = err
+			return
+		}
+		gazetteerData = g
+	})
+
+	return gazetteerData, gazetteerErr
+}
+
+// read adds the places of a csv with a header of name, lat, lon and km
+func (g *gazetteer) read(r io.Reader) error {
+	c := csv.NewReader(r)
+	c.FieldsPerRecord = 4
+	c.TrimLeadingSpace = true
+	records, err := c.ReadAll()
+	if err != nil {
+		return err
+	}
+	for i, rec := range records {
+		if i == 0 && strings.EqualFold(rec[0], "name") {
+			continue
+		}
+		p := place{name: strings.TrimSpace(rec[0])}
+		var errs [3]error
+		p.lat, errs[0] = strconv.ParseFloat(rec[1], 64)
+		p.lon, errs[1] = strconv.ParseFloat(rec[2], 64)
+		p.km, errs[2] = strconv.ParseFloat(rec[3], 64)
+		for _, err := range errs {
+			if err != nil {
+				return fmt.Errorf("line %d: %v", i+1, err)
+			}
+		}
+		if p.name == "" || math.Abs(p.lat) > 90 || math.Abs(p.lon) > 180 || p.km < 0 {
+			return fmt.Errorf("line %d: bad place %q", i+1, strings.Join(rec, ","))
+		}
+		g.places[strings.ToLower(p.name)] = p
+		if n := len(strings.Fields(p.name)); n > g.maxWords {
+			g.maxWords = n
+		}
+	}
+
+	return nil
+}
+
+var coordinatesRe = regexp.MustCompile(`^\s*(-?[0-9.]+)\s*,\s*(-?[0-9.]+)\s*$`)
+
+// resolve returns the place of --near, a name of the gazetteer or lat,lon
+func (g *gazetteer) resolve(s string) (place, error) {
+	if m := coordinatesRe.FindStringSubmatch(s); m != nil {
+		lat, err1 := strconv.ParseFloat(m[1], 64)
+		lon, err2 := strconv.ParseFloat(m[2], 64)
+		if err1 == nil && err2 == nil && math.Abs(lat) <= 90 && math.Abs(lon) <= 180 {
+			return place{name: s, lat: lat, lon: lon}, nil
+		}
+	}
+	if p, ok := g.places[strings.ToLower(strings.TrimSpace(s))]; ok {
+		return p, nil
+	}
+
+	return place{}, fmt.Errorf(tr("--near: %q is not a place of the gazetteer or lat,lon, thames places lists them"), s)
+}
+
+// checkNear checks that the place of --near is known
+func checkNear() error {
+	if *nearPlace == "" {
+		return nil
+	}
+	g, err := loadGazetteer()
+	if err != nil {
+		return err
+	}
+	_, err = g.resolve(*nearPlace)
+
+	return err
+}
+
+// find returns the places named in text. Names are proper nouns, they start with a capital
+// letter, and the longest name wins, so New York isn't York
+func (g *gazetteer) find(text string) []place {
+	text = strings.NewReplacer("'", "", "’", "", ".", "").Replace(text)
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var found []place
+	seen := make(map[string]bool)
+	for i := 0; i < len(words); i++ {
+		if r := []rune(words[i]); !unicode.IsUpper(r[0]) {
+			continue
+		}
+		for n := g.maxWords; n > 0; n-- {
+			if i+n > len(words) {
+				continue
+			}
+			p, ok := g.places[strings.ToLower(strings.Join(words[i:i+n], " "))]
+			if !ok {
+				continue
+			}
+			if !seen[p.name] {
+				seen[p.name] = true
+				found = append(found, p)
+			}
+			i += n - 1
+			break
+		}
+	}
+
+	return found
+}
+
+// indexPlaces finds the places of all the sounds of the index, replacing the old ones
+func indexPlaces(tx *sql.Tx) error {
+	g, err := loadGazetteer()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(placesSchema); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM places`); err != nil {
+		return err
+	}
+
+	type text struct{ location, descr, place string }
+	var texts []text
+	rows, err := tx.Query(`SELECT sounds.location, description, coalesce(extras.place, '')
+                               FROM sounds LEFT JOIN extras ON extras.location = sounds.location`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var t text
+		if err := rows.Scan(&t.location, &t.descr, &t.place); err != nil {
+			rows.Close()
+			return err
+		}
+		texts = append(texts, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO places(location, place, lat, lon) VALUES(?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, t := range texts {
+		for _, p := range g.find(t.place + ", " + t.descr) {
+			if _, err := stmt.Exec(t.location, p.name, p.lat, p.lon); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// migratePlaces finds the places of the sounds of indexes older than the places table
+func migratePlaces(db *sql.DB) error {
+	var n int
+	if err := db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'places'`).Scan(&n); err != nil || n > 0 {
+		return err
+	}
+
+	return reindexPlaces(db)
+}
+
+func reindexPlaces(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := indexPlaces(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// sqlDistance is the sql function distance(lat1, lon1, lat2, lon2), the great circle distance
+// in km
+func sqlDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371
+	rad := math.Pi / 180
+	dlat, dlon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dlon/2)*math.Sin(dlon/2)
+
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// readPlaces returns the names of the places of the sounds, by location
+func readPlaces(db *sql.DB, locations []string) (map[string][]string, error) {
+	places := make(map[string][]string)
+	for _, location := range locations {
+		rows, err := db.Query(`SELECT place FROM places WHERE location = ? ORDER BY place`, location)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var p string
+			if err := rows.Scan(&p); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			places[location] = append(places[location], p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return places, nil
+}
+
+// placesCommand implements the places command. It lists the places of the sounds, with their
+// number, or finds them again with the gazetteer
+func placesCommand(args []string) error {
+	fs := flag.NewFlagSet("places", flag.ExitOnError)
+	extract := fs.Bool("extract", false, "Find the places of the sounds again, after editing gazetteer.csv")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames places [--extract]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *extract {
+		if err := reindexPlaces(db); err != nil {
+			return err
+		}
+	}
+
+	places, err := readPlaceCounts(db)
+	if err != nil {
+		return err
+	}
+	for _, p := range places {
+		fmt.Printf("%6d  %-24s %8.3f %8.3f\n", p.sounds, p.name, p.lat, p.lon)
+	}
+
+	return nil
+}
+
+// placeCount is a place of the sounds with their number
+type placeCount struct {
+	place
+	sounds int
+}
+
+// readPlaceCounts returns the places of the sounds, those of the most sounds first
+func readPlaceCounts(db *sql.DB) ([]placeCount, error) {
+	rows, err := db.Query(`SELECT place, lat, lon, count(*) FROM places GROUP BY place ORDER BY count(*) DESC, place`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var places []placeCount
+	for rows.Next() {
+		var p placeCount
+		if err := rows.Scan(&p.name, &p.lat, &p.lon, &p.sounds); err != nil {
+			return nil, err
+		}
+		places = append(places, p)
+	}
+
+	return places, rows.Err()
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+var (
+	noColor     = flag.Bool("no-color", false, "Don't emphasize with colors or bold, like when NO_COLOR is set")
+	plainOutput = flag.Bool("plain", false, "Plain output for screen readers and serial consoles: no colors, one-shots and --browse read as lines and not as single keys")
+)
+
+// colorOutput reports whether f is a terminal that may be written ANSI escapes
+func colorOutput(f *os.File) bool {
+	if *noColor || *plainOutput || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+
+	return isTerminal(f)
+}
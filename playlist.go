@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var playlistFile = flag.String("export", "", "Write the sounds of --query, or the sounds played in the session, to the playlist `file`, m3u or json by its extension, for other players")
+
+// The playlists of --export open the sounds in other players, like VLC or mpd. Their entries
+// are the files of the cache, with absolute paths, or the urls of the sources for the sounds
+// of --query that aren't cached, which most players stream. The m3u playlists are extended, with
+// the descriptions and the durations, and thames attribution reads them
+
+// playlistEntry is a sound of a json playlist
+type playlistEntry struct {
+	Location    string `json:"location"`
+	Description string `json:"description"`
+	Secs        int    `json:"secs"`
+	Query       string `json:"query"`
+	Path        string `json:"path"` // the file, or the url
+}
+
+// playlistFormat returns the format of the playlist at fpath by its extension, empty if unknown
+func playlistFormat(fpath string) string {
+	switch strings.ToLower(filepath.Ext(fpath)) {
+	case ".m3u", ".m3u8":
+		return "m3u"
+	case ".json":
+		return "json"
+	}
+
+	return ""
+}
+
+// playlist collects the sounds played in a session, for --export. The methods of a nil
+// playlist do nothing
+type playlist struct {
+	sync.Mutex
+
+	sounds []sound
+}
+
+// sessionPlaylist is the playlist of the session, nil without --export
+var sessionPlaylist *playlist
+
+func (p *playlist) add(snd sound) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	p.sounds = append(p.sounds, snd)
+}
+
+// write writes the sounds played so far to the playlist of --export
+func (p *playlist) write() error {
+	if p == nil {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	return writePlaylist(*playlistFile, p.sounds)
+}
+
+// resolvedPath returns where other players find snd: its file in the cache, with an absolute
+// path, otherwise its url at the first source with urls, like --copy, or at the CDN
+func resolvedPath(snd sound) string {
+	abs := func(fpath string) string {
+		if p, err := filepath.Abs(fpath); err == nil {
+			return p
+		}
+		return fpath
+	}
+	if sp, exists, _ := cachedPath(soundsDir, snd.fname); exists {
+		return abs(sp)
+	}
+	for _, src := range extraSources {
+		if u, ok := src.(urlSource); ok {
+			return u.url(snd.fname)
+		}
+	}
+	if *cdnURL != "" {
+		return newHTTPSource(*cdnURL).url(snd.fname)
+	}
+
+	return abs(snd.fpath)
+}
+
+// writePlaylist writes the sounds to the playlist fpath, in the format of its extension
+func writePlaylist(fpath string, sounds []sound) error {
+	var data []byte
+	switch playlistFormat(fpath) {
+	case "m3u":
+		var b strings.Builder
+		b.WriteString("#EXTM3U\n")
+		for _, snd := range sounds {
+			fmt.Fprintf(&b, "#EXTINF:%d,%s\n%s\n", snd.secs, strings.Join(strings.Fields(snd.descr), " "), resolvedPath(snd))
+		}
+		data = []byte(b.String())
+	case "json":
+		entries := []playlistEntry{}
+		for _, snd := range sounds {
+			entries = append(entries, playlistEntry{snd.fname, snd.descr, snd.secs, snd.query, resolvedPath(snd)})
+		}
+		var err error
+		if data, err = json.MarshalIndent(entries, "", "  "); err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	default:
+		return fmt.Errorf(tr("unknown playlist format of %s, expected .m3u or .json"), fpath)
+	}
+
+	return ioutil.WriteFile(fpath, data, 0644)
+}
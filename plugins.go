@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plugins extend thames without forking it. A plugin is an executable in the plugins directory
+// of the root directory, that thames starts and talks to with json messages, one per line, on
+// its stdin and stdout, like JSON-RPC. Its stderr is that of thames. First thames asks
+//
+//	{"id": 1, "method": "hello", "params": {"thames": 1}}
+//
+// and the plugin replies with its name and what it does
+//
+//	{"id": 1, "result": {"name": "no-dogs", "kinds": ["filter", "notify", "control"]}}
+//
+// A filter is asked about the sounds selected for each query, and replies with a keep for each
+//
+//	{"id": 2, "method": "filter", "params": {"sounds": [{"location": "07070051.wav", ...}]}}
+//	{"id": 2, "result": {"keep": [false]}}
+//
+// A notify plugin, a sink, is told about each sound that starts playing, with no reply
+//
+//	{"method": "playing", "params": {"location": "07070051.wav", "description": "...", ...}}
+//
+// and about each change of the volume of the mix by the schedule, 100 when it is back
+//
+//	{"method": "schedule", "params": {"volume": 30, "reason": "Standup"}}
+//
+// A control plugin, like a controller of the parameters of the effects, sends commands at
+// any time, with no id: gain {group, volume}, oneshot {query}, preset {file}, skip {query},
+// seek {group, offset} and stop
+//
+//	{"method": "gain", "params": {"group": "rain", "volume": 0.5}}
+
+const pluginVersion = 1
+
+// pluginTimeout is how long thames waits for the replies of a plugin
+const pluginTimeout = 5 * time.Second
+
+// pluginsDir is the directory of the plugins
+func pluginsDir() string {
+	return filepath.Join(*rootDir, "plugins")
+}
+
+// pluginMessage is a message to or from a plugin. Requests and their replies have an id,
+// notifications and commands don't
+type pluginMessage struct {
+	ID     int64           `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// pluginSound is a sound as plugins see it
+type pluginSound struct {
+	Location    string `json:"location"`
+	Description string `json:"description"`
+	Secs        int    `json:"secs"`
+	Query       string `json:"query"`
+	Group       string `json:"group,omitempty"`
+}
+
+func toPluginSound(snd sound) pluginSound {
+	return pluginSound{snd.fname, snd.descr, snd.secs, snd.query, snd.group}
+}
+
+// plugin is a running plugin
+type plugin struct {
+	name  string
+	path  string
+	kinds map[string]bool
+
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	mu      sync.Mutex // guards the writes, the ids and the pending requests
+	lastID  int64
+	pending map[int64]chan pluginMessage
+	dead    bool
+
+	commands chan pluginMessage // of a control plugin
+}
+
+// startPlugin starts the plugin at path and asks it what it does
+func startPlugin(path string) (*plugin, error) {
+	p := &plugin{name: filepath.Base(path), path: path, kinds: make(map[string]bool),
+		pending: make(map[int64]chan pluginMessage), commands: make(chan pluginMessage, 16)}
+
+	p.cmd = exec.Command(path)
+	p.cmd.Stderr = os.Stderr
+	stdin, err := p.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	p.stdin = stdin
+	if err := p.cmd.Start(); err != nil {
+		return nil, err
+	}
+	go p.read(stdout)
+
+	var hello struct {
+		Name  string   `json:"name"`
+		Kinds []string `json:"kinds"`
+	}
+	if err := p.call(context.Background(), "hello", map[string]int{"thames": pluginVersion}, &hello); err != nil {
+		p.stop()
+		return nil, err
+	}
+	if hello.Name != "" {
+		p.name = hello.Name
+	}
+	for _, k := range hello.Kinds {
+		p.kinds[k] = true
+	}
+
+	return p, nil
+}
+
+// read receives the messages of the plugin until it exits
+func (p *plugin) read(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var m pluginMessage
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			log.Printf("Error:Plugin: %s: %v", p.name, err)
+			continue
+		}
+		if m.Method != "" {
+			select {
+			case p.commands <- m:
+			default:
+				log.Printf("Error:Plugin: %s: too many commands, %s dropped", p.name, m.Method)
+			}
+			continue
+		}
+
+		p.mu.Lock()
+		c := p.pending[m.ID]
+		delete(p.pending, m.ID)
+		p.mu.Unlock()
+		if c != nil {
+			c <- m
+		}
+	}
+
+	p.mu.Lock()
+	p.dead = true
+	for id, c := range p.pending {
+		close(c)
+		delete(p.pending, id)
+	}
+	p.mu.Unlock()
+	close(p.commands)
+}
+
+// send writes a message, of a request if id is not 0
+func (p *plugin) send(id int64, method string, params interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(pluginMessage{ID: id, Method: method, Params: data})
+	if err != nil {
+		return err
+	}
+
+	_, err = p.stdin.Write(append(line, '\n'))
+
+	return err
+}
+
+// call sends the request and decodes the result of the reply into result
+func (p *plugin) call(ctx context.Context, method string, params, result interface{}) error {
+	p.mu.Lock()
+	if p.dead {
+		p.mu.Unlock()
+		return errors.New("the plugin exited")
+	}
+	p.lastID++
+	id := p.lastID
+	c := make(chan pluginMessage, 1)
+	p.pending[id] = c
+	err := p.send(id, method, params)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pluginTimeout)
+	defer cancel()
+	select {
+	case m, ok := <-c:
+		if !ok {
+			return errors.New("the plugin exited")
+		}
+		if m.Error != "" {
+			return errors.New(m.Error)
+		}
+		return json.Unmarshal(m.Result, result)
+	case <-ctx.Done():
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+		return fmt.Errorf("%s: no reply in %s", method, pluginTimeout)
+	}
+}
+
+// notify sends a notification, without waiting for the plugin
+func (p *plugin) notify(method string, params interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.dead {
+		if err := p.send(0, method, params); err != nil {
+			log.Printf("Error:Plugin: %s: %v", p.name, err)
+		}
+	}
+}
+
+// stop closes the stdin of the plugin, which should exit, and waits for it
+func (p *plugin) stop() {
+	p.stdin.Close()
+	done := make(chan bool)
+	go func() {
+		p.cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(pluginTimeout):
+		p.cmd.Process.Kill()
+		<-done
+	}
+}
+
+func (p *plugin) kindNames() string {
+	var kinds []string
+	for k := range p.kinds {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+
+	return strings.Join(kinds, ",")
+}
+
+// pluginSet is the plugins that run
+type pluginSet []*plugin
+
+// activePlugins are the plugins that run, nil if none
+var activePlugins pluginSet
+
+// findPlugins returns the executables of the plugins directory
+func findPlugins() ([]string, error) {
+	infos, err := ioutil.ReadDir(pluginsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, info := range infos {
+		if info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			paths = append(paths, filepath.Join(pluginsDir(), info.Name()))
+		}
+	}
+
+	return paths, nil
+}
+
+// startPlugins starts the plugins of the plugins directory. Those that fail to start are
+// left out. The returned function stops them
+func startPlugins() func() {
+	paths, err := findPlugins()
+	if err != nil {
+		log.Printf("Error:Plugin: %v", err)
+	}
+
+	for _, path := range paths {
+		p, err := startPlugin(path)
+		if err != nil {
+			log.Printf("Error:Plugin: %s: %v", filepath.Base(path), err)
+			pipelineErrors.report("plugin", filepath.Base(path), err)
+			continue
+		}
+		log.Printf("Plugin: %s %s", p.name, p.kindNames())
+		activePlugins = append(activePlugins, p)
+	}
+
+	return func() {
+		for _, p := range activePlugins {
+			p.stop()
+		}
+	}
+}
+
+// filter returns the sounds that all the filter plugins keep. A plugin that fails keeps all
+func (ps pluginSet) filter(ctx context.Context, sounds []sound) []sound {
+	for _, p := range ps {
+		if !p.kinds["filter"] || len(sounds) == 0 {
+			continue
+		}
+
+		params := struct {
+			Sounds []pluginSound `json:"sounds"`
+		}{}
+		for _, snd := range sounds {
+			params.Sounds = append(params.Sounds, toPluginSound(snd))
+		}
+		var result struct {
+			Keep []bool `json:"keep"`
+		}
+		err := p.call(ctx, "filter", params, &result)
+		if err == nil && len(result.Keep) != len(sounds) {
+			err = fmt.Errorf("filter: %d keeps for %d sounds", len(result.Keep), len(sounds))
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Error:Plugin: %s: %v", p.name, err)
+				pipelineErrors.report("plugin", p.name, err)
+			}
+			continue
+		}
+
+		var kept []sound
+		for i, snd := range sounds {
+			if result.Keep[i] {
+				kept = append(kept, snd)
+			}
+		}
+		sounds = kept
+	}
+
+	return sounds
+}
+
+// notify tells the notify plugins that the sound started playing
+func (ps pluginSet) playing(snd sound) {
+	for _, p := range ps {
+		if p.kinds["notify"] {
+			p.notify("playing", toPluginSound(snd))
+		}
+	}
+}
+
+// scheduled tells the notify plugins that the schedule set the volume of the mix, for reason
+func (ps pluginSet) scheduled(volume int, reason string) {
+	for _, p := range ps {
+		if p.kinds["notify"] {
+			p.notify("schedule", struct {
+				Volume int    `json:"volume"`
+				Reason string `json:"reason"`
+			}{volume, reason})
+		}
+	}
+}
+
+// control applies the commands of the control plugins to the controls until ctx is done
+func (ps pluginSet) control(ctx context.Context, ctl *controls) {
+	for _, p := range ps {
+		if !p.kinds["control"] {
+			continue
+		}
+		go func(p *plugin) {
+			for {
+				select {
+				case m, ok := <-p.commands:
+					if !ok {
+						return
+					}
+					if err := applyPluginCommand(m, ctl); err != nil {
+						log.Printf("Error:Plugin: %s: %s: %v", p.name, m.Method, err)
+						pipelineErrors.report("plugin", p.name, err)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(p)
+	}
+}
+
+func applyPluginCommand(m pluginMessage, ctl *controls) error {
+	var params struct {
+		Group  string   `json:"group"`
+		Volume *float64 `json:"volume"`
+		Query  string   `json:"query"`
+		File   string   `json:"file"`
+		Offset string   `json:"offset"`
+	}
+	if len(m.Params) > 0 {
+		if err := json.Unmarshal(m.Params, &params); err != nil {
+			return err
+		}
+	}
+
+	switch m.Method {
+	case "gain":
+		if params.Group == "" || params.Volume == nil || *params.Volume < 0 {
+			return errors.New("expected a group and a volume")
+		}
+		if !ctl.setGain(params.Group, *params.Volume) {
+			return fmt.Errorf("no group %q in the session", params.Group)
+		}
+	case "oneshot":
+		if params.Query == "" {
+			return errors.New("expected a query")
+		}
+		ctl.fire(params.Query)
+	case "preset":
+		if params.File == "" {
+			return errors.New("expected a preset file")
+		}
+		ctl.switchPreset(params.File)
+	case "skip":
+		if params.Query == "" {
+			return errors.New("expected a query")
+		}
+		ctl.skip(params.Query)
+	case "seek":
+		target, err := parseSeek(strings.Fields(params.Offset))
+		if err != nil {
+			return err
+		}
+		return ctl.seek(params.Group, target)
+	case "stop":
+		ctl.stop()
+	default:
+		return errors.New("unknown command")
+	}
+
+	return nil
+}
+
+// pluginsCommand implements the plugins command. It lists the plugins and what they do
+func pluginsCommand(args []string) error {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "usage: thames plugins\n")
+		return errUsage
+	}
+
+	paths, err := findPlugins()
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		log.Printf("No plugins in %s", pluginsDir())
+		return nil
+	}
+	for _, path := range paths {
+		p, err := startPlugin(path)
+		if err != nil {
+			fmt.Printf("%s\terror: %v\n", filepath.Base(path), err)
+			continue
+		}
+		fmt.Printf("%s\t%s\t%s\n", filepath.Base(path), p.name, p.kindNames())
+		p.stop()
+	}
+
+	return nil
+}
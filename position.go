@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// playback is a sound as it plays, where it is and where it is asked to go
+type playback struct {
+	snd    sound
+	length time.Duration
+	cues   []time.Duration // the cue points of the wav, in order
+	seeks  chan time.Duration
+	skips  chan bool
+
+	mu      sync.Mutex
+	from    time.Duration // where the player started
+	started time.Time
+}
+
+func newPlayback(snd sound) *playback {
+	p := &playback{snd: snd, length: time.Duration(snd.secs) * time.Second, seeks: make(chan time.Duration, 1), skips: make(chan bool, 1)}
+	if length, cues, err := wavMarkers(snd.fpath); err == nil {
+		p.length, p.cues = length, cues
+	}
+
+	return p
+}
+
+// restart records that the player starts again at from
+func (p *playback) restart(from time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.from = from
+	p.started = time.Now()
+}
+
+// position is how far the sound has played. The players decode in real time, so it is
+// where the player started and the time since
+func (p *playback) position() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pos := p.from + time.Since(p.started)
+	if p.length > 0 && pos > p.length {
+		pos = p.length
+	}
+
+	return pos
+}
+
+// seek asks the player to go to pos. If a seek is pending, the latest wins
+func (p *playback) seek(pos time.Duration) {
+	if pos < 0 {
+		pos = 0
+	}
+	if p.length > 0 && pos > p.length {
+		pos = p.length
+	}
+
+	select {
+	case p.seeks <- pos:
+	default:
+		select {
+		case <-p.seeks:
+		default:
+		}
+		p.seeks <- pos
+	}
+}
+
+// skip asks the player to stop the sound, the next one plays
+func (p *playback) skip() {
+	select {
+	case p.skips <- true:
+	default:
+	}
+}
+
+func (p *playback) String() string {
+	pos := p.position()
+
+	return fmt.Sprintf("%s\t%s\t%s/%s\t-%s\t%s", p.snd.group, p.snd.fname, formatPosition(pos),
+		formatPosition(p.length), formatPosition(p.length-pos.Truncate(time.Second)), p.snd.descr)
+}
+
+// formatPosition formats d as minutes and seconds, like 1:05
+func formatPosition(d time.Duration) string {
+	secs := int(d / time.Second)
+
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
+
+// playbacks are the sounds that a session plays
+type playbacks struct {
+	sync.Mutex
+
+	sounds []*playback // in the order they started
+}
+
+// playbacksKey is the key of the playbacks in the context of a session. Without it the
+// players play without tracking, like those of the one-shots
+type playbacksKey struct{}
+
+func (ps *playbacks) add(p *playback) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	ps.sounds = append(ps.sounds, p)
+}
+
+func (ps *playbacks) remove(p *playback) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	for i, q := range ps.sounds {
+		if q == p {
+			ps.sounds = append(ps.sounds[:i], ps.sounds[i+1:]...)
+			return
+		}
+	}
+}
+
+// playing returns the sounds of the group, or any sound if group is empty
+func (ps *playbacks) playing(group string) []*playback {
+	ps.Lock()
+	defer ps.Unlock()
+
+	var sounds []*playback
+	for _, p := range ps.sounds {
+		if group == "" || p.snd.group == group || p.snd.query == group {
+			sounds = append(sounds, p)
+		}
+	}
+
+	return sounds
+}
+
+// playTracked plays the sound like playSound. In a session it records where the sound
+// is, for the position command, starts it again wherever it is sought and stops it when it
+// is skipped
+func playTracked(ctx context.Context, snd sound, gain float64) error {
+	ps, ok := ctx.Value(playbacksKey{}).(*playbacks)
+	if !ok {
+		return playSound(ctx, snd.fpath, gain, 0)
+	}
+
+	p := newPlayback(snd)
+	ps.add(p)
+	defer ps.remove(p)
+
+	var from time.Duration
+	for {
+		pctx, cancel := context.WithCancel(ctx)
+		p.restart(from)
+		done := make(chan error, 1)
+		go func(from time.Duration) {
+			done <- playSound(pctx, snd.fpath, gain, from)
+		}(from)
+
+		select {
+		case err := <-done:
+			cancel()
+			return err
+		case from = <-p.seeks:
+			cancel()
+			<-done
+			log.Printf("Seek: %s %s/%s", snd.fname, formatPosition(from), formatPosition(p.length))
+		case <-p.skips:
+			cancel()
+			<-done
+			log.Printf("Skipped: %s %s", snd.fname, snd.descr)
+			return nil
+		}
+	}
+}
+
+// seekTarget is where to seek, relative to the position, to a position or to a cue point
+type seekTarget struct {
+	offset   time.Duration
+	relative bool
+	cue      int // the number of the cue point, from 1, 0 if none
+	nextCue  bool
+}
+
+// parseSeek parses the words of a seek, like +10, -10s, 1:30, cue 2 or cue next
+func parseSeek(words []string) (seekTarget, error) {
+	if len(words) == 2 && words[0] == "cue" {
+		if words[1] == "next" {
+			return seekTarget{nextCue: true}, nil
+		}
+		n, err := strconv.Atoi(words[1])
+		if err != nil || n < 1 {
+			return seekTarget{}, fmt.Errorf("bad cue %q, expected a number from 1 or next", words[1])
+		}
+		return seekTarget{cue: n}, nil
+	}
+	if len(words) != 1 {
+		return seekTarget{}, errors.New("expected an offset, like +10 or 1:30, or cue n")
+	}
+
+	v := words[0]
+	t := seekTarget{relative: strings.HasPrefix(v, "+") || strings.HasPrefix(v, "-")}
+	if ms := strings.SplitN(v, ":", 2); len(ms) == 2 && !t.relative {
+		m, merr := strconv.Atoi(ms[0])
+		s, serr := strconv.ParseFloat(ms[1], 64)
+		if merr != nil || serr != nil || m < 0 || s < 0 || s >= 60 {
+			return seekTarget{}, fmt.Errorf("bad position %q, expected like 1:30", v)
+		}
+		t.offset = time.Duration(m)*time.Minute + time.Duration(s*float64(time.Second))
+		return t, nil
+	}
+	if secs, err := strconv.ParseFloat(v, 64); err == nil && !math.IsInf(secs, 0) && !math.IsNaN(secs) {
+		t.offset = time.Duration(secs * float64(time.Second))
+	} else if d, err := time.ParseDuration(v); err == nil {
+		t.offset = d
+	} else {
+		return seekTarget{}, fmt.Errorf("bad offset %q, expected like +10, -10s or 1:30", v)
+	}
+	if !t.relative && t.offset < 0 {
+		return seekTarget{}, fmt.Errorf("bad position %q", v)
+	}
+
+	return t, nil
+}
+
+// resolve returns the position of the target in the sound p
+func (t seekTarget) resolve(p *playback) (time.Duration, error) {
+	switch {
+	case t.relative:
+		return p.position() + t.offset, nil
+	case t.nextCue:
+		pos := p.position()
+		for _, c := range p.cues {
+			// a cue just passed is not the next, the seek would repeat it
+			if c > pos+time.Second/2 {
+				return c, nil
+			}
+		}
+		return 0, fmt.Errorf("%s: no cue point after %s", p.snd.fname, formatPosition(pos))
+	case t.cue > 0:
+		if t.cue > len(p.cues) {
+			return 0, fmt.Errorf("%s: no cue point %d, the sound has %d", p.snd.fname, t.cue, len(p.cues))
+		}
+		return p.cues[t.cue-1], nil
+	}
+
+	return t.offset, nil
+}
+
+// wavMarkers reads the length and the cue points of the wav at fpath. Those of the archive
+// mark the takes of a recording, like the separate thunderclaps of a storm
+func wavMarkers(fpath string) (time.Duration, []time.Duration, error) {
+	fin, err := os.Open(fpath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer fin.Close()
+
+	head := make([]byte, 12)
+	if _, err := io.ReadFull(fin, head); err != nil || string(head[0:4]) != "RIFF" || string(head[8:12]) != "WAVE" {
+		return 0, nil, errors.New("not a wav file")
+	}
+
+	var sampleRate, byteRate, dataSize int64
+	var offsets []int64
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(fin, chunk); err != nil {
+			break
+		}
+		size := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		switch string(chunk[0:4]) {
+		case "fmt ", "cue ":
+			body := make([]byte, size)
+			if _, err := io.ReadFull(fin, body); err != nil {
+				return 0, nil, err
+			}
+			if string(chunk[0:4]) == "fmt " && size >= 16 {
+				sampleRate = int64(binary.LittleEndian.Uint32(body[4:]))
+				byteRate = int64(binary.LittleEndian.Uint32(body[8:]))
+			} else if size >= 4 {
+				// a count, then points of 24 bytes with the sample offset last
+				n := int64(binary.LittleEndian.Uint32(body))
+				for i := int64(0); i < n && 4+24*(i+1) <= size; i++ {
+					offsets = append(offsets, int64(binary.LittleEndian.Uint32(body[4+24*i+20:])))
+				}
+			}
+			if size%2 == 1 {
+				fin.Seek(1, io.SeekCurrent)
+			}
+			continue
+		case "data":
+			dataSize = size
+		}
+		// chunks are padded to an even size
+		if _, err := fin.Seek(size+size%2, io.SeekCurrent); err != nil {
+			break
+		}
+	}
+	if sampleRate == 0 || byteRate == 0 {
+		return 0, nil, errors.New("wav without a fmt chunk")
+	}
+
+	length := time.Duration(dataSize * int64(time.Second) / byteRate)
+	var cues []time.Duration
+	for _, o := range offsets {
+		cues = append(cues, time.Duration(o*int64(time.Second)/sampleRate))
+	}
+	sort.Slice(cues, func(i, j int) bool { return cues[i] < cues[j] })
+
+	return length, cues, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var presetFile = flag.String("preset", "", "Mix the queries of the preset `file`, with their volume automation")
+
+// A preset is a text file that describes a soundscape. Each line is a query, or a group of
+// queries in parentheses, followed by options. The lines are mixed, like with --mix.
+//
+//	# a rainy night
+//	rain gain=0.8 at=10m:0.8,12m:0.3
+//	thunder gain=0.5
+//	birds start=15m
+//
+// The options are
+//
+//	gain=v            the volume of the line, 1 is the volume of the recording
+//	at=t:v,t:v...     automation of the volume, at time t of the session the volume is v.
+//	                  Between the points the volume changes linearly
+//	start=t           the line starts playing at time t of the session
+//
+// Empty lines and lines starting with # are ignored
+
+// presetLine is a line of a preset
+type presetLine struct {
+	group queryGroup
+	auto  *automation
+}
+
+// automation controls the volume of a player over the session
+type automation struct {
+	gain  float64
+	keys  []keyframe // sorted by time
+	start time.Duration
+
+	since time.Time // the start of the session
+
+	// controllers like MIDI may set the volume by hand, overriding the automation
+	mu     sync.Mutex
+	manual float64
+	isSet  bool
+}
+
+type keyframe struct {
+	at   time.Duration
+	gain float64
+}
+
+var optionRe = regexp.MustCompile(`^[a-z]+=`)
+
+func loadPreset(fpath string) ([]presetLine, error) {
+	fpath = resolvePreset(fpath)
+	fin, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	var lines []presetLine
+	scanner := bufio.NewScanner(fin)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		line, err := parsePresetLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fpath, lineno, err)
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("%s: no queries", fpath)
+	}
+
+	return lines, nil
+}
+
+// presetGroups loads a preset and returns its groups with their automations
+func presetGroups(fpath string) ([]queryGroup, map[string]*automation, error) {
+	lines, err := loadPreset(fpath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var groups []queryGroup
+	autos := make(map[string]*automation)
+	for i := range lines {
+		groups = append(groups, lines[i].group)
+		autos[lines[i].group.name] = lines[i].auto
+	}
+
+	return groups, autos, nil
+}
+
+// parsePresetLine parses a line of a preset. The options are the trailing key=value
+// fields, everything before them is the query
+func parsePresetLine(text string) (presetLine, error) {
+	line := presetLine{auto: &automation{gain: 1}}
+
+	fields := strings.Fields(text)
+	n := len(fields)
+	for n > 0 && optionRe.MatchString(fields[n-1]) {
+		n--
+	}
+	if n == 0 {
+		return line, fmt.Errorf("no query")
+	}
+
+	for _, opt := range fields[n:] {
+		kv := strings.SplitN(opt, "=", 2)
+		var err error
+		switch kv[0] {
+		case "gain":
+			line.auto.gain, err = parseGain(kv[1])
+		case "at":
+			line.auto.keys, err = parseKeyframes(kv[1])
+		case "start":
+			line.auto.start, err = time.ParseDuration(kv[1])
+		default:
+			err = fmt.Errorf("unknown option %q", kv[0])
+		}
+		if err != nil {
+			return line, err
+		}
+	}
+
+	query := strings.Join(fields[:n], " ")
+	line.group = parseGroups([]string{query})[0]
+
+	return line, nil
+}
+
+func parseGain(v string) (float64, error) {
+	g, err := strconv.ParseFloat(v, 64)
+	if err != nil || g < 0 {
+		return 0, fmt.Errorf("bad gain %q", v)
+	}
+
+	return g, nil
+}
+
+func parseKeyframes(v string) ([]keyframe, error) {
+	var keys []keyframe
+	for _, point := range strings.Split(v, ",") {
+		tv := strings.SplitN(point, ":", 2)
+		if len(tv) != 2 {
+			return nil, fmt.Errorf("bad automation point %q", point)
+		}
+		at, err := time.ParseDuration(tv[0])
+		if err != nil {
+			return nil, err
+		}
+		g, err := parseGain(tv[1])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, keyframe{at, g})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].at < keys[j].at })
+
+	return keys, nil
+}
+
+// setGain sets the volume by hand, from now on the automation is ignored
+func (a *automation) setGain(g float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.manual = g
+	a.isSet = true
+}
+
+// gainAt returns the volume at time t of the session
+func (a *automation) gainAt(t time.Duration) float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.isSet {
+		return a.manual
+	}
+	if len(a.keys) == 0 || t < a.keys[0].at {
+		return a.gain
+	}
+
+	for i := 1; i < len(a.keys); i++ {
+		k0, k1 := a.keys[i-1], a.keys[i]
+		if t < k1.at {
+			frac := float64(t-k0.at) / float64(k1.at-k0.at)
+			return k0.gain + frac*(k1.gain-k0.gain)
+		}
+	}
+
+	return a.keys[len(a.keys)-1].gain
+}
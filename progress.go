@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+var progressStyle = flag.String("progress", "", "Show the progress of fetch, export and cache compress as a `style`: bar, percent or none. The default is the progress of thames.json, else a bar on a terminal and percent otherwise")
+
+// progressStyles are the ways to show the progress of long commands. bar redraws a line on
+// the terminal, percent prints a line every 10%, which works on serial consoles, braille
+// displays and in logs, and none shows nothing
+var progressStyles = map[string]bool{
+	"bar":     true,
+	"percent": true,
+	"none":    true,
+}
+
+// progress shows how many of the total steps of a command are done. The commands log
+// through it, so their lines don't mix with the bar
+type progress struct {
+	mu      sync.Mutex
+	name    string
+	style   string
+	total   int
+	done    int
+	percent int // last printed, for the percent style
+	drawn   bool
+}
+
+// newProgress returns the progress of total steps in the configured style
+func newProgress(name string, total int) *progress {
+	style := *progressStyle
+	if style == "" {
+		style = "bar"
+	}
+	if style == "bar" && (*plainOutput || !isTerminal(os.Stderr)) {
+		style = "percent"
+	}
+
+	return &progress{name: name, style: style, total: total, percent: -1}
+}
+
+// step records that one more step is done
+func (p *progress) step() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done++
+	p.show()
+}
+
+// logf logs a line, above the bar
+func (p *progress) logf(format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clear()
+	log.Printf(format, args...)
+	if p.drawn {
+		p.show()
+	}
+}
+
+// finish removes the bar, the lines of percent stay
+func (p *progress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clear()
+	p.drawn = false
+}
+
+func (p *progress) show() {
+	if p.total == 0 {
+		return
+	}
+	percent := p.done * 100 / p.total
+
+	switch p.style {
+	case "percent":
+		if percent/10 > p.percent/10 || p.done == p.total && percent > p.percent {
+			p.percent = percent
+			log.Printf("%s: %d%% %d/%d", p.name, percent, p.done, p.total)
+		}
+	case "bar":
+		const width = 30
+		filled := width * p.done / p.total
+		fmt.Fprintf(os.Stderr, "\r%s [%s%s] %3d%% %d/%d", p.name, strings.Repeat("#", filled), strings.Repeat(" ", width-filled), percent, p.done, p.total)
+		p.drawn = true
+	}
+}
+
+func (p *progress) clear() {
+	if p.style == "bar" && p.drawn {
+		fmt.Fprint(os.Stderr, "\r\x1b[K")
+	}
+}
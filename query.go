@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+)
+
+var (
+	onlyCached = flag.Bool("cached", false, "Select only sounds already in the cache, don't fetch anything")
+	grepDescr  = flag.String("grep", "", "Select only sounds whose description matches the `regexp`, for what the queries can't express, like \\b1930s\\b. (?i) ignores the case")
+	order      = flag.String("order", "random", "Order of the sounds of each query: random, alpha, tracknum or rank")
+	rankOrder  = flag.Bool("rank", false, "Order the sounds of each query by relevance, the best matches first. The same as --order rank")
+	minLength  = flag.Int("min-secs", 0, "Select only sounds of at least `n` seconds")
+	maxLength  = flag.Int("max-secs", 0, "Select only sounds of at most `n` seconds, 0 for any length")
+	warmStart  = flag.Bool("warm-start", true, "Play the cached sounds of each query first, while the others download, when the order is random")
+)
+
+var excludeCDs, excludeLocations, onlyCategories, onlyCDs stringsFlag
+
+func init() {
+	flag.Var(&excludeCDs, "exclude-cd", "Never select sounds of the CDs that match the `pattern`, like EC1* for the discs EC1xx. May be repeated")
+	flag.Var(&excludeLocations, "exclude-location", "Never select sounds whose location matches the `pattern`, like 0703*. May be repeated")
+	flag.Var(&onlyCategories, "category", "Select only sounds of `category` and its subcategories, like Birds. May be repeated")
+	flag.Var(&onlyCDs, "cd", "Select only sounds of the CDs whose name contains `name`, like Transport, or whose number is name, like EC1B. May be repeated")
+}
+
+// orderings are the ORDER BY clauses for the values of --order. Only random is not deterministic.
+// rank orders by the bm25 score of the query in the columns, the description weighs the most.
+// Queries without words, like @name or the empty one, are in random order
+var orderings = map[string]string{
+	"random":   "RANDOM()",
+	"alpha":    "description COLLATE NOCASE, sounds.location",
+	"tracknum": "CDNumber, CAST(tracknum AS INTEGER), sounds.location",
+	"rank":     "coalesce(ranked.score, 0), sounds.location",
+}
+
+// rankScore is the bm25 score of the sounds, by the weights of the columns of indexColumns
+const rankScore = "bm25(sounds, 0, 4, 0, 2, 0, 1, 0, 4)"
+
+// selection selects sounds from the index. Besides the full text query it applies the
+// restrictions of the profile and the command line
+type selection struct {
+	db *sql.DB
+
+	categories  []string // if not empty only sounds in these categories, or their subcategories
+	cachedOnly  bool     // only sounds already in the cache
+	maxSecs     int      // if not 0 only sounds cached or as short, on a metered connection
+	stereo      bool     // only sounds known to have two channels or more
+	minRate     int      // if not 0 only sounds known to be sampled at this rate or more
+	order       string   // a key of orderings
+	sampling    string   // how to select random sounds, a key of samplings
+	notes       bool     // queries also match the notes of the sounds
+	described   bool     // queries also match the descriptions of the users
+	lang        string   // queries also match the translations to lang, or to any language if empty
+	translated  bool     // there are translations to search
+	exact       bool     // queries are phrases
+	noStem      bool     // the words of the queries match as written
+	grep        string   // if not empty only sounds whose description matches the regexp
+	shortest    int      // if not 0 only sounds of at least so many seconds
+	longest     int      // if not 0 only sounds of at most so many seconds
+	cds         []string // if not empty only sounds of these CDs, by part of their names or by their numbers
+	excludes    []string // sql conditions of the --exclude patterns
+	excludeArgs []interface{}
+	rules       []smartRule
+	rng         *rand.Rand // draws the random selections, from the seed of the session
+	near        *place     // if not nil only sounds of places within nearKm of it
+	nearKm      float64
+	era         *era // if not nil only sounds of years in it
+}
+
+func newSelection(db *sql.DB) *selection {
+	s := new(selection)
+	s.db = db
+	s.rng = newSessionRand(sessionSeed)
+	s.categories = activeProfile.Categories
+	s.cachedOnly = *onlyCached
+	if !s.cachedOnly && !*onlyQuery && isMetered() {
+		s.maxSecs = meteredSecs()
+	}
+	s.stereo = *stereoOnly
+	s.minRate = *minSampleRate
+	s.order = *order
+	if *rankOrder {
+		s.order = "rank"
+	}
+	s.sampling = *sampling
+	s.notes = hasNotes(db)
+	s.described = hasDescriptions(db)
+	s.lang = *descriptionLang
+	s.translated = hasTranslations(db, s.lang)
+	s.exact = *exactQuery
+	s.grep = *grepDescr
+	// the categories are checked against the profile with the flags
+	s.restrictCategories(onlyCategories)
+	s.shortest, s.longest = *minLength, *maxLength
+	s.cds = onlyCDs
+	// patterns are globs, case insensitive for CD numbers written in any case
+	for _, p := range excludeCDs {
+		s.excludes = append(s.excludes, "NOT coalesce(upper(CDNumber) GLOB upper(?), 0)")
+		s.excludeArgs = append(s.excludeArgs, p)
+	}
+	for _, p := range excludeLocations {
+		s.excludes = append(s.excludes, "NOT (sounds.location GLOB ? OR sounds.location GLOB ?)")
+		s.excludeArgs = append(s.excludeArgs, p, p+".wav")
+	}
+	if *nearPlace != "" {
+		// validated with the flags
+		if g, err := loadGazetteer(); err == nil {
+			if p, err := g.resolve(*nearPlace); err == nil {
+				s.near, s.nearKm = &p, p.km+*nearRadius
+			}
+		}
+	}
+	if *sessionEra != "" {
+		if e, err := parseEra(*sessionEra); err == nil {
+			s.era = &e
+		}
+	}
+	s.noStem = *noStem || *exactQuery
+
+	return s
+}
+
+// restrictCategories narrows the selection to the categories. When the profile has an allowlist
+// the categories must be in it
+func (s *selection) restrictCategories(categories []string) error {
+	if len(categories) == 0 {
+		return nil
+	}
+
+	if len(s.categories) > 0 {
+		for _, c := range categories {
+			if !inCategories(c, s.categories) {
+				return fmt.Errorf("category %q is not allowed by profile %s", c, *profileName)
+			}
+		}
+	}
+	s.categories = categories
+
+	return nil
+}
+
+// inCategories reports whether category c is one of categories or a subcategory of one.
+// Subcategories are separated with a colon like in "Cars: Ford Cortina"
+func inCategories(c string, categories []string) bool {
+	for _, p := range categories {
+		if strings.EqualFold(c, p) || strings.HasPrefix(strings.ToLower(c), strings.ToLower(p)+":") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// statement returns the SQL and its arguments for selecting at most limit sounds, in the order of the selection,
+// that match the full text query. An empty query matches all the sounds and a
+// non positive limit means no limit
+func (s *selection) statement(query string, limit int) (string, []interface{}) {
+	from, args := s.from(query)
+	stmt := `SELECT sounds.location, ` + describedAs + `, secs, coalesce(files.cached, 0) ` + from
+	orderBy := orderings[s.order]
+	if s.random(query) {
+		orderBy = orderings["random"]
+	}
+	stmt += " ORDER BY " + orderBy
+	if limit > 0 {
+		stmt += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	return stmt, args
+}
+
+// random reports whether the sounds of query are in random order, like those of --order rank
+// for queries without words
+func (s *selection) random(query string) bool {
+	_, ok := orderings[s.order]
+
+	return !ok || s.order == "random" || s.order == "rank" && !s.ranks(query)
+}
+
+// ranks reports whether the sounds of query are ordered by relevance. Only queries with words are,
+// by an index with fts5
+func (s *selection) ranks(query string) bool {
+	if _, rest, ok := collectionQuery(query); ok {
+		query = rest
+	}
+
+	return s.order == "rank" && query != "" && hasFTS5()
+}
+
+// count returns the number of sounds of the selection that match the full text query
+func (s *selection) count(ctx context.Context, query string) (int, error) {
+	from, args := s.from(query)
+	var n int
+	err := s.db.QueryRowContext(ctx, "SELECT count(*) "+from, args...).Scan(&n)
+
+	return n, err
+}
+
+// from returns the FROM and WHERE clauses, and their arguments, for the sounds of the selection
+// that match the full text query. A query like @name, or @name words, selects from a collection
+func (s *selection) from(query string) (string, []interface{}) {
+	var where []string
+	var args []interface{}
+	from := `FROM sounds LEFT JOIN files ON files.location = sounds.location`
+	if s.ranks(query) {
+		// the notes and the translations have no score, the sounds that matched only them are last
+		q := query
+		if _, rest, ok := collectionQuery(q); ok {
+			q = rest
+		}
+		if s.exact {
+			q = exactPhrase(q)
+		}
+		from += ` LEFT JOIN (SELECT rowid AS id, ` + rankScore + ` AS score FROM sounds WHERE sounds MATCH ?) AS ranked
+                            ON ranked.id = sounds.rowid`
+		args = append(args, matchQuery(q))
+	}
+
+	if name, rest, ok := collectionQuery(query); ok {
+		where = append(where, "sounds.location IN (SELECT location FROM collections WHERE name = ? AND verdict = ?)")
+		args = append(args, name, verdictKeep)
+		query = rest
+	}
+
+	if query != "" {
+		if s.exact {
+			query = exactPhrase(query)
+		}
+		fts := "sounds MATCH ?"
+		ftsArgs := []interface{}{matchQuery(query)}
+		if s.noStem {
+			// the stems match, the tokens that matched are compared to the words of the query
+			fts = `sounds.rowid IN (SELECT rowid FROM sounds WHERE sounds MATCH ?
+                                 AND unstemmed(?, ` + highlights(indexColumns) + `))`
+			ftsArgs = append(ftsArgs, queryWords(query))
+		}
+
+		if s.notes || s.described || s.translated {
+			// MATCH can't be or'ed with other conditions, all go through subqueries
+			if !s.noStem {
+				fts = "sounds.rowid IN (SELECT rowid FROM sounds WHERE sounds MATCH ?)"
+			}
+			or := []string{fts}
+			args = append(args, ftsArgs...)
+			if s.notes {
+				or = append(or, "sounds.location IN (SELECT location FROM notes_fts WHERE notes_fts MATCH ?)")
+				args = append(args, userMatchQuery(query))
+			}
+			if s.described {
+				or = append(or, "sounds.location IN (SELECT location FROM descriptions_fts WHERE descriptions_fts MATCH ?)")
+				args = append(args, userMatchQuery(query))
+			}
+			if s.translated {
+				or = append(or, "sounds.location IN (SELECT location FROM translations_fts WHERE translations_fts MATCH ? AND (? = '' OR lang = ?))")
+				args = append(args, userMatchQuery(query), s.lang, s.lang)
+			}
+			where = append(where, "("+strings.Join(or, " OR ")+")")
+		} else {
+			where = append(where, fts)
+			args = append(args, ftsArgs...)
+		}
+	}
+
+	if len(s.categories) > 0 {
+		var or []string
+		for _, c := range s.categories {
+			or = append(or, "category = ? COLLATE NOCASE OR category LIKE ?")
+			args = append(args, c, c+":%")
+		}
+		where = append(where, "("+strings.Join(or, " OR ")+")")
+	}
+
+	if s.shortest > 0 {
+		where = append(where, "CAST(secs AS INTEGER) >= ?")
+		args = append(args, s.shortest)
+	}
+	if s.longest > 0 {
+		where = append(where, "CAST(secs AS INTEGER) <= ?")
+		args = append(args, s.longest)
+	}
+	if len(s.cds) > 0 {
+		var or []string
+		for _, c := range s.cds {
+			or = append(or, "instr(lower(CDName), lower(?)) > 0 OR CDNumber = ? COLLATE NOCASE")
+			args = append(args, c, c)
+		}
+		where = append(where, "("+strings.Join(or, " OR ")+")")
+	}
+
+	if s.cachedOnly {
+		where = append(where, "files.cached")
+	} else if s.maxSecs > 0 {
+		where = append(where, "(files.cached OR CAST(secs AS INTEGER) <= ?)")
+		args = append(args, s.maxSecs)
+	}
+
+	// the audio properties are known only from the headers of fetched files
+	if s.stereo {
+		where = append(where, "files.channels >= 2")
+	}
+	if s.minRate > 0 {
+		where = append(where, "files.samplerate >= ?")
+		args = append(args, s.minRate)
+	}
+
+	if s.grep != "" {
+		where = append(where, "description REGEXP ?")
+		args = append(args, s.grep)
+	}
+
+	if s.near != nil {
+		where = append(where, "sounds.location IN (SELECT location FROM places WHERE distance(lat, lon, ?, ?) <= ?)")
+		args = append(args, s.near.lat, s.near.lon, s.nearKm)
+	}
+	if s.era != nil {
+		where = append(where, "sounds.location IN (SELECT location FROM eras WHERE first <= ? AND last >= ?)")
+		args = append(args, s.era.last, s.era.first)
+	}
+
+	where = append(where, s.excludes...)
+	args = append(args, s.excludeArgs...)
+
+	for _, r := range s.rules {
+		where = append(where, r.where)
+		args = append(args, r.args...)
+	}
+
+	if len(where) > 0 {
+		from += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	return from, args
+}
+
+// restricted reports whether the selection selects only some of the sounds without a query,
+// by the conditions of from
+func (s *selection) restricted() bool {
+	from, _ := s.from("")
+
+	return strings.Contains(from, " WHERE ")
+}
+
+// orQuery combines full text queries into one that matches any of them
+func orQuery(queries []string) string {
+	var or []string
+	for _, q := range queries {
+		or = append(or, "("+q+")")
+	}
+
+	return strings.Join(or, " OR ")
+}
+
+// queryGroup is a set of queries whose sounds play as a unit, interleaved. On the command line
+// a group is written in parentheses, like '(rain thunder)'. Any other query is a group of one
+type queryGroup struct {
+	name    string // as written on the command line. Routes the group to its player when mixing
+	queries []string
+}
+
+func parseGroups(args []string) []queryGroup {
+	var groups []queryGroup
+	for _, arg := range args {
+		a := strings.TrimSpace(arg)
+		if strings.HasPrefix(a, "(") && strings.HasSuffix(a, ")") {
+			if terms := splitTerms(a[1 : len(a)-1]); len(terms) > 0 {
+				groups = append(groups, queryGroup{arg, terms})
+				continue
+			}
+		}
+		groups = append(groups, queryGroup{arg, []string{arg}})
+	}
+
+	return groups
+}
+
+// splitTerms splits s at white space, keeping "quoted phrases" together
+func splitTerms(s string) []string {
+	var terms []string
+	var term strings.Builder
+	quoted := false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			term.WriteRune(r)
+		case !quoted && (r == ' ' || r == '\t'):
+			if term.Len() > 0 {
+				terms = append(terms, term.String())
+				term.Reset()
+			}
+		default:
+			term.WriteRune(r)
+		}
+	}
+	if term.Len() > 0 {
+		terms = append(terms, term.String())
+	}
+
+	return terms
+}
+
+// queryCounts are the numbers of sounds of the queries of a --playlist that has them, guarded
+// by queryGainsMu as the mixes of the web UI set them too
+var queryCounts = make(map[string]int)
+
+// queryCount is the number of sounds to select for query, n unless its playlist has another
+func queryCount(query string, n int) int {
+	queryGainsMu.Lock()
+	defer queryGainsMu.Unlock()
+	if c, ok := queryCounts[query]; ok {
+		return c
+	}
+
+	return n
+}
+
+// groupCount is the number of sounds to select for the group, n for each query unless its
+// playlist has another
+func groupCount(g queryGroup, n int) int {
+	total := 0
+	for _, q := range g.queries {
+		total += queryCount(q, n)
+	}
+
+	return total
+}
+
+// groupQueries returns the queries of all the groups
+func groupQueries(groups []queryGroup) []string {
+	var queries []string
+	for _, g := range groups {
+		queries = append(queries, g.queries...)
+	}
+
+	return queries
+}
+
+// selectGroup selects nsounds for each query of the group and interleaves them. With --warm-start
+// the random sounds in the cache dir come first
+func selectGroup(ctx context.Context, sel *selection, g queryGroup, nsounds int, dir string) []sound {
+	var selected [][]sound
+	for _, q := range g.queries {
+		n := queryCount(q, nsounds)
+		sounds := selectSounds(ctx, sel, q, n, dir)
+		for i := range sounds {
+			sounds[i].group = g.name
+		}
+		sounds = activePlugins.filter(ctx, sounds)
+		if *explainSelection {
+			explain(ctx, sel, q, sounds, n)
+		}
+		if q != "" && n > 0 && len(sounds) < n && *minResults == 0 && ctx.Err() == nil {
+			log.Printf("Few sounds: %q matches %d of the %d sounds requested, --min broadens the queries", q, len(sounds), n)
+		}
+		if *warmStart && sel.random(q) {
+			sounds = cachedFirst(dir, sounds)
+		}
+		selected = append(selected, sounds)
+	}
+
+	if len(selected) == 1 {
+		return selected[0]
+	}
+
+	return interleave(sel.rng, selected, nil)
+}
+
+// cachedFirst returns the sounds with those in the cache dir first, both in the order of the
+// selection, so a query plays at once while its other sounds download. The cache is looked
+// up, since the index may still think deleted files are cached
+func cachedFirst(dir string, sounds []sound) []sound {
+	var cached, uncached []sound
+	for _, snd := range sounds {
+		if _, exists, err := cachedPath(dir, snd.fname); err == nil && exists {
+			cached = append(cached, snd)
+		} else {
+			uncached = append(uncached, snd)
+		}
+	}
+
+	return append(cached, uncached...)
+}
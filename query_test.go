@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSelectExcludes(t *testing.T) {
+	db, err := openMemoryDatabase(t.Name(), selftestCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	notes := map[string]string{
+		"10000005.wav": "rain at the window",
+		"10000006.wav": "rain and thunder outside the office",
+	}
+	for location, note := range notes {
+		if _, err := db.Exec(`INSERT INTO notes(location, note) VALUES(?, ?)`, location, note); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sel := newSelection(db)
+	dir := t.TempDir()
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"rain", []string{"10000001.wav", "10000002.wav", "10000003.wav", "10000005.wav", "10000006.wav"}},
+		// the notes exclude like the descriptions do
+		{"rain -thunder", []string{"10000001.wav", "10000002.wav", "10000005.wav"}},
+		{`rain -"distant thunder"`, []string{"10000001.wav", "10000002.wav", "10000005.wav", "10000006.wav"}},
+		{"window -rain", nil},
+		{"office -thunder", []string{"10000006.wav"}}, // of the category, not the note
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, snd := range selectSounds(context.Background(), sel, tt.query, 0, dir) {
+			got = append(got, snd.fname)
+			if snd.fpath != filepath.Join(dir, snd.fname) {
+				t.Errorf("%q: %s is at %s, not in the cache %s", tt.query, snd.fname, snd.fpath, dir)
+			}
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%q: selected %v, expected %v", tt.query, got, tt.want)
+		}
+	}
+}
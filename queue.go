@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The queue of a session is the sounds on their way to the players: selected and waiting for
+// the downloader, downloading, fetched and waiting for their player, and playing. The queue
+// command prints it, a player after the other when mixing, with how soon each sound plays.
+// The estimates add up the durations of the sounds ahead, so a slow download makes the
+// sounds behind it play later
+
+// queueLength is how many sounds of each player the queue command prints, unless asked
+const queueLength = 10
+
+// queuedSound is a sound waiting for the downloader
+type queuedSound struct {
+	snd         sound
+	downloading bool
+}
+
+func (s queuedSound) status() string {
+	switch {
+	case s.downloading:
+		return "downloading"
+	case s.snd.cached:
+		return "cached"
+	}
+
+	return "download"
+}
+
+// playerQueue is what a player plays: the sound that plays and the sounds fetched for it,
+// the requested first
+type playerQueue struct {
+	requested []sound
+	ready     []sound
+	current   *sound
+	started   time.Time
+}
+
+// playQueue is the queue of a session. The methods of a nil queue do nothing, like those of
+// the sessions without controls
+type playQueue struct {
+	sync.Mutex
+
+	mixing  bool
+	playing *playbacks
+	pending []queuedSound // in the order the downloader takes them
+	players map[string]*playerQueue
+	names   []string // of the players, in the order they started
+}
+
+// playQueueKey is the key of the queue in the context of a session, playerKey of the name of
+// the player in the context of a player
+type (
+	playQueueKey struct{}
+	playerKey    struct{}
+)
+
+func newPlayQueue(playing *playbacks) *playQueue {
+	return &playQueue{playing: playing, players: make(map[string]*playerQueue)}
+}
+
+// sessionQueue returns the queue of the session of ctx, nil if it has none
+func sessionQueue(ctx context.Context) *playQueue {
+	q, _ := ctx.Value(playQueueKey{}).(*playQueue)
+
+	return q
+}
+
+// setMixing tells the queue whether each group has its own player
+func (q *playQueue) setMixing(mixing bool) {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	q.mixing = mixing
+}
+
+// player returns the context of the player name, which plays the sounds routed to it
+func (q *playQueue) player(ctx context.Context, name string) context.Context {
+	if q == nil {
+		return ctx
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	q.playerQueue(name)
+
+	return context.WithValue(ctx, playerKey{}, name)
+}
+
+// playerQueue returns the queue of the player name, added if new. The lock must be held
+func (q *playQueue) playerQueue(name string) *playerQueue {
+	p, ok := q.players[name]
+	if !ok {
+		p = new(playerQueue)
+		q.players[name] = p
+		q.names = append(q.names, name)
+	}
+
+	return p
+}
+
+// route is the name of the player of snd, like the router of the session decides
+func (q *playQueue) route(snd sound) string {
+	if q.mixing {
+		return snd.group
+	}
+
+	return ""
+}
+
+// add queues the sounds for the downloader
+func (q *playQueue) add(sounds []sound) {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	for _, snd := range sounds {
+		q.pending = append(q.pending, queuedSound{snd: snd})
+	}
+}
+
+// pendingIndex returns the index of the first pending sound at fname, -1 if none. The
+// lock must be held
+func (q *playQueue) pendingIndex(fname string) int {
+	for i, s := range q.pending {
+		if s.snd.fname == fname {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// fetching records that the downloader fetches snd, at once if it is in the cache
+func (q *playQueue) fetching(snd sound) {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	if i := q.pendingIndex(snd.fname); i >= 0 {
+		q.pending[i].downloading = true
+	}
+}
+
+// fetched moves snd from the downloader to its player
+func (q *playQueue) fetched(snd sound) {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	if i := q.pendingIndex(snd.fname); i >= 0 {
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+	}
+	p := q.playerQueue(q.route(snd))
+	p.ready = append(p.ready, snd)
+}
+
+// drop removes snd, skipped or missing, before the downloader sent it to its player
+func (q *playQueue) drop(snd sound) {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	if i := q.pendingIndex(snd.fname); i >= 0 {
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+	}
+}
+
+// request queues snd, requested next, before the fetched sounds of the player of the session.
+// When mixing the requested sounds play at once and aren't queued
+func (q *playQueue) request(snd sound) {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	if !q.mixing {
+		p := q.playerQueue("")
+		p.requested = append(p.requested, snd)
+	}
+}
+
+// start records that the player of ctx took snd to play
+func (q *playQueue) start(ctx context.Context, snd sound) {
+	name, ok := ctx.Value(playerKey{}).(string)
+	if q == nil || !ok {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	p := q.playerQueue(name)
+	p.requested = removeSound(p.requested, snd)
+	p.ready = removeSound(p.ready, snd)
+	p.current = &snd
+	p.started = time.Now()
+}
+
+// finish records that the player of ctx stopped playing its sound
+func (q *playQueue) finish(ctx context.Context) {
+	name, ok := ctx.Value(playerKey{}).(string)
+	if q == nil || !ok {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	q.playerQueue(name).current = nil
+}
+
+// removeSound removes the first of sounds at the location of snd
+func removeSound(sounds []sound, snd sound) []sound {
+	for i, s := range sounds {
+		if s.fname == snd.fname {
+			return append(sounds[:i], sounds[i+1:]...)
+		}
+	}
+
+	return sounds
+}
+
+// view returns the queue, for each player the sound that plays and the next n sounds with
+// their status and how soon they play, and the sounds that play at once, like the requested
+// now and the one-shots, last
+func (q *playQueue) view(n int) string {
+	if q == nil {
+		return ""
+	}
+	playing := q.playing.playing("")
+	q.Lock()
+	defer q.Unlock()
+
+	var lines []string
+	owned := make(map[*playback]bool)
+	for _, name := range q.names {
+		p := q.players[name]
+		if q.mixing {
+			lines = append(lines, "player "+name)
+		}
+
+		var ahead time.Duration
+		if p.current != nil {
+			snd := *p.current
+			var pb *playback
+			for _, b := range playing {
+				if b.snd.fname == snd.fname && b.snd.group == snd.group && !owned[b] {
+					pb = b
+					break
+				}
+			}
+			if pb != nil {
+				owned[pb] = true
+				ahead = pb.length - pb.position()
+				lines = append(lines, "playing\t"+pb.String())
+			} else {
+				// announcing, or about to start
+				ahead = time.Duration(snd.secs)*time.Second - time.Since(p.started)
+				if ahead < 0 {
+					ahead = 0
+				}
+				lines = append(lines, fmt.Sprintf("playing\t%s\t%s\t\t-%s\t%s", snd.group, snd.fname, formatPosition(ahead), snd.descr))
+			}
+		}
+
+		type next struct {
+			snd    sound
+			status string
+		}
+		var queued []next
+		for _, snd := range p.requested {
+			queued = append(queued, next{snd, "requested"})
+		}
+		for _, snd := range p.ready {
+			queued = append(queued, next{snd, "ready"})
+		}
+		for _, s := range q.pending {
+			if q.route(s.snd) == name {
+				queued = append(queued, next{s.snd, s.status()})
+			}
+		}
+
+		for i, s := range queued {
+			if i == n {
+				var rest time.Duration
+				for _, s := range queued[n:] {
+					rest += time.Duration(s.snd.secs) * time.Second
+				}
+				lines = append(lines, fmt.Sprintf("and %d more, %s to play", len(queued)-n, formatPosition(rest)))
+				break
+			}
+			lines = append(lines, fmt.Sprintf("%d\t%s\t%s\t%s\tin %s\t%s", i+1, s.snd.group, s.snd.fname, s.status,
+				formatPosition(ahead), s.snd.descr))
+			ahead += time.Duration(s.snd.secs) * time.Second
+		}
+		if p.current == nil && len(queued) == 0 {
+			lines = append(lines, "nothing queued")
+		}
+	}
+
+	for _, b := range playing {
+		if !owned[b] {
+			lines = append(lines, "playing\t"+b.String())
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var shuffleRatio = flag.String("ratio", "", "With --shuffle, interleave the queries in the `pattern`, like 2:1:1 for two sounds of the first query to one of each of the others")
+
+// A ratio weighs the queries of --shuffle, a weight for each query group of the command line
+// in order. Each round of the interleaving takes as many sounds of a group as its weight, in
+// random order, and each group selects -n sounds for each unit of its weight, so the pattern
+// holds until the end of the session
+
+// ratioWeights are the weights of --ratio, nil without it
+var ratioWeights []int
+
+// parseRatio parses --ratio
+func parseRatio() error {
+	ratioWeights = nil
+	if *shuffleRatio == "" {
+		return nil
+	}
+	for _, part := range strings.Split(*shuffleRatio, ":") {
+		w, err := strconv.Atoi(part)
+		if err != nil || w <= 0 {
+			return fmt.Errorf(tr("bad --ratio %q, expected positive weights like 2:1:1"), *shuffleRatio)
+		}
+		ratioWeights = append(ratioWeights, w)
+	}
+
+	return nil
+}
+
+// ratioWeight is the weight of the query group i, 1 without --ratio
+func ratioWeight(i int) int {
+	if i < len(ratioWeights) {
+		return ratioWeights[i]
+	}
+
+	return 1
+}
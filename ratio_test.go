@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRatio(t *testing.T) {
+	defer func(ratio string) {
+		*shuffleRatio = ratio
+		parseRatio()
+	}(*shuffleRatio)
+
+	tests := []struct {
+		ratio   string
+		weights []int
+		ok      bool
+	}{
+		{"", nil, true},
+		{"2:1:1", []int{2, 1, 1}, true},
+		{"3", []int{3}, true},
+		{"1:10", []int{1, 10}, true},
+		{"0:1", nil, false},
+		{"-1:2", nil, false},
+		{"2::1", nil, false},
+		{"2:1:", nil, false},
+		{"a:b", nil, false},
+		{"1.5:1", nil, false},
+	}
+	for _, tt := range tests {
+		*shuffleRatio = tt.ratio
+		err := parseRatio()
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: error %v", tt.ratio, err)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(ratioWeights, tt.weights) {
+			t.Errorf("%q: weights %v, expected %v", tt.ratio, ratioWeights, tt.weights)
+		}
+	}
+
+	*shuffleRatio = "2:3"
+	if err := parseRatio(); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{2, 3, 1, 1} {
+		if w := ratioWeight(i); w != want {
+			t.Errorf("the weight of the group %d is %d, expected %d", i, w, want)
+		}
+	}
+}
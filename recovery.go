@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var repairIndex = flag.Bool("repair", false, "Rebuild a corrupt index from the csv without asking")
+
+// userTables are the tables of the data users add, in user.db
+var userTables = []string{"tags", "ratings", "notes", "descriptions", "plays", "smart_playlists", "collections", "translations", "features"}
+
+// checkIntegrity runs the quick integrity check of sqlite on the database file
+func checkIntegrity(fpath string) error {
+	db, err := sql.Open(sqliteDriver, "file:"+fpath+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`PRAGMA quick_check`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		if len(problems) > 3 {
+			problems = append(problems[:3], fmt.Sprintf("and %d more", len(problems)-3))
+		}
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// recoverDatabase rebuilds the corrupt index from the csv, if the user agrees or --repair.
+// The user data of user.db is untouched, and that of indexes older than user.db is copied
+// from the corrupt file, as much as can still be read. The corrupt file is kept next to the new one
+func recoverDatabase(cause error) error {
+	log.Printf("Error:Index: %s is corrupt: %v", dbFile, cause)
+	if !*repairIndex && !confirmRepair() {
+		return fmt.Errorf("%s is corrupt, thames --repair rebuilds it from the csv", dbFile)
+	}
+
+	corrupt := fmt.Sprintf("%s.corrupt-%s", dbFile, time.Now().Format("20060102-150405"))
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		if err := os.Rename(dbFile+suffix, corrupt+suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := initDatabase(dbFile, csvFile); err != nil {
+		return err
+	}
+
+	db, err := sql.Open(sqliteDriver, "file:"+dbFile+"?_busy_timeout=5000")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := migrateFiles(db); err != nil {
+		return err
+	}
+	if err := syncCached(db); err != nil {
+		log.Printf("Error:Index: the sounds of the cache: %v", err)
+	}
+
+	// the user data is in user.db, the index had it only before the split
+	udb, err := sql.Open(sqliteDriver, "file:"+userDBFile+"?_busy_timeout=5000")
+	if err != nil {
+		return err
+	}
+	defer udb.Close()
+	if err := migrateUser(udb); err != nil {
+		return err
+	}
+	if err := salvageUser(udb, corrupt); err != nil {
+		log.Printf("Error:Index: no user data recovered from %s: %v", corrupt, err)
+	}
+	log.Printf("Recovered: rebuilt %s from %s, the corrupt index is %s", dbFile, csvFile, corrupt)
+
+	return nil
+}
+
+// confirmRepair asks on the terminal whether to rebuild the index. Without a terminal it doesn't
+func confirmRepair() bool {
+	if !isTerminal(os.Stdin) {
+		return false
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "Rebuild the index from %s? The user data of %s is kept [Y/n] ", csvFile, userDBFile)
+	scanner := bufio.NewScanner(tty)
+	if !scanner.Scan() {
+		return false
+	}
+	answer := strings.ToLower(strings.TrimSpace(scanner.Text()))
+
+	return answer == "" || answer == "y" || answer == "yes"
+}
+
+// salvageUser copies the rows of the user tables of the corrupt database file into db, row by
+// row, so that a damaged page loses only the rows after it
+func salvageUser(db *sql.DB, corrupt string) error {
+	old, err := sql.Open(sqliteDriver, "file:"+corrupt+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+
+	var recovered []string
+	for _, table := range userTables {
+		n, err := salvageTable(db, old, table)
+		if err != nil {
+			log.Printf("Error:Index: %s: %v, %d rows recovered", table, err, n)
+		}
+		if n > 0 {
+			recovered = append(recovered, fmt.Sprintf("%d %s", n, table))
+		}
+	}
+	if len(recovered) > 0 {
+		log.Printf("Recovered: %s", strings.Join(recovered, ", "))
+	}
+
+	return nil
+}
+
+// salvageTable copies the rows of table from old to db. The columns are those of the table in
+// db, the current schema, that old has too
+func salvageTable(db, old *sql.DB, table string) (int, error) {
+	columns, err := tableColumns(db, table)
+	if err != nil {
+		return 0, err
+	}
+	oldColumns, err := tableColumns(old, table)
+	if err != nil || len(oldColumns) == 0 {
+		return 0, err
+	}
+	have := make(map[string]bool)
+	for _, c := range oldColumns {
+		have[c] = true
+	}
+	var common []string
+	for _, c := range columns {
+		if have[c] {
+			common = append(common, c)
+		}
+	}
+
+	rows, err := old.Query(fmt.Sprintf(`SELECT %s FROM %s`, strings.Join(common, ", "), table))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(fmt.Sprintf(`INSERT OR IGNORE INTO %s(%s) VALUES(?%s)`,
+		table, strings.Join(common, ", "), strings.Repeat(", ?", len(common)-1)))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	n := 0
+	values := make([]interface{}, len(common))
+	ptrs := make([]interface{}, len(common))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			break
+		}
+		if _, err := stmt.Exec(values...); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	// the rows read before a damaged page are kept
+	rerr := rows.Err()
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return n, rerr
+}
+
+// tableColumns returns the columns of table, none if there is no such table
+func tableColumns(db *sql.DB, table string) ([]string, error) {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+
+	return columns, rows.Err()
+}
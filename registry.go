@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A registry is a static json index of shared bundles, served over http by anyone, like
+//
+//	{"bundles": [{"name": "focus-mix", "description": "rain and a cafe, for work",
+//	              "url": "focus-mix.thames", "sha256": "9f86d0...",
+//	              "signature": "base64 of the ed25519 signature of the bundle"}]}
+//
+// The urls are relative to the index. Bundles are installed only if their checksum matches
+// and, when the registry has a key in thames.json, if they are signed with it
+
+type registryConfig struct {
+	URL string `json:"url"` // of the index
+	Key string `json:"key"` // the ed25519 public key of the registry, in base64
+}
+
+type registryIndex struct {
+	Bundles []registryEntry `json:"bundles"`
+}
+
+type registryEntry struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+	SHA256      string `json:"sha256"`
+	Signature   string `json:"signature,omitempty"`
+}
+
+// maxBundleSize limits what is downloaded from a registry, bundles have no audio
+const maxBundleSize = 4 << 20
+
+// registryGet returns the body of rawurl, relative to base if not absolute
+func registryGet(base, rawurl string) ([]byte, string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, "", err
+	}
+	if base != "" {
+		b, err := url.Parse(base)
+		if err != nil {
+			return nil, "", err
+		}
+		u = b.ResolveReference(u)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, "", fmt.Errorf("%s: not an http url", u)
+	}
+
+	var buf bytes.Buffer
+	if err := httpGet(context.Background(), httpClient(), u.String(), &limitedWriter{w: &buf, n: maxBundleSize}); err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), u.String(), nil
+}
+
+// limitedWriter fails the writes past n bytes
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, fmt.Errorf("more than %s", formatBytes(maxBundleSize))
+	}
+	l.n -= int64(len(p))
+
+	return l.w.Write(p)
+}
+
+func loadRegistry(indexURL string) (registryIndex, error) {
+	var index registryIndex
+	data, _, err := registryGet("", indexURL)
+	if err != nil {
+		return index, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("%s: not a registry index: %v", indexURL, err)
+	}
+
+	return index, nil
+}
+
+// matches reports whether the entry matches all the words, in its name or description
+func (e registryEntry) matches(words []string) bool {
+	text := strings.ToLower(e.Name + " " + e.Description)
+	for _, w := range words {
+		if !strings.Contains(text, strings.ToLower(w)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// verify checks the bundle data of the entry against its checksum and, if key is not
+// empty, its signature
+func (e registryEntry) verify(data []byte, key string) error {
+	sum := sha256.Sum256(data)
+	if e.SHA256 == "" {
+		return errors.New("the registry has no checksum of the bundle")
+	}
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), e.SHA256) {
+		return fmt.Errorf("the checksum of the bundle is %x, the registry has %s", sum, e.SHA256)
+	}
+
+	if key == "" {
+		return nil
+	}
+	pub, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("the key of the registry in thames.json is not an ed25519 public key in base64")
+	}
+	if e.Signature == "" {
+		return errors.New("the bundle is not signed, and the registry has a key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(e.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(pub), data, sig) {
+		return errors.New("the signature of the bundle doesn't match the key of the registry")
+	}
+
+	return nil
+}
+
+// presetCommand implements the preset command. It searches the registry of shared bundles
+// and installs them, and lists the installed presets
+func presetCommand(args []string) error {
+	fs := flag.NewFlagSet("preset", flag.ExitOnError)
+	registry := fs.String("registry", conf.Registry.URL, "The `url` of the index of the registry, the registry of thames.json by default")
+	force := fs.Bool("force", false, "With install, replace the installed presets of the same name")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames preset [--registry url] search [words...]\n"+
+			"       thames preset [--registry url] [--force] install name...\n       thames preset list\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	switch args := fs.Args(); {
+	case args[0] == "list" && len(args) == 1:
+		names, err := filepath.Glob(filepath.Join(presetsDir(), "*.preset"))
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Println(presetName(name))
+		}
+	case args[0] == "search" || args[0] == "install" && len(args) >= 2:
+		if *registry == "" {
+			return errors.New("no registry, set registry.url in thames.json or use --registry")
+		}
+		index, err := loadRegistry(*registry)
+		if err != nil {
+			return err
+		}
+		if args[0] == "search" {
+			for _, e := range index.Bundles {
+				if e.matches(args[1:]) {
+					fmt.Printf("%s\t%s\n", e.Name, e.Description)
+				}
+			}
+			return nil
+		}
+		db, err := openDatabase()
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		for _, name := range args[1:] {
+			if err := installFromRegistry(db, *registry, index, name, *force); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	default:
+		fs.Usage()
+		return errUsage
+	}
+
+	return nil
+}
+
+// installFromRegistry downloads, verifies and installs the bundle name of the registry
+func installFromRegistry(db *sql.DB, registry string, index registryIndex, name string, force bool) error {
+	for _, e := range index.Bundles {
+		if e.Name != name {
+			continue
+		}
+		data, u, err := registryGet(registry, e.URL)
+		if err != nil {
+			return err
+		}
+		if err := e.verify(data, conf.Registry.Key); err != nil {
+			return fmt.Errorf("%s: %v, not installed", u, err)
+		}
+		b, err := parseBundle(data, u)
+		if err != nil {
+			return err
+		}
+		return installBundle(db, u, b, force)
+	}
+
+	return fmt.Errorf("no bundle %q in the registry", name)
+}
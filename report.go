@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// reportPeriod is the time range of a report, from the history of the sounds played
+type reportPeriod struct {
+	name       string
+	start, end time.Time
+}
+
+// parsePeriod parses the period of a report, like 2026-09 or 2026, or returns the current
+// month with month, or all time
+func parsePeriod(arg string, month bool) (reportPeriod, error) {
+	now := time.Now()
+	switch {
+	case arg != "":
+		if t, err := time.ParseInLocation("2006-01", arg, time.Local); err == nil {
+			return reportPeriod{t.Format("January 2006"), t, t.AddDate(0, 1, 0)}, nil
+		}
+		if t, err := time.ParseInLocation("2006", arg, time.Local); err == nil {
+			return reportPeriod{t.Format("2006"), t, t.AddDate(1, 0, 0)}, nil
+		}
+		return reportPeriod{}, fmt.Errorf("bad period %q, like 2026-09 or 2026", arg)
+	case month:
+		t := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+		return reportPeriod{t.Format("January 2006"), t, t.AddDate(0, 1, 0)}, nil
+	}
+
+	return reportPeriod{"all time", time.Unix(0, 0), now.Add(time.Hour)}, nil
+}
+
+// formatListened formats a listening time in seconds, like 3h12m
+func formatListened(secs int64) string {
+	d := time.Duration(secs) * time.Second
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", secs)
+	}
+
+	return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// reportCommand implements the report command. It summarizes the history of the sounds
+// played, listening time by query, category and preset and the most played sounds, and
+// how the cache grew
+func reportCommand(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	month := fs.Bool("month", false, "Report the current month")
+	top := fs.Int("top", 10, "Print the `n` top queries, categories, presets and sounds")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames report [--month] [--top n] [YYYY-MM|YYYY]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 || *top < 1 {
+		fs.Usage()
+		return errUsage
+	}
+	period, err := parsePeriod(fs.Arg(0), *month)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	from, to := period.start.Unix(), period.end.Unix()
+	var plays, sounds, secs int64
+	if err := db.QueryRow(`SELECT count(*), count(DISTINCT location), coalesce(sum(secs), 0) FROM plays WHERE at >= ? AND at < ?`,
+		from, to).Scan(&plays, &sounds, &secs); err != nil {
+		return err
+	}
+
+	fmt.Printf("Listening report for %s\n\n", period.name)
+	fmt.Printf("Listened %s to %d sounds, %d different\n", formatListened(secs), plays, sounds)
+
+	if plays > 0 {
+		sections := []struct {
+			title, key string
+			base       bool // of the paths of the presets
+		}{
+			{"By query", `CASE plays.query WHEN '' THEN '(random)' ELSE plays.query END`, false},
+			{"By category", `coalesce(sounds.category, '(not in the index)')`, false},
+			{"By preset", `CASE plays.preset WHEN '' THEN '(none)' ELSE plays.preset END`, true},
+		}
+		for _, s := range sections {
+			fmt.Printf("\n%s\n", s.title)
+			if err := printListened(db, s.base, `SELECT `+s.key+`, sum(plays.secs), count(*)
+                                                      FROM plays LEFT JOIN sounds ON sounds.location = plays.location
+                                                      WHERE at >= ? AND at < ?
+                                                      GROUP BY 1 ORDER BY 2 DESC, 3 DESC, 1 LIMIT ?`, from, to, *top); err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("\nMost played\n")
+		if err := printListened(db, false, `SELECT plays.location || coalesce(' ' || sounds.description, ''), sum(plays.secs), count(*)
+                                             FROM plays LEFT JOIN sounds ON sounds.location = plays.location
+                                             WHERE at >= ? AND at < ?
+                                             GROUP BY plays.location ORDER BY 3 DESC, 2 DESC, 1 LIMIT ?`, from, to, *top); err != nil {
+			return err
+		}
+	}
+
+	added, addedFiles, total, totalFiles, err := cacheGrowth(period)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nCache\n")
+	fmt.Printf("  +%s in %d files, %s in %d files in all\n", formatBytes(added), addedFiles, formatBytes(total), totalFiles)
+
+	return nil
+}
+
+// printListened prints the rows of key, listening time and count of plays of the query
+func printListened(db *sql.DB, base bool, query string, args ...interface{}) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var secs, n int64
+		if err := rows.Scan(&key, &secs, &n); err != nil {
+			return err
+		}
+		if base && strings.ContainsRune(key, filepath.Separator) {
+			key = filepath.Base(key)
+		}
+		fmt.Printf("  %8s %5d  %s\n", formatListened(secs), n, key)
+	}
+
+	return rows.Err()
+}
+
+// cacheGrowth returns the size and the number of the files added to the cache in the period,
+// by their modification time, and of all the files of the cache
+func cacheGrowth(period reportPeriod) (added, addedFiles, total, totalFiles int64, err error) {
+	infos, err := ioutil.ReadDir(soundsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, 0, 0, 0, err
+	}
+
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || strings.HasSuffix(info.Name(), ".part") {
+			continue
+		}
+		total += info.Size()
+		totalFiles++
+		if t := info.ModTime(); !t.Before(period.start) && t.Before(period.end) {
+			added += info.Size()
+			addedFiles++
+		}
+	}
+
+	return added, addedFiles, total, totalFiles, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+)
+
+// requestedQuery is the query of the sounds requested by location, for the logs and the history
+const requestedQuery = "requested"
+
+// requests are the sounds that users ask a running session to play, by location, besides the
+// sounds of its queries. Sounds requested next play after the sound playing, before the
+// queued ones, and sounds requested now play at once, over the others, like one-shots
+type requests struct {
+	c chan request
+}
+
+type request struct {
+	snd sound
+	now bool
+}
+
+func newRequests() *requests {
+	return &requests{c: make(chan request, PlayerChannelSize)}
+}
+
+// add requests snd. A nil set of requests belongs to no session
+func (r *requests) add(snd sound, now bool) error {
+	if r == nil {
+		return errors.New("no session is playing")
+	}
+	select {
+	case r.c <- request{snd, now}:
+		return nil
+	default:
+		return fmt.Errorf("%d sounds are already requested", cap(r.c))
+	}
+}
+
+// serve fetches the requested sounds and sends them to next, or to now, until ctx is done
+func (r *requests) serve(ctx context.Context, f *fetcher, next, now chan<- sound) {
+	if r == nil {
+		return
+	}
+	q := sessionQueue(ctx)
+	for {
+		var req request
+		select {
+		case req = <-r.c:
+		case <-ctx.Done():
+			return
+		}
+
+		snd := req.snd
+		sp, exists, err := f.cache(ctx, snd.fname)
+		if err != nil || !exists {
+			log.Printf("Missing File: %s: %v", sp, err)
+			pipelineErrors.report("fetch", snd.fname, missingError(err))
+			continue
+		}
+		snd.fpath = sp
+
+		out := next
+		if req.now {
+			out = now
+		} else {
+			q.request(snd)
+		}
+		select {
+		case out <- snd:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// lookupSounds returns the sounds at the locations, in order, with their paths in the cache dir
+func lookupSounds(ctx context.Context, db *sql.DB, locations []string, dir string) ([]sound, error) {
+	var sounds []sound
+	for _, location := range locations {
+		snd := sound{fname: normalizeLocation(location), query: requestedQuery, group: requestedQuery}
+		err := db.QueryRowContext(ctx, `SELECT `+describedAs+`, secs, coalesce(files.cached, 0)
+                                                FROM sounds LEFT JOIN files ON files.location = sounds.location
+                                                WHERE sounds.location = ?`, snd.fname).Scan(&snd.descr, &snd.secs, &snd.cached)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("no sound at %s", location)
+		} else if err != nil {
+			return nil, err
+		}
+		snd.fpath = filepath.Join(dir, snd.fname)
+		sounds = append(sounds, snd)
+	}
+
+	return sounds, nil
+}
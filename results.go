@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	countOnly  = flag.Bool("count", false, "With --query, print only the number of sounds that match each query")
+	sampleSize = flag.Int("sample", 0, "With --query, print `n` sounds of each query picked at random with --seed, the same every time")
+	sampleSeed = flag.Int64("seed", 1, "The `seed` of --sample")
+	groupBy    = flag.String("group-by", "", "With --query, group the sounds by `cd` or category, in the order of the archive")
+	format     = flag.String("format", "text", "With --query, print the sounds as text, or as csv or tsv with all their metadata, for spreadsheets")
+	verbose    = flag.Bool("verbose", false, "With --query, print the duration of each sound and the audio properties of its file, when known")
+)
+
+// formats are the values of --format
+var formats = map[string]bool{
+	"text": true,
+	"csv":  true,
+	"tsv":  true,
+}
+
+// groupings are the values of --group-by
+var groupings = map[string]bool{
+	"":         true,
+	"cd":       true,
+	"category": true,
+}
+
+// the ANSI escapes that emphasize the matched words on a terminal
+const (
+	boldOn  = "\x1b[1m"
+	boldOff = "\x1b[0m"
+)
+
+// printQuery implements --query. It prints the sounds selected for each query, with their
+// path in the cache or as missing
+func printQuery(ctx context.Context, sel *selection, queries []string) {
+	if *countOnly {
+		printCounts(ctx, sel, queries)
+		return
+	}
+
+	var table *csv.Writer
+	if *format != "text" {
+		table = csv.NewWriter(os.Stdout)
+		if *format == "tsv" {
+			table.Comma = '\t'
+		}
+		table.Write(tableHeader)
+		defer table.Flush()
+	}
+
+	var copied []string
+	var exported []sound
+	color := colorOutput(os.Stdout) && table == nil
+	for _, query := range queries {
+		var sounds []sound
+		if *sampleSize > 0 {
+			var err error
+			if sounds, err = sel.seededSample(ctx, query, *sampleSize, *sampleSeed, soundsDir); err != nil {
+				log.Printf("Error:Query: %q: %v", query, err)
+				pipelineErrors.report("query", query, err)
+			}
+		} else {
+			sounds = selectSounds(ctx, sel, query, queryCount(query, *nsounds), soundsDir)
+		}
+		if *explainSelection {
+			limit := queryCount(query, *nsounds)
+			if *sampleSize > 0 {
+				limit = *sampleSize
+			}
+			explain(ctx, sel, query, sounds, limit)
+		}
+		for _, snd := range sounds {
+			copied = append(copied, copyTarget(snd))
+		}
+		// before the bold of the matched words
+		exported = append(exported, sounds...)
+		if color {
+			if err := highlightSounds(ctx, sel.db, query, sounds, boldOn, boldOff); err != nil {
+				log.Printf("Error:Highlight: %q: %v", query, err)
+			}
+		}
+		if *descriptionLang != "" && table == nil {
+			translations, err := readTranslations(ctx, sel.db, sounds, *descriptionLang)
+			if err != nil {
+				log.Printf("Error:Translations: %v", err)
+			}
+			for i, snd := range sounds {
+				if t, ok := translations[snd.fname]; ok {
+					sounds[i].descr = t
+				}
+			}
+		}
+		notes, err := readNotes(ctx, sel.db, sounds)
+		if err != nil {
+			log.Printf("Error:Notes: %v", err)
+		}
+		if table != nil {
+			if err := writeTable(ctx, table, sel.db, sounds, notes); err != nil {
+				log.Printf("Error:Query: %q: %v", query, err)
+				pipelineErrors.report("query", query, err)
+			}
+			continue
+		}
+		if *groupBy != "" {
+			if err := printGroups(ctx, sel.db, sounds, notes, *groupBy); err != nil {
+				log.Printf("Error:Query: %q: %v", query, err)
+				pipelineErrors.report("query", query, err)
+			}
+			continue
+		}
+		if *verbose {
+			if err := printVerbose(ctx, sel.db, sounds, notes); err != nil {
+				log.Printf("Error:Query: %q: %v", query, err)
+				pipelineErrors.report("query", query, err)
+			}
+			continue
+		}
+		for _, snd := range sounds {
+			printSound(snd, notes[snd.fname], "", "")
+		}
+	}
+
+	if *copyResults && len(copied) > 0 {
+		if err := copyToClipboard(strings.Join(copied, "\n") + "\n"); err != nil {
+			log.Printf("Error:Copy: %v", err)
+		} else {
+			log.Printf("Copied %d paths to the clipboard", len(copied))
+		}
+	}
+	if *playlistFile != "" {
+		if err := writePlaylist(*playlistFile, exported); err != nil {
+			log.Printf("Error:Export: %v", err)
+			pipelineErrors.report("export", *playlistFile, err)
+		}
+	}
+}
+
+// printSound prints the description and the path of a sound in the cache, or the path it would have,
+// and the note and the details if there are. The path is always last
+func printSound(snd sound, note, details, indent string) {
+	if note != "" {
+		note = "[" + note + "] "
+	}
+	if details != "" {
+		note += "(" + details + ") "
+	}
+	if !snd.cached {
+		fmt.Printf("%smissing: %s%s\n", indent, note, snd.fpath)
+	} else if fpath, exists, _ := cachedPath(soundsDir, snd.fname); exists {
+		fmt.Printf("%s%s %s%s\n", indent, snd.descr, note, fpath)
+	} else {
+		fmt.Printf("%smissing: %s%s\n", indent, note, snd.fpath)
+	}
+}
+
+// soundMeta is the metadata of a sound in the index, with the fields that selections don't read
+type soundMeta struct {
+	description string
+	category    string
+	cdNumber    string
+	cdName      string
+	tracknum    string
+	size        int64     // 0 if not known
+	audio       audioInfo // from the header of the file, zero if not known
+
+	// the archival context of the newer editions of the csv, empty if not known
+	recordist, place, recorded, notes string
+}
+
+// readMetadata reads the metadata of the sounds, by location
+func readMetadata(ctx context.Context, db *sql.DB, sounds []sound) (map[string]soundMeta, error) {
+	meta := make(map[string]soundMeta)
+	for start := 0; start < len(sounds); start += sampleBatch {
+		batch := sounds[start:]
+		if len(batch) > sampleBatch {
+			batch = batch[:sampleBatch]
+		}
+		var args []interface{}
+		for _, snd := range batch {
+			args = append(args, snd.fname)
+		}
+		marks := strings.TrimSuffix(strings.Repeat("?,", len(batch)), ",")
+		rows, err := db.QueryContext(ctx, `SELECT sounds.location, description, category, CDNumber, CDName, tracknum, coalesce(files.size, 0),
+                                                          coalesce(files.format, ''), coalesce(files.samplerate, 0), coalesce(files.channels, 0), coalesce(files.bits, 0),
+                                                          coalesce(extras.recordist, ''), coalesce(extras.place, ''), coalesce(extras.recorded, ''), coalesce(extras.notes, '')
+                                                   FROM sounds LEFT JOIN files ON files.location = sounds.location
+                                                        LEFT JOIN extras ON extras.location = sounds.location
+                                                   WHERE sounds.location IN (`+marks+`)`, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var location string
+			var m soundMeta
+			if err := rows.Scan(&location, &m.description, &m.category, &m.cdNumber, &m.cdName, &m.tracknum, &m.size,
+				&m.audio.format, &m.audio.sampleRate, &m.audio.channels, &m.audio.bits,
+				&m.recordist, &m.place, &m.recorded, &m.notes); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			meta[location] = m
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return meta, nil
+}
+
+// tableHeader are the columns of --format csv. They are named like the columns of the
+// archive's csv, so a curated table can be indexed as a collection
+var tableHeader = []string{"location", "description", "secs", "category", "CDNumber", "CDName", "tracknum", "size", "format", "samplerate", "channels", "bits", "cached", "path", "note"}
+
+// writeTable writes a row of the table for each sound
+func writeTable(ctx context.Context, table *csv.Writer, db *sql.DB, sounds []sound, notes map[string]string) error {
+	meta, err := readMetadata(ctx, db, sounds)
+	if err != nil {
+		return err
+	}
+
+	for _, snd := range sounds {
+		m := meta[snd.fname]
+		cached, fpath := "0", snd.fpath
+		if p, exists, _ := cachedPath(soundsDir, snd.fname); snd.cached && exists {
+			cached, fpath = "1", p
+		}
+		size := ""
+		if m.size > 0 {
+			size = strconv.FormatInt(m.size, 10)
+		}
+		rate, channels, bits := "", "", ""
+		if m.audio.format != "" {
+			rate, channels, bits = strconv.Itoa(m.audio.sampleRate), strconv.Itoa(m.audio.channels), strconv.Itoa(m.audio.bits)
+		}
+		table.Write([]string{snd.fname, snd.descr, strconv.Itoa(snd.secs), m.category, m.cdNumber, m.cdName, m.tracknum, size,
+			m.audio.format, rate, channels, bits, cached, fpath, notes[snd.fname]})
+	}
+	table.Flush()
+
+	return table.Error()
+}
+
+// printVerbose prints the sounds with their duration and the audio properties of their files,
+// or unknown for the sounds never fetched or verified
+func printVerbose(ctx context.Context, db *sql.DB, sounds []sound, notes map[string]string) error {
+	meta, err := readMetadata(ctx, db, sounds)
+	if err != nil {
+		return err
+	}
+
+	for _, snd := range sounds {
+		audio := "unknown audio"
+		if a := meta[snd.fname].audio; a.format != "" {
+			audio = a.String()
+		}
+		printSound(snd, notes[snd.fname], fmt.Sprintf("%s, %s", time.Duration(snd.secs)*time.Second, audio), "")
+	}
+
+	return nil
+}
+
+// printGroups prints the sounds under a heading for each cd or category, like the archive
+// is organized. The groups are in the order of the cd numbers or the category names and
+// the sounds of a group in the order of the tracks
+func printGroups(ctx context.Context, db *sql.DB, sounds []sound, notes map[string]string, by string) error {
+	meta, err := readMetadata(ctx, db, sounds)
+	if err != nil {
+		return err
+	}
+
+	heading := func(m soundMeta) string {
+		if by == "cd" {
+			return strings.TrimSpace(m.cdNumber + " " + m.cdName)
+		}
+		return m.category
+	}
+	sorted := append([]sound(nil), sounds...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		mi, mj := meta[sorted[i].fname], meta[sorted[j].fname]
+		if by == "cd" && mi.cdNumber != mj.cdNumber {
+			return mi.cdNumber < mj.cdNumber
+		}
+		if hi, hj := heading(mi), heading(mj); hi != hj {
+			return strings.ToLower(hi) < strings.ToLower(hj)
+		}
+		if mi.cdNumber != mj.cdNumber {
+			return mi.cdNumber < mj.cdNumber
+		}
+		ti, _ := strconv.Atoi(mi.tracknum)
+		tj, _ := strconv.Atoi(mj.tracknum)
+		return ti < tj
+	})
+
+	last := "\x00"
+	for _, snd := range sorted {
+		h := heading(meta[snd.fname])
+		if h != last {
+			if h == "" {
+				fmt.Printf("(none)\n")
+			} else {
+				fmt.Printf("%s\n", h)
+			}
+			last = h
+		}
+		printSound(snd, notes[snd.fname], "", "  ")
+	}
+
+	return nil
+}
+
+// printCounts prints the number of sounds that match each query. A single query
+// prints just the number, for scripts
+func printCounts(ctx context.Context, sel *selection, queries []string) {
+	for _, query := range queries {
+		n, err := sel.count(ctx, query)
+		if err != nil {
+			log.Printf("Error:Query: %q: %v", query, err)
+			pipelineErrors.report("query", query, err)
+			continue
+		}
+		if len(queries) == 1 {
+			fmt.Println(n)
+		} else {
+			fmt.Printf("%d\t%s\n", n, query)
+		}
+	}
+}
+
+// isTerminal reports whether f is a terminal and not a pipe or a file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// highlightSounds replaces the descriptions of the sounds with their fts snippets, the words
+// that matched the query between on and off. Words that matched through their ascii spelling,
+// in the folded column, are found in the description by folding its words the same way.
+// The descriptions of the users stay as they are
+func highlightSounds(ctx context.Context, db *sql.DB, query string, sounds []sound, on, off string) error {
+	if query == "" {
+		return nil
+	}
+
+	for start := 0; start < len(sounds); start += sampleBatch {
+		batch := sounds[start:]
+		if len(batch) > sampleBatch {
+			batch = batch[:sampleBatch]
+		}
+
+		args := []interface{}{on, off, on, off, matchQuery(query)}
+		for _, snd := range batch {
+			args = append(args, snd.fname)
+		}
+		marks := strings.TrimSuffix(strings.Repeat("?,", len(batch)), ",")
+		rows, err := db.QueryContext(ctx, `SELECT location, `+snippetSQL(1, "...")+`, `+snippetSQL(7, "")+`
+                                                   FROM sounds WHERE sounds MATCH ? AND location IN (`+marks+`)
+                                                        AND location NOT IN (SELECT location FROM descriptions)`, args...)
+		if err != nil {
+			return err
+		}
+
+		// the snippets of the description and of the folded spelling
+		snippets := make(map[string][2]string)
+		for rows.Next() {
+			var location string
+			var snip [2]string
+			if err := rows.Scan(&location, &snip[0], &snip[1]); err != nil {
+				rows.Close()
+				return err
+			}
+			snippets[location] = snip
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for i := range batch {
+			snip := snippets[batch[i].fname]
+			if strings.Contains(snip[0], on) {
+				batch[i].descr = snip[0]
+			} else if strings.Contains(snip[1], on) {
+				batch[i].descr = markFolded(batch[i].descr, markedWords(snip[1], on, off), on, off)
+			}
+		}
+	}
+
+	return nil
+}
+
+// markedWords returns the words of a snippet between on and off
+func markedWords(snippet, on, off string) map[string]bool {
+	words := make(map[string]bool)
+	for _, s := range strings.Split(snippet, on)[1:] {
+		if i := strings.Index(s, off); i >= 0 {
+			words[s[:i]] = true
+		}
+	}
+
+	return words
+}
+
+// markFolded puts between on and off the words of text whose folded spelling is one of words
+func markFolded(text string, words map[string]bool, on, off string) string {
+	var b strings.Builder
+	var word []rune
+	flush := func() {
+		w := string(word)
+		if len(word) > 0 && words[foldDiacritics(strings.ToLower(w))] {
+			w = on + w + off
+		}
+		b.WriteString(w)
+		word = word[:0]
+	}
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			word = append(word, r)
+			continue
+		}
+		flush()
+		b.WriteRune(r)
+	}
+	flush()
+
+	return b.String()
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var sampling = flag.String("sampling", "rowid", "How to select random sounds: rowid samples the matching rows in thames, sql orders them by RANDOM() in sqlite")
+
+// samplings are the values of --sampling
+var samplings = map[string]bool{
+	"rowid": true,
+	"sql":   true,
+}
+
+// ORDER BY RANDOM() LIMIT n reads every column of every matching row and sorts them, which
+// is slow for big limits, like -n 5000 for bulk fetches. rowid sampling reads only the rowids
+// of the matching rows, from the full text index, picks n of them at random and then reads
+// just those rows. When the whole archive matches, the rowids are drawn from their range
+// and not read at all
+
+// sampleBatch is the number of rows read with each statement of the second step
+const sampleBatch = 500
+
+// sampleDatabase is queryDatabase for the random order of rowid sampling
+func sampleDatabase(ctx context.Context, sel *selection, query string, nsounds int, dir string, out chan<- sound) {
+	next, err := sel.sampler(ctx, query, nsounds)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Error:Query: %q: %v", query, err)
+			pipelineErrors.report("query", query, err)
+		}
+		return
+	}
+
+	need := nsounds
+	if need <= 0 {
+		need = math.MaxInt32
+	}
+	for need > 0 {
+		n := need
+		if n > sampleBatch {
+			n = sampleBatch
+		}
+		ids := next(n)
+		if len(ids) == 0 {
+			return
+		}
+		sounds, err := sel.readRows(ctx, ids)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Error:Query: %q: %v", query, err)
+				pipelineErrors.report("query", query, err)
+			}
+			return
+		}
+		for _, id := range ids {
+			snd, ok := sounds[id]
+			if !ok {
+				// a gap of the rowids
+				continue
+			}
+			snd.query = query
+			snd.fpath = filepath.Join(dir, snd.fname)
+			select {
+			case out <- snd:
+			case <-ctx.Done():
+				return
+			}
+			need--
+		}
+	}
+}
+
+// sampler returns, in random order, at most n of the rowids of the sounds not returned yet.
+// It returns none when there are no more. Some may be the rowids of deleted sounds
+type sampler func(n int) []int64
+
+// sampler returns the sampler of the sounds of the selection that match the query
+func (s *selection) sampler(ctx context.Context, query string, limit int) (sampler, error) {
+	if query == "" && !s.restricted() && limit > 0 {
+		var max int64
+		if err := s.db.QueryRowContext(ctx, `SELECT coalesce(max(rowid), 0) FROM sounds`).Scan(&max); err != nil {
+			return nil, err
+		}
+		// for big limits the rowids drawn again would cost more than reading all of them
+		if int64(limit) <= max/2 {
+			return rangeSampler(s.rng, max), nil
+		}
+	}
+
+	ids, err := s.rowids(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	s.rng.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+
+	return func(n int) []int64 {
+		if n > len(ids) {
+			n = len(ids)
+		}
+		next := ids[:n]
+		ids = ids[n:]
+		return next
+	}, nil
+}
+
+// seededSample returns n of the sounds of the selection that match the query, picked at random
+// with the seed. The same seed picks the same sounds while the index doesn't change, and the
+// sample of n is the first n sounds of any bigger sample
+func (s *selection) seededSample(ctx context.Context, query string, n int, seed int64, dir string) ([]sound, error) {
+	ids, err := s.rowids(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	// rowids come in the order of the index, which depends on the query plan
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	r := rand.New(rand.NewSource(seed))
+	r.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	if n < len(ids) {
+		ids = ids[:n]
+	}
+
+	var sample []sound
+	for start := 0; start < len(ids); start += sampleBatch {
+		batch := ids[start:]
+		if len(batch) > sampleBatch {
+			batch = batch[:sampleBatch]
+		}
+		sounds, err := s.readRows(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range batch {
+			if snd, ok := sounds[id]; ok {
+				snd.query = query
+				snd.fpath = filepath.Join(dir, snd.fname)
+				sample = append(sample, snd)
+			}
+		}
+	}
+
+	return sample, nil
+}
+
+// rangeSampler draws the rowids from 1 to max, the largest rowid, with rng, without reading them
+func rangeSampler(rng *rand.Rand, max int64) sampler {
+	tried := make(map[int64]bool)
+	return func(n int) []int64 {
+		var ids []int64
+		for len(ids) < n && int64(len(tried)) < max {
+			id := rng.Int63n(max) + 1
+			if !tried[id] {
+				tried[id] = true
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+}
+
+// rowids returns the rowids of the sounds of the selection that match the query
+func (s *selection) rowids(ctx context.Context, query string) ([]int64, error) {
+	from, args := s.from(query)
+	rows, err := s.db.QueryContext(ctx, "SELECT sounds.rowid "+from, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// readRows reads the sounds with the rowids
+func (s *selection) readRows(ctx context.Context, ids []int64) (map[int64]sound, error) {
+	marks := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT sounds.rowid, sounds.location, `+describedAs+`, secs, coalesce(files.cached, 0)
+                                             FROM sounds LEFT JOIN files ON files.location = sounds.location
+                                             WHERE sounds.rowid IN (`+marks+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sounds := make(map[int64]sound)
+	for rows.Next() {
+		var id int64
+		var snd sound
+		if err := rows.Scan(&id, &snd.fname, &snd.descr, &snd.secs, &snd.cached); err != nil {
+			return nil, err
+		}
+		sounds[id] = snd
+	}
+
+	return sounds, rows.Err()
+}
+
+// benchCommand implements the bench command. It times the random selection of the
+// samplings for a few limits
+func benchCommand(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	runs := fs.Int("runs", 5, "Time the average of `n` runs")
+	var limits stringsFlag
+	fs.Var(&limits, "limit", "Select `n` sounds. May be repeated, the default is 30, 1000 and 5000")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames bench [--runs n] [--limit n]... [queries...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	queries := fs.Args()
+	if len(queries) == 0 {
+		queries = []string{"", "water", "rain"}
+	}
+	if len(limits) == 0 {
+		limits = stringsFlag{"30", "1000", "5000"}
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	sel := newSelection(db)
+	sel.order = "random"
+
+	fmt.Printf("%-10s %6s %8s %10s %10s\n", "query", "limit", "selected", "sql", "rowid")
+	for _, query := range queries {
+		for _, l := range limits {
+			limit, err := strconv.Atoi(l)
+			if err != nil {
+				return fmt.Errorf("bad limit %q", l)
+			}
+
+			var selected int
+			times := make(map[string]time.Duration)
+			for _, strategy := range []string{"sql", "rowid"} {
+				sel.sampling = strategy
+				start := time.Now()
+				for i := 0; i < *runs; i++ {
+					selected = len(selectSounds(context.Background(), sel, query, limit, soundsDir))
+				}
+				times[strategy] = time.Since(start) / time.Duration(*runs)
+			}
+
+			name := query
+			if name == "" {
+				name = "(all)"
+			}
+			fmt.Printf("%-10s %6d %8d %10s %10s\n", name, limit, selected,
+				times["sql"].Round(10*time.Microsecond), times["rowid"].Round(10*time.Microsecond))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The schedule softens the mix at times and returns it to its volume afterwards, during the
+// events of --calendar, like meetings, and the times of the rules of thames.json
+//
+//	"schedule": {
+//	  "calendar": "https://calendar.example.org/private/basic.ics",
+//	  "volume": 30,
+//	  "rules": [
+//	    {"name": "lunch", "days": "mon-fri", "from": "12:30", "to": "13:30", "volume": 60},
+//	    {"name": "night", "from": "23:00", "to": "07:00", "volume": 10}
+//	  ]
+//	}
+//
+// The volumes are percents of --volume, of the events 30 if not set and of a rule that of the
+// events if not set. When several times overlap the softest wins. The mix of thames fades to
+// the volume in a few seconds, the sounds played with exec: take it as they start. The notify
+// plugins are told of each change, to hook other things to the schedule, like a status
+
+// scheduleConfig is the schedule of thames.json
+type scheduleConfig struct {
+	Calendar string         `json:"calendar"` // the url or the file of the calendar, the default of --calendar
+	Volume   *int           `json:"volume"`   // of the mix during the events
+	Rules    []scheduleRule `json:"rules"`
+}
+
+type scheduleRule struct {
+	Name   string `json:"name"`
+	Days   string `json:"days"` // like mon-fri or sat,sun, every day if empty
+	From   string `json:"from"` // like 12:30
+	To     string `json:"to"`   // the next day if before from
+	Volume *int   `json:"volume"`
+}
+
+const (
+	// defaultQuietVolume is the volume of the mix during the events, unless configured
+	defaultQuietVolume = 30
+
+	// scheduleInterval is how often the schedule is checked, calendarRefresh how often the
+	// calendar is read again
+	scheduleInterval = 15 * time.Second
+	calendarRefresh  = 10 * time.Minute
+
+	// scheduleFade is how long the mix takes to reach the volume of the schedule
+	scheduleFade = 5 * time.Second
+)
+
+// quietRule is a parsed rule of the schedule
+type quietRule struct {
+	name     string
+	days     [7]bool // by time.Weekday
+	from, to time.Duration
+	volume   int
+}
+
+// quietRules are the rules of the schedule, parsed with the configuration
+var quietRules []quietRule
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseScheduleRules parses the rules of the schedule
+func parseScheduleRules(sc scheduleConfig) ([]quietRule, error) {
+	var rules []quietRule
+	for i, r := range sc.Rules {
+		q := quietRule{name: r.Name, volume: quietVolume(sc)}
+		if q.name == "" {
+			q.name = fmt.Sprintf("rule %d", i+1)
+		}
+		if r.Volume != nil {
+			q.volume = *r.Volume
+		}
+		if q.volume < 0 || q.volume > 100 {
+			return nil, fmt.Errorf("schedule: %s: the volume is from 0 to 100", q.name)
+		}
+		var err error
+		if q.days, err = parseWeekdays(r.Days); err != nil {
+			return nil, fmt.Errorf("schedule: %s: %v", q.name, err)
+		}
+		if q.from, err = parseClock(r.From); err != nil {
+			return nil, fmt.Errorf("schedule: %s: %v", q.name, err)
+		}
+		if q.to, err = parseClock(r.To); err != nil {
+			return nil, fmt.Errorf("schedule: %s: %v", q.name, err)
+		}
+		rules = append(rules, q)
+	}
+
+	return rules, nil
+}
+
+// quietVolume is the volume of the mix during the events of the calendar
+func quietVolume(sc scheduleConfig) int {
+	if sc.Volume != nil {
+		return *sc.Volume
+	}
+
+	return defaultQuietVolume
+}
+
+// parseWeekdays parses days like mon-fri or sat,sun. Empty is every day
+func parseWeekdays(v string) ([7]bool, error) {
+	var days [7]bool
+	if strings.TrimSpace(v) == "" {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+	day := func(name string) (int, error) {
+		for i, n := range weekdayNames {
+			if strings.EqualFold(strings.TrimSpace(name), n) {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("bad day %q, the days are mon, tue, wed, thu, fri, sat and sun", name)
+	}
+	for _, part := range strings.Split(v, ",") {
+		ends := strings.SplitN(part, "-", 2)
+		from, err := day(ends[0])
+		if err != nil {
+			return days, err
+		}
+		to := from
+		if len(ends) == 2 {
+			if to, err = day(ends[1]); err != nil {
+				return days, err
+			}
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// parseClock parses a time of day like 09:30, as the time since midnight
+func parseClock(v string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(v))
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q, expected a time like 09:30", v)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// until returns when the time of the rule that is on at t ends, if it is on
+func (r quietRule) until(t time.Time) (time.Time, bool) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	since := t.Sub(midnight)
+	today, yesterday := r.days[t.Weekday()], r.days[(t.Weekday()+6)%7]
+	switch {
+	case r.from <= r.to:
+		if today && since >= r.from && since < r.to {
+			return midnight.Add(r.to), true
+		}
+	case today && since >= r.from:
+		return midnight.AddDate(0, 0, 1).Add(r.to), true
+	case yesterday && since < r.to:
+		return midnight.Add(r.to), true
+	}
+
+	return time.Time{}, false
+}
+
+// quietness is what softens the mix: the volume, why and until when
+type quietness struct {
+	volume int
+	reason string
+	until  time.Time
+}
+
+// quietAt returns what softens the mix at t, the softest of the rules and the events, if any
+func quietAt(t time.Time, rules []quietRule, events []calendarEvent, eventVolume int) (quietness, bool) {
+	var q quietness
+	found := false
+	softer := func(c quietness) {
+		if !found || c.volume < q.volume || c.volume == q.volume && c.until.After(q.until) {
+			q, found = c, true
+		}
+	}
+	for _, r := range rules {
+		if until, ok := r.until(t); ok {
+			softer(quietness{r.volume, r.name, until})
+		}
+	}
+	for _, e := range events {
+		if start, ok := e.at(t); ok {
+			softer(quietness{eventVolume, e.summary, start.Add(e.duration)})
+		}
+	}
+
+	return q, found
+}
+
+// scheduleLevel is the level of the mix that the schedule sets, 1 for its volume
+var scheduleLevel = struct {
+	sync.Mutex
+	level float64
+}{level: 1}
+
+func currentScheduleLevel() float64 {
+	scheduleLevel.Lock()
+	defer scheduleLevel.Unlock()
+
+	return scheduleLevel.level
+}
+
+func setScheduleLevel(level float64) {
+	scheduleLevel.Lock()
+	defer scheduleLevel.Unlock()
+
+	scheduleLevel.level = level
+}
+
+// hasSchedule reports whether a calendar or rules soften the mix
+func hasSchedule() bool {
+	return *calendarSource != "" || len(quietRules) > 0
+}
+
+// scheduler sets the level of the mix by the schedule
+type scheduler struct {
+	events      []calendarEvent
+	read        time.Time // when the calendar was read last
+	eventVolume int
+	last        int // the volume set, -1 for that of the mix
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{eventVolume: quietVolume(conf.Schedule), last: -1}
+}
+
+// check sets the level of the mix for the schedule at t
+func (s *scheduler) check(t time.Time) {
+	q, quiet := quietAt(t, quietRules, s.events, s.eventVolume)
+	switch {
+	case quiet && q.volume != s.last:
+		log.Printf("Schedule: %s, the mix at %d%% until %s", q.reason, q.volume, q.until.Format("15:04"))
+		setScheduleLevel(float64(q.volume) / 100)
+		activePlugins.scheduled(q.volume, q.reason)
+		s.last = q.volume
+	case !quiet && s.last >= 0:
+		log.Printf("Schedule: the mix is back to its volume")
+		setScheduleLevel(1)
+		activePlugins.scheduled(100, "")
+		s.last = -1
+	}
+}
+
+// run checks the schedule, reading the calendar again from time to time, until ctx is done
+func (s *scheduler) run(ctx context.Context) {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for {
+		if *calendarSource != "" && time.Since(s.read) >= calendarRefresh {
+			s.read = time.Now()
+			if events, err := readCalendar(ctx, *calendarSource); err != nil {
+				// keep the events read last, the feed may be down for a while
+				log.Printf("Error:Calendar: %v", err)
+				pipelineErrors.report("calendar", *calendarSource, err)
+			} else {
+				s.events = events
+			}
+		}
+		s.check(time.Now())
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
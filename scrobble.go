@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listenBrainzURL is the api of ListenBrainz. Other servers, like Maloja, implement it too
+const listenBrainzURL = "https://api.listenbrainz.org"
+
+// scrobbleArtist is the artist of the sounds submitted, their titles are their descriptions
+const scrobbleArtist = "BBC Sound Effects"
+
+type listenBrainzConfig struct {
+	Token string `json:"token"` // the user token, from the settings of the account
+	URL   string `json:"url"`   // the api, if not ListenBrainz
+}
+
+// listen is a listen of the ListenBrainz api
+type listen struct {
+	ListenedAt int64 `json:"listened_at"`
+	Track      struct {
+		Artist string `json:"artist_name"`
+		Title  string `json:"track_name"`
+		Info   struct {
+			Player     string `json:"media_player"`
+			Client     string `json:"submission_client"`
+			DurationMs int    `json:"duration_ms,omitempty"`
+			OriginURL  string `json:"origin_url"`
+			Location   string `json:"bbc_location"`
+		} `json:"additional_info"`
+	} `json:"track_metadata"`
+}
+
+// scrobbler submits the sounds played to ListenBrainz, in the background so that a slow or
+// unreachable server never delays the players
+type scrobbler struct {
+	url     string
+	token   string
+	client  *http.Client
+	listens chan listen
+	pending sync.WaitGroup // the listens not submitted yet
+}
+
+// playScrobbler is the scrobbler of the session, nil when there is no token in the configuration
+var playScrobbler *scrobbler
+
+// newScrobbler returns a running scrobbler, or nil if it is not configured
+func newScrobbler(c listenBrainzConfig) *scrobbler {
+	if c.Token == "" {
+		return nil
+	}
+	s := &scrobbler{
+		url:     strings.TrimSuffix(c.URL, "/"),
+		token:   c.Token,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		listens: make(chan listen, 100),
+	}
+	if s.url == "" {
+		s.url = listenBrainzURL
+	}
+	go s.run()
+
+	return s
+}
+
+// submit submits snd that played from start until now. Like music players, only sounds that
+// played for half their duration, or for 4 minutes, count
+func (s *scrobbler) submit(snd sound, start time.Time) {
+	if s == nil {
+		return
+	}
+	played := time.Since(start)
+	if played < time.Duration(snd.secs)*time.Second/2 && played < 4*time.Minute {
+		return
+	}
+
+	var l listen
+	l.ListenedAt = start.Unix()
+	l.Track.Artist = scrobbleArtist
+	l.Track.Title = snd.descr
+	l.Track.Info.Player = "thames"
+	l.Track.Info.Client = "thames"
+	l.Track.Info.DurationMs = snd.secs * 1000
+	l.Track.Info.OriginURL = soundURL(catalogURL, snd.fname)
+	l.Track.Info.Location = snd.fname
+
+	s.pending.Add(1)
+	select {
+	case s.listens <- l:
+	default:
+		s.pending.Done()
+		log.Printf("Error:Scrobble: too many listens waiting, dropped %s", snd.fname)
+	}
+}
+
+// flush waits, for a while, for the listens waiting to be submitted, before thames exits
+func (s *scrobbler) flush(timeout time.Duration) {
+	if s == nil {
+		return
+	}
+	done := make(chan bool)
+	go func() {
+		s.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Error:Scrobble: gave up waiting for %d listens", len(s.listens))
+	}
+}
+
+func (s *scrobbler) run() {
+	for l := range s.listens {
+		if err := s.post(l); err != nil {
+			log.Printf("Error:Scrobble: %s: %v", l.Track.Info.Location, err)
+		}
+		s.pending.Done()
+	}
+}
+
+func (s *scrobbler) post(l listen) error {
+	body, err := json.Marshal(struct {
+		Type    string   `json:"listen_type"`
+		Payload []listen `json:"payload"`
+	}{"single", []listen{l}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.url+"/1/submit-listens", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
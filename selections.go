@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"strings"
+)
+
+var selectionCache = flag.Bool("selection-cache", true, "Start with a cached sound of the last selection of the queries, playing while they are selected again")
+
+// Selecting the sounds takes a while on a big index, or with smart playlists and plugins,
+// and nothing plays meanwhile. The last selection of each query is kept in user.db, so a
+// session that runs again starts at once with a sound of it, the head start, that is in the
+// cache and that the query still selects. The head start is one of the sounds of its query
+// group, the fresh selection plays after it. "selectionCache": false in thames.json turns it off
+
+const selectionsSchema = `CREATE TABLE IF NOT EXISTS selections(
+                            query TEXT NOT NULL,
+                            position INTEGER NOT NULL,
+                            location TEXT NOT NULL,
+                            PRIMARY KEY(query, position)
+                          )`
+
+// rememberSelections replaces the last selections of the queries of the sounds
+func rememberSelections(db *sql.DB, selected [][]sound) error {
+	var queries []string
+	byQuery := make(map[string][]string)
+	for _, sounds := range selected {
+		for _, snd := range sounds {
+			if _, ok := byQuery[snd.query]; !ok {
+				queries = append(queries, snd.query)
+			}
+			byQuery[snd.query] = append(byQuery[snd.query], snd.fname)
+		}
+	}
+	if len(queries) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, q := range queries {
+		if _, err := tx.Exec(`DELETE FROM selections WHERE query = ?`, q); err != nil {
+			return err
+		}
+		for i, location := range byQuery[q] {
+			if _, err := tx.Exec(`INSERT INTO selections(query, position, location) VALUES(?, ?, ?)`, q, i, location); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// headStart returns the sound of the group to play while it is selected, the first of the
+// last selection of its queries that is in the cache dir and that the selection still selects
+func headStart(ctx context.Context, sel *selection, dir string, g queryGroup) (sound, bool, error) {
+	for _, q := range g.queries {
+		locations, err := lastSelection(ctx, sel.db, q)
+		if err != nil {
+			return sound{}, false, err
+		}
+		var cached []string
+		paths := make(map[string]string)
+		for _, l := range locations {
+			if sp, exists, err := cachedPath(dir, l); err == nil && exists {
+				cached = append(cached, l)
+				paths[l] = sp
+			}
+		}
+		if len(cached) == 0 {
+			continue
+		}
+
+		sounds, err := sel.selects(ctx, q, cached)
+		if err != nil {
+			return sound{}, false, err
+		}
+		for _, l := range cached {
+			if snd, ok := sounds[l]; ok {
+				snd.group = g.name
+				snd.fpath = paths[l]
+				return snd, true, nil
+			}
+		}
+	}
+
+	return sound{}, false, nil
+}
+
+// lastSelection returns the locations of the last selection of query, in order
+func lastSelection(ctx context.Context, db *sql.DB, query string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT location FROM selections WHERE query = ? ORDER BY position`, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var locations []string
+	for rows.Next() {
+		var l string
+		if err := rows.Scan(&l); err != nil {
+			return nil, err
+		}
+		locations = append(locations, l)
+	}
+
+	return locations, rows.Err()
+}
+
+// selects returns the sounds at the locations that the selection selects for query, by location
+func (s *selection) selects(ctx context.Context, query string, locations []string) (map[string]sound, error) {
+	from, args := s.from(query)
+	marks := strings.TrimSuffix(strings.Repeat("?, ", len(locations)), ", ")
+	stmt := `SELECT sounds.location, ` + describedAs + `, secs, coalesce(files.cached, 0)
+                 FROM sounds LEFT JOIN files ON files.location = sounds.location
+                 WHERE sounds.location IN (` + marks + `) AND sounds.rowid IN (SELECT sounds.rowid ` + from + `)`
+	var all []interface{}
+	for _, l := range locations {
+		all = append(all, l)
+	}
+	rows, err := s.db.QueryContext(ctx, stmt, append(all, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sounds := make(map[string]sound)
+	for rows.Next() {
+		var snd sound
+		if err := rows.Scan(&snd.fname, &snd.descr, &snd.secs, &snd.cached); err != nil {
+			return nil, err
+		}
+		snd.query = query
+		sounds[snd.fname] = snd
+	}
+
+	return sounds, rows.Err()
+}
+
+// withoutHeadStart returns the sounds selected for the group of the head start, n for each
+// query, without it, or without the last of them if it wasn't selected again and the group has
+// all its sounds, so the group plays as many sounds as without a head start
+func withoutHeadStart(sounds []sound, start sound, g queryGroup, n int) []sound {
+	for i, snd := range sounds {
+		if snd.fname == start.fname {
+			return append(sounds[:i:i], sounds[i+1:]...)
+		}
+	}
+	if n > 0 && len(sounds) >= groupCount(g, n) {
+		return sounds[:len(sounds)-1]
+	}
+
+	return sounds
+}
@@ -0,0 +1,662 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// A daemon plays sessions on request. It is controlled with one line commands on a unix
+// socket, usually with thames ctl. The words of a command are separated by tabs, or by
+// spaces if the line has no tabs
+//
+//	play queries...       play the queries, one after the other
+//	mix queries...        mix the queries
+//	preset file           mix the lines of a preset
+//	gain group volume     set the volume of a mixed query group
+//	oneshot query         fire a one-shot of query
+//	next location...      play the sounds at the locations next, before the queued sounds
+//	now location...       play the sounds at the locations at once, over the others
+//	skip query            skip the remaining sounds of a query, or query group
+//	position              print where the sounds that play are, elapsed and remaining
+//	queue [n]             print the sounds that play and the next n of each player, with
+//	                      their downloads and how soon they play
+//	seek [group] offset   seek the sounds, or those of the group, like +10, -10, 1:30 or cue 2
+//	stop                  stop the session
+//	status                print what is playing
+//	errors                print the errors of the sessions so far
+//	health                print the goroutines, open files, memory and queues of the daemon
+//
+// The daemon plays several named sessions at once, each with its own queue and output.
+// The commands above control the default session, or the session name with a prefix
+//
+//	session name command  send the command to the session name
+//	open name [output]    open the session name on the output: device, the default, or stream addr
+//	close name            stop the session name and close its output
+//	sessions              print the sessions, their outputs and what they play
+//
+// Every reply ends with a line that is ok, or error: followed by the message
+
+// daemon is the state of thames serve
+type daemon struct {
+	db  *sql.DB
+	sel *selection
+	ctx context.Context // the sessions stop when it is done
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func defaultSocket() string {
+	return filepath.Join(*rootDir, "thames.sock")
+}
+
+// serveCommand implements the serve command
+func serveCommand(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	socket := fs.String("socket", defaultSocket(), "Listen for commands on the unix socket `path`, unless the socket is passed by systemd")
+	systemd := fs.Bool("systemd", false, "Notify systemd of readiness, status and watchdog keep-alives")
+	apiAddr := fs.String("addr", "", "Serve the HTTP API and the web UI, to search, listen, request sounds and build mixes from the LAN, at `addr`, like :8080")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames serve [--socket path] [--addr addr] [--systemd] [queries...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	ln, err := controlListener(*socket)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stopPlugins := startPlugins()
+	defer stopPlugins()
+
+	playHistory = newHistory(db)
+	playScrobbler = newScrobbler(conf.ListenBrainz)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		log.Printf("Stopping")
+		if *systemd {
+			sdNotify("STOPPING=1")
+		}
+		cancel()
+		ln.Close()
+	}()
+
+	if *streamAddr != "" {
+		if err := startStream(*streamAddr); err != nil {
+			return err
+		}
+	}
+
+	d := &daemon{db: db, sel: newSelection(db), ctx: ctx, sessions: make(map[string]*session)}
+	def, err := d.openSession(defaultSession, nil)
+	if err != nil {
+		return err
+	}
+	wait, err := startControllers(ctx, db, d.sel, def.ctl)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cancel()
+		wait()
+	}()
+	if *heartbeatFile != "" {
+		go heartbeat(ctx, *heartbeatFile)
+	}
+	go d.checkHealth(ctx)
+	if *apiAddr != "" {
+		if err := d.serveAPI(*apiAddr); err != nil {
+			return err
+		}
+	}
+
+	if *systemd {
+		go d.notifySystemd(ctx)
+	}
+
+	// the queries of the command line play at once
+	if *presetFile != "" {
+		def.ctl.switchPreset(*presetFile)
+	} else if fs.NArg() > 0 {
+		def.ctl.switchSession(sessionSpec{groups: parseGroups(volumeArgs(fs.Args())), mix: *mix})
+	}
+
+	log.Printf("Serving commands at %s", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				pipelineErrors.logSummary()
+				return nil
+			}
+			return err
+		}
+		go d.handle(conn)
+	}
+}
+
+// play plays what the controls of the session request until ctx is done
+func (d *daemon) play(ctx context.Context, s *session) {
+	for {
+		var next sessionSpec
+		select {
+		case next = <-s.ctl.switchTo:
+		case <-s.ctl.quit:
+			// nothing is playing
+			continue
+		case <-ctx.Done():
+			return
+		}
+
+		for {
+			groups, autos, mixing, err := next.load()
+			if err != nil {
+				log.Printf("Error:Preset: %v", err)
+				pipelineErrors.report("preset", next.String(), err)
+				break
+			}
+			s.ctl.setAutomations(autos)
+			s.setPlaying(next.String())
+			playHistory.setPreset(next.preset)
+
+			var end sessionEnd
+			next, end = s.ctl.play(ctx, func(ctx context.Context, skips *skipSet, req *requests) {
+				playSession(ctx, newPipeline(d.db), d.sel, groups, autos, mixing, skips, req)
+			})
+			if end != sessionSwitched {
+				break
+			}
+		}
+		s.setPlaying("")
+	}
+}
+
+// status is what the default session plays or, when there are others, what each plays
+func (d *daemon) status() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.sessions) == 1 && d.sessions[defaultSession] != nil {
+		return d.sessions[defaultSession].status()
+	}
+	var names []string
+	for name := range d.sessions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var statuses []string
+	for _, name := range names {
+		statuses = append(statuses, name+" "+d.sessions[name].status())
+	}
+
+	return strings.Join(statuses, ", ")
+}
+
+func (s sessionSpec) String() string {
+	if s.preset != "" {
+		return "preset " + s.preset
+	}
+	verb := "play"
+	if s.mix {
+		verb = "mix"
+	}
+
+	return verb + " " + strings.Join(groupNames(s.groups), " ")
+}
+
+func groupNames(groups []queryGroup) []string {
+	var names []string
+	for _, g := range groups {
+		names = append(names, g.name)
+	}
+
+	return names
+}
+
+// controlIdleTimeout closes the connections to the control socket that send no commands,
+// clients that hang don't hold a goroutine forever
+const controlIdleTimeout = 10 * time.Minute
+
+// handle executes the commands of a connection to the control socket
+func (d *daemon) handle(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(controlIdleTimeout))
+		if !scanner.Scan() {
+			return
+		}
+		reply, err := d.command(splitCommand(scanner.Text()))
+		if reply != "" {
+			fmt.Fprintln(conn, reply)
+		}
+		if err != nil {
+			fmt.Fprintf(conn, "error: %v\n", err)
+		} else {
+			fmt.Fprintln(conn, "ok")
+		}
+	}
+}
+
+func splitCommand(line string) []string {
+	line = strings.TrimRight(line, "\r")
+	if strings.Contains(line, "\t") {
+		var words []string
+		for _, w := range strings.Split(line, "\t") {
+			if w != "" {
+				words = append(words, w)
+			}
+		}
+		return words
+	}
+
+	return strings.Fields(line)
+}
+
+// command executes a command of the control socket and returns its reply
+func (d *daemon) command(words []string) (string, error) {
+	if len(words) == 0 {
+		return "", errors.New("no command")
+	}
+
+	args := words[1:]
+	switch words[0] {
+	case "session":
+		if len(args) < 2 {
+			return "", errors.New("expected a session and a command")
+		}
+		s, err := d.session(args[0])
+		if err != nil {
+			return "", err
+		}
+		return d.sessionCommand(s, args[1:])
+	case "open":
+		if len(args) == 0 {
+			return "", errors.New("expected a session name")
+		}
+		_, err := d.openSession(args[0], args[1:])
+		return "", err
+	case "close":
+		if len(args) != 1 {
+			return "", errors.New("expected a session name")
+		}
+		return "", d.closeSession(args[0])
+	case "sessions":
+		return d.listSessions(), nil
+	case "errors":
+		if s := pipelineErrors.summary(); s != "" {
+			return s, nil
+		}
+		return "no errors", nil
+	case "health":
+		return d.sampleHealth().String(), nil
+	}
+
+	s, err := d.session(defaultSession)
+	if err != nil {
+		return "", err
+	}
+
+	return d.sessionCommand(s, words)
+}
+
+// sessionCommand executes a command of the control socket on the session
+func (d *daemon) sessionCommand(s *session, words []string) (string, error) {
+	args := words[1:]
+	switch words[0] {
+	case "play", "mix":
+		if len(args) == 0 {
+			return "", errors.New("no queries")
+		}
+		s.ctl.switchSession(sessionSpec{groups: parseGroups(volumeArgs(args)), mix: words[0] == "mix"})
+	case "preset":
+		if len(args) != 1 {
+			return "", errors.New("expected a preset file")
+		}
+		if _, err := os.Stat(resolvePreset(args[0])); err != nil {
+			return "", err
+		}
+		s.ctl.switchPreset(args[0])
+	case "gain":
+		if len(args) != 2 {
+			return "", errors.New("expected group and volume")
+		}
+		gain, err := parseGain(args[1])
+		if err != nil {
+			return "", err
+		}
+		if !s.ctl.setGain(args[0], gain) {
+			return "", fmt.Errorf("no group %q in the session", args[0])
+		}
+	case "oneshot":
+		if len(args) == 0 {
+			return "", errors.New("expected a query")
+		}
+		if s.ctl.oneshots == nil {
+			return "", errors.New("one-shots play only in the default session")
+		}
+		s.ctl.fire(strings.Join(args, " "))
+	case "next", "now":
+		if len(args) == 0 {
+			return "", errors.New("expected locations")
+		}
+		sounds, err := lookupSounds(d.ctx, d.db, args, soundsDir)
+		if err != nil {
+			return "", err
+		}
+		return "", s.ctl.request(sounds, words[0] == "now")
+	case "skip":
+		if len(args) == 0 {
+			return "", errors.New("expected a query")
+		}
+		s.ctl.skip(strings.Join(args, " "))
+	case "position":
+		if p := s.ctl.positions(); p != "" {
+			return p, nil
+		}
+		return "nothing is playing", nil
+	case "queue":
+		n := queueLength
+		if len(args) > 0 {
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil || n < 0 || len(args) > 1 {
+				return "", errors.New("expected the number of sounds")
+			}
+		}
+		if q := s.ctl.queued(n); q != "" {
+			return q, nil
+		}
+		return "nothing is playing", nil
+	case "seek":
+		group, target, err := seekArgs(args)
+		if err != nil {
+			return "", err
+		}
+		return "", s.ctl.seek(group, target)
+	case "stop":
+		s.ctl.stop()
+	case "status":
+		return fmt.Sprintf("%s\nplayed %d", s.status(), atomic.LoadInt64(&played)), nil
+	default:
+		return "", fmt.Errorf("unknown command %q", words[0])
+	}
+
+	return "", nil
+}
+
+// seekArgs parses the arguments of seek, the group if any and the offset or cue
+func seekArgs(args []string) (string, seekTarget, error) {
+	n := 1
+	if len(args) >= 2 && args[len(args)-2] == "cue" {
+		n = 2
+	}
+	if len(args) < n {
+		return "", seekTarget{}, errors.New("expected an offset, like +10 or 1:30, or cue n")
+	}
+	target, err := parseSeek(args[len(args)-n:])
+
+	return strings.Join(args[:len(args)-n], " "), target, err
+}
+
+// controlListener returns the control socket passed by systemd socket activation or,
+// if there is none, listens on the unix socket path
+func controlListener(path string) (net.Listener, error) {
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid == os.Getpid() {
+		nfds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		// the players must not inherit the socket
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		if nfds != 1 {
+			return nil, fmt.Errorf("systemd passed %d sockets, expected 1", nfds)
+		}
+		// passed sockets start at fd 3
+		syscall.CloseOnExec(3)
+		return net.FileListener(os.NewFile(3, "systemd socket"))
+	}
+
+	// a socket left by a daemon that crashed would make listen fail
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s: another thames is serving", path)
+	}
+	os.Remove(path)
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+// notifySystemd tells systemd that the daemon is ready, reports what it plays and sends
+// the watchdog keep-alives until ctx is done. See sd_notify(3)
+func (d *daemon) notifySystemd(ctx context.Context) {
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("Error:Systemd: %v", err)
+		return
+	}
+
+	// the status is checked every few seconds, the keep-alives are sent at least at half
+	// the watchdog timeout, as sd_watchdog_enabled(3) recommends
+	interval := 5 * time.Second
+	usec, _ := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	pid, _ := strconv.Atoi(os.Getenv("WATCHDOG_PID"))
+	watchdog := usec > 0 && (pid == 0 || pid == os.Getpid())
+	if half := time.Duration(usec) * time.Microsecond / 2; watchdog && half < interval {
+		interval = half
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last string
+	for {
+		var lines []string
+		if status := "STATUS=" + d.status(); status != last {
+			lines = append(lines, status)
+			last = status
+		}
+		if watchdog {
+			lines = append(lines, "WATCHDOG=1")
+		}
+		if len(lines) > 0 {
+			if err := sdNotify(strings.Join(lines, "\n")); err != nil {
+				log.Printf("Error:Systemd: %v", err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sdNotify sends state to the notification socket of systemd, if there is one
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		// abstract socket
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+
+	return err
+}
+
+// ctlCommand implements the ctl command, the client of the control socket. With --watch it
+// sends the command again at every interval, showing the replies like top, until interrupted
+func ctlCommand(args []string) error {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socket := fs.String("socket", defaultSocket(), "The control socket `path` of thames serve")
+	name := fs.String("session", "", "Send the command to the session `name` instead of the default session")
+	watch := fs.Duration("watch", 0, "Send the command again at every `interval`, like 2s, replacing the reply on the terminal")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames ctl [--socket path] [--session name] [--watch interval] command [args...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 || *watch < 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	words := fs.Args()
+	if *name != "" {
+		words = append([]string{"session", *name}, words...)
+	}
+	redraw := colorOutput(os.Stdout)
+	for {
+		reply, err := sendCommand(*socket, words)
+		if err != nil {
+			return err
+		}
+		if *watch == 0 {
+			if reply != "" {
+				fmt.Println(reply)
+			}
+			return nil
+		}
+		if redraw {
+			// home and clear the screen
+			fmt.Print("\x1b[H\x1b[2J")
+		} else {
+			fmt.Println()
+		}
+		fmt.Printf("%s  %s\n\n", time.Now().Format("15:04:05"), strings.Join(fs.Args(), " "))
+		if reply != "" {
+			fmt.Println(reply)
+		}
+		time.Sleep(*watch)
+	}
+}
+
+// sendCommand sends the command of words to the control socket and returns its reply
+func sendCommand(socket string, words []string) (string, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprintln(conn, strings.Join(words, "\t")); err != nil {
+		return "", err
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "ok":
+			return strings.Join(lines, "\n"), nil
+		case strings.HasPrefix(line, "error: "):
+			return "", errors.New(strings.TrimPrefix(line, "error: "))
+		default:
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", errors.New("connection closed without a reply")
+}
+
+// unitCommand implements the unit command. It prints systemd units that run thames serve
+func unitCommand(args []string) error {
+	fs := flag.NewFlagSet("unit", flag.ExitOnError)
+	socketUnit := fs.Bool("socket", false, "Print the socket unit, for socket activation, instead of the service unit")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames unit [--socket]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	root, err := filepath.Abs(*rootDir)
+	if err != nil {
+		return err
+	}
+
+	if *socketUnit {
+		fmt.Printf(`[Unit]
+Description=Thames control socket
+
+[Socket]
+ListenStream=%s
+SocketMode=0600
+
+[Install]
+WantedBy=sockets.target
+`, filepath.Join(root, "thames.sock"))
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	fmt.Printf(`[Unit]
+Description=Thames sound effects player
+After=network-online.target sound.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+ExecStart=%s -r %s serve --systemd
+WatchdogSec=60
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy=default.target
+`, exe, root)
+
+	return nil
+}
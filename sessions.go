@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultSession is the session of the daemon that plays the queries of the command line and
+// that the controllers, like MIDI and OSC, control. It can't be closed
+const defaultSession = "default"
+
+// output is where a session plays, the audio device or its own stream
+type output struct {
+	name  string // like device, or stream :8001
+	mixer *mixer // of the stream, nil for the audio device
+}
+
+// outputKey is the key of the output in the context of a session. Without it the sounds
+// play on the output of the command line
+type outputKey struct{}
+
+// openOutput opens the output of the words, device or stream addr, until ctx is done
+func openOutput(ctx context.Context, words []string) (*output, error) {
+	switch {
+	case len(words) == 0 || len(words) == 1 && words[0] == "device":
+		return &output{name: "device"}, nil
+	case len(words) == 2 && words[0] == "stream":
+		m, err := serveStream(ctx, words[1])
+		if err != nil {
+			return nil, err
+		}
+		return &output{name: "stream " + words[1], mixer: m}, nil
+	}
+
+	return nil, fmt.Errorf("unknown output %q, expected device or stream addr", strings.Join(words, " "))
+}
+
+// session is a named session of the daemon. Each has its own controls, so its own queue
+// and volumes, and its own output
+type session struct {
+	name   string
+	out    *output // nil for the output of the command line
+	ctl    *controls
+	cancel context.CancelFunc
+	done   chan bool
+
+	mu      sync.Mutex
+	playing string // what the session plays, empty when idle
+}
+
+// openSession starts the session name on the output of the words. The default session plays
+// on the output of the command line
+func (d *daemon) openSession(name string, words []string) (*session, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.sessions[name] != nil {
+		return nil, fmt.Errorf("session %q is open", name)
+	}
+	if len(d.sessions) >= maxSessions {
+		return nil, fmt.Errorf("%d sessions are open, close one first", len(d.sessions))
+	}
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	s := &session{name: name, ctl: newControls(), cancel: cancel, done: make(chan bool)}
+	if name != defaultSession {
+		out, err := openOutput(ctx, words)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		s.out = out
+		ctx = context.WithValue(ctx, outputKey{}, out)
+	}
+	d.sessions[name] = s
+
+	go func() {
+		d.play(ctx, s)
+		close(s.done)
+	}()
+	log.Printf("Session %s: open on %s", name, s.outputName())
+
+	return s, nil
+}
+
+// closeSession stops the session name and closes its output
+func (d *daemon) closeSession(name string) error {
+	if name == defaultSession {
+		return errors.New("the default session can't be closed, stop it instead")
+	}
+
+	d.mu.Lock()
+	s := d.sessions[name]
+	delete(d.sessions, name)
+	d.mu.Unlock()
+	if s == nil {
+		return fmt.Errorf("no session %q", name)
+	}
+
+	s.cancel()
+	<-s.done
+	log.Printf("Session %s: closed", name)
+
+	return nil
+}
+
+func (d *daemon) session(name string) (*session, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := d.sessions[name]
+	if s == nil {
+		return nil, fmt.Errorf("no session %q", name)
+	}
+
+	return s, nil
+}
+
+// listSessions returns a line for each session, its name, output and what it plays
+func (d *daemon) listSessions() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var names []string
+	for name := range d.sessions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, name := range names {
+		s := d.sessions[name]
+		lines = append(lines, fmt.Sprintf("%s\t%s\t%s", name, s.outputName(), s.status()))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (s *session) outputName() string {
+	switch {
+	case s.out != nil:
+		return s.out.name
+	case *streamAddr != "":
+		return "stream " + *streamAddr
+	}
+
+	return "device"
+}
+
+func (s *session) setPlaying(what string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.playing = what
+	if what != "" {
+		log.Printf("Session %s: %s", s.name, what)
+	}
+}
+
+func (s *session) status() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.playing == "" {
+		return "idle"
+	}
+
+	return "playing " + s.playing
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var smartName = flag.String("smart", "", "Play, or with --query print, the sounds of the smart playlist `name`, evaluated now")
+
+// A smart playlist is a saved set of rules that sounds must match, like
+//
+//	category=Birds AND secs>60 AND rating>=4 AND not played in 30d
+//
+// The rules are evaluated when the sounds are selected, so the sounds change as they are
+// rated and played. The rules are joined with AND and are one of
+//
+//	category=c, category!=c     the category, or a subcategory of it, like with --category
+//	cd=n, cd!=n                 the number of the CD, like EC198A
+//	tag=t, tag!=t               sounds tagged, or not, with t
+//	rating op n                 the rating, 0 if not rated. op is one of = != < <= > >=
+//	secs op n                   the duration
+//	query=q                     sounds that match the full text query q. Quote phrases, query="heavy rain"
+//	played in 30d               played in the last 30 days, with h, d or w for hours, days or weeks
+//	not played in 30d           not played in the last 30 days, or never
+//	cached, not cached          in the cache or not
+
+// smartSchema is the table of the smart playlists
+const smartSchema = `CREATE TABLE IF NOT EXISTS smart_playlists(
+                       name TEXT PRIMARY KEY,
+                       rules TEXT NOT NULL
+                     )`
+
+// smartRule is a rule of a smart playlist as an SQL condition on the sounds
+type smartRule struct {
+	where string
+	args  []interface{}
+}
+
+var (
+	playedRe  = regexp.MustCompile(`(?i)^(not\s+)?played\s+in\s+(\d+)([hdw])$`)
+	cachedRe  = regexp.MustCompile(`(?i)^(not\s+)?cached$`)
+	compareRe = regexp.MustCompile(`^([a-zA-Z]+)\s*(<=|>=|!=|=|<|>)\s*(.+)$`)
+	andRe     = regexp.MustCompile(`(?i)^and$`)
+)
+
+// parseRules parses the rules of a smart playlist
+func parseRules(text string) ([]smartRule, error) {
+	var clauses [][]string
+	var clause []string
+	for _, term := range splitTerms(text) {
+		if andRe.MatchString(term) {
+			clauses = append(clauses, clause)
+			clause = nil
+			continue
+		}
+		clause = append(clause, term)
+	}
+	clauses = append(clauses, clause)
+
+	var rules []smartRule
+	for _, c := range clauses {
+		if len(c) == 0 {
+			return nil, fmt.Errorf("empty rule in %q", text)
+		}
+		r, err := parseRule(strings.Join(c, " "))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+func parseRule(text string) (smartRule, error) {
+	if m := playedRe.FindStringSubmatch(text); m != nil {
+		n, _ := strconv.Atoi(m[2])
+		unit := map[string]time.Duration{"h": time.Hour, "d": 24 * time.Hour, "w": 7 * 24 * time.Hour}[strings.ToLower(m[3])]
+		secs := int64(time.Duration(n) * unit / time.Second)
+		op := "IN"
+		if m[1] != "" {
+			op = "NOT IN"
+		}
+		// relative to the time of the selection, not of the parsing
+		return smartRule{"sounds.location " + op + " (SELECT location FROM plays WHERE at >= CAST(strftime('%s', 'now') AS INTEGER) - ?)", []interface{}{secs}}, nil
+	}
+	if m := cachedRe.FindStringSubmatch(text); m != nil {
+		if m[1] != "" {
+			return smartRule{"NOT coalesce(files.cached, 0)", nil}, nil
+		}
+		return smartRule{"coalesce(files.cached, 0)", nil}, nil
+	}
+
+	m := compareRe.FindStringSubmatch(text)
+	if m == nil {
+		return smartRule{}, fmt.Errorf("bad rule %q", text)
+	}
+	field, op, value := strings.ToLower(m[1]), m[2], m[3]
+	if field != "query" {
+		value = strings.Trim(value, `"`)
+	}
+	equality := op == "=" || op == "!="
+	not := ""
+	if op == "!=" {
+		not = "NOT "
+	}
+
+	switch {
+	case field == "category" && equality:
+		return smartRule{not + "(category = ? COLLATE NOCASE OR category LIKE ?)", []interface{}{value, value + ":%"}}, nil
+	case field == "cd" && equality:
+		return smartRule{"CDNumber " + op + " ? COLLATE NOCASE", []interface{}{value}}, nil
+	case field == "tag" && equality:
+		return smartRule{"sounds.location " + not + "IN (SELECT location FROM tags WHERE tag = ?)", []interface{}{value}}, nil
+	case field == "query" && op == "=":
+		return smartRule{"sounds.rowid IN (SELECT rowid FROM sounds WHERE sounds MATCH ?)", []interface{}{matchQuery(value)}}, nil
+	case field == "rating" || field == "secs":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return smartRule{}, fmt.Errorf("bad rule %q: %s is not a number", text, value)
+		}
+		column := "CAST(secs AS INTEGER)"
+		if field == "rating" {
+			column = "coalesce((SELECT rating FROM ratings WHERE ratings.location = sounds.location), 0)"
+		}
+		return smartRule{column + " " + op + " ?", []interface{}{n}}, nil
+	case field == "category" || field == "cd" || field == "tag" || field == "query":
+		return smartRule{}, fmt.Errorf("bad rule %q: %s can't be compared with %s", text, field, op)
+	}
+
+	return smartRule{}, fmt.Errorf("bad rule %q: unknown field %s", text, field)
+}
+
+// loadSmart returns the rules of the smart playlist name
+func loadSmart(db *sql.DB, name string) (string, []smartRule, error) {
+	var text string
+	err := db.QueryRow(`SELECT rules FROM smart_playlists WHERE name = ?`, name).Scan(&text)
+	if err == sql.ErrNoRows {
+		return "", nil, fmt.Errorf("no smart playlist %q", name)
+	} else if err != nil {
+		return "", nil, err
+	}
+	rules, err := parseRules(text)
+	if err != nil {
+		return "", nil, fmt.Errorf("smart playlist %s: %v", name, err)
+	}
+
+	return text, rules, nil
+}
+
+// smartCommand implements the smart command which maintains the smart playlists
+func smartCommand(args []string) error {
+	usage := func() error {
+		fmt.Fprintf(os.Stderr, "usage: thames smart save name rules...\n       thames smart list\n       thames smart delete name\n")
+		return errUsage
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch {
+	case args[0] == "save" && len(args) >= 3:
+		text := strings.Join(args[2:], " ")
+		if _, err := parseRules(text); err != nil {
+			return err
+		}
+		if _, err := db.Exec(`INSERT INTO smart_playlists(name, rules) VALUES(?, ?)
+                                      ON CONFLICT(name) DO UPDATE SET rules = excluded.rules`, args[1], text); err != nil {
+			return err
+		}
+	case args[0] == "list" && len(args) == 1:
+		rows, err := db.Query(`SELECT name, rules FROM smart_playlists ORDER BY name`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name, text string
+			if err := rows.Scan(&name, &text); err != nil {
+				return err
+			}
+			fmt.Printf("%s\t%s\n", name, text)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	case args[0] == "delete" && len(args) == 2:
+		res, err := db.Exec(`DELETE FROM smart_playlists WHERE name = ?`, args[1])
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("no smart playlist %q", args[1])
+		}
+	default:
+		return usage()
+	}
+
+	return nil
+}
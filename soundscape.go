@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var soundscapeFile = flag.String("playlist", "", "Play the queries of the playlist `file`, a json soundscape with the number of sounds, the gain and the group of each query, or of a mix saved by the web UI")
+
+// A playlist of queries saves a soundscape to run again, instead of a long command line. It is
+// a json file like
+//
+//	{
+//	  "mix": true,
+//	  "queries": [
+//	    {"query": "rain", "count": 10, "gain": 0.8},
+//	    {"query": "cafe crockery", "count": 5, "group": "cafe"},
+//	    {"query": "chatter", "gain": 0.4, "group": "cafe"}
+//	  ]
+//	}
+//
+// count is the number of sounds of the query, -n if not set, and gain is its volume, like
+// --gain, which overrides it. The queries of a group play as one, like (cafe crockery) on the
+// command line does, in their own player when mixing. The queries of the command line play
+// before those of the playlist. The web UI of thames serve saves its mixes as playlists in
+// the root directory, and --playlist plays them by name
+
+// soundscape is a playlist of queries
+type soundscape struct {
+	Mix     bool              `json:"mix"`
+	Queries []soundscapeQuery `json:"queries"`
+}
+
+type soundscapeQuery struct {
+	Query string   `json:"query"`
+	Count int      `json:"count,omitempty"`
+	Gain  *float64 `json:"gain,omitempty"`
+	Group string   `json:"group,omitempty"`
+}
+
+// soundscapesDir is the directory of the playlists of queries saved by the web UI
+func soundscapesDir() string {
+	return filepath.Join(*rootDir, "playlists")
+}
+
+// resolveSoundscape returns the file of the playlist of queries fpath. A name that is not a
+// file is that of a playlist saved in the root directory
+func resolveSoundscape(fpath string) string {
+	if _, err := os.Stat(fpath); err == nil || strings.ContainsRune(fpath, os.PathSeparator) {
+		return fpath
+	}
+	name := filepath.Join(soundscapesDir(), strings.TrimSuffix(fpath, ".json")+".json")
+	if _, err := os.Stat(name); err == nil {
+		return name
+	}
+
+	return fpath
+}
+
+// loadSoundscape reads the playlist of queries at fpath
+func loadSoundscape(fpath string) (*soundscape, error) {
+	fpath = resolveSoundscape(fpath)
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	sc := new(soundscape)
+	if err := json.Unmarshal(data, sc); err != nil {
+		return nil, fmt.Errorf("%s: %v", fpath, err)
+	}
+	if err := sc.check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fpath, err)
+	}
+
+	return sc, nil
+}
+
+// check returns an error if the playlist has no queries or bad counts or gains
+func (sc *soundscape) check() error {
+	if len(sc.Queries) == 0 {
+		return errors.New("no queries")
+	}
+	for i, q := range sc.Queries {
+		switch {
+		case q.Count < 0:
+			return fmt.Errorf("query %d: the count must be positive", i+1)
+		case q.Gain != nil && *q.Gain < 0:
+			return fmt.Errorf("query %d: bad gain %v", i+1, *q.Gain)
+		}
+	}
+
+	return nil
+}
+
+// groups returns the query groups of the playlist, in the order they first appear, and sets
+// the counts and the gains of their queries. The gains of --gain win, unless override, like
+// the volumes of the mixes of the daemon do
+func (sc *soundscape) groups(override bool) []queryGroup {
+	queryGainsMu.Lock()
+	defer queryGainsMu.Unlock()
+
+	var groups []queryGroup
+	named := make(map[string]int)
+	for _, q := range sc.Queries {
+		if q.Count > 0 {
+			queryCounts[q.Query] = q.Count
+		}
+		if _, ok := queryGains[q.Query]; q.Gain != nil && (override || !ok) {
+			queryGains[q.Query] = *q.Gain
+		}
+
+		if q.Group == "" {
+			groups = append(groups, queryGroup{q.Query, []string{q.Query}})
+			continue
+		}
+		if i, ok := named[q.Group]; ok {
+			groups[i].queries = append(groups[i].queries, q.Query)
+			continue
+		}
+		named[q.Group] = len(groups)
+		groups = append(groups, queryGroup{q.Group, []string{q.Query}})
+	}
+
+	return groups
+}
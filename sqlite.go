@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"sync"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteDriver is the sqlite3 driver with the functions of thames, and sqliteIndexDriver
+// is the driver of the index, that also attaches the user database
+const (
+	sqliteDriver      = "sqlite3_thames"
+	sqliteIndexDriver = "sqlite3_thames_index"
+)
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{ConnectHook: registerFuncs})
+	sql.Register(sqliteIndexDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := registerFuncs(conn); err != nil {
+				return err
+			}
+			_, err := conn.Exec(`ATTACH DATABASE ? AS user`, []driver.Value{userDBFile})
+			return err
+		},
+	})
+}
+
+// isDatabaseError reports whether err is a failure of sqlite, like a locked or a corrupt
+// database or a full disk, rather than of the statement, like a malformed full text query
+func isDatabaseError(err error) bool {
+	var e sqlite3.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	return e.Code != sqlite3.ErrError && e.Code != sqlite3.ErrInterrupt
+}
+
+func registerFuncs(conn *sqlite3.SQLiteConn) error {
+	if err := conn.RegisterFunc("unstemmed", unstemmed, true); err != nil {
+		return err
+	}
+
+	if err := conn.RegisterFunc("distance", sqlDistance, true); err != nil {
+		return err
+	}
+
+	return conn.RegisterFunc("regexp", sqlRegexp, true)
+}
+
+// regexps are the compiled patterns of sqlRegexp
+var regexps sync.Map
+
+// sqlRegexp is the sql function regexp(pattern, text), which sqlite calls for text REGEXP pattern
+func sqlRegexp(pattern, text string) (bool, error) {
+	re, ok := regexps.Load(pattern)
+	if !ok {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return false, err
+		}
+		re, _ = regexps.LoadOrStore(pattern, compiled)
+	}
+
+	return re.(*regexp.Regexp).MatchString(text), nil
+}
+
+func validRegexp(pattern string) bool {
+	_, err := regexp.Compile(pattern)
+	return err == nil
+}
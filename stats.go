@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// Thames counts the features it is used with, the commands and the names of the flags, in
+// user.db. Nothing is sent anywhere; thames stats --features shows them, and --export prints
+// them for the user to attach to a bug report, if they want to. "stats": false in thames.json
+// turns the counting off
+
+const statsSchema = `CREATE TABLE IF NOT EXISTS features(
+                       name TEXT PRIMARY KEY,   -- a command, like serve, or a flag, like --mix
+                       uses INTEGER NOT NULL,
+                       first INTEGER NOT NULL,  -- unix time of the first use
+                       last INTEGER NOT NULL    -- and of the last
+                     )`
+
+// usedFeatures are the features of the command line: the command, play for sessions, and
+// the flags set, without their values
+func usedFeatures() []string {
+	features := []string{"play"}
+	if _, ok := commands[flag.Arg(0)]; ok {
+		features[0] = flag.Arg(0)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if len(f.Name) == 1 {
+			features = append(features, "-"+f.Name)
+		} else {
+			features = append(features, "--"+f.Name)
+		}
+	})
+
+	return features
+}
+
+// recordFeatures counts the uses of the features in user.db. It doesn't create user.db, so the
+// runs before there is one, or with an encrypted one that they didn't open, aren't counted
+func recordFeatures(features []string) {
+	if conf.Stats != nil && !*conf.Stats {
+		return
+	}
+	db, err := sql.Open(sqliteDriver, "file:"+userDBFile+"?mode=rw&_busy_timeout=5000")
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	if _, err := db.Exec(statsSchema); err != nil {
+		return
+	}
+
+	now := time.Now().Unix()
+	for _, name := range features {
+		if _, err := db.Exec(`INSERT INTO features(name, uses, first, last) VALUES(?, 1, ?, ?)
+                              ON CONFLICT(name) DO UPDATE SET uses = uses + 1, last = excluded.last`, name, now, now); err != nil {
+			log.Printf("Error:Stats: %v", err)
+			return
+		}
+	}
+}
+
+// featureUse is a row of the features table
+type featureUse struct {
+	Name  string `json:"name"`
+	Uses  int    `json:"uses"`
+	First string `json:"first"`
+	Last  string `json:"last"`
+}
+
+// readFeatures returns the features used, the most used first
+func readFeatures(db *sql.DB) ([]featureUse, error) {
+	rows, err := db.Query(`SELECT name, uses, first, last FROM features`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var features []featureUse
+	for rows.Next() {
+		var f featureUse
+		var first, last int64
+		if err := rows.Scan(&f.Name, &f.Uses, &first, &last); err != nil {
+			return nil, err
+		}
+		f.First = time.Unix(first, 0).Format("2006-01-02")
+		f.Last = time.Unix(last, 0).Format("2006-01-02")
+		features = append(features, f)
+	}
+	sort.SliceStable(features, func(i, j int) bool {
+		if features[i].Uses != features[j].Uses {
+			return features[i].Uses > features[j].Uses
+		}
+		return features[i].Name < features[j].Name
+	})
+
+	return features, rows.Err()
+}
+
+// statsCommand implements the stats command. It prints the features used, or exports them as
+// json, for a bug report, or forgets them
+func statsCommand(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	features := fs.Bool("features", false, "Print the commands and the flags used, how often and when")
+	export := fs.Bool("export", false, "Print the features used and the platform as json, to attach to a bug report")
+	reset := fs.Bool("reset", false, "Forget the features used")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames stats --features | --export | --reset\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 || !*features && !*export && !*reset {
+		fs.Usage()
+		return errUsage
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *reset {
+		if _, err := db.Exec(`DELETE FROM features`); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	used, err := readFeatures(db)
+	if err != nil {
+		return err
+	}
+	if *export {
+		report := struct {
+			OS       string       `json:"os"`
+			Arch     string       `json:"arch"`
+			Go       string       `json:"go"`
+			Player   string       `json:"player"`
+			Features []featureUse `json:"features"`
+		}{runtime.GOOS, runtime.GOARCH, runtime.Version(), *playerName, used}
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", data)
+		return nil
+	}
+
+	if len(used) == 0 {
+		fmt.Printf("No features used yet\n")
+	}
+	for _, f := range used {
+		fmt.Printf("%6d  %-20s  %s to %s\n", f.Uses, f.Name, f.First, f.Last)
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A story is a sequence of presets, the acts, with durations and transitions, for theatre or
+// tabletop sessions planned in advance. The file is a small subset of YAML, a list of maps:
+//
+//	# night journey
+//	- preset: forest.preset
+//	  duration: 10m
+//	  transition: overlap 20s
+//	- preset: storm.preset
+//	  duration: 5m
+//	- preset: dawn.preset
+//
+// An act without a duration lasts until its sounds are over. The transition to the next act
+// is either cut, the default, or overlap d where the next act starts d before this one ends.
+// Presets are relative to the directory of the story
+
+// act is a preset of a story
+type act struct {
+	preset   string
+	duration time.Duration
+	overlap  time.Duration
+}
+
+func loadStory(fpath string) ([]act, error) {
+	fin, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	var acts []act
+	scanner := bufio.NewScanner(fin)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || text == "---" {
+			continue
+		}
+		if strings.HasPrefix(text, "- ") {
+			acts = append(acts, act{})
+			text = strings.TrimSpace(text[2:])
+		}
+		if len(acts) == 0 {
+			return nil, fmt.Errorf("%s:%d: expected a list item", fpath, lineno)
+		}
+
+		kv := strings.SplitN(text, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key: value", fpath, lineno)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+		a := &acts[len(acts)-1]
+		switch key {
+		case "preset":
+			a.preset = value
+			if !filepath.IsAbs(value) {
+				a.preset = filepath.Join(filepath.Dir(fpath), value)
+			}
+		case "duration":
+			a.duration, err = time.ParseDuration(value)
+		case "transition":
+			a.overlap, err = parseTransition(value)
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fpath, lineno, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, a := range acts {
+		if a.preset == "" {
+			return nil, fmt.Errorf("%s: act %d has no preset", fpath, i+1)
+		}
+		if a.overlap > 0 && a.duration > 0 && a.overlap > a.duration {
+			return nil, fmt.Errorf("%s: act %d overlaps more than its duration", fpath, i+1)
+		}
+	}
+	if len(acts) == 0 {
+		return nil, fmt.Errorf("%s: no acts", fpath)
+	}
+
+	return acts, nil
+}
+
+// parseTransition returns the overlap of a transition
+func parseTransition(v string) (time.Duration, error) {
+	fields := strings.Fields(v)
+	switch {
+	case len(fields) == 1 && fields[0] == "cut":
+		return 0, nil
+	case len(fields) == 2 && fields[0] == "overlap":
+		return time.ParseDuration(fields[1])
+	}
+
+	return 0, fmt.Errorf("bad transition %q, expected cut or overlap <duration>", v)
+}
+
+// storyCommand implements the story command which plays the acts of a story one after the other
+func storyCommand(args []string) error {
+	fs := flag.NewFlagSet("story", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames story file\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+
+	acts, err := loadStory(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	sel := newSelection(db)
+	playHistory = newHistory(db)
+	playScrobbler = newScrobbler(conf.ListenBrainz)
+
+	// Ctrl-C ends the story, stopping the players and the downloads
+	story, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var done chan bool
+	for i, a := range acts {
+		groups, autos, err := presetGroups(a.preset)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := story, context.CancelFunc(func() {})
+		if a.duration > 0 {
+			ctx, cancel = context.WithTimeout(ctx, a.duration)
+		}
+		defer cancel()
+
+		log.Printf("Act %d/%d: %s %s", i+1, len(acts), a.preset, a.duration)
+		playHistory.setPreset(a.preset)
+		done = make(chan bool)
+		go func(done chan bool) {
+			playSession(ctx, newPipeline(db), sel, groups, autos, true, nil, nil)
+			close(done)
+		}(done)
+
+		// the next act starts when this one is done, or overlaps with its end
+		if i == len(acts)-1 {
+			break
+		}
+		if a.duration > 0 {
+			select {
+			case <-time.After(a.duration - a.overlap):
+			case <-done:
+			}
+		} else {
+			<-done
+		}
+		if story.Err() != nil {
+			break
+		}
+	}
+
+	<-done
+	playScrobbler.flush(10 * time.Second)
+	pipelineErrors.logSummary()
+
+	return nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var streamAddr = flag.String("stream", "", "Don't use an audio device. Mix the sounds and stream them over http at `addr`, like :8000")
+
+// The stream is 16 bit signed little endian stereo PCM at 44.1kHz, the format of the
+// archive. Sounds are decoded by thames, or by sox if they are not pcm wavs at 44.1kHz,
+// which needs no audio device, so thames can run headless, for example in a container on a NAS
+const (
+	streamRate     = 44100
+	streamChannels = 2
+	frameSize      = 2 * streamChannels
+
+	mixInterval = 50 * time.Millisecond
+	maxBuffered = streamRate * frameSize // 1s of audio per input
+)
+
+// streamMixer is the mixer of --stream, nil when playing on the audio device
+var streamMixer *mixer
+
+// mixer sums the sounds of the players in real time and sends the mix to the listeners
+type mixer struct {
+	mu        sync.Mutex
+	inputs    map[*mixerInput]bool
+	listeners map[chan []byte]bool
+
+	level float64 // of the mix, fading to the level of the schedule. Only mix uses it
+}
+
+// mixerInput is the decoded audio of a sound, waiting to be mixed
+type mixerInput struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	closed bool // the sound was stopped, the buffered audio is dropped
+}
+
+func newMixer() *mixer {
+	m := new(mixer)
+	m.inputs = make(map[*mixerInput]bool)
+	m.listeners = make(map[chan []byte]bool)
+	m.level = currentScheduleLevel()
+
+	return m
+}
+
+// startStream starts the mixer of --stream and serves the stream at addr
+func startStream(addr string) error {
+	m, err := serveStream(context.Background(), addr)
+	if err != nil {
+		return err
+	}
+	streamMixer = m
+
+	return nil
+}
+
+// serveStream starts a mixer and serves its stream at addr, until ctx is done
+func serveStream(ctx context.Context, addr string) (*mixer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	m := newMixer()
+	go m.run(ctx)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream.wav", m.serveHTTP)
+	srv := &http.Server{Handler: mux}
+	log.Printf("Streaming at http://%s/stream.wav", addr)
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			log.Printf("Error:Stream: %v", err)
+			pipelineErrors.report("stream", addr, err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	return m, nil
+}
+
+// run mixes the inputs at the rate of the stream until ctx is done. The inputs are
+// consumed in real time even when nobody listens, so that the sessions keep their pace
+func (m *mixer) run(ctx context.Context) {
+	start := time.Now()
+	var frames int64
+	ticker := time.NewTicker(mixInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		due := int64(time.Since(start) * streamRate / time.Second)
+		n := int(due - frames)
+		if n <= 0 {
+			continue
+		}
+		frames = due
+		m.broadcast(m.mix(n))
+	}
+}
+
+// mix sums n frames of all the inputs, clipping to the range of 16 bits
+func (m *mixer) mix(n int) []byte {
+	sum := make([]int32, n*streamChannels)
+	m.mu.Lock()
+	for in := range m.inputs {
+		chunk := in.take(n * frameSize)
+		for i := 0; i+1 < len(chunk); i += 2 {
+			sum[i/2] += int32(int16(binary.LittleEndian.Uint16(chunk[i:])))
+		}
+	}
+	m.mu.Unlock()
+
+	target := currentScheduleLevel()
+	step := 1 / (scheduleFade.Seconds() * streamRate)
+	out := make([]byte, len(sum)*2)
+	for i, v := range sum {
+		if i%streamChannels == 0 && m.level != target {
+			// a frame closer to the level of the schedule
+			if m.level < target {
+				m.level = math.Min(m.level+step, target)
+			} else {
+				m.level = math.Max(m.level-step, target)
+			}
+		}
+		if m.level != 1 {
+			v = int32(float64(v) * m.level)
+		}
+		if v > 32767 {
+			v = 32767
+		} else if v < -32768 {
+			v = -32768
+		}
+		binary.LittleEndian.PutUint16(out[2*i:], uint16(int16(v)))
+	}
+
+	return out
+}
+
+func (m *mixer) broadcast(chunk []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for l := range m.listeners {
+		select {
+		case l <- chunk:
+		default:
+			// a slow listener misses audio, it doesn't hold back the others
+		}
+	}
+}
+
+// serveHTTP streams the mix as a wav of unknown length
+func (m *mixer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	l := make(chan []byte, 40)
+	m.mu.Lock()
+	m.listeners[l] = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.listeners, l)
+		m.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "audio/wav")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("icy-name", "thames")
+	if _, err := w.Write(wavHeader()); err != nil {
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	for {
+		select {
+		case chunk := <-l:
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// wavHeader is the header of a wav stream. The sizes are the largest possible, players
+// of streams read until the connection closes
+func wavHeader() []byte {
+	h := make([]byte, 44)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], 0xFFFFFFFF)
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], streamChannels)
+	binary.LittleEndian.PutUint32(h[24:], streamRate)
+	binary.LittleEndian.PutUint32(h[28:], streamRate*frameSize)
+	binary.LittleEndian.PutUint16(h[32:], frameSize)
+	binary.LittleEndian.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], 0xFFFFFFFF-36)
+
+	return h
+}
+
+// play decodes the sound file, from the position from, into the mix and returns when it
+// has been mixed, or when ctx is done
+func (m *mixer) play(ctx context.Context, fpath string, gain float64, from time.Duration) error {
+	in := &mixerInput{}
+	in.cond = sync.NewCond(&in.mu)
+	m.mu.Lock()
+	m.inputs[in] = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.inputs, in)
+		m.mu.Unlock()
+	}()
+
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			in.close()
+		case <-stop:
+		}
+	}()
+
+	if err := decodeWAV(fpath, gain, from, in); err == errNotNative {
+		args := []string{"-q", "-v", strconv.FormatFloat(gain, 'f', 2, 64), fpath,
+			"-t", "raw", "-r", strconv.Itoa(streamRate), "-c", strconv.Itoa(streamChannels),
+			"-b", "16", "-e", "signed-integer", "-L", "-"}
+		cmd := exec.CommandContext(ctx, "sox", append(args, trimArgs(from)...)...)
+		cmd.Stdout = in
+		if err := cmd.Run(); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	return in.drain()
+}
+
+// Write buffers decoded audio. It blocks while the input is a second ahead of the mix
+func (in *mixerInput) Write(p []byte) (int, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	for len(in.buf) > maxBuffered && !in.closed {
+		in.cond.Wait()
+	}
+	if in.closed {
+		return 0, errors.New("sound stopped")
+	}
+	in.buf = append(in.buf, p...)
+
+	return len(p), nil
+}
+
+// take removes up to n bytes, whole frames, of audio
+func (in *mixerInput) take(n int) []byte {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if n > len(in.buf) {
+		n = len(in.buf) - len(in.buf)%frameSize
+	}
+	chunk := make([]byte, n)
+	copy(chunk, in.buf)
+	in.buf = in.buf[n:]
+	in.cond.Broadcast()
+
+	return chunk
+}
+
+// drain waits until all the audio is mixed
+func (in *mixerInput) drain() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	for len(in.buf) >= frameSize && !in.closed {
+		in.cond.Wait()
+	}
+	if in.closed {
+		return errors.New("sound stopped")
+	}
+
+	return nil
+}
+
+func (in *mixerInput) close() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.closed = true
+	in.buf = nil
+	in.cond.Broadcast()
+}
@@ -1,18 +1,22 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 const (
@@ -20,7 +24,7 @@ const (
 )
 
 func usage() {
-	fmt.Fprintf(os.Stderr, `usage: thames [-r root] [-n N] [--query] [--shuffle] [--mix] queries...
+	fmt.Fprint(os.Stderr, tr(`usage: thames [-r root] [-n N] [--query] [--shuffle] [--mix] [--any] queries...
 
 Thames is a browser and player for the BBC Sound Effects collection which
 contains sounds from cafes, markets, cars, typewriters, nature etc.
@@ -29,7 +33,8 @@ You can browse the collection online at http://thames.acropolis.org.uk/.
 Thames creates an index for the collection in an sqlite3 database, makes
 full text queries to it and plays the sounds. Each query is an
 sqlite3 full text query and is applied verbatim. Usually it is a single term
-or a phrase but you can also use NEAR queries.
+or a phrase but you can also use NEAR queries. On the first run it downloads
+the csv of the collection and indexes it, thames --bootstrap does it again.
 
 Some examples
 
@@ -45,10 +50,22 @@ play sounds from cafes and typewriters interleaved
 
   thames --shuffle cafe typewriter
 
+play two sounds of rain for each sound of wind and of birds, interleaved
+
+  thames --shuffle --ratio 2:1:1 rain wind birds
+
 mix sounds from cafes and typewriters
 
   thames --mix cafe typewriter
 
+mix them with the cafe at half the volume, into a wav file
+
+  thames --mix --gain cafe=0.5 --record cafe.wav cafe typewriter
+
+balance the layers of an ambience, with a volume from 0 to 100 for each, and all of them quieter
+
+  thames --volume 60 --mix rain:80 wind:40
+
 go out in the wild nature
 
   thames --mix wind rain water fire
@@ -57,8 +74,174 @@ browse sounds from space
 
   thames --query space
 
+write a playlist of sounds from space, to open in another player
+
+  thames --query --export space.m3u space
+
+list the sounds of heavy rain, the best matches first
+
+  thames --query --rank 'heavy rain'
+
+browse them on the terminal, playing and fetching them with keys
+
+  thames --browse space
+
+mix rain with thunder and cafe sounds with crockery, each group interleaved
+
+  thames --mix '(rain thunder)' '(cafe crockery)'
+
+mix the soundscape of a preset file, with its volume automation
+
+  thames --preset rainy-night.preset
+
+run again a soundscape saved in a playlist, with the count, gain and group of each query
+
+  thames --playlist rainy-cafe.json
+
+play sounds from the rain and press t for a thunderclap
+
+  thames --oneshot t=thunderclap rain
+
+run headless, in a container, and stream the mix over http
+
+  thames --stream :8000 serve
+
+keep an installation playing the preset for weeks, restarting what fails
+
+  thames --forever --heartbeat /run/thames.beat --preset gallery.preset
+
+keep the ambience going while working, selecting more sounds as they are over
+
+  thames --loop --mix rain:70 '(cafe crockery):40'
+
+play the sounds of the streets of London
+
+  thames --near London street
+
+play the traffic of the fifties, for a period drama
+
+  thames --era 1950s traffic
+
+play the short sounds of birds of the Birds category and its subcategories, like Birds: Owls
+
+  thames --category Birds --max-secs 30 birds
+
+play sounds matching any of the words, as a single query
+
+  thames --any rain drizzle downpour
+
+Commands
+
+  thames import-dump [--move] dir...
+        link, or move, an existing copy of the archive into the cache
+
+  thames cache dedupe [--dry-run]
+        hard link byte-identical sounds in the cache
+
+  thames cache compress
+        compress the sounds of the cache as FLAC, needs flac(1)
+
+  thames cache sync
+        update the index after adding or removing files of the cache by hand
+
+  thames cache verify
+        check that the files of the cache are audio, quarantining the others
+
+  thames fetch [--category c]... [--all] [queries...]
+        fetch the sounds into the cache without playing them
+
+  thames export [--layout flat|daw] [--link] [--category c]... [--all] dir [queries...]
+        copy the sounds out of the cache, organized for a DAW with --layout daw
+
+  thames attribution [--json] playlist|dir...
+        print the credits of the sounds of a playlist or an export, for publishing
+
+  thames --audit file audit [pattern]
+        print the sounds exported into output files matching the pattern, from the audit log
+
+  thames edit [--query q] [--set f=v]... [--unset f[=v]]... [--dry-run] [locations...]
+        tag, rate and annotate all the sounds of a query, or at the locations
+
+  thames info location...
+        print all that is known about sounds, with the recordist, the place, the date and the notes of the archive
+
+  thames places [--extract]
+        list the places of the gazetteer named by the sounds, for --near, or find them again
+
+  thames note [--delete] location [note...]
+        print, set or remove the note of a sound. Queries also search the notes
+
+  thames describe [--delete] location [description...] | --import file.csv [--dry-run]
+        describe sounds better than the archive, without changing the index. Queries also search the descriptions
+
+  thames smart save name rules... | list | delete name
+        maintain the smart playlists, like rating>=4 AND not played in 30d, for --smart
+
+  thames collection add|remove name location... | list [name] | delete name | export name | import [name] file.json
+        maintain the collections, sets of sounds played with @name, and share them as json
+
+  thames share preset|@collection...
+        print a bundle of presets and the collections they play, without audio, to share
+
+  thames install [--force] bundle...
+        install the presets and collections of bundles. Installed presets play by name
+
+  thames preset search [words...] | install name... | list
+        search and install the bundles of a registry of shared presets, list the installed presets
+
+  thames plugins
+        list the plugins of the plugins directory and what they do: filter, control or notify
+
+  thames translations import [--lang l] file.csv | list | delete lang
+        maintain the translations of the descriptions that queries search, see --lang
+
+  thames userdb encrypt | decrypt
+        keep the user data encrypted in user.db.enc, with the passphrase of $THAMES_PASSPHRASE or the keyring
+
+  thames report [--month] [--top n] [YYYY-MM|YYYY]
+        summarize the listening time by query, category and preset, the most played sounds and the cache growth
+
+  thames stats --features | --export | --reset
+        print the commands and flags used, counted only locally, or export them as json for a bug report
+
+  thames story file
+        play a sequence of presets with durations and transitions
+
+  thames serve [--socket path] [--addr addr] [--systemd] [queries...]
+        run as a daemon that plays the sessions requested on a control socket, or with --addr an HTTP API and a web UI
+
+  thames ctl [--socket path] [--session name] [--watch interval] command [args...]
+        send a command, like mix rain wind, status, queue or open office device, to the daemon
+
+  thames unit [--socket]
+        print the systemd service unit, or the socket unit, of the daemon
+
+  thames fake-cdn [--addr addr] [--fail fraction]
+        serve tiny silent sounds for any location, to test with --source
+
+  thames selftest
+        play sessions end to end against a fake CDN with the null player
+
+  thames check-csv [file]
+        validate the csv of the archive, or another, without indexing it
+
+  thames [--tokenizer t] reindex [file]
+        recreate the full text index from the csv, keeping the cache
+
+  thames open [--print] location...
+        open the page of a sound at the BBC Sound Effects website in the browser
+
+  thames compare location location
+        switch between two sounds at matched loudness, at the same position, and print the one picked
+
+  thames audition --collection name [--preview duration] queries...
+        play a preview of each sound and keep or block it in a collection with a key
+
+  thames bench [--runs n] [--limit n]... [queries...]
+        time the random selection of sounds with each --sampling
+
 Flags:
-`)
+`))
 	flag.PrintDefaults()
 	os.Exit(2)
 }
@@ -69,22 +252,73 @@ var (
 	onlyQuery = flag.Bool("query", false, "Only query and print the results, don't download, don't play")
 	shuffle   = flag.Bool("shuffle", false, "Interleave sounds from queries")
 	mix       = flag.Bool("mix", false, "Mix the sounds from queries")
-
-	soundsDir string
+	anyQuery  = flag.Bool("any", false, "Combine the queries into a single query that matches any of them")
+
+	printProgram = flag.Bool("program", false, "Print the numbered program before playing, in sequential mode")
+	shareAddr    = flag.String("share", "", "Share the local cache with thames peers on the LAN, serving it at `addr`")
+	usePeers     = flag.Bool("peers", true, "Fetch missing sounds from thames peers on the LAN")
+	maxWait      = flag.Duration("max-wait", 0, "Play the next cached sounds when a download takes longer than `duration`, and the slow sound when it arrives. 0 waits for it")
+
+	soundsDir    string
+	dbFile       string
+	userDBFile   string
+	csvFile      string
+	extraSources sourcesFlag
 )
 
+// commands are the subcommands of thames. Any other first argument is a query
+var commands = map[string]func(args []string) error{
+	"import-dump":  importDump,
+	"cache":        cacheCommand,
+	"fetch":        fetchCommand,
+	"story":        storyCommand,
+	"serve":        serveCommand,
+	"ctl":          ctlCommand,
+	"unit":         unitCommand,
+	"fake-cdn":     fakeCDNCommand,
+	"selftest":     selftestCommand,
+	"bench":        benchCommand,
+	"check-csv":    checkCSVCommand,
+	"reindex":      reindexCommand,
+	"open":         openCommand,
+	"compare":      compareCommand,
+	"audition":     auditionCommand,
+	"export":       exportCommand,
+	"attribution":  attributionCommand,
+	"audit":        auditCommand,
+	"edit":         editCommand,
+	"smart":        smartCommand,
+	"collection":   collectionCommand,
+	"share":        shareCommand,
+	"install":      installCommand,
+	"preset":       presetCommand,
+	"plugins":      pluginsCommand,
+	"report":       reportCommand,
+	"translations": translateCommand,
+	"note":         noteCommand,
+	"describe":     describeCommand,
+	"userdb":       userdbCommand,
+	"stats":        statsCommand,
+	"info":         infoCommand,
+	"places":       placesCommand,
+}
+
+func init() {
+	flag.Var(&extraSources, "source", "Fetch missing sounds from `src`: an http mirror, ipfs:<cid> or torrent:<file>. May be repeated")
+}
+
 func soundPath(fname string) string {
 	return filepath.Join(soundsDir, fname)
 }
 
-// playersRouter routes sounds to sound players, deciding by the query that originated a sound
+// playersRouter routes sounds to sound players, deciding by the query group that originated a sound
 // When mixing each query gets a dedicated player otherwise there is one player for all
 type playersRouter interface {
 	// route Returns a buffered channel for a player
 	// The channels to players need to be buffered to avoid blocking the downloader
 	// The size ideally should be a combination of the download latency and the
 	// number of queries but for now we go with an empirical choice
-	route(query string) chan sound
+	route(group string) chan sound
 
 	// close Closes the channels of the router
 	close()
@@ -102,7 +336,7 @@ func newSinglePlayersRouter() *singlePlayersRouter {
 	return r
 }
 
-func (r *singlePlayersRouter) route(query string) chan sound {
+func (r *singlePlayersRouter) route(group string) chan sound {
 	return r.c
 }
 
@@ -124,14 +358,14 @@ func newMultiPlayersRouter() *multiPlayersRouter {
 	return r
 }
 
-func (r *multiPlayersRouter) route(query string) chan sound {
+func (r *multiPlayersRouter) route(group string) chan sound {
 	r.Lock()
 	defer r.Unlock()
 
-	c, present := r.routes[query]
+	c, present := r.routes[group]
 	if !present {
 		c = make(chan sound, PlayerChannelSize)
-		r.routes[query] = c
+		r.routes[group] = c
 	}
 
 	return c
@@ -147,109 +381,460 @@ func (r *multiPlayersRouter) close() {
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// run runs thames and returns its exit code. Errors return, so that the deferred functions,
+// like sealing the user database, run before exiting
+func run() int {
 	log.SetPrefix("")
 	log.SetFlags(log.Ltime)
 	flag.Usage = usage
 	flag.Parse()
+	sessionSeed = time.Now().UnixNano()
+	if *replaySeed != 0 {
+		sessionSeed = *replaySeed
+	}
 
 	soundsDir = filepath.Join(*rootDir, "sounds")
-	dbFile := filepath.Join(*rootDir, "sounds.db")
-	csvFile := filepath.Join(*rootDir, "BBCSoundEffects.csv")
-	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
-		initDatabase(dbFile, csvFile)
+	dbFile = filepath.Join(*rootDir, "sounds.db")
+	userDBFile = filepath.Join(*rootDir, "user.db")
+	csvFile = filepath.Join(*rootDir, "BBCSoundEffects.csv")
+	if err := loadConfig(filepath.Join(*rootDir, "thames.json")); err != nil {
+		log.Print(err)
+		return exitFailed
+	}
+	// an encrypted user database has its changes sealed on exit
+	defer func() {
+		if err := sealUserDatabase(); err != nil {
+			log.Printf("Error:UserDB: %v", err)
+		}
+	}()
+	defer recordFeatures(usedFeatures())
+	if *announceSounds {
+		if _, err := findSpeaker(); err != nil {
+			log.Print(err)
+			return exitPlayer
+		}
+	}
+
+	if cmd, ok := commands[flag.Arg(0)]; ok {
+		// the commands return their errors, those that play also report them like sessions
+		if err := cmd(flag.Args()[1:]); errors.Is(err, errUsage) {
+			return exitUsage
+		} else if err != nil {
+			log.Print(err)
+			pipelineErrors.report(errorStage(err), flag.Arg(0), err)
+		}
+		return pipelineErrors.exitCode()
+	}
+
+	nothingToPlay := flag.NArg() == 0 && *shareAddr == "" && *presetFile == "" && *smartName == "" && *soundscapeFile == ""
+	if nothingToPlay && !*bootstrapIndex {
+		usage()
+	}
+	if err := validateFlags(); err != nil {
+		fmt.Fprintf(os.Stderr, "thames: %v\n", err)
+		return exitUsage
 	}
 
-	db, err := sql.Open("sqlite3", "file:"+dbFile)
+	db, err := openIndex()
 	if err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		return exitDatabase
 	}
 	defer db.Close()
+	if nothingToPlay {
+		// thames --bootstrap only rebuilds the index
+		return pipelineErrors.exitCode()
+	}
 
-	stmt, err := db.Prepare(`SELECT location, description, secs FROM sounds WHERE sounds MATCH ? ORDER BY RANDOM() LIMIT ?`)
-	if err != nil {
-		log.Fatal(err)
+	stopPlugins := startPlugins()
+	defer stopPlugins()
+
+	sel := newSelection(db)
+
+	groups := parseGroups(volumeArgs(flag.Args()))
+	if *smartName != "" {
+		// the rules restrict the queries, without queries they select by themselves
+		text, rules, err := loadSmart(db, *smartName)
+		if err != nil {
+			log.Print(err)
+			return exitQuery
+		}
+		log.Printf("Smart playlist: %s: %s", *smartName, text)
+		sel.rules = rules
+		if len(groups) == 0 {
+			groups = []queryGroup{{"@" + *smartName, []string{""}}}
+		}
+	}
+
+	// the players of the preset lines follow their automation
+	autos := make(map[string]*automation)
+	if *presetFile != "" {
+		pgroups, pautos, err := presetGroups(*presetFile)
+		if err != nil {
+			log.Print(err)
+			return exitFailed
+		}
+		groups = append(groups, pgroups...)
+		autos = pautos
+		*mix = true
+	}
+	if *soundscapeFile != "" {
+		sc, err := loadSoundscape(*soundscapeFile)
+		if err != nil {
+			log.Print(err)
+			return exitFailed
+		}
+		if sc.Mix && *shuffle {
+			fmt.Fprintf(os.Stderr, "thames: %s\n", fmt.Sprintf(tr("%s mixes its groups, they can't be interleaved with --shuffle"), *soundscapeFile))
+			return exitUsage
+		}
+		groups = append(groups, sc.groups(false)...)
+		*mix = *mix || sc.Mix
+	}
+	if ratioWeights != nil && len(ratioWeights) != len(groups) {
+		fmt.Fprintf(os.Stderr, "thames: %s\n", fmt.Sprintf(tr("--ratio has %d weights for %d queries"), len(ratioWeights), len(groups)))
+		return exitUsage
+	}
+	if *anyQuery && flag.NArg() > 1 {
+		q := orQuery(groupQueries(groups))
+		groups = []queryGroup{{q, []string{q}}}
+	}
+	if *minResults > 0 {
+		groups = broadenGroups(context.Background(), sel, groups, *minResults)
+	}
+
+	if *shareAddr != "" {
+		// with no queries, just act as a mirror for the peers
+		if flag.NArg() == 0 {
+			log.Print(shareCache(*shareAddr))
+			return exitFailed
+		}
+		go func() {
+			err := shareCache(*shareAddr)
+			log.Printf("Error:Share: %v", err)
+			pipelineErrors.report("share", *shareAddr, err)
+		}()
+	}
+
+	if *browseResults {
+		if err := browse(context.Background(), db, sel, groupQueries(groups)); err != nil {
+			log.Print(err)
+			return exitFailed
+		}
+		return pipelineErrors.exitCode()
 	}
-	defer stmt.Close()
 
 	if *onlyQuery {
-		for _, query := range flag.Args() {
-			out := make(chan sound)
-			go func() {
-				for snd := range out {
-					if _, err := os.Stat(snd.fpath); err == nil {
-						fmt.Printf("%s %s\n", snd.descr, snd.fpath)
-					} else {
-						fmt.Printf("missing: %s\n", snd.fpath)
-					}
+		printQuery(context.Background(), sel, groupQueries(groups))
+		return pipelineErrors.exitCode()
+	}
+
+	if *fetchOnly {
+		var selected [][]sound
+		for _, g := range groups {
+			selected = append(selected, selectGroup(context.Background(), sel, g, *nsounds, soundsDir))
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		fetchSounds(ctx, newFetcher(db), selected)
+		return pipelineErrors.exitCode()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	playHistory = newHistory(db)
+	playHistory.setPreset(*presetFile)
+	playScrobbler = newScrobbler(conf.ListenBrainz)
+	if *playlistFile != "" {
+		sessionPlaylist = new(playlist)
+	}
+
+	if *streamAddr != "" {
+		if err := startStream(*streamAddr); err != nil {
+			log.Print(err)
+			return exitFailed
+		}
+	}
+	if *recordFile != "" {
+		stopRecording, err := startRecording(ctx, *recordFile)
+		if err != nil {
+			log.Print(err)
+			return exitFailed
+		}
+		defer stopRecording()
+	}
+
+	// the controllers of the running session
+	ctl := newControls()
+	wait, err := startControllers(ctx, db, sel, ctl)
+	if err != nil {
+		log.Print(err)
+		return exitFailed
+	}
+	defer func() {
+		cancel()
+		wait()
+	}()
+	go handleInterrupts(ctx, ctl, cancel)
+
+	if *heartbeatFile != "" {
+		go heartbeat(ctx, *heartbeatFile)
+	}
+
+	if *forever {
+		// an installation resumes where it was, with the preset and the volumes of the controllers
+		state, err := loadState(statePath())
+		if err != nil {
+			log.Print(err)
+			return exitFailed
+		}
+		if state.Preset != "" {
+			pgroups, pautos, err := presetGroups(state.Preset)
+			if err != nil {
+				log.Print(err)
+				return exitFailed
+			}
+			log.Printf("Preset: %s", state.Preset)
+			groups, autos, *mix = pgroups, pautos, true
+			playHistory.setPreset(state.Preset)
+		}
+		for group, gain := range state.Gains {
+			if a, ok := autos[group]; ok {
+				a.setGain(gain)
+			} else if *mix {
+				autos[group] = &automation{gain: gain}
+			}
+		}
+		ctl.state = state
+	}
+
+	// the controllers may replace the session with a preset, so play sessions until one ends by itself
+	var restarts backoff
+	for {
+		if *mix {
+			// every mixed group has a volume that controllers can set
+			for _, g := range groups {
+				if autos[g.name] == nil {
+					autos[g.name] = &automation{gain: 1}
+				}
+			}
+		}
+		ctl.setAutomations(autos)
+
+		before := atomic.LoadInt64(&played)
+		next, end := ctl.play(ctx, func(ctx context.Context, skips *skipSet, req *requests) {
+			playSession(ctx, newPipeline(db), sel, groups, autos, *mix, skips, req)
+		})
+		if end == sessionStopped || (end == sessionDone && !*forever) {
+			break
+		}
+		if end == sessionDone {
+			// with --forever a session that ends starts again, with new sounds. If nothing
+			// played, something is broken, like the audio device or the network
+			if atomic.LoadInt64(&played) > before {
+				restarts.reset()
+			} else {
+				log.Printf("Watchdog: nothing played, restarting the session")
+				if !restarts.wait(ctx) {
+					break
 				}
-			}()
-			queryDatabase(stmt, query, *nsounds, out)
+			}
+			continue
+		}
+
+		ngroups, nautos, nmix, err := next.load()
+		if err != nil {
+			log.Printf("Error:Preset: %v", err)
+			pipelineErrors.report("preset", next.preset, err)
+			if *forever {
+				continue
+			}
+			break
+		}
+		log.Printf("Preset: %s", next.preset)
+		groups, autos, *mix = ngroups, nautos, nmix
+		playHistory.setPreset(next.preset)
+		if ctl.state != nil {
+			ctl.state.setPreset(next.preset)
 		}
+	}
 
-		os.Exit(0)
+	playScrobbler.flush(10 * time.Second)
+	if err := sessionPlaylist.write(); err != nil {
+		log.Printf("Error:Export: %v", err)
+		pipelineErrors.report("export", *playlistFile, err)
 	}
+	pipelineErrors.logSummary()
+
+	return pipelineErrors.exitCode()
+}
+
+// pipeline is what the sessions play with: the index, the sources of the sounds missing from
+// the cache, the directory of the cache, the player and the number of sounds of each query.
+// Sessions play with the pipeline of the flags, the self test and the tests with their own
+type pipeline struct {
+	db        *sql.DB
+	sources   []source // in order of preference
+	soundsDir string
+	play      func(ctx context.Context, in, first <-chan sound, auto *automation, skips *skipSet)
+	nsounds   int
+}
+
+// newPipeline returns the pipeline of the flags, with the index of db
+func newPipeline(db *sql.DB) *pipeline {
+	return &pipeline{db: db, sources: flagSources(), soundsDir: soundsDir, play: runPlayer, nsounds: *nsounds}
+}
+
+// fetcher returns a fetcher from the sources into the cache of the pipeline
+func (p *pipeline) fetcher() *fetcher {
+	return &fetcher{db: p.db, sources: p.sources, dir: p.soundsDir}
+}
 
+// playSession selects, fetches and plays the sounds of the query groups until all of them
+// are played or ctx is done. When mixing each group gets its own player. The sounds of
+// the queries in skips, that controllers may add to while playing, are dropped. The sounds
+// requested in req play next, in the player of the session, or at once in a player of theirs
+func playSession(ctx context.Context, p *pipeline, sel *selection, groups []queryGroup, autos map[string]*automation, mixing bool, skips *skipSet, req *requests) {
 	// a group to track inquirers, downloaders and players
 	var wg sync.WaitGroup
 
 	// router to players
 	var router playersRouter
-	if *mix {
+	if mixing {
 		router = newMultiPlayersRouter()
 	} else {
 		router = newSinglePlayersRouter()
 	}
 
+	// what is on its way to the players, for the queue command
+	q := sessionQueue(ctx)
+	q.setMixing(mixing)
+
 	// downloader input
 	downloadCh := make(chan sound)
 
+	// fetcher of the sounds missing from the cache
+	f := p.fetcher()
+
 	// launch the downloader. Only one for now, BBC seems to have throttling
 	wg.Add(1)
 	go func() {
-		downloader(downloadCh, router)
+		downloader(ctx, downloadCh, router, f, skips)
 		wg.Done()
 	}()
 
-	// launch the database inquirers. When finish, must close downloadCh
+	// the requested sounds. When mixing there is no next sound, they all play at once
+	first := make(chan sound, PlayerChannelSize)
+	now := make(chan sound, PlayerChannelSize)
+	if req != nil {
+		next := first
+		if mixing {
+			next = now
+		}
+		go req.serve(ctx, f, next, now)
+		go p.play(ctx, now, nil, nil, skips)
+	}
+
+	// launch players, before the selection, so the head starts play at once. The automations
+	// follow the time of the session
+	for _, auto := range autos {
+		auto.since = time.Now()
+	}
 	wg.Add(1)
 	go func() {
-		if *shuffle || *mix {
-			var qwg sync.WaitGroup
-			for _, query := range flag.Args() {
-				qwg.Add(1)
-				go func(q string) {
-					queryDatabase(stmt, q, *nsounds, downloadCh)
-					qwg.Done()
-				}(query)
-			}
-			qwg.Wait()
+		if !mixing {
+			p.play(q.player(ctx, ""), router.route(""), first, nil, skips)
 		} else {
-			for _, query := range flag.Args() {
-				queryDatabase(stmt, query, *nsounds, downloadCh)
+			for _, g := range groups {
+				// players are added to the wait group because they will have stuff to play
+				// after inquirers and downloader finish
+				wg.Add(1)
+				go func(ctx context.Context, name string) {
+					p.play(ctx, router.route(name), nil, autos[name], skips)
+					wg.Done()
+				}(q.player(ctx, g.name), g.name)
 			}
 		}
 
-		close(downloadCh)
 		wg.Done()
 	}()
 
-	// launch players
+	// the head starts of the groups play at once, while their sounds are selected
+	starts := make([]*sound, len(groups))
+	for i, g := range groups {
+		if !*selectionCache || i > 0 && !mixing {
+			break
+		}
+		snd, ok, err := headStart(ctx, sel, p.soundsDir, g)
+		if err != nil {
+			log.Printf("Error:Selection cache: %v", err)
+			break
+		}
+		if !ok {
+			continue
+		}
+		log.Printf("Head start: %q %s, of the last selection", snd.query, snd.descr)
+		starts[i] = &snd
+		q.fetched(snd)
+		select {
+		case router.route(snd.group) <- snd:
+		case <-ctx.Done():
+		}
+	}
+
+	// select the sounds up front, to know the cost of the session before fetching anything
+	selected := make([][]sound, len(groups))
+	for i, g := range groups {
+		selected[i] = selectGroup(ctx, sel, g, p.nsounds*ratioWeight(i), p.soundsDir)
+	}
+	if *selectionCache && ctx.Err() == nil {
+		if err := rememberSelections(p.db, selected); err != nil {
+			log.Printf("Error:Selection cache: %v", err)
+		}
+		for i, snd := range starts {
+			if snd != nil {
+				selected[i] = withoutHeadStart(selected[i], *snd, groups[i], p.nsounds*ratioWeight(i))
+			}
+		}
+	}
+	if *explainSelection {
+		explainDuplicates(selected)
+	}
+	if err := downloadBudget(selected, f); err != nil {
+		log.Printf("Error:Fetch: %v", err)
+		pipelineErrors.report("fetch", "", err)
+		close(downloadCh)
+		wg.Wait()
+		return
+	}
+
+	// in sequential mode the sounds play in a predictable program
+	if !*shuffle && !mixing {
+		numberProgram(selected)
+		if *printProgram {
+			for _, sounds := range selected {
+				for _, snd := range sounds {
+					fmt.Printf("%d/%d %q %s %s\n", snd.num, snd.total, snd.query, snd.descr, time.Duration(snd.secs)*time.Second)
+				}
+			}
+		}
+	}
+
+	// launch the feeders of the downloader. When finish, must close downloadCh
 	wg.Add(1)
 	go func() {
-		if !*mix {
-			realPlayer(router.route(""))
-		} else {
-			for _, query := range flag.Args() {
-				// players are added to the wait group because they will have stuff to play
-				// after inquirers and downloader finish
-				wg.Add(1)
-				go func(q string) {
-					realPlayer(router.route(q))
-					wg.Done()
-				}(query)
-			}
+		// interleaved evenly from the first track when shuffling. When mixing this also
+		// gets each player its first sound as soon as possible
+		feed(ctx, program(sel.rng, selected, *shuffle || mixing), downloadCh, skips)
+		if *loopSession {
+			loopRounds(ctx, sel, groups, f, p.nsounds, *shuffle || mixing, downloadCh, skips)
 		}
 
+		close(downloadCh)
 		wg.Done()
 	}()
 
@@ -257,116 +842,564 @@ func main() {
 	wg.Wait()
 }
 
-// initDatabase creates the schema in an sqlite3 database and fills the tables with the sounds records from the BBC csv
-func initDatabase(dbFile, csvFile string) {
-	log.Printf("Initializing database %s", dbFile)
+// validateFlags checks for combinations of flags that make no sense
+func validateFlags() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if err := parseGains(); err != nil {
+		return err
+	}
+	if err := parseRatio(); err != nil {
+		return err
+	}
+	if err := checkNear(); err != nil {
+		return err
+	}
+	if *sessionEra != "" {
+		if _, err := parseEra(*sessionEra); err != nil {
+			return err
+		}
+	}
+	for _, c := range onlyCategories {
+		if len(activeProfile.Categories) > 0 && !inCategories(c, activeProfile.Categories) {
+			return fmt.Errorf(tr("--category %q is not allowed by profile %s"), c, *profileName)
+		}
+	}
 
-	db, err := sql.Open("sqlite3", "file:"+dbFile)
+	switch {
+	case *nsounds <= 0:
+		return errors.New(tr("-n must be positive"))
+	case *maxWait < 0:
+		return errors.New(tr("--max-wait must be positive, or 0 to wait for each download"))
+	case orderings[*order] == "":
+		return fmt.Errorf(tr("unknown --order %q"), *order)
+	case *rankOrder && set["order"] && *order != "rank":
+		return errors.New(tr("--rank orders by relevance, it can't be used with another --order"))
+	case (*rankOrder || *order == "rank") && !hasFTS5():
+		return errors.New(tr("--rank orders by the relevance of fts5, which thames has only when built with go build -tags sqlite_fts5"))
+	case !samplings[*sampling]:
+		return fmt.Errorf(tr("unknown --sampling %q"), *sampling)
+	case *presetFile != "" && *shuffle:
+		return errors.New(tr("--preset mixes its lines, they can't be interleaved with --shuffle"))
+	case *shuffleRatio != "" && !*shuffle:
+		return errors.New(tr("--ratio weighs the queries that --shuffle interleaves"))
+	case *shuffle && *mix:
+		return errors.New(tr("--shuffle and --mix are exclusive: --mix plays each query in its own player, there is nothing to interleave"))
+	case !groupings[*groupBy]:
+		return fmt.Errorf(tr("unknown --group-by %q"), *groupBy)
+	case !formats[*format]:
+		return fmt.Errorf(tr("unknown --format %q"), *format)
+	case (*countOnly || set["sample"] || set["seed"] || *groupBy != "" || set["format"] || *copyResults) && !*onlyQuery:
+		return errors.New(tr("--count, --sample, --seed, --group-by, --format and --copy only change the output of --query"))
+	case *format != "text" && (*countOnly || *groupBy != ""):
+		return fmt.Errorf(tr("--format %s prints a row for each sound, it can't print counts or groups"), *format)
+	case *sampleSize < 0 || set["sample"] && *sampleSize == 0:
+		return errors.New(tr("--sample must be positive"))
+	case *countOnly && (set["sample"] || *groupBy != "" || *copyResults):
+		return errors.New(tr("--count prints only the number of sounds, there are no sounds to sample, group or copy"))
+	case *onlyQuery && (*shuffle || *mix):
+		return errors.New(tr("--query only prints the results, it doesn't play them with --shuffle or --mix"))
+	case *anyQuery && (*shuffle || *mix) && flag.NArg() > 1:
+		return errors.New(tr("--any combines the queries into one, there is nothing to interleave with --shuffle or mix with --mix"))
+	case *grepDescr != "" && !validRegexp(*grepDescr):
+		return fmt.Errorf(tr("bad --grep %q, it is a go regexp"), *grepDescr)
+	case *nearRadius < 0:
+		return errors.New(tr("--radius must be positive"))
+	case !validPlayer(*playerName):
+		return fmt.Errorf(tr("unknown --player %q, expected native, exec:command or null"), *playerName)
+	case *masterVolume < 0 || *masterVolume > 100:
+		return errors.New(tr("--volume is from 0 to 100"))
+	case *minSampleRate < 0:
+		return errors.New(tr("--min-samplerate must be positive"))
+	case *playlistFile != "" && playlistFormat(*playlistFile) == "":
+		return fmt.Errorf(tr("unknown playlist format of %s, expected .m3u or .json"), *playlistFile)
+	case *playlistFile != "" && (*countOnly || *fetchOnly || *browseResults):
+		return errors.New(tr("--export writes the sounds of --query or those played, --count, --fetch and --browse play none"))
+	case *minLength < 0 || *maxLength < 0:
+		return errors.New(tr("--min-secs and --max-secs must be positive"))
+	case *maxLength > 0 && *minLength > *maxLength:
+		return errors.New(tr("--min-secs is more than --max-secs, no sound is that long and that short"))
+	case *minResults < 0:
+		return errors.New(tr("--min must be positive"))
+	case *askBroaden && *minResults == 0:
+		return errors.New(tr("--ask asks how to broaden the queries of --min"))
+	case *exactQuery && *anyQuery && flag.NArg() > 1:
+		return errors.New(tr("--exact makes the query of --any a single phrase, quote the phrases instead"))
+	case *onlyCached && set["source"]:
+		return errors.New(tr("--cached never fetches, --source is of no use"))
+	case *onlyCached && (set["max-download"] || set["flac"]):
+		return errors.New(tr("--cached never fetches, --max-download and --flac are of no use"))
+	case *fetchOnly && (*onlyQuery || *onlyCached || *noDownload):
+		return errors.New(tr("--fetch fetches the sounds, --query, --cached and --no-download don't"))
+	case *fetchOnly && (*mix || *shuffle || *forever || *streamAddr != ""):
+		return errors.New(tr("--fetch doesn't play, --mix, --shuffle, --forever and --stream are of no use"))
+	case *browseResults && (*onlyQuery || *fetchOnly):
+		return errors.New(tr("--browse lists the sounds on the terminal, --query prints them and --fetch fetches them"))
+	case *browseResults && (*mix || *shuffle || *forever || *streamAddr != "" || *recordFile != "" || *presetFile != ""):
+		return errors.New(tr("--browse plays one sound at a time, --mix, --shuffle, --forever, --stream, --record and --preset are of no use"))
+	case *recordFile != "" && (*onlyQuery || *fetchOnly):
+		return errors.New(tr("--record records what plays, --query and --fetch don't play"))
+	case *loopSession && (*onlyQuery || *fetchOnly || *browseResults):
+		return errors.New(tr("--loop keeps a session playing, --query, --fetch and --browse don't play one"))
+	case *noDownload && (set["source"] || set["cdn"] || set["max-download"] || set["flac"]):
+		return errors.New(tr("--no-download never fetches, --source, --cdn, --max-download and --flac are of no use"))
+	case *noDownload && *bootstrapIndex:
+		return errors.New(tr("--bootstrap downloads the csv, --no-download never does"))
+	case *csvChecksum != "" && !sha256Re.MatchString(*csvChecksum):
+		return fmt.Errorf(tr("bad --csv-sha256 %q, expected 64 hex digits"), *csvChecksum)
+	}
+
+	return nil
+}
+
+// openDatabase opens the database for the commands, its errors are of the database stage
+func openDatabase() (*sql.DB, error) {
+	db, err := openIndex()
 	if err != nil {
-		log.Fatal(err)
+		return nil, stageError{"database", err}
+	}
+
+	return db, nil
+}
+
+// openIndex opens the index, creating it from the BBC csv on the first run, and
+// rebuilding it if it is corrupt or with --bootstrap, with the user database attached
+func openIndex() (*sql.DB, error) {
+	if err := unsealUserDatabase(); err != nil {
+		return nil, err
+	}
+	rebuild := false
+	if *bootstrapIndex {
+		if err := ensureCSV(csvFile, true); err != nil {
+			return nil, err
+		}
+		rebuild = true
+	}
+	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+		if err := initDatabase(dbFile, csvFile); err != nil {
+			return nil, err
+		}
+		rebuild = false
+	} else if err := checkIntegrity(dbFile); err != nil {
+		if err := recoverDatabase(err); err != nil {
+			return nil, err
+		}
+		rebuild = false
+	}
+	if exists, _ := fileExists(userDBFile); exists {
+		if err := checkIntegrity(userDBFile); err != nil {
+			return nil, fmt.Errorf("%s is corrupt: %v. It has the user data, which can't be recreated, restore it from a backup", userDBFile, err)
+		}
+	}
+
+	if err := prepareUserDatabase(); err != nil {
+		return nil, err
+	}
+
+	// the downloader and the players write to the database concurrently
+	db, err := sql.Open(sqliteIndexDriver, "file:"+dbFile+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if rebuild {
+		if err := rebuildIndex(db); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %v", dbFile, err)
+		}
+	}
+	for _, migrate := range []func(*sql.DB) error{migrateFTS5, migrateFiles, migratePlaces, migrateEras} {
+		if err := migrate(db); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %v", dbFile, err)
+		}
 	}
-	defer db.Close()
 
-	schemaSql := `CREATE VIRTUAL TABLE IF NOT EXISTS sounds USING fts4(
-                        location, description, secs, category, CDNumber, CDName, tracknum,
+	return db, nil
+}
 
-                        tokenize=porter, notindexed=location, notindexed=secs, notindexed=CDNumber, notindexed=tracknum
-                      )`
-	if _, err := db.Exec(schemaSql); err != nil {
-		log.Fatal(err)
+// initDatabase creates the schema in an sqlite3 database and fills the tables with the sounds
+// records from the BBC csv. A database that couldn't be filled is removed, to be created again
+func initDatabase(dbFile, csvFile string) error {
+	if err := ensureCSV(csvFile, false); err != nil {
+		return err
 	}
+	log.Printf("Initializing database %s", dbFile)
 
 	fin, err := os.Open(csvFile)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer fin.Close()
 
-	r := csv.NewReader(fin)
-	records, err := r.ReadAll()
+	db, err := sql.Open(sqliteDriver, "file:"+dbFile)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-
-	insertSql := `INSERT INTO sounds(location, description, secs, category, CDNumber, CDName, tracknum) VALUES(?, ?, ?, ?, ?, ?, ?);`
-	stmt, err := db.Prepare(insertSql)
+	err = createIndex(db, fin)
+	db.Close()
 	if err != nil {
-		log.Fatal(err)
+		os.Remove(dbFile)
 	}
-	defer stmt.Close()
 
-	for _, record := range records {
-		if _, err := stmt.Exec(record[0], record[1], record[2], record[3], record[4], record[5], record[6]); err != nil {
-			log.Fatal(err)
-		}
-	}
+	return err
 }
 
 type sound struct {
 	descr string // the description of the sound
 	fname string // file name of the sound in the DB index
 	fpath string // full path of the sound file constructed by the downloader
-	query string // the query for this sound. Used to route to proper player when mixing
+	query string // the query for this sound
+	group string // the group of the query. Used to route to proper player when mixing
 	secs  int    // duration in seconds. Useful for logging
+
+	cached bool // whether the sound file is in the cache, as recorded in the index
+
+	num, total int // position in the program in sequential mode, 0 otherwise
 }
 
-// queryDatabase sends query string q to database and sends each sound to out
-func queryDatabase(stmt *sql.Stmt, query string, nsounds int, out chan<- sound) {
-	rows, err := stmt.Query(query, nsounds)
+// queryDatabase sends query string q to database and sends each sound to out, with its path in the cache dir
+// Rows are read as out receives them, so a reader that stops early, by cancelling ctx,
+// costs no more than the rows it received, however big nsounds is
+func queryDatabase(ctx context.Context, sel *selection, query string, nsounds int, dir string, out chan<- sound) {
+	if sel.order == "random" && sel.sampling == "rowid" {
+		sampleDatabase(ctx, sel, query, nsounds, dir, out)
+		return
+	}
+
+	stmt, args := sel.statement(query, nsounds)
+	rows, err := sel.db.QueryContext(ctx, stmt, args...)
 	if err != nil {
-		log.Fatal(err)
+		if ctx.Err() == nil {
+			log.Printf("Error:Query: %q: %v", query, err)
+			pipelineErrors.report("query", query, err)
+		}
+		return
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var snd sound
-		if err := rows.Scan(&snd.fname, &snd.descr, &snd.secs); err != nil {
-			log.Fatal(err)
+		if err := rows.Scan(&snd.fname, &snd.descr, &snd.secs, &snd.cached); err != nil {
+			log.Printf("Error:Query: %q: %v", query, err)
+			pipelineErrors.report("query", query, err)
+			return
 		}
 		snd.query = query
-		snd.fpath = soundPath(snd.fname)
-		out <- snd
+		snd.fpath = filepath.Join(dir, snd.fname)
+		select {
+		case out <- snd:
+		case <-ctx.Done():
+			return
+		}
+	}
+	if err := rows.Err(); err != nil && ctx.Err() == nil {
+		log.Printf("Error:Query: %q: %v", query, err)
+		pipelineErrors.report("query", query, err)
+	}
+}
+
+// selectSounds returns the sounds selected for query, with their paths in the cache dir. If ctx is done it returns the sounds selected so far
+func selectSounds(ctx context.Context, sel *selection, query string, nsounds int, dir string) []sound {
+	out := make(chan sound)
+	go func() {
+		queryDatabase(ctx, sel, query, nsounds, dir, out)
+		close(out)
+	}()
+
+	var sounds []sound
+	for snd := range out {
+		sounds = append(sounds, snd)
+	}
+
+	return sounds
+}
+
+// numberProgram numbers the selected sounds in the order they will play
+func numberProgram(selected [][]sound) {
+	var total int
+	for _, sounds := range selected {
+		total += len(sounds)
+	}
+
+	num := 0
+	for _, sounds := range selected {
+		for i := range sounds {
+			num++
+			sounds[i].num = num
+			sounds[i].total = total
+		}
+	}
+}
+
+// interleave merges the sounds of the queries in rounds. Each round takes the next sound of
+// every query that has sounds left, or the next as many as its weight if weights has one, in
+// the random order of rng, so that no query dominates any part of the session and no query
+// sound plays twice before every other had its turn
+func interleave(rng *rand.Rand, selected [][]sound, weights []int) []sound {
+	var merged []sound
+	taken := make([]int, len(selected))
+	for {
+		var next []sound
+		for i, sounds := range selected {
+			w := 1
+			if i < len(weights) {
+				w = weights[i]
+			}
+			for ; w > 0 && taken[i] < len(sounds); w-- {
+				next = append(next, sounds[taken[i]])
+				taken[i]++
+			}
+		}
+		if len(next) == 0 {
+			return merged
+		}
+		rng.Shuffle(len(next), func(i, j int) { next[i], next[j] = next[j], next[i] })
+		merged = append(merged, next...)
+	}
+}
+
+// program returns the sounds of the queries in the order they are fed, interleaved with rng by
+// the weights of --ratio or a query after the other
+func program(rng *rand.Rand, selected [][]sound, interleaved bool) []sound {
+	if interleaved {
+		return interleave(rng, selected, ratioWeights)
+	}
+	var sounds []sound
+	for _, s := range selected {
+		sounds = append(sounds, s...)
 	}
-	if rows.Err() != nil {
-		log.Fatal(err)
+
+	return sounds
+}
+
+// feed sends the sounds, except the skipped, to out until ctx is done. They are queued in
+// the queue of the session, if any, at once
+func feed(ctx context.Context, sounds []sound, out chan<- sound, skips *skipSet) {
+	q := sessionQueue(ctx)
+	q.add(sounds)
+	for _, snd := range sounds {
+		if skips.skipped(snd) {
+			q.drop(snd)
+			continue
+		}
+		select {
+		case out <- snd:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-// downloader receives sounds from in, downloads the file, fills the path and sends to out (player)
-func downloader(in <-chan sound, router playersRouter) {
+// downloader receives sounds from in, downloads the file, fills the path and sends to out (player).
+// A download that takes longer than --max-wait goes on while the cached sounds that follow
+// it are sent, so the players don't stall, and the slow sound is sent when it arrives. There
+// is still one download at a time, the next to download waits for the slow one
+func downloader(ctx context.Context, in <-chan sound, router playersRouter, f *fetcher, skips *skipSet) {
 	defer router.close()
 
-	for snd := range in {
-		sp := soundPath(snd.fname)
-		exists, err := fileExists(sp)
-		if err != nil || !exists {
-			log.Printf("Missing File: %s: %v", sp, err)
+	type download struct {
+		snd    sound
+		sp     string
+		exists bool
+		err    error
+	}
+	q := sessionQueue(ctx)
+	deliver := func(d download) {
+		if ctx.Err() != nil {
+			return
+		}
+		snd := d.snd
+		if d.err != nil || !d.exists {
+			q.drop(snd)
+			log.Printf("Missing File: %s: %v", d.sp, d.err)
+			pipelineErrors.report("fetch", snd.fname, missingError(d.err))
+			if snd.cached {
+				setCached(f.db, snd.fname, false)
+			}
 		} else {
-			router.route(snd.query) <- snd
+			snd.fpath = d.sp
+			q.fetched(snd)
+			select {
+			case router.route(snd.group) <- snd:
+			case <-ctx.Done():
+			}
 		}
 	}
+
+	var slow chan download // the download that took longer than --max-wait, nil if none
+	for {
+		var snd sound
+		var ok bool
+		select {
+		case d := <-slow:
+			deliver(d)
+			slow = nil
+			continue
+		case snd, ok = <-in:
+		}
+		if !ok {
+			break
+		}
+		if skips.skipped(snd) {
+			q.drop(snd)
+			continue
+		}
+		if slow != nil {
+			if _, exists, err := cachedPath(f.dir, snd.fname); err != nil || !exists {
+				select {
+				case d := <-slow:
+					deliver(d)
+				case <-ctx.Done():
+				}
+				slow = nil
+			}
+		}
+
+		q.fetching(snd)
+		done := make(chan download, 1)
+		go func(snd sound) {
+			sp, exists, err := f.cache(ctx, snd.fname)
+			done <- download{snd, sp, exists, err}
+		}(snd)
+		if *maxWait <= 0 {
+			deliver(<-done)
+			continue
+		}
+		select {
+		case d := <-done:
+			deliver(d)
+		case <-time.After(*maxWait):
+			log.Printf("Slow download: %s, playing the next cached sounds meanwhile", snd.fname)
+			slow = done
+		}
+	}
+	if slow != nil {
+		deliver(<-slow)
+	}
 }
 
-// player receives and plays sounds
-func player(in <-chan sound, mock bool) {
-	for snd := range in {
-		log.Printf("Playing: %q %s %s %s", snd.query, snd.descr, time.Duration(snd.secs)*time.Second, snd.fpath)
+// player receives and plays sounds, those waiting in first before those of in. The automation,
+// if any, sets the volume of each sound as it starts
+func player(ctx context.Context, in, first <-chan sound, auto *automation, skips *skipSet, mock bool) {
+	if auto != nil && auto.start > 0 {
+		select {
+		case <-time.After(time.Until(auto.since.Add(auto.start))):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	q := sessionQueue(ctx)
+	for {
+		snd, ok := nextSound(ctx, in, first)
+		if !ok || ctx.Err() != nil {
+			return
+		}
+		q.start(ctx, snd)
+		if skips.skipped(snd) {
+			q.finish(ctx)
+			continue
+		}
+
+		gain := 1.0
+		if auto != nil {
+			gain = auto.gainAt(time.Since(auto.since))
+		}
+		gain *= queryGain(snd)
 
+		if auto != nil {
+			log.Printf("Playing: %q gain %.2f %s %s %s", snd.query, gain, snd.descr, time.Duration(snd.secs)*time.Second, snd.fpath)
+		} else if snd.num > 0 {
+			log.Printf("Playing: %d/%d %q %s %s %s", snd.num, snd.total, snd.query, snd.descr, time.Duration(snd.secs)*time.Second, snd.fpath)
+		} else {
+			log.Printf("Playing: %q %s %s %s", snd.query, snd.descr, time.Duration(snd.secs)*time.Second, snd.fpath)
+		}
+		activePlugins.playing(snd)
+
+		if *announceSounds && !mock {
+			if err := announce(ctx, snd.descr); err != nil && ctx.Err() == nil {
+				log.Printf("Error:Announce: %v", err)
+			}
+		}
+
+		start := time.Now()
 		if !mock {
-			cmd := exec.Command("play", "-q", snd.fpath)
-			if err := cmd.Run(); err != nil {
-				log.Printf("Error:Play: %v", err)
+			if err := playTracked(ctx, snd, gain); err != nil {
+				q.finish(ctx)
+				if ctx.Err() == nil {
+					log.Printf("Error:Play: %v", err)
+					pipelineErrors.report("play", snd.fname, err)
+				}
+				continue
 			}
 		}
+		q.finish(ctx)
+		atomic.AddInt64(&played, 1)
+		playHistory.record(snd, start)
+		sessionPlaylist.add(snd)
+		playScrobbler.submit(snd, start)
+	}
+}
+
+// nextSound returns the next sound to play, the first of first if any is waiting, else the
+// next of in. It reports false when in is closed or ctx is done
+func nextSound(ctx context.Context, in, first <-chan sound) (sound, bool) {
+	select {
+	case snd := <-first:
+		return snd, true
+	default:
+	}
+
+	select {
+	case snd, ok := <-in:
+		return snd, ok
+	case snd := <-first:
+		return snd, true
+	case <-ctx.Done():
+		return sound{}, false
 	}
 }
 
-func realPlayer(in <-chan sound) {
-	player(in, false)
+// playFile plays the sound file, from the position from, on the audio device, natively or with
+// the command of exec:, or into the mix of the stream. The sessions of the daemon may play elsewhere, on the output of their ctx.
+// The gain is scaled by --volume
+func playFile(ctx context.Context, fpath string, gain float64, from time.Duration) error {
+	gain *= volumeGain()
+	m := streamMixer
+	if out, ok := ctx.Value(outputKey{}).(*output); ok {
+		m = out.mixer
+	}
+	if m == nil {
+		m = deviceMixer()
+	}
+	if m != nil {
+		return m.play(ctx, fpath, gain, from)
+	}
+	// the mixer follows the schedule as it mixes, the players as the sounds start
+	gain *= currentScheduleLevel()
+
+	args := append([]string{"-q", "-v", strconv.FormatFloat(gain, 'f', 2, 64), fpath}, trimArgs(from)...)
+
+	return runDetached(ctx, exec.Command(playerCommand(), args...))
+}
+
+// trimArgs are the arguments of the sox effect that starts the sound at from
+func trimArgs(from time.Duration) []string {
+	if from <= 0 {
+		return nil
+	}
+
+	return []string{"trim", strconv.FormatFloat(from.Seconds(), 'f', 3, 64)}
+}
+
+func realPlayer(ctx context.Context, in, first <-chan sound, auto *automation, skips *skipSet) {
+	player(ctx, in, first, auto, skips, false)
 }
 
-func mockPlayer(in <-chan sound) {
-	player(in, true)
+func mockPlayer(ctx context.Context, in, first <-chan sound, auto *automation, skips *skipSet) {
+	player(ctx, in, first, auto, skips, true)
 }
 
 func fileExists(fpath string) (bool, error) {
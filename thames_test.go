@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestSession returns the pipeline and the selection of a session of the index of the
+// self test, in memory, that fetches its sounds from cdn into a temporary cache
+func newTestSession(t *testing.T, cdn http.Handler) (*pipeline, *selection) {
+	t.Helper()
+	db, err := openMemoryDatabase(strings.ReplaceAll(t.Name(), "/", "-"), selftestCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	srv := httptest.NewServer(cdn)
+	t.Cleanup(srv.Close)
+	pipelineErrors = newErrorLog()
+
+	return testPipeline(db, srv.URL, t.TempDir()), newSelection(db)
+}
+
+// playTestSession plays the queries and returns the number of sounds played
+func playTestSession(p *pipeline, sel *selection, queries []string, mixing bool) int {
+	groups := parseGroups(queries)
+	autos := make(map[string]*automation)
+	if mixing {
+		for _, g := range groups {
+			autos[g.name] = &automation{gain: 1}
+		}
+	}
+
+	before := atomic.LoadInt64(&played)
+	playSession(context.Background(), p, sel, groups, autos, mixing, nil, nil)
+
+	return int(atomic.LoadInt64(&played) - before)
+}
+
+func TestSessionPaths(t *testing.T) {
+	// the sounds are cached and played in the cache of the pipeline, not in that of the root
+	defer func(dir string) { soundsDir = dir }(soundsDir)
+	soundsDir = t.TempDir()
+
+	tests := []struct {
+		name    string
+		queries []string
+		mix     bool
+		order   string
+	}{
+		{"sequential", []string{"rain", "typewriter"}, false, "random"},
+		{"mix", []string{"rain", "cafe"}, true, "random"},
+		{"sql sampling", []string{"rain"}, false, "sql"},
+		{"ordered", []string{"(cafe typewriter)"}, false, "alpha"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, sel := newTestSession(t, fakeCDN(0))
+			if tt.order == "sql" {
+				sel.sampling = "sql"
+			} else {
+				sel.order = tt.order
+			}
+			var mu sync.Mutex
+			var paths []string
+			play := p.play
+			p.play = func(ctx context.Context, in, first <-chan sound, auto *automation, skips *skipSet) {
+				seen := make(chan sound)
+				go func() {
+					defer close(seen)
+					for snd := range in {
+						mu.Lock()
+						paths = append(paths, snd.fpath)
+						mu.Unlock()
+						select {
+						case seen <- snd:
+						case <-ctx.Done():
+							return
+						}
+					}
+				}()
+				play(ctx, seen, first, auto, skips)
+			}
+
+			if n := playTestSession(p, sel, tt.queries, tt.mix); n == 0 || n != len(paths) {
+				t.Errorf("played %d sounds of %d", n, len(paths))
+			}
+			for _, fpath := range paths {
+				if filepath.Dir(fpath) != p.soundsDir {
+					t.Errorf("played %s, not in the cache %s", fpath, p.soundsDir)
+				}
+				if _, err := os.Stat(fpath); err != nil {
+					t.Error(err)
+				}
+			}
+			if entries, _ := os.ReadDir(soundsDir); len(entries) > 0 {
+				t.Errorf("%d files in the cache of the root", len(entries))
+			}
+			if s := pipelineErrors.summary(); s != "" {
+				t.Error(s)
+			}
+		})
+	}
+}
+
+func TestSessionSkipsMissing(t *testing.T) {
+	const missing = "10000002.wav"
+	cdn := fakeCDN(0)
+	p, sel := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/"+missing) {
+			http.NotFound(w, r)
+			return
+		}
+		cdn.ServeHTTP(w, r)
+	}))
+
+	if n := playTestSession(p, sel, []string{"rain"}, false); n != 2 {
+		t.Errorf("played %d sounds, expected the 2 of the 3 the CDN has", n)
+	}
+	if _, err := os.Stat(filepath.Join(p.soundsDir, missing)); !os.IsNotExist(err) {
+		t.Errorf("%s is in the cache: %v", missing, err)
+	}
+	if code := pipelineErrors.exitCode(); code != exitFetch {
+		t.Errorf("exit code %d, expected %d", code, exitFetch)
+	}
+}
+
+func TestSessionRetries(t *testing.T) {
+	// the CDN is busy the first time each sound is downloaded, the sizes are HEADs
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	cdn := fakeCDN(0)
+	p, sel := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			cdn.ServeHTTP(w, r)
+			return
+		}
+		mu.Lock()
+		requests[r.URL.Path]++
+		n := requests[r.URL.Path]
+		mu.Unlock()
+		if n == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		cdn.ServeHTTP(w, r)
+	}))
+
+	if n := playTestSession(p, sel, []string{"typewriter"}, false); n != 1 {
+		t.Errorf("played %d sounds, expected 1", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for path, n := range requests {
+		if n != 2 {
+			t.Errorf("%s was downloaded %d times, expected 2", path, n)
+		}
+	}
+	if len(requests) != 1 {
+		t.Errorf("%d sounds were downloaded, expected 1", len(requests))
+	}
+	if s := pipelineErrors.summary(); s != "" {
+		t.Error(s)
+	}
+}
@@ -0,0 +1,208 @@
+// Command messages extracts the messages of thames that are translated, the arguments of tr,
+// and updates the catalogs of locales with them. Run it from the root of the source:
+//
+//	go run ./tools/messages el
+//
+// adds to locales/el.json the new messages, with an empty translation for translators to fill
+// in, and drops the ones the source no longer has. With -check it changes nothing and fails
+// if a catalog is missing messages or a translation has other format verbs than its message
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+var (
+	srcDir  = flag.String("dir", ".", "The `dir` of the source of thames")
+	checkOn = flag.Bool("check", false, "Only check the catalogs, for CI")
+)
+
+var verbRe = regexp.MustCompile(`%[-+# 0]*[0-9*]*(\.[0-9*]*)?[a-zA-Z%]`)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("messages: ")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: go run ./tools/messages [-dir dir] [-check] lang...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	langs := flag.Args()
+	if len(langs) == 0 {
+		// all the catalogs there are
+		files, _ := filepath.Glob(filepath.Join(*srcDir, "locales", "*.json"))
+		for _, f := range files {
+			langs = append(langs, filepath.Base(f[:len(f)-len(".json")]))
+		}
+	}
+	if len(langs) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	msgs, err := extract(*srcDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := false
+	for _, lang := range langs {
+		if !update(lang, msgs) {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// extract returns the messages of the go files of dir: the string literals passed to tr, and
+// the string constants passed to it
+func extract(dir string) (map[string]bool, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	pkg, ok := pkgs["main"]
+	if !ok {
+		return nil, fmt.Errorf("no package main in %s", dir)
+	}
+
+	consts := make(map[string]string)
+	for _, f := range pkg.Files {
+		for _, decl := range f.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.CONST {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				vs := spec.(*ast.ValueSpec)
+				for i, name := range vs.Names {
+					if i < len(vs.Values) {
+						if s, ok := stringLit(vs.Values[i]); ok {
+							consts[name.Name] = s
+						}
+					}
+				}
+			}
+		}
+	}
+
+	msgs := make(map[string]bool)
+	for _, f := range pkg.Files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) != 1 {
+				return true
+			}
+			if fn, ok := call.Fun.(*ast.Ident); !ok || fn.Name != "tr" {
+				return true
+			}
+			if s, ok := stringLit(call.Args[0]); ok {
+				msgs[s] = true
+			} else if id, ok := call.Args[0].(*ast.Ident); ok && consts[id.Name] != "" {
+				msgs[consts[id.Name]] = true
+			} else {
+				log.Printf("%s: tr of something that isn't a string constant", fset.Position(call.Pos()))
+			}
+			return true
+		})
+	}
+
+	return msgs, nil
+}
+
+func stringLit(e ast.Expr) (string, bool) {
+	lit, ok := e.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	s, err := strconv.Unquote(lit.Value)
+
+	return s, err == nil
+}
+
+// update updates, or with -check checks, the catalog of lang and reports whether it is fine
+func update(lang string, msgs map[string]bool) bool {
+	fpath := filepath.Join(*srcDir, "locales", lang+".json")
+	old := make(map[string]string)
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &old); err != nil {
+			log.Fatalf("%s: %v", fpath, err)
+		}
+	}
+
+	catalog := make(map[string]string)
+	var added, dropped, translated int
+	ok := true
+	for msg := range msgs {
+		t, exists := old[msg]
+		if !exists {
+			added++
+		}
+		if t != "" {
+			translated++
+			if !reflect.DeepEqual(verbRe.FindAllString(msg, -1), verbRe.FindAllString(t, -1)) {
+				log.Printf("%s: the translation of %q has other format verbs", fpath, msg)
+				ok = false
+			}
+		}
+		catalog[msg] = t
+	}
+	var obsolete []string
+	for msg := range old {
+		if !msgs[msg] {
+			obsolete = append(obsolete, msg)
+			dropped++
+		}
+	}
+	sort.Strings(obsolete)
+
+	if *checkOn {
+		if added > 0 || dropped > 0 {
+			log.Printf("%s: %d messages missing and %d obsolete, run go run ./tools/messages %s", fpath, added, dropped, lang)
+			ok = false
+		}
+		return ok
+	}
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(catalog); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fpath, b.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+	for _, msg := range obsolete {
+		log.Printf("%s: dropped %q", fpath, msg)
+	}
+	fmt.Printf("%s: %d messages, %d translated, %d new\n", fpath, len(catalog), translated, added)
+
+	return ok
+}
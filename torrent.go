@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// torrentSource fetches single sounds out of a torrent of the archive
+// It reads the file list from the .torrent and asks aria2c to download only the requested file
+type torrentSource struct {
+	torrent string
+
+	once  sync.Once
+	files map[string]torrentFile // by base name
+	err   error
+}
+
+type torrentFile struct {
+	index  int    // 1-based, as aria2c --select-file expects
+	path   string // relative to the download directory
+	length int64
+}
+
+func newTorrentSource(torrent string) *torrentSource {
+	return &torrentSource{torrent: torrent}
+}
+
+func (s *torrentSource) fetch(ctx context.Context, fname string, w io.Writer) error {
+	s.once.Do(func() {
+		s.files, s.err = readTorrentFiles(s.torrent)
+	})
+	if s.err != nil {
+		return s.err
+	}
+
+	tf, ok := s.files[fname]
+	if !ok {
+		return fmt.Errorf("%s not in torrent", fname)
+	}
+
+	dir, err := ioutil.TempDir("", "thames-torrent")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := exec.CommandContext(ctx, "aria2c", "--quiet", "--seed-time=0", "--follow-torrent=mem",
+		"--select-file="+strconv.Itoa(tf.index), "--dir="+dir, s.torrent)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("aria2c: %v: %s", err, out)
+	}
+
+	fin, err := os.Open(filepath.Join(dir, filepath.FromSlash(tf.path)))
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+
+	_, err = io.Copy(w, fin)
+
+	return err
+}
+
+func (s *torrentSource) size(fname string) (int64, error) {
+	s.once.Do(func() {
+		s.files, s.err = readTorrentFiles(s.torrent)
+	})
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	tf, ok := s.files[fname]
+	if !ok {
+		return 0, fmt.Errorf("%s not in torrent", fname)
+	}
+
+	return tf.length, nil
+}
+
+func (s *torrentSource) String() string {
+	return "torrent " + s.torrent
+}
+
+// readTorrentFiles returns the files of the torrent keyed by their base name
+func readTorrentFiles(torrent string) (map[string]torrentFile, error) {
+	fin, err := os.Open(torrent)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	v, err := bdecode(bufio.NewReader(fin))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", torrent, err)
+	}
+	meta, _ := v.(map[string]interface{})
+	info, _ := meta["info"].(map[string]interface{})
+	if info == nil {
+		return nil, fmt.Errorf("%s: no info dictionary", torrent)
+	}
+	name, _ := info["name"].(string)
+
+	files := make(map[string]torrentFile)
+	list, _ := info["files"].([]interface{})
+	if list == nil {
+		// single file torrent
+		length, _ := info["length"].(int64)
+		files[name] = torrentFile{1, name, length}
+		return files, nil
+	}
+	for i, f := range list {
+		fd, _ := f.(map[string]interface{})
+		elems, _ := fd["path"].([]interface{})
+		if len(elems) == 0 {
+			continue
+		}
+		p := name
+		for _, e := range elems {
+			s, _ := e.(string)
+			p = path.Join(p, s)
+		}
+		length, _ := fd["length"].(int64)
+		files[path.Base(p)] = torrentFile{i + 1, p, length}
+	}
+
+	return files, nil
+}
+
+// bdecode decodes a bencoded value. Strings are returned as string, integers as int64,
+// lists as []interface{} and dictionaries as map[string]interface{}
+func bdecode(r *bufio.Reader) (interface{}, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c == 'i':
+		s, err := r.ReadString('e')
+		if err != nil {
+			return nil, err
+		}
+		return strconv.ParseInt(s[:len(s)-1], 10, 64)
+	case c == 'l':
+		var list []interface{}
+		for {
+			if b, err := r.Peek(1); err != nil {
+				return nil, err
+			} else if b[0] == 'e' {
+				r.ReadByte()
+				return list, nil
+			}
+			v, err := bdecode(r)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+	case c == 'd':
+		dict := make(map[string]interface{})
+		for {
+			if b, err := r.Peek(1); err != nil {
+				return nil, err
+			} else if b[0] == 'e' {
+				r.ReadByte()
+				return dict, nil
+			}
+			k, err := bdecode(r)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, errors.New("dictionary key is not a string")
+			}
+			v, err := bdecode(r)
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = v
+		}
+	case c >= '0' && c <= '9':
+		r.UnreadByte()
+		s, err := r.ReadString(':')
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad string length %q", s)
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf), nil
+	}
+
+	return nil, fmt.Errorf("unexpected byte %q", c)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// convertedPath returns where the playable copy of the sound file at fpath is cached
+func convertedPath(fpath string) string {
+	name := strings.TrimSuffix(filepath.Base(fpath), filepath.Ext(fpath)) + ".wav"
+
+	return filepath.Join(*rootDir, "converted", name)
+}
+
+// convertMu serializes the conversions, so two players don't convert the same file at once
+var convertMu sync.Mutex
+
+// unplayable reports whether the audio is of an encoding that players can't be
+// relied on to play, like a wav of an unknown format code or of 12 bits per sample
+func unplayable(info audioInfo) bool {
+	switch {
+	case strings.HasPrefix(info.format, "wav/0x"):
+		return true
+	case info.format == "wav" && (info.bits%8 != 0 || info.bits > 32):
+		return true
+	}
+
+	return false
+}
+
+// plainPCM reports whether the file is of the archive's format, that every player plays. When
+// such a file fails to play, the fault is elsewhere, like the audio device
+func plainPCM(info audioInfo) bool {
+	return (info.format == "wav" || info.format == "flac") && info.bits == 16
+}
+
+// convertSound returns the path of a copy of the sound file at fpath as a 16 bit wav, which
+// every player plays, converting it with sox the first time
+func convertSound(ctx context.Context, fpath string) (string, error) {
+	convertMu.Lock()
+	defer convertMu.Unlock()
+
+	dst := convertedPath(fpath)
+	if exists, err := fileExists(dst); err != nil || exists {
+		return dst, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+
+	tmp := dst + ".part"
+	cmd := exec.CommandContext(ctx, "sox", "-q", fpath, "-t", "wav", "-b", "16", "-e", "signed-integer", tmp)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("sox: %s: %v: %s", filepath.Base(fpath), err, strings.TrimSpace(string(out)))
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return "", err
+	}
+	log.Printf("Converted: %s to %s", fpath, dst)
+
+	return dst, nil
+}
+
+// playSound plays the sound file from the position like playFile. Files that players can't play are converted
+// first, and files that fail to play, unless of the archive's format, are converted and played
+// again. The converted copies are cached
+func playSound(ctx context.Context, fpath string, gain float64, from time.Duration) error {
+	info, perr := probeAudio(fpath)
+	if perr == nil && unplayable(info) {
+		converted, err := convertSound(ctx, fpath)
+		if err != nil {
+			return err
+		}
+		return playFile(ctx, converted, gain, from)
+	}
+
+	err := playFile(ctx, fpath, gain, from)
+	if err == nil || ctx.Err() != nil || perr == nil && plainPCM(info) {
+		return err
+	}
+	converted, cerr := convertSound(ctx, fpath)
+	if cerr != nil {
+		return fmt.Errorf("%v, and converting it failed: %v", err, cerr)
+	}
+
+	return playFile(ctx, converted, gain, from)
+}
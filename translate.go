@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+var descriptionLang = flag.String("lang", "", "Search only the translations to `lang`, like el or fr, besides the English descriptions, and print the translations with --query")
+
+// translationsSchema is the table of the descriptions translated to other languages, imported
+// from user or community files. Like the user metadata it is kept when the index is recreated
+const translationsSchema = `CREATE TABLE IF NOT EXISTS translations(
+                              location TEXT NOT NULL,
+                              lang TEXT NOT NULL,
+                              description TEXT NOT NULL,
+                              PRIMARY KEY(location, lang)
+                            )`
+
+// translationsIndex is the full text index of the translations, kept up to date by triggers.
+// Like the notes they are indexed with the unicode tokenizer
+const translationsIndex = `CREATE VIRTUAL TABLE translations_fts USING fts4(
+                             location, lang, description,
+
+                             tokenize=unicode61 "remove_diacritics=1", notindexed=location, notindexed=lang
+                           );
+                           INSERT INTO translations_fts(location, lang, description) SELECT location, lang, description FROM translations`
+
+const translationsTriggers = `CREATE TRIGGER IF NOT EXISTS translations_insert AFTER INSERT ON translations BEGIN
+                                INSERT INTO translations_fts(location, lang, description) VALUES(new.location, new.lang, new.description);
+                              END;
+                              CREATE TRIGGER IF NOT EXISTS translations_update AFTER UPDATE ON translations BEGIN
+                                UPDATE translations_fts SET description = new.description WHERE location = old.location AND lang = old.lang;
+                              END;
+                              CREATE TRIGGER IF NOT EXISTS translations_delete AFTER DELETE ON translations BEGIN
+                                DELETE FROM translations_fts WHERE location = old.location AND lang = old.lang;
+                              END`
+
+// migrateTranslations creates the tables of the translations in older databases
+func migrateTranslations(db *sql.DB) error {
+	if _, err := db.Exec(translationsSchema); err != nil {
+		return err
+	}
+	var exists bool
+	if err := db.QueryRow(`SELECT count(*) > 0 FROM sqlite_master WHERE name = 'translations_fts'`).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := db.Exec(translationsIndex); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(translationsTriggers)
+
+	return err
+}
+
+// hasTranslations reports whether there are translations, in lang if it is not empty, so
+// queries should search them too
+func hasTranslations(db *sql.DB, lang string) bool {
+	var n bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM translations WHERE ? = '' OR lang = ?)`, lang, lang).Scan(&n); err != nil {
+		return false
+	}
+
+	return n
+}
+
+// readTranslations reads the descriptions of the sounds in lang, by location
+func readTranslations(ctx context.Context, db *sql.DB, sounds []sound, lang string) (map[string]string, error) {
+	translations := make(map[string]string)
+	for start := 0; start < len(sounds); start += sampleBatch {
+		batch := sounds[start:]
+		if len(batch) > sampleBatch {
+			batch = batch[:sampleBatch]
+		}
+		args := []interface{}{lang}
+		for _, snd := range batch {
+			args = append(args, snd.fname)
+		}
+		marks := strings.TrimSuffix(strings.Repeat("?,", len(batch)), ",")
+
+		rows, err := db.QueryContext(ctx, `SELECT location, description FROM translations WHERE lang = ? AND location IN (`+marks+`)`, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var location, descr string
+			if err := rows.Scan(&location, &descr); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			translations[location] = descr
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return translations, nil
+}
+
+// translateCommand implements the translations command which maintains the translations
+func translateCommand(args []string) error {
+	usage := func() error {
+		fmt.Fprintf(os.Stderr, "usage: thames translations import [--lang l] file.csv\n       thames translations list\n       thames translations delete lang\n")
+		return errUsage
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+
+	switch {
+	case args[0] == "import":
+		return translationsImport(args[1:])
+	case args[0] == "list" && len(args) == 1:
+		db, err := openDatabase()
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		rows, err := db.Query(`SELECT lang, count(*) FROM translations GROUP BY lang ORDER BY lang`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var lang string
+			var n int
+			if err := rows.Scan(&lang, &n); err != nil {
+				return err
+			}
+			fmt.Printf("%s\t%d\n", lang, n)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	case args[0] == "delete" && len(args) == 2:
+		db, err := openDatabase()
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		res, err := db.Exec(`DELETE FROM translations WHERE lang = ?`, args[1])
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		log.Printf("Deleted %d translations to %s", n, args[1])
+	default:
+		return usage()
+	}
+
+	return nil
+}
+
+// translationsImport imports a csv of translations. Its header names the columns location,
+// description and, unless all the rows are of --lang, lang. Other columns are ignored
+func translationsImport(args []string) error {
+	fs := flag.NewFlagSet("translations import", flag.ExitOnError)
+	lang := fs.String("lang", "", "The `lang` of the rows of a csv without a lang column")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames translations import [--lang l] file.csv\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+
+	fin, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+
+	r := csv.NewReader(fin)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(0), err)
+	}
+	columns := make(map[string]int)
+	for i, h := range header {
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))] = i
+	}
+	locCol, ok1 := columns["location"]
+	descCol, ok2 := columns["description"]
+	langCol, hasLang := columns["lang"]
+	if !ok1 || !ok2 {
+		return fmt.Errorf("%s: the header must name the location and description columns", fs.Arg(0))
+	}
+	if !hasLang && *lang == "" {
+		return fmt.Errorf("%s: no lang column, give the lang with --lang", fs.Arg(0))
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var imported, unknown, skipped int
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Printf("Skipped: %v", err)
+			skipped++
+			continue
+		}
+		line, _ := r.FieldPos(0)
+		field := func(i int) string {
+			if i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		location, descr, l := normalizeLocation(field(locCol)), field(descCol), *lang
+		if hasLang && field(langCol) != "" {
+			l = strings.ToLower(field(langCol))
+		}
+		if field(locCol) == "" || descr == "" || l == "" {
+			log.Printf("Skipped: line %d: missing location, description or lang", line)
+			skipped++
+			continue
+		}
+
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM sounds WHERE location = ?)`, location).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			unknown++
+			continue
+		}
+		if _, err := tx.Exec(`INSERT INTO translations(location, lang, description) VALUES(?, ?, ?)
+                                      ON CONFLICT(location, lang) DO UPDATE SET description = excluded.description`, location, l, descr); err != nil {
+			return err
+		}
+		imported++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Imported %d translations, %d sounds not in the index, skipped %d rows", imported, unknown, skipped)
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// The data users add, tags, ratings, notes, the history, smart playlists, collections and
+// translations, is kept in user.db apart from the index in sounds.db, which can always be
+// recreated from the csv. Every connection to the index attaches user.db as user, so the
+// queries join the two as if they were one database
+
+// userIndexes are the full text indexes of the user tables, kept with them in user.db
+var userIndexes = []string{"notes_fts", "translations_fts"}
+
+// prepareUserDatabase creates the tables of user.db and moves into it the user tables of
+// indexes older than the split
+func prepareUserDatabase() error {
+	udb, err := sql.Open(sqliteDriver, "file:"+userDBFile+"?_busy_timeout=5000")
+	if err != nil {
+		return err
+	}
+	defer udb.Close()
+
+	if err := migrateUser(udb); err != nil {
+		return fmt.Errorf("%s: %v", userDBFile, err)
+	}
+
+	idx, err := sql.Open(sqliteDriver, "file:"+dbFile+"?_busy_timeout=5000")
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+
+	for _, table := range userTables {
+		columns, err := tableColumns(idx, table)
+		if err != nil {
+			return err
+		}
+		if len(columns) == 0 {
+			continue
+		}
+		n, err := salvageTable(udb, idx, table)
+		if err != nil {
+			return fmt.Errorf("moving %s to %s: %v", table, userDBFile, err)
+		}
+		if _, err := idx.Exec(fmt.Sprintf(`DROP TABLE %s`, table)); err != nil {
+			return err
+		}
+		log.Printf("Moved: %d %s from %s to %s", n, table, dbFile, userDBFile)
+	}
+	for _, table := range userIndexes {
+		if _, err := idx.Exec(fmt.Sprintf(`DROP TABLE IF EXISTS %s`, table)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// userSchema are the tables of the metadata users add to the sounds, in user.db. Unlike the
+// index they can't be recreated from the csv
+const userSchema = `CREATE TABLE IF NOT EXISTS tags(
+                      location TEXT NOT NULL,
+                      tag TEXT NOT NULL,
+                      PRIMARY KEY(location, tag)
+                    );
+                    CREATE TABLE IF NOT EXISTS ratings(
+                      location TEXT PRIMARY KEY,
+                      rating INTEGER NOT NULL
+                    );
+                    CREATE TABLE IF NOT EXISTS notes(
+                      location TEXT PRIMARY KEY,
+                      note TEXT NOT NULL
+                    );
+                    CREATE TABLE IF NOT EXISTS descriptions(
+                      location TEXT PRIMARY KEY,
+                      description TEXT NOT NULL  -- shown instead of that of the archive
+                    )`
+
+// migrateUser creates the tables of the user metadata in the user database, or brings them up to date
+func migrateUser(db *sql.DB) error {
+	for _, schema := range []string{userSchema, historySchema, smartSchema, collectionSchema, statsSchema, selectionsSchema} {
+		if _, err := db.Exec(schema); err != nil {
+			return err
+		}
+	}
+
+	if err := migrateTranslations(db); err != nil {
+		return err
+	}
+
+	if err := migrateNotes(db); err != nil {
+		return err
+	}
+
+	return migrateDescriptions(db)
+}
+
+// userMeta is the metadata a user added to a sound
+type userMeta struct {
+	tags        []string // sorted
+	rating      int      // 1 to 5, 0 if not rated
+	note        string
+	description string // of the user, empty for that of the archive
+}
+
+func (m userMeta) hasTag(tag string) bool {
+	for _, t := range m.tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// userEdit is a change of the user metadata, from edit --set and --unset
+type userEdit struct {
+	unset bool
+	field string // tag, rating, note or description
+	value string
+}
+
+// editsFlag collects the --set or the --unset flags of edit
+type editsFlag struct {
+	edits *[]userEdit
+	unset bool
+}
+
+func (f editsFlag) String() string {
+	return ""
+}
+
+func (f editsFlag) Set(v string) error {
+	kv := strings.SplitN(v, "=", 2)
+	e := userEdit{unset: f.unset, field: kv[0]}
+	if len(kv) == 2 {
+		e.value = strings.TrimSpace(kv[1])
+	}
+	switch {
+	case e.field != "tag" && e.field != "rating" && e.field != "note" && e.field != "description":
+		return fmt.Errorf("unknown field %q, the fields are tag, rating, note and description", e.field)
+	case !f.unset && e.value == "":
+		return fmt.Errorf("%s needs a value", e.field)
+	case f.unset && e.field == "tag" && e.value == "":
+		return fmt.Errorf("which tag to unset, like tag=work")
+	case !f.unset && e.field == "rating":
+		if r, err := strconv.Atoi(e.value); err != nil || r < 1 || r > 5 {
+			return fmt.Errorf("bad rating %q, ratings are 1 to 5", e.value)
+		}
+	}
+	*f.edits = append(*f.edits, e)
+
+	return nil
+}
+
+// apply returns the metadata after the edits
+func (m userMeta) apply(edits []userEdit) userMeta {
+	n := m
+	n.tags = append([]string(nil), m.tags...)
+	for _, e := range edits {
+		switch {
+		case e.field == "tag" && e.unset:
+			var tags []string
+			for _, t := range n.tags {
+				if t != e.value {
+					tags = append(tags, t)
+				}
+			}
+			n.tags = tags
+		case e.field == "tag":
+			if !n.hasTag(e.value) {
+				n.tags = append(n.tags, e.value)
+				sort.Strings(n.tags)
+			}
+		case e.field == "rating" && e.unset:
+			n.rating = 0
+		case e.field == "rating":
+			n.rating, _ = strconv.Atoi(e.value)
+		case e.field == "note" && e.unset:
+			n.note = ""
+		case e.field == "note":
+			n.note = e.value
+		case e.field == "description" && e.unset:
+			n.description = ""
+		case e.field == "description":
+			n.description = e.value
+		}
+	}
+
+	return n
+}
+
+// diff describes the changes from m to n, like "+tag=work rating=4"
+func (m userMeta) diff(n userMeta) string {
+	var changes []string
+	for _, t := range n.tags {
+		if !m.hasTag(t) {
+			changes = append(changes, "+tag="+t)
+		}
+	}
+	for _, t := range m.tags {
+		if !n.hasTag(t) {
+			changes = append(changes, "-tag="+t)
+		}
+	}
+	if m.rating != n.rating {
+		if n.rating == 0 {
+			changes = append(changes, "-rating")
+		} else {
+			changes = append(changes, fmt.Sprintf("rating=%d", n.rating))
+		}
+	}
+	if m.note != n.note {
+		if n.note == "" {
+			changes = append(changes, "-note")
+		} else {
+			changes = append(changes, fmt.Sprintf("note=%q", n.note))
+		}
+	}
+	if m.description != n.description {
+		if n.description == "" {
+			changes = append(changes, "-description")
+		} else {
+			changes = append(changes, fmt.Sprintf("description=%q", n.description))
+		}
+	}
+
+	return strings.Join(changes, " ")
+}
+
+// readUserMeta reads the user metadata of the sounds, by location
+func readUserMeta(ctx context.Context, db *sql.DB, locations []string) (map[string]userMeta, error) {
+	meta := make(map[string]userMeta)
+	for start := 0; start < len(locations); start += sampleBatch {
+		batch := locations[start:]
+		if len(batch) > sampleBatch {
+			batch = batch[:sampleBatch]
+		}
+		args := make([]interface{}, len(batch))
+		for i, l := range batch {
+			args[i] = l
+		}
+		marks := strings.TrimSuffix(strings.Repeat("?,", len(batch)), ",")
+
+		for _, q := range []string{
+			`SELECT location, tag, 0, '', '' FROM tags WHERE location IN (` + marks + `) ORDER BY tag`,
+			`SELECT location, '', rating, '', '' FROM ratings WHERE location IN (` + marks + `)`,
+			`SELECT location, '', 0, note, '' FROM notes WHERE location IN (` + marks + `)`,
+			`SELECT location, '', 0, '', description FROM descriptions WHERE location IN (` + marks + `)`,
+		} {
+			rows, err := db.QueryContext(ctx, q, args...)
+			if err != nil {
+				return nil, err
+			}
+			for rows.Next() {
+				var location, tag, note, description string
+				var rating int
+				if err := rows.Scan(&location, &tag, &rating, &note, &description); err != nil {
+					rows.Close()
+					return nil, err
+				}
+				m := meta[location]
+				if tag != "" {
+					m.tags = append(m.tags, tag)
+				}
+				if rating != 0 {
+					m.rating = rating
+				}
+				if note != "" {
+					m.note = note
+				}
+				if description != "" {
+					m.description = description
+				}
+				meta[location] = m
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return meta, nil
+}
+
+// writeUserMeta replaces the user metadata of the sound at location with m
+func writeUserMeta(tx *sql.Tx, location string, m userMeta) error {
+	if _, err := tx.Exec(`DELETE FROM tags WHERE location = ?`, location); err != nil {
+		return err
+	}
+	for _, t := range m.tags {
+		if _, err := tx.Exec(`INSERT INTO tags(location, tag) VALUES(?, ?)`, location, t); err != nil {
+			return err
+		}
+	}
+
+	if m.rating == 0 {
+		if _, err := tx.Exec(`DELETE FROM ratings WHERE location = ?`, location); err != nil {
+			return err
+		}
+	} else if _, err := tx.Exec(`INSERT INTO ratings(location, rating) VALUES(?, ?)
+                                     ON CONFLICT(location) DO UPDATE SET rating = excluded.rating`, location, m.rating); err != nil {
+		return err
+	}
+
+	if m.note == "" {
+		if _, err := tx.Exec(`DELETE FROM notes WHERE location = ?`, location); err != nil {
+			return err
+		}
+	} else if _, err := tx.Exec(`INSERT INTO notes(location, note) VALUES(?, ?)
+                                     ON CONFLICT(location) DO UPDATE SET note = excluded.note`, location, m.note); err != nil {
+		return err
+	}
+
+	if m.description == "" {
+		_, err := tx.Exec(`DELETE FROM descriptions WHERE location = ?`, location)
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO descriptions(location, description) VALUES(?, ?)
+                           ON CONFLICT(location) DO UPDATE SET description = excluded.description`, location, m.description)
+
+	return err
+}
+
+// editCommand implements the edit command. It changes the tags, ratings, notes and descriptions of all the
+// sounds that match a query, or of the sounds at the locations, in one transaction
+func editCommand(args []string) error {
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	query := fs.String("query", "", "Edit all the sounds that match the `query`")
+	var categories stringsFlag
+	fs.Var(&categories, "category", "Edit only sounds of `category` and its subcategories. May be repeated")
+	var edits []userEdit
+	fs.Var(editsFlag{&edits, false}, "set", "Set `field=value`: tag=t adds the tag t, rating=1..5, note=text, description=text. May be repeated")
+	fs.Var(editsFlag{&edits, true}, "unset", "Unset `field`: tag=t removes the tag t, rating, note and description remove them. May be repeated")
+	dryRun := fs.Bool("dry-run", false, "Print the changes, don't make them")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: thames edit [--query q] [--category c]... [--set f=v]... [--unset f[=v]]... [--dry-run] [locations...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if len(edits) == 0 || (*query == "" && len(categories) == 0) == (fs.NArg() == 0) {
+		fs.Usage()
+		return errUsage
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	var sounds []sound
+	if fs.NArg() == 0 {
+		sel := newSelection(db)
+		sel.order = "alpha"
+		if err := sel.restrictCategories(categories); err != nil {
+			return err
+		}
+		sounds = selectSounds(ctx, sel, *query, 0, soundsDir)
+	} else {
+		for _, l := range fs.Args() {
+			sounds = append(sounds, sound{fname: normalizeLocation(l)})
+		}
+		meta, err := readMetadata(ctx, db, sounds)
+		if err != nil {
+			return err
+		}
+		for i := range sounds {
+			m, ok := meta[sounds[i].fname]
+			if !ok {
+				return fmt.Errorf("%s is not in the index", sounds[i].fname)
+			}
+			sounds[i].descr = m.description
+		}
+	}
+
+	var locations []string
+	for _, snd := range sounds {
+		locations = append(locations, snd.fname)
+	}
+	current, err := readUserMeta(ctx, db, locations)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	changed := 0
+	for _, snd := range sounds {
+		m := current[snd.fname]
+		n := m.apply(edits)
+		d := m.diff(n)
+		if d == "" {
+			continue
+		}
+		changed++
+		fmt.Printf("%s %s: %s\n", snd.fname, snd.descr, d)
+		if *dryRun {
+			continue
+		}
+		if err := writeUserMeta(tx, snd.fname, n); err != nil {
+			return err
+		}
+	}
+
+	if *dryRun {
+		log.Printf("Would edit %d of %d sounds", changed, len(sounds))
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Edited %d of %d sounds", changed, len(sounds))
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	forever       = flag.Bool("forever", false, "Play until stopped, restarting failed sessions and controllers, as for an unattended installation")
+	heartbeatFile = flag.String("heartbeat", "", "Write the time and the number of played sounds to `file` every 30s, for monitoring")
+)
+
+const (
+	minBackoff        = time.Second
+	maxBackoff        = 5 * time.Minute
+	heartbeatInterval = 30 * time.Second
+)
+
+// played counts the sounds played since the start. The watchdog uses it to tell
+// working sessions from failing ones
+var played int64
+
+// backoff is an exponential delay between restarts of a failing component
+type backoff struct {
+	delay time.Duration
+}
+
+// wait sleeps for the current delay and doubles it. It reports false if ctx is done first
+func (b *backoff) wait(ctx context.Context) bool {
+	if b.delay == 0 {
+		b.delay = minBackoff
+	}
+	select {
+	case <-time.After(b.delay):
+	case <-ctx.Done():
+		return false
+	}
+	if b.delay *= 2; b.delay > maxBackoff {
+		b.delay = maxBackoff
+	}
+
+	return true
+}
+
+func (b *backoff) reset() {
+	b.delay = 0
+}
+
+// supervise runs the component fn. With --forever fn is restarted whenever it fails,
+// with exponential backoff while it keeps failing
+func supervise(ctx context.Context, name string, fn func(ctx context.Context) error) {
+	var b backoff
+	for {
+		start := time.Now()
+		err := fn(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Error:%s: %v", name, err)
+			pipelineErrors.report(strings.ToLower(name), "", err)
+		}
+		if !*forever {
+			return
+		}
+		if time.Since(start) > maxBackoff {
+			// it worked for a while, this is a new failure
+			b.reset()
+		}
+		log.Printf("Watchdog: restarting %s", name)
+		if !b.wait(ctx) {
+			return
+		}
+	}
+}
+
+// watchState is the state of an installation that survives restarts of thames,
+// the preset and the volumes set by the controllers
+type watchState struct {
+	Preset string             `json:"preset,omitempty"`
+	Gains  map[string]float64 `json:"gains,omitempty"`
+
+	mu    sync.Mutex
+	fpath string
+}
+
+func statePath() string {
+	return filepath.Join(*rootDir, "thames.state")
+}
+
+// loadState reads the state of the previous run, if any
+func loadState(fpath string) (*watchState, error) {
+	s := &watchState{fpath: fpath, Gains: make(map[string]float64)}
+	data, err := ioutil.ReadFile(fpath)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("%s: %v", fpath, err)
+	}
+	if s.Gains == nil {
+		s.Gains = make(map[string]float64)
+	}
+
+	return s, nil
+}
+
+// setPreset records a switch to a preset. The volumes of the old preset are forgotten
+func (s *watchState) setPreset(fpath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Preset = fpath
+	s.Gains = make(map[string]float64)
+	s.save()
+}
+
+func (s *watchState) setGain(group string, gain float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Gains[group] = gain
+	s.save()
+}
+
+// save writes the state atomically, a power cut never leaves a broken state file
+func (s *watchState) save() {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(s.fpath, data)
+	}
+	if err != nil {
+		log.Printf("Error:State: %v", err)
+	}
+}
+
+// heartbeat writes the heartbeat file until ctx is done. Monitors can check
+// its modification time and whether the number of played sounds grows
+func heartbeat(ctx context.Context, fpath string) {
+	start := time.Now()
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		beat := fmt.Sprintf("time %s\npid %d\nuptime %s\nplayed %d\ngoroutines %d\n",
+			time.Now().Format(time.RFC3339), os.Getpid(), time.Since(start).Round(time.Second), atomic.LoadInt64(&played), runtime.NumGoroutine())
+		if err := writeFileAtomic(fpath, []byte(beat)); err != nil {
+			log.Printf("Error:Heartbeat: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func writeFileAtomic(fpath string, data []byte) error {
+	fout, err := ioutil.TempFile(filepath.Dir(fpath), filepath.Base(fpath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fout.Name())
+
+	if _, err := fout.Write(data); err != nil {
+		fout.Close()
+		return err
+	}
+	if err := fout.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(fout.Name(), fpath)
+}
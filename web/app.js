@@ -0,0 +1,299 @@
+// The web UI of thames serve: search and preview sounds, request them in a session, and build,
+// play and save mixes of queries. It only talks to the API of the daemon
+'use strict';
+
+const $ = (id) => document.getElementById(id);
+
+// api calls the API and returns the decoded json reply, or throws the message of the error
+async function api(path, options) {
+  const resp = await fetch(path, options);
+  if (!resp.ok) {
+    throw new Error((await resp.text()).trim() || resp.statusText);
+  }
+  return resp.json();
+}
+
+function status(message, isError) {
+  const p = $('status');
+  p.textContent = message;
+  p.className = isError ? 'error' : '';
+}
+
+function session() {
+  return $('session').value.trim();
+}
+
+function el(tag, text, attrs) {
+  const e = document.createElement(tag);
+  if (text !== undefined) {
+    e.textContent = text;
+  }
+  Object.assign(e, attrs || {});
+  return e;
+}
+
+function duration(secs) {
+  const m = Math.floor(secs / 60);
+  const s = String(secs % 60).padStart(2, '0');
+  return `${m}:${s}`;
+}
+
+// search
+
+async function search() {
+  const q = $('query').value.trim();
+  const params = new URLSearchParams({ q, limit: 50 });
+  if ($('near').value.trim()) {
+    params.set('near', $('near').value.trim());
+    if ($('radius').value !== '') {
+      params.set('radius', $('radius').value);
+    }
+  }
+  status('Searching…');
+  try {
+    const sounds = await api('/search?' + params);
+    showResults(sounds);
+    status(`${sounds.length} sounds`);
+  } catch (err) {
+    status(err.message, true);
+  }
+  markNear();
+}
+
+function showResults(sounds) {
+  const list = $('results');
+  list.replaceChildren();
+  for (const snd of sounds) {
+    const li = el('li');
+    li.append(el('span', snd.description));
+    li.append(el('button', '▶', { title: 'Preview', onclick: () => preview(snd) }));
+    li.append(el('button', 'next', { title: 'Play it next in the session', onclick: () => request(snd, false) }));
+    li.append(el('button', 'now', { title: 'Play it at once in the session', onclick: () => request(snd, true) }));
+
+    const meta = [duration(snd.secs)];
+    if (snd.cached) {
+      meta.push('cached');
+    }
+    if (snd.story) {
+      meta.push(snd.story);
+    }
+    const info = el('div', meta.join(' · '), { className: 'meta' });
+    for (const name of snd.places || []) {
+      info.append(' · ');
+      info.append(el('a', name, { href: '#', onclick: (e) => { e.preventDefault(); searchNear(name); } }));
+    }
+    li.append(info);
+    list.append(li);
+  }
+}
+
+function preview(snd) {
+  const audio = $('preview');
+  audio.src = snd.url;
+  audio.play().catch((err) => status(err.message, true));
+  status(`Previewing ${snd.description}`);
+}
+
+async function request(snd, now) {
+  const params = new URLSearchParams({ location: snd.location });
+  if (now) {
+    params.set('now', '1');
+  }
+  if (session()) {
+    params.set('session', session());
+  }
+  try {
+    await api('/play', { method: 'POST', body: params });
+    status(`${snd.description} plays ${now ? 'now' : 'next'}`);
+  } catch (err) {
+    status(err.message, true);
+  }
+}
+
+function searchNear(name) {
+  $('near').value = name;
+  search();
+}
+
+// the map of the places, an equirectangular projection of their coordinates
+
+async function loadMap() {
+  const grid = $('graticule');
+  for (let lon = -150; lon < 180; lon += 30) {
+    grid.append(svgEl('line', { x1: lon, y1: -90, x2: lon, y2: 90 }));
+  }
+  for (let lat = -60; lat < 90; lat += 30) {
+    grid.append(svgEl('line', { x1: -180, y1: lat, x2: 180, y2: lat }));
+  }
+
+  let places;
+  try {
+    places = await api('/places');
+  } catch (err) {
+    status(err.message, true);
+    return;
+  }
+  if (places.length === 0) {
+    $('map').style.display = 'none';
+    return;
+  }
+  const g = $('places');
+  for (const p of places) {
+    const c = svgEl('circle', { cx: p.lon, cy: -p.lat, r: Math.min(6, 0.8 + Math.sqrt(p.sounds) * 0.4) });
+    c.dataset.name = p.name;
+    const title = svgEl('title');
+    title.textContent = `${p.name}, ${p.sounds} sounds`;
+    c.append(title);
+    c.addEventListener('click', () => searchNear(p.name));
+    g.append(c);
+  }
+}
+
+function svgEl(tag, attrs) {
+  const e = document.createElementNS('http://www.w3.org/2000/svg', tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    e.setAttribute(k, v);
+  }
+  return e;
+}
+
+function markNear() {
+  const near = $('near').value.trim().toLowerCase();
+  for (const c of $('places').children) {
+    c.classList.toggle('near', near !== '' && c.dataset.name.toLowerCase() === near);
+  }
+}
+
+// the mix, a playlist of queries like those of --playlist
+
+function addRow(q) {
+  q = q || {};
+  const tr = el('tr');
+  const cell = (input) => {
+    const td = el('td');
+    td.append(input);
+    tr.append(td);
+    return input;
+  };
+  cell(el('input', undefined, { className: 'query', value: q.query || '', placeholder: 'query' }));
+  cell(el('input', undefined, { className: 'count', type: 'number', min: 1, value: q.count || '', placeholder: '-n' }));
+  cell(el('input', undefined, { className: 'gain', type: 'number', min: 0, step: 0.1, value: q.gain === undefined ? '' : q.gain, placeholder: '1' }));
+  cell(el('input', undefined, { className: 'group', value: q.group || '', placeholder: 'alone' }));
+  cell(el('button', '×', { type: 'button', title: 'Remove', onclick: () => tr.remove() }));
+  document.querySelector('#mix tbody').append(tr);
+}
+
+function mix() {
+  const queries = [];
+  for (const tr of document.querySelectorAll('#mix tbody tr')) {
+    const query = tr.querySelector('.query').value.trim();
+    if (!query) {
+      continue;
+    }
+    const q = { query };
+    const count = parseInt(tr.querySelector('.count').value, 10);
+    if (count > 0) {
+      q.count = count;
+    }
+    const gain = parseFloat(tr.querySelector('.gain').value);
+    if (!Number.isNaN(gain)) {
+      q.gain = gain;
+    }
+    const group = tr.querySelector('.group').value.trim();
+    if (group) {
+      q.group = group;
+    }
+    queries.push(q);
+  }
+  return { mix: $('mixed').checked, queries };
+}
+
+function showMix(sc) {
+  document.querySelector('#mix tbody').replaceChildren();
+  for (const q of sc.queries) {
+    addRow(q);
+  }
+  $('mixed').checked = sc.mix;
+}
+
+async function playMix(sc) {
+  const params = session() ? '?' + new URLSearchParams({ session: session() }) : '';
+  try {
+    const groups = await api('/mix' + params, { method: 'POST', body: JSON.stringify(sc) });
+    status(`Playing ${groups.join(', ')}`);
+  } catch (err) {
+    status(err.message, true);
+  }
+}
+
+async function saveMix() {
+  const name = $('mix-name').value.trim();
+  if (!name) {
+    status('The mix needs a name', true);
+    return;
+  }
+  try {
+    await api('/mixes/' + encodeURIComponent(name), { method: 'PUT', body: JSON.stringify(mix()) });
+    status(`Saved ${name}, thames --playlist ${name} plays it`);
+    loadSaved();
+  } catch (err) {
+    status(err.message, true);
+  }
+}
+
+async function loadSaved() {
+  const list = $('saved');
+  list.replaceChildren();
+  let names;
+  try {
+    names = await api('/mixes');
+  } catch (err) {
+    status(err.message, true);
+    return;
+  }
+  if (names.length === 0) {
+    list.append(el('li', 'none yet', { className: 'meta' }));
+  }
+  for (const name of names) {
+    const li = el('li', name);
+    const saved = () => api('/mixes/' + encodeURIComponent(name));
+    li.append(el('button', 'edit', {
+      onclick: async () => {
+        try {
+          showMix(await saved());
+          $('mix-name').value = name;
+        } catch (err) {
+          status(err.message, true);
+        }
+      },
+    }));
+    li.append(el('button', 'play', {
+      onclick: async () => {
+        try {
+          await playMix(await saved());
+        } catch (err) {
+          status(err.message, true);
+        }
+      },
+    }));
+    list.append(li);
+  }
+}
+
+$('search').addEventListener('submit', (e) => {
+  e.preventDefault();
+  search();
+});
+$('add-query').addEventListener('click', () => {
+  const query = $('query').value.trim();
+  if (query) {
+    addRow({ query });
+  }
+});
+$('add-row').addEventListener('click', () => addRow());
+$('play-mix').addEventListener('click', () => playMix(mix()));
+$('save-mix').addEventListener('click', saveMix);
+
+addRow();
+loadMap();
+loadSaved();
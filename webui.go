@@ -0,0 +1,150 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The web UI of thames serve --addr is a page of plain html and javascript over the API. It
+// searches the sounds, by query and on a map of their places, previews them in the browser,
+// sends them to play next in a session, and builds mixes of queries with their counts, gains
+// and groups, to play in a session or to save as playlists for --playlist
+
+//go:embed web
+var webFiles embed.FS
+
+// webHandler serves the files of the web UI
+func webHandler() (http.Handler, error) {
+	files, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		return nil, err
+	}
+
+	return http.FileServer(http.FS(files)), nil
+}
+
+// mixNameRe is the name of a saved mix, a file of the playlists directory
+var mixNameRe = regexp.MustCompile(`^[\pL\pN_-][\pL\pN _.-]*$`)
+
+// mixFile returns the file of the saved mix name
+func mixFile(name string) (string, bool) {
+	name = strings.TrimSuffix(name, ".json")
+	if !mixNameRe.MatchString(name) || strings.Contains(name, "..") {
+		return "", false
+	}
+
+	return filepath.Join(soundscapesDir(), name+".json"), true
+}
+
+// readMix decodes the json playlist of queries of the body of the request
+func readMix(w http.ResponseWriter, r *http.Request) (*soundscape, error) {
+	sc := new(soundscape)
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(sc); err != nil {
+		return nil, err
+	}
+	if err := sc.check(); err != nil {
+		return nil, err
+	}
+
+	return sc, nil
+}
+
+// apiMix replaces what plays in a session with the playlist of queries of the body
+func (d *daemon) apiMix(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+	sc, err := readMix(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.URL.Query().Get("session")
+	if name == "" {
+		name = defaultSession
+	}
+	s, err := d.session(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	groups := sc.groups(true)
+	s.ctl.switchSession(sessionSpec{groups: groups, mix: sc.Mix})
+
+	writeJSON(w, groupNames(groups))
+}
+
+// apiMixes replies with the names of the saved mixes
+func (d *daemon) apiMixes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "expected GET", http.StatusMethodNotAllowed)
+		return
+	}
+	infos, err := ioutil.ReadDir(soundscapesDir())
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	names := []string{}
+	for _, info := range infos {
+		if name := info.Name(); !info.IsDir() && strings.HasSuffix(name, ".json") {
+			names = append(names, strings.TrimSuffix(name, ".json"))
+		}
+	}
+	sort.Strings(names)
+
+	writeJSON(w, names)
+}
+
+// apiSavedMix replies with the saved mix of the path, or saves the playlist of the body as it
+func (d *daemon) apiSavedMix(w http.ResponseWriter, r *http.Request) {
+	fpath, ok := mixFile(strings.TrimPrefix(r.URL.Path, "/mixes/"))
+	if !ok {
+		http.Error(w, "bad name, expected letters, digits, spaces and -_.", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		sc, err := loadSoundscape(fpath)
+		if os.IsNotExist(err) {
+			http.Error(w, "no such mix", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, sc)
+	case http.MethodPut:
+		sc, err := readMix(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := json.MarshalIndent(sc, "", "  ")
+		if err == nil {
+			err = os.MkdirAll(soundscapesDir(), 0755)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(fpath, append(data, '\n'), 0644)
+		}
+		if err != nil {
+			log.Printf("Error:API: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, sc)
+	default:
+		http.Error(w, "expected GET or PUT", http.StatusMethodNotAllowed)
+	}
+}